@@ -0,0 +1,258 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// lmdbbench drives a Rend LMDB handler in process with a mix of sets, gets,
+// GATs and appends from many goroutines, and reports the throughput and
+// latency of each. Items can be given a TTL so the reaper runs under the load
+// too. The handler is used directly, without rend's protocol parsing or
+// networking, so the numbers are of the storage layer alone.
+//
+//	lmdbbench -path /tmp/rendbench -duration 30s -concurrency 64 -get 0.8 -set 0.2
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend-lmdb/lmdbh"
+	"github.com/netflix/rend/common"
+)
+
+type opKind int
+
+const (
+	opSet opKind = iota
+	opGet
+	opGAT
+	opAppend
+	numKinds
+)
+
+var kindNames = [numKinds]string{"set", "get", "gat", "append"}
+
+// result is what one worker saw of one kind of op.
+type result struct {
+	latencies []time.Duration
+	errors    int
+}
+
+type config struct {
+	keys         int
+	keySize      int
+	minValueSize int
+	maxValueSize int
+	multiGet     int
+	ttl          uint32
+	ratios       [numKinds]float64
+}
+
+func main() {
+	path := flag.String("path", "", "Directory of the LMDB environment, a new temporary one if empty")
+	duration := flag.Duration("duration", 10*time.Second, "How long to run the load for")
+	concurrency := flag.Int("concurrency", 16, "Number of goroutines issuing ops")
+	shards := flag.Int("shards", 0, "Number of shards, 0 for one environment")
+	mapSize := flag.Int64("map-size", 4*1024*1024*1024, "Size of the LMDB map in bytes")
+	batch := flag.Int("write-batch", 0, "Mutations per batched write transaction, 0 or 1 disables batching")
+	noSync := flag.Bool("nosync", false, "Skip the fsync after each commit")
+	reaperInterval := flag.Duration("reaper-interval", 5*time.Second, "Time between reaper runs")
+	prefill := flag.Bool("prefill", true, "Store every key once before the load starts")
+
+	var c config
+	flag.IntVar(&c.keys, "keys", 100000, "Number of distinct keys")
+	flag.IntVar(&c.keySize, "key-size", 16, "Length of each key in bytes, at least 9")
+	flag.IntVar(&c.minValueSize, "min-value-size", 100, "Smallest value stored, in bytes")
+	flag.IntVar(&c.maxValueSize, "max-value-size", 1000, "Largest value stored, in bytes")
+	flag.IntVar(&c.multiGet, "multiget", 1, "Keys per get")
+	ttl := flag.Duration("ttl", 0, "TTL of stored items, 0 for none")
+	flag.Float64Var(&c.ratios[opSet], "set", 0.2, "Share of ops that are sets")
+	flag.Float64Var(&c.ratios[opGet], "get", 0.8, "Share of ops that are gets")
+	flag.Float64Var(&c.ratios[opGAT], "gat", 0, "Share of ops that are GATs")
+	flag.Float64Var(&c.ratios[opAppend], "append", 0, "Share of ops that are appends")
+	flag.Parse()
+
+	c.ttl = uint32(*ttl / time.Second)
+	if c.keySize < 9 || c.keys <= 0 || c.minValueSize < 0 || c.maxValueSize < c.minValueSize || c.multiGet < 1 {
+		fmt.Fprintln(os.Stderr, "invalid key or value sizes")
+		os.Exit(2)
+	}
+	var total float64
+	for _, r := range c.ratios {
+		total += r
+	}
+	if total <= 0 {
+		fmt.Fprintln(os.Stderr, "the op shares must add up to more than 0")
+		os.Exit(2)
+	}
+
+	if *path == "" {
+		dir, err := ioutil.TempDir("", "lmdbbench")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer os.RemoveAll(dir)
+		*path = dir
+	}
+
+	hi, err := lmdbh.New(lmdbh.Options{
+		Path:           *path,
+		Shards:         *shards,
+		MapSize:        *mapSize,
+		WriteBatchSize: *batch,
+		NoSync:         *noSync,
+		ReaperInterval: *reaperInterval,
+		Logger:         lmdbh.NewLogger(os.Stderr, lmdbh.LevelWarn, false),
+	})()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	h := hi.(*lmdbh.Handler)
+	defer h.Close()
+
+	if *prefill {
+		start := time.Now()
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < c.keys; i++ {
+			if err := h.Set(common.SetRequest{Key: c.key(i), Data: c.value(rnd), Exptime: c.ttl}); err != nil {
+				fmt.Fprintln(os.Stderr, "Error prefilling:", err)
+				os.Exit(1)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Stored %d keys in %v\n", c.keys, time.Since(start))
+	}
+
+	results := make([][numKinds]result, *concurrency)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := range results {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			c.work(h, int64(w), stop, &results[w])
+		}(w)
+	}
+
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+
+	report(results, *duration)
+
+	if st, err := h.Stats(); err == nil {
+		fmt.Printf("\nitems %d, reaped %d in %d runs taking %v, evictions %d\n",
+			st.Items, st.ReaperDeleted, st.ReaperRuns, st.ReaperTime, st.Evictions)
+	}
+}
+
+// key returns key number i, padded to keySize.
+func (c *config) key(i int) []byte {
+	return []byte(fmt.Sprintf("%0*d", c.keySize, i))
+}
+
+func (c *config) value(rnd *rand.Rand) []byte {
+	return make([]byte, c.minValueSize+rnd.Intn(c.maxValueSize-c.minValueSize+1))
+}
+
+// pick returns a kind of op at random in the configured ratios.
+func (c *config) pick(rnd *rand.Rand) opKind {
+	var total float64
+	for _, r := range c.ratios {
+		total += r
+	}
+	x := rnd.Float64() * total
+	for k, r := range c.ratios {
+		if x < r {
+			return opKind(k)
+		}
+		x -= r
+	}
+	return opGet
+}
+
+// work issues ops until stop is closed, recording them in res.
+func (c *config) work(h *lmdbh.Handler, seed int64, stop <-chan struct{}, res *[numKinds]result) {
+	rnd := rand.New(rand.NewSource(seed))
+	keys := make([][]byte, c.multiGet)
+	opaques := make([]uint32, c.multiGet)
+	quiet := make([]bool, c.multiGet)
+	suffix := []byte("x")
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		kind := c.pick(rnd)
+		key := c.key(rnd.Intn(c.keys))
+		start := time.Now()
+
+		var err error
+		switch kind {
+		case opSet:
+			err = h.Set(common.SetRequest{Key: key, Data: c.value(rnd), Exptime: c.ttl})
+		case opGet:
+			keys[0] = key
+			for i := 1; i < c.multiGet; i++ {
+				keys[i] = c.key(rnd.Intn(c.keys))
+			}
+			data, errs := h.Get(common.GetRequest{Keys: keys, Opaques: opaques, Quiet: quiet})
+			for range data {
+			}
+			err = <-errs
+		case opGAT:
+			_, err = h.GAT(common.GATRequest{Key: key, Exptime: c.ttl})
+		case opAppend:
+			err = h.Append(common.SetRequest{Key: key, Data: suffix})
+			// Appends to missing or too big values are expected
+			if err == common.ErrKeyNotFound || err == common.ErrValueTooBig {
+				err = nil
+			}
+		}
+
+		r := &res[kind]
+		r.latencies = append(r.latencies, time.Since(start))
+		if err != nil {
+			r.errors++
+		}
+	}
+}
+
+func report(results [][numKinds]result, d time.Duration) {
+	fmt.Printf("%-7s %10s %10s %8s %10s %10s %10s %10s\n", "op", "count", "ops/s", "errors", "p50", "p99", "p99.9", "max")
+	for k := opKind(0); k < numKinds; k++ {
+		var lat []time.Duration
+		errors := 0
+		for _, w := range results {
+			lat = append(lat, w[k].latencies...)
+			errors += w[k].errors
+		}
+		if len(lat) == 0 {
+			continue
+		}
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		q := func(p float64) time.Duration { return lat[int(p*float64(len(lat)-1))] }
+
+		fmt.Printf("%-7s %10d %10.0f %8d %10v %10v %10v %10v\n", kindNames[k], len(lat),
+			float64(len(lat))/d.Seconds(), errors, q(0.5), q(0.99), q(0.999), lat[len(lat)-1])
+	}
+}
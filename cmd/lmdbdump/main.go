@@ -0,0 +1,67 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// lmdbdump writes every live item in a Rend LMDB database to stdout as
+// memcached text protocol set commands, which can be piped into any memcached
+// compatible server or into lmdbload.
+//
+//	lmdbdump -path /tmp/rendb > dump.txt
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/netflix/rend-lmdb/lmdbh"
+)
+
+func main() {
+	path := flag.String("path", "/tmp/rendb/", "Directory of the LMDB environment")
+	dbName := flag.String("db", "rendb", "Name of the database inside the environment")
+	shards := flag.Int("shards", 0, "Number of shards the environment was created with, 0 if not sharded")
+	noSubdir := flag.Bool("no-subdir", false, "Take -path as the data file rather than its directory")
+	namespaces := flag.String("namespaces", "", "Namespaces of the environment, as name=prefix pairs separated by commas")
+	flag.Parse()
+
+	nss, err := lmdbh.ParseNamespaces(*namespaces)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	hi, err := lmdbh.New(lmdbh.Options{
+		Path:          *path,
+		DBName:        *dbName,
+		Shards:        *shards,
+		NoSubdir:      *noSubdir,
+		Namespaces:    nss,
+		DisableReaper: true,
+		Logger:        lmdbh.NewLogger(os.Stderr, lmdbh.LevelWarn, false),
+	})()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	h := hi.(*lmdbh.Handler)
+
+	n, err := h.Dump(os.Stdout)
+	h.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error dumping database:", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Dumped %d items\n", n)
+}
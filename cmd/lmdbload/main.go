@@ -0,0 +1,80 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// lmdbload reads memcached text protocol set commands, as written by
+// lmdbdump, from stdin and stores the items in a Rend LMDB database. Loading a
+// sorted dump into an empty database is the fastest way to seed a cache.
+//
+//	lmdbload -path /tmp/rendb < dump.txt
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/netflix/rend-lmdb/lmdbh"
+)
+
+func main() {
+	path := flag.String("path", "/tmp/rendb/", "Directory of the LMDB environment")
+	dbName := flag.String("db", "rendb", "Name of the database inside the environment")
+	shards := flag.Int("shards", 0, "Number of shards the environment was created with, 0 if not sharded")
+	noSubdir := flag.Bool("no-subdir", false, "Take -path as the data file rather than its directory")
+	namespaces := flag.String("namespaces", "", "Namespaces of the environment, as name=prefix pairs separated by commas")
+	mapSize := flag.Int64("map-size", 2*1024*1024*1024, "Initial size of the LMDB map in bytes")
+	maxMapSize := flag.Int64("max-map-size", 0, "Size in bytes the map may grow to when full, 0 disables growth")
+	batch := flag.Int("batch", 10000, "Items per write transaction")
+	noSync := flag.Bool("nosync", false, "Skip the fsync after each batch, syncing once at the end")
+	flag.Parse()
+
+	nss, err := lmdbh.ParseNamespaces(*namespaces)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	hi, err := lmdbh.New(lmdbh.Options{
+		Path:          *path,
+		DBName:        *dbName,
+		Shards:        *shards,
+		NoSubdir:      *noSubdir,
+		Namespaces:    nss,
+		MapSize:       *mapSize,
+		MaxMapSize:    *maxMapSize,
+		NoSync:        *noSync,
+		DisableReaper: true,
+		Logger:        lmdbh.NewLogger(os.Stderr, lmdbh.LevelWarn, false),
+	})()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening database:", err)
+		os.Exit(1)
+	}
+	h := hi.(*lmdbh.Handler)
+
+	start := time.Now()
+	n, err := h.Load(os.Stdin, *batch)
+
+	// Closing syncs, which matters with -nosync
+	if cerr := h.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error after loading %d items: %v\n", n, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Loaded %d items in %v\n", n, time.Since(start))
+}
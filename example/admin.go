@@ -0,0 +1,56 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/netflix/rend-lmdb/lmdbh"
+)
+
+// serveAdmin serves the admin endpoints of lmdbh.AdminHandler on addr. With
+// debug set, it also serves pprof under /debug/pprof/ and expvar, which
+// includes the handler's stats, at /debug/vars, behind the same token.
+func serveAdmin(addr, token string, debug bool, h *lmdbh.Handler) {
+	var handler http.Handler = lmdbh.AdminHandler(h, token)
+
+	if debug {
+		expvar.Publish("rendlmdb", expvar.Func(func() interface{} {
+			st, err := h.Stats()
+			if err != nil {
+				return err.Error()
+			}
+			return st
+		}))
+
+		debugMux := http.NewServeMux()
+		debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+		debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		debugMux.Handle("/debug/vars", expvar.Handler())
+
+		mux := http.NewServeMux()
+		mux.Handle("/debug/", lmdbh.RequireToken(token, debugMux))
+		mux.Handle("/", handler)
+		handler = mux
+	}
+
+	log.Println("Error serving admin endpoints:", http.ListenAndServe(addr, handler))
+}
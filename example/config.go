@@ -0,0 +1,291 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netflix/rend-lmdb/lmdbh"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+// envPrefix is prepended to the upper cased flag name, with dashes turned into
+// underscores, to get the environment variable for a flag, e.g. -map-size can
+// also be given as RENDLMDB_MAP_SIZE. Flags on the command line win.
+const envPrefix = "RENDLMDB_"
+
+type config struct {
+	port       int
+	socket     string
+	socketMode os.FileMode
+	l1         string
+	admin      string
+	adminToken string
+	adminDebug bool
+	tls        tlsConfig
+	protocols  []protocol.Components
+	opts       lmdbh.Options
+}
+
+func parseConfig() (config, error) {
+	var c config
+	var syncMode, syncOps, protocols, socketMode, fileMode, dirMode, logLevel, compression, keyPrefix, namespaces, eviction, onCorruption string
+	var logJSON bool
+
+	flag.IntVar(&c.port, "port", 12121, "TCP port to listen on")
+	flag.StringVar(&c.socket, "socket", "", "Listen on a unix domain socket at this path instead of TCP")
+	flag.StringVar(&socketMode, "socket-mode", "0660", "Permissions, in octal, for the unix domain socket")
+	flag.StringVar(&c.admin, "admin-addr", "", "Address to serve metrics and admin commands over HTTP on, e.g. :9100")
+	flag.StringVar(&c.adminToken, "admin-token", "", "Bearer token required by the admin endpoints other than /healthz and /readyz")
+	flag.BoolVar(&c.adminDebug, "admin-debug", false, "Also serve pprof and expvar on the admin address")
+	flag.StringVar(&c.tls.cert, "tls-cert", "", "PEM certificate file, enables TLS on the TCP port")
+	flag.StringVar(&c.tls.key, "tls-key", "", "PEM private key file for -tls-cert")
+	flag.StringVar(&c.tls.ca, "tls-ca", "", "PEM file of CA certificates used to verify client certificates")
+	flag.BoolVar(&c.tls.verifyClient, "tls-verify-client", false, "Require clients to present a certificate signed by -tls-ca")
+	flag.StringVar(&c.l1, "l1", "none", "In-memory cache in front of LMDB: none, or memory to run LMDB as the L2 of rend's L1L2 orchestrator")
+	flag.StringVar(&protocols, "protocols", "both", "Protocols to accept: text, binary or both")
+	flag.StringVar(&c.opts.Path, "path", "/tmp/rendb/", "Directory for the LMDB environment")
+	flag.BoolVar(&c.opts.NoSubdir, "no-subdir", false, "Take -path as the data file rather than its directory, with the lock file next to it")
+	flag.StringVar(&fileMode, "file-mode", "0664", "Permissions, in octal, for the data and lock files and backups")
+	flag.StringVar(&dirMode, "dir-mode", "0774", "Permissions, in octal, for the directories created for the data, backups and compaction")
+	flag.BoolVar(&c.opts.ExactModes, "exact-modes", false, "Apply -file-mode and -dir-mode as given, regardless of the umask, to existing files too")
+	flag.BoolVar(&c.opts.ReadOnly, "read-only", false, "Open an existing environment read-only, failing every write")
+	flag.BoolVar(&c.opts.NoLock, "no-lock", false, "With -read-only, open without the lock file, for read-only file systems where nothing writes the data")
+	flag.BoolVar(&c.opts.SharedReaders, "shared-readers", false, "Other processes open the environment with -read-only, which turns compaction off")
+	flag.DurationVar(&c.opts.ReadTimeout, "read-timeout", 0, "Fail gets that wait longer than this on LMDB, 0 waits for as long as it takes")
+	flag.DurationVar(&c.opts.WriteTimeout, "write-timeout", 0, "Fail writes that wait longer than this on LMDB, though they may still commit, 0 waits for as long as it takes")
+	flag.DurationVar(&c.opts.BreakerLatency, "breaker-latency", 0, "Fail writes fast once writes take longer than this, e.g. on a stalled disk, 0 disables it")
+	flag.Float64Var(&c.opts.BreakerErrorRate, "breaker-error-rate", 0, "Fraction of recent writes that must be slow or fail in the OS to open the breaker, 0 for 0.5")
+	flag.IntVar(&c.opts.BreakerWindow, "breaker-window", 0, "Number of recent writes the breaker looks at, 0 for 20")
+	flag.DurationVar(&c.opts.BreakerCooldown, "breaker-cooldown", 0, "Time writes fail fast for once the breaker opens, 0 for 5s")
+	flag.IntVar(&c.opts.OplogSize, "oplog-size", 0, "Record every change in an oplog, keeping this many records, 0 disables it")
+	flag.BoolVar(&c.opts.OplogValues, "oplog-values", false, "Record the values of sets in the oplog, not only their hashes")
+	flag.BoolVar(&c.opts.WriteTimes, "write-times", false, "Record when each item was written, for inspecting items")
+	flag.BoolVar(&c.opts.TagIndex, "tag-index", false, "Index the tags of items for invalidating them by tag")
+	flag.StringVar(&c.opts.ReplicaAddr, "replica-addr", "", "host:port of a server to replicate every change to, needs -oplog-size and -oplog-values")
+	flag.DurationVar(&c.opts.ReplicaTimeout, "replica-timeout", 5*time.Second, "Time limit for each connect and batch sent to the replica")
+	flag.DurationVar(&c.opts.ReplicaMaxBackoff, "replica-max-backoff", 10*time.Second, "Longest wait before retrying a failed replication batch")
+	flag.DurationVar(&c.opts.DiskFullProbeInterval, "disk-full-probe-interval", 10*time.Second, "Time between checks for room once writes are off for a full file system")
+	flag.IntVar(&c.opts.MaxReaders, "max-readers", 0, "Most concurrent read transactions across all processes, 0 for LMDB's 126")
+	flag.DurationVar(&c.opts.ReaderCheckInterval, "reader-check-interval", time.Minute, "Time between clearing reader slots left by dead processes, 0 only clears them on startup")
+	flag.DurationVar(&c.opts.LongReadThreshold, "long-read-threshold", 0, "Report read transactions open longer than this, 0 disables it")
+	flag.DurationVar(&c.opts.SlowOpThreshold, "slow-op-threshold", 0, "Log operations that take longer than this, with their sizes and transaction wait, 0 disables it")
+	flag.BoolVar(&c.opts.AbortLongReads, "abort-long-reads", false, "Abort long reads that scan the DB, like dumps, instead of only reporting them")
+	flag.IntVar(&c.opts.Shards, "shards", 0, "Number of LMDB environments to split items across by key hash, 0 for one")
+	flag.StringVar(&namespaces, "namespaces", "", "Namespaces with DBs of their own, as name=prefix pairs separated by commas, e.g. a=tenantA:")
+	flag.Int64Var(&c.opts.MapSize, "map-size", 2*1024*1024*1024, "Initial size of the LMDB map in bytes")
+	flag.Int64Var(&c.opts.MaxMapSize, "max-map-size", 0, "Size in bytes the map may grow to when full, 0 disables growth")
+	flag.StringVar(&eviction, "eviction", "none", "What to evict once the map is full: none, soonest-expiring, clock or lru")
+	flag.IntVar(&c.opts.LRUSampleRate, "lru-sample-rate", 1, "Track one in this many hits for -eviction lru")
+	flag.Float64Var(&c.opts.EvictHighWater, "evict-high-water", 0, "Fraction of the map in use past which items are evicted ahead of time, 0 disables it")
+	flag.Float64Var(&c.opts.EvictLowWater, "evict-low-water", 0, "Fraction of the map in use that eviction from -evict-high-water stops at, 0 for 0.05 below it")
+	flag.DurationVar(&c.opts.ReaperInterval, "reaper-interval", 30*time.Second, "Time between runs of the expired item reaper")
+	flag.DurationVar(&c.opts.ReaperInitialDelay, "reaper-initial-delay", 0, "Time before the first reaper run, 0 for one -reaper-interval")
+	flag.Float64Var(&c.opts.ReaperJitter, "reaper-jitter", 0, "Fraction of the reaper interval each wait is randomly varied by either way")
+	flag.IntVar(&c.opts.ReaperMaxDeletes, "reaper-max-deletes", 0, "Most items the reaper removes per run, 0 for no limit")
+	flag.DurationVar(&c.opts.ReaperMaxDuration, "reaper-max-duration", 0, "Longest a reaper run may take, 0 for no limit")
+	flag.IntVar(&c.opts.ReaperBatchSize, "reaper-batch-size", 64, "Most expired items the reaper removes per write transaction")
+	flag.IntVar(&c.opts.ReaperMaxRate, "reaper-max-rate", 0, "Most expired items the reaper removes per second, 0 for no limit")
+	flag.DurationVar(&c.opts.ReaperBatchPause, "reaper-batch-pause", 0, "Least time the reaper waits between batches of deletes")
+	flag.BoolVar(&c.opts.DisableReaper, "disable-reaper", false, "Turn off the expired item reaper")
+	flag.BoolVar(&c.opts.PurgeOnOpen, "purge-on-open", false, "Remove items that expired while the server was down before serving")
+	flag.Float64Var(&c.opts.TTLJitter, "ttl-jitter", 0, "Fraction of each item's TTL it is randomly varied by either way when set or touched")
+	flag.BoolVar(&c.opts.ExptimeMillis, "exptime-ms", false, "Take exptimes set outside any namespace as milliseconds from now instead of seconds")
+	flag.DurationVar(&c.opts.LeaseTTL, "lease-ttl", 10*time.Second, "How long a lease from GetL is held if the value isn't stored with it")
+	flag.DurationVar(&c.opts.NegativeCacheTTL, "negative-cache-ttl", 0, "How long to remember keys found missing, to answer repeated misses from memory, 0 disables it")
+	flag.IntVar(&c.opts.NegativeCacheSize, "negative-cache-size", 100000, "Most missing keys remembered per namespace for -negative-cache-ttl")
+	flag.IntVar(&c.opts.WriteBehind, "write-behind", 0, "Acknowledge sets once staged in memory, committing up to this many at a time in the background, 0 disables it")
+	flag.DurationVar(&c.opts.WriteBehindDelay, "write-behind-delay", 100*time.Millisecond, "Longest a staged set waits to be committed")
+	flag.BoolVar(&c.opts.CoalesceGets, "coalesce-gets", false, "Have concurrent gets of the same key share one read")
+	flag.IntVar(&c.opts.ReadCacheBytes, "read-cache-bytes", 0, "Keep up to this many bytes of recently read items in memory per namespace, 0 disables it")
+	flag.IntVar(&c.opts.BloomFilterItems, "bloom-filter-items", 0, "Size an in-memory bloom filter of the keys for this many items, to answer misses without touching the map, 0 disables it")
+	flag.DurationVar(&c.opts.EarlyExpiration, "early-expiration", 0, "Miss reads of items near their exptime with a probability growing toward it, about the time a refill takes, 0 disables it")
+	flag.DurationVar(&c.opts.BackupInterval, "backup-interval", 0, "Time between scheduled backups, 0 disables them")
+	flag.StringVar(&c.opts.BackupDir, "backup-dir", "", "Directory to keep scheduled backups in")
+	flag.IntVar(&c.opts.BackupKeep, "backup-keep", 7, "Number of scheduled backups to keep, 0 keeps all")
+	flag.BoolVar(&c.opts.BackupCompact, "backup-compact", false, "Compact scheduled backups")
+	flag.StringVar(&c.opts.RestoreFrom, "restore-from", "", "Backup to restore from on startup if the data file is missing or corrupt")
+	flag.StringVar(&onCorruption, "on-corruption", "restore", "What to do when the data file fails its check on startup: restore (from -restore-from), fail or wipe")
+	flag.IntVar(&c.opts.CheckEntries, "check-entries", 0, "Number of entries picked at random that the startup check reads")
+	flag.BoolVar(&c.opts.CheckChecksums, "check-checksums", false, "Have the startup check verify the checksums of the entries it reads")
+	flag.DurationVar(&c.opts.CompactInterval, "compact-interval", 0, "Time between checks for compaction, 0 disables it")
+	flag.Float64Var(&c.opts.CompactMinFree, "compact-min-free", 0.5, "Fraction of pages that must be free to compact")
+	flag.StringVar(&compression, "compression", "none", "Value compression: none, deflate or snappy")
+	flag.IntVar(&c.opts.CompressionThreshold, "compression-threshold", 1024, "Smallest value in bytes to compress")
+	flag.IntVar(&c.opts.MaxKeySize, "max-key-size", 250, "Longest key accepted, in bytes")
+	flag.BoolVar(&c.opts.HashLongKeys, "hash-long-keys", false, "Store keys too long for LMDB under a hash, up to -max-key-size")
+	flag.IntVar(&c.opts.MaxValueSize, "max-value-size", 1024*1024, "Largest value accepted, in bytes")
+	flag.IntVar(&c.opts.ChunkSize, "chunk-size", 0, "Split stored values bigger than this many bytes into chunks, 0 to disable")
+	flag.BoolVar(&c.opts.SeparateValues, "separate-values", false, "Keep values in their own DB apart from item metadata, for cheap touches")
+	flag.BoolVar(&c.opts.Checksums, "checksums", false, "Store a checksum with each item and check it on reads")
+	flag.BoolVar(&c.opts.DeleteCorrupt, "delete-corrupt", false, "Delete items that fail their checksum")
+	flag.StringVar(&keyPrefix, "encryption-key-env", "", "Encrypt values with keys from environment variables with this prefix, e.g. RENDLMDB_KEY_")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level to log: debug, info, warn or error")
+	flag.BoolVar(&logJSON, "log-json", false, "Log JSON objects instead of text")
+	flag.StringVar(&syncMode, "sync", "full", "Commit durability: full, nometa (skip meta page fsync) or none (no fsync)")
+	flag.StringVar(&syncOps, "sync-ops", "", "Operations synced before they return with -sync nometa or none, separated by commas, e.g. delete,cas")
+	flag.DurationVar(&c.opts.SyncInterval, "sync-interval", 0, "Sync the environment this often with -sync nometa or none, 0 leaves it to the OS")
+	flag.BoolVar(&c.opts.NoReadahead, "no-readahead", false, "Turn off OS readahead on the map, for data bigger than memory")
+	flag.BoolVar(&c.opts.WarmUp, "warm-up", false, "Read the data file into the page cache on startup, /readyz answers 503 until done")
+
+	flag.Parse()
+
+	if err := applyEnv(); err != nil {
+		return c, err
+	}
+
+	if c.tls.enabled() && c.socket != "" {
+		return c, errors.New("TLS is only available on the TCP port, not with -socket")
+	}
+
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return c, fmt.Errorf("invalid socket mode %q", socketMode)
+	}
+	c.socketMode = os.FileMode(mode)
+
+	if mode, err = strconv.ParseUint(fileMode, 8, 32); err != nil || mode > 0777 {
+		return c, fmt.Errorf("invalid file mode %q", fileMode)
+	}
+	c.opts.FileMode = os.FileMode(mode)
+	if mode, err = strconv.ParseUint(dirMode, 8, 32); err != nil || mode > 0777 {
+		return c, fmt.Errorf("invalid directory mode %q", dirMode)
+	}
+	c.opts.DirMode = os.FileMode(mode)
+
+	switch protocols {
+	case "text":
+		c.protocols = []protocol.Components{textprot.Components}
+	case "binary":
+		c.protocols = []protocol.Components{binprot.Components}
+	case "both":
+		c.protocols = []protocol.Components{binprot.Components, textprot.Components}
+	default:
+		return c, fmt.Errorf("invalid protocol set %q", protocols)
+	}
+
+	switch c.l1 {
+	case "none", "memory":
+	default:
+		return c, fmt.Errorf("invalid l1 %q", c.l1)
+	}
+
+	if c.opts.Namespaces, err = lmdbh.ParseNamespaces(namespaces); err != nil {
+		return c, err
+	}
+
+	switch eviction {
+	case "none":
+	case "soonest-expiring":
+		c.opts.Eviction = lmdbh.EvictSoonestExpiring
+	case "clock":
+		c.opts.Eviction = lmdbh.EvictClock
+	case "lru":
+		c.opts.Eviction = lmdbh.EvictLRU
+	default:
+		return c, fmt.Errorf("invalid eviction policy %q", eviction)
+	}
+
+	switch onCorruption {
+	case "restore":
+	case "fail":
+		c.opts.OnCorruption = lmdbh.CorruptFail
+	case "wipe":
+		c.opts.OnCorruption = lmdbh.CorruptWipe
+	default:
+		return c, fmt.Errorf("invalid corruption policy %q", onCorruption)
+	}
+
+	switch compression {
+	case "none":
+	case "deflate":
+		c.opts.Compression = lmdbh.Deflate
+	case "snappy":
+		c.opts.Compression = lmdbh.Snappy
+	default:
+		return c, fmt.Errorf("invalid compression %q", compression)
+	}
+
+	if keyPrefix != "" {
+		keys, err := lmdbh.EnvKeys(keyPrefix)
+		if err != nil {
+			return c, err
+		}
+		c.opts.Encryption = keys
+	}
+
+	var level lmdbh.Level
+	switch logLevel {
+	case "debug":
+		level = lmdbh.LevelDebug
+	case "info":
+		level = lmdbh.LevelInfo
+	case "warn":
+		level = lmdbh.LevelWarn
+	case "error":
+		level = lmdbh.LevelError
+	default:
+		return c, fmt.Errorf("invalid log level %q", logLevel)
+	}
+	c.opts.Logger = lmdbh.NewLogger(os.Stderr, level, logJSON)
+
+	switch syncMode {
+	case "full":
+	case "nometa":
+		c.opts.NoMetaSync = true
+	case "none":
+		c.opts.NoSync = true
+	default:
+		return c, fmt.Errorf("invalid sync mode %q", syncMode)
+	}
+	if c.opts.SyncOps, err = lmdbh.ParseSyncOps(syncOps); err != nil {
+		return c, err
+	}
+
+	return c, nil
+}
+
+// applyEnv sets every flag not given on the command line from its environment
+// variable, if there is one.
+func applyEnv() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if val, ok := os.LookupEnv(name); ok {
+			if serr := f.Value.Set(val); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", val, name, serr)
+			}
+		}
+	})
+
+	return err
+}
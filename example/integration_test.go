@@ -0,0 +1,299 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+// The integration test builds the example server, runs it on a free port and
+// drives it with the memcached text protocol. It is left out of normal test
+// runs, run it with:
+//
+//	go test -tags integration ./example/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testServer is a running example server.
+type testServer struct {
+	cmd  *exec.Cmd
+	addr string
+}
+
+// buildServer builds the example server into dir.
+func buildServer(t *testing.T, dir string) string {
+	bin := filepath.Join(dir, "rend-lmdb")
+	out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("building the server: %v\n%s", err, out)
+	}
+	return bin
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startServer runs bin with an environment at path and waits for it to take
+// connections.
+func startServer(t *testing.T, bin, path string, args ...string) *testServer {
+	port := freePort(t)
+	args = append([]string{"-port", fmt.Sprint(port), "-path", path, "-protocols", "text"}, args...)
+
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{cmd: cmd, addr: fmt.Sprintf("127.0.0.1:%d", port)}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		conn, err := net.Dial("tcp", s.addr)
+		if err == nil {
+			conn.Close()
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server didn't start listening: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// stop shuts the server down like an operator would and checks it exits
+// cleanly.
+func (s *testServer) stop(t *testing.T) {
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.cmd.Wait(); err != nil {
+		t.Fatalf("server exited with %v", err)
+	}
+}
+
+// client speaks the memcached text protocol.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *testServer) dial(t *testing.T) *client {
+	conn, err := net.Dial("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) line() string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	l, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("reading a response: %v", err)
+	}
+	return strings.TrimRight(l, "\r\n")
+}
+
+// do sends a command, with data if it is a storage command, and returns the
+// first line of the response.
+func (c *client) do(cmd string, data ...string) string {
+	c.t.Helper()
+	msg := cmd + "\r\n"
+	for _, d := range data {
+		msg += d + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, msg); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.line()
+}
+
+func (c *client) store(op, key string, flags, exptime int, data string) string {
+	c.t.Helper()
+	return c.do(fmt.Sprintf("%s %s %d %d %d", op, key, flags, exptime, len(data)), data)
+}
+
+// item is a value returned by get or gat.
+type item struct {
+	flags int
+	data  string
+}
+
+// values sends a retrieval command and reads the items up to END.
+func (c *client) values(cmd string) map[string]item {
+	c.t.Helper()
+	items := make(map[string]item)
+	for l := c.do(cmd); l != "END"; l = c.line() {
+		var key string
+		var flags, size int
+		if _, err := fmt.Sscanf(l, "VALUE %s %d %d", &key, &flags, &size); err != nil {
+			c.t.Fatalf("%s: unexpected %q", cmd, l)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		items[key] = item{flags: flags, data: string(buf[:size])}
+	}
+	return items
+}
+
+func (c *client) expect(got, want string) {
+	c.t.Helper()
+	if got != want {
+		c.t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func (c *client) expectValue(key, data string) {
+	c.t.Helper()
+	it, ok := c.values("get " + key)[key]
+	if !ok {
+		c.t.Fatalf("get %s: miss", key)
+	}
+	if it.data != data {
+		c.t.Fatalf("get %s: %q, want %q", key, it.data, data)
+	}
+}
+
+func (c *client) expectMiss(key string) {
+	c.t.Helper()
+	if it, ok := c.values("get " + key)[key]; ok {
+		c.t.Fatalf("get %s: %q, want a miss", key, it.data)
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rend-lmdb-integration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := buildServer(t, dir)
+	path := filepath.Join(dir, "db")
+	srv := startServer(t, bin, path)
+	c := srv.dial(t)
+
+	c.expectMiss("foo")
+	c.expect(c.store("set", "foo", 5, 0, "bar"), "STORED")
+	if it := c.values("get foo")["foo"]; it.data != "bar" || it.flags != 5 {
+		t.Fatalf("get foo: %+v", it)
+	}
+
+	c.expect(c.store("add", "foo", 0, 0, "x"), "NOT_STORED")
+	c.expect(c.store("add", "new", 0, 0, "x"), "STORED")
+	c.expect(c.store("replace", "missing", 0, 0, "x"), "NOT_STORED")
+	c.expect(c.store("replace", "new", 0, 0, "y"), "STORED")
+	c.expectValue("new", "y")
+
+	c.expect(c.store("append", "foo", 0, 0, "-end"), "STORED")
+	c.expect(c.store("prepend", "foo", 0, 0, "start-"), "STORED")
+	c.expectValue("foo", "start-bar-end")
+	c.expect(c.store("append", "missing", 0, 0, "x"), "NOT_STORED")
+
+	// Multi-key gets return the hits only
+	items := c.values("get foo missing new")
+	if len(items) != 2 || items["foo"].data != "start-bar-end" || items["new"].data != "y" {
+		t.Fatalf("multi-key get: %+v", items)
+	}
+
+	c.expect(c.do("touch foo 100"), "TOUCHED")
+	c.expect(c.do("touch missing 100"), "NOT_FOUND")
+	if it := c.values("gat 100 foo")["foo"]; it.data != "start-bar-end" {
+		t.Fatalf("gat foo: %+v", it)
+	}
+
+	c.expect(c.do("delete new"), "DELETED")
+	c.expect(c.do("delete new"), "NOT_FOUND")
+	c.expectMiss("new")
+
+	// Items stored already expired are never returned
+	c.expect(c.store("set", "old", 0, int(time.Now().Unix())-10, "x"), "STORED")
+	c.expectMiss("old")
+
+	// Values bigger than memcached's 1MB limit are refused. The server may
+	// drop the connection over it, so carry on with a new one.
+	big := strings.Repeat("x", 1024*1024+1)
+	if got := c.store("set", "big", 0, 0, big); got == "STORED" {
+		t.Fatal("stored a value over the size limit")
+	}
+	c = srv.dial(t)
+	c.expectMiss("big")
+
+	// Several clients at once
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			conn, err := net.Dial("tcp", srv.addr)
+			if err != nil {
+				done <- err
+				return
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for j := 0; j < 50; j++ {
+				data := fmt.Sprintf("%d-%d", i, j)
+				fmt.Fprintf(conn, "set c%d 0 0 %d\r\n%s\r\n", i, len(data), data)
+				if l, err := r.ReadString('\n'); err != nil || l != "STORED\r\n" {
+					done <- fmt.Errorf("client %d: %q, %v", i, l, err)
+					return
+				}
+			}
+			done <- nil
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		c.expectValue(fmt.Sprintf("c%d", i), fmt.Sprintf("%d-49", i))
+	}
+
+	// Everything stored survives a clean restart
+	srv.stop(t)
+	srv = startServer(t, bin, path)
+	c = srv.dial(t)
+	c.expectValue("foo", "start-bar-end")
+	c.expectValue("c0", "0-49")
+	c.expectMiss("new")
+	srv.stop(t)
+}
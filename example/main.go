@@ -15,23 +15,115 @@
 package main
 
 import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/netflix/rend-lmdb/lmdbh"
 	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/server"
 )
 
 func main() {
+	c, err := parseConfig()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	go closeOnSignal()
+
+	hc := lmdbh.New(c.opts)
+
+	if c.admin != "" {
+		h, err := hc()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go serveAdmin(c.admin, c.adminToken, c.adminDebug, h.(*lmdbh.Handler))
+	}
+
 	largs := server.ListenArgs{
 		Type: server.ListenTCP,
-		Port: 12121,
+		Port: c.port,
+	}
+
+	if c.socket != "" {
+		largs, err = unixListenArgs(c.socket)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go chmodSocket(c.socket, c.socketMode)
+	}
+
+	if c.tls.enabled() {
+		conf, err := c.tls.build()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		backend, err := backendSocket()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		largs, err = unixListenArgs(backend)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go func() {
+			log.Fatalln(serveTLS(c.port, conf, backend))
+		}()
+	}
+
+	// With an L1, a get that misses in memory is served from LMDB and the
+	// item is set back into memory, so the memory cache fills back up from
+	// LMDB after a restart instead of from the backing service.
+	orca, l1, l2 := orcas.L1Only, hc, handlers.HandlerConst(handlers.NilHandler)
+	if c.l1 == "memory" {
+		orca, l1, l2 = orcas.L1L2, inmem.New, hc
 	}
 
 	server.ListenAndServe(
 		largs,
+		c.protocols,
 		server.Default,
-		orcas.L1Only,
-		lmdbh.New("/tmp/rendb/", 2*1024*1024*1024),
-		handlers.NilHandler,
+		orca,
+		l1,
+		l2,
 	)
 }
+
+// shutdownTimeout bounds how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// closeOnSignal waits for SIGINT or SIGTERM, then closes the LMDB environment
+// and exits. The server has no way to stop listening, so instead new
+// connections are refused by the handler once closing starts. Closing waits
+// for in-flight requests, then syncs, so no committed writes are lost and the
+// reader slots are released.
+func closeOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	log.Println("Received", sig, "shutting down")
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- lmdbh.CloseAll()
+	}()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			log.Println("Error closing LMDB:", err)
+			os.Exit(1)
+		}
+	case <-time.After(shutdownTimeout):
+		log.Println("Timed out waiting for in-flight requests, exiting anyway")
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
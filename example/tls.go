@@ -0,0 +1,145 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The server only knows how to listen on plain TCP or unix sockets, so TLS is
+// terminated here and each connection is piped to the server over a unix
+// socket that only this process can reach.
+
+type tlsConfig struct {
+	cert         string
+	key          string
+	ca           string
+	verifyClient bool
+}
+
+func (t tlsConfig) enabled() bool {
+	return t.cert != "" || t.key != ""
+}
+
+func (t tlsConfig) build() (*tls.Config, error) {
+	if t.cert == "" || t.key == "" {
+		return nil, errors.New("TLS needs both a certificate and a key")
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.cert, t.key)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if t.ca != "" {
+		pem, err := ioutil.ReadFile(t.ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ca)
+		}
+		conf.ClientCAs = pool
+	}
+
+	if t.verifyClient {
+		if conf.ClientCAs == nil {
+			return nil, errors.New("client certificate verification needs a CA")
+		}
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// backendSocket returns the path of the private socket the server listens on
+// behind the TLS listener.
+func backendSocket() (string, error) {
+	dir, err := ioutil.TempDir("", "rendlmdb")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rend.sock"), nil
+}
+
+// serveTLS accepts TLS connections on port and proxies each to the server on
+// the unix socket at backend. It only returns if the listener fails.
+func serveTLS(port int, conf *tls.Config, backend string) error {
+	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), conf)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		go proxy(conn, backend)
+	}
+}
+
+func proxy(front net.Conn, backend string) {
+	defer front.Close()
+
+	back, err := net.Dial("unix", backend)
+	if err != nil {
+		log.Println("Error connecting to server socket:", err)
+		return
+	}
+	defer back.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(back, front)
+		// Let the server see EOF from the client
+		back.(*net.UnixConn).CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(front, back)
+		if tc, ok := front.(*tls.Conn); ok {
+			tc.CloseWrite()
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/netflix/rend/server"
+)
+
+// socketWait is how long to wait for the server to create the socket file
+// before giving up on setting its permissions
+const socketWait = 5 * time.Second
+
+// unixListenArgs returns the ListenArgs for a unix domain socket at path. A
+// socket left behind by a previous run is removed first, since the server
+// cannot bind over it. Anything else at path is an error.
+func unixListenArgs(path string) (server.ListenArgs, error) {
+	fi, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return server.ListenArgs{}, err
+	case fi.Mode()&os.ModeSocket == 0:
+		return server.ListenArgs{}, fmt.Errorf("%s exists and is not a socket", path)
+	default:
+		if err := os.Remove(path); err != nil {
+			return server.ListenArgs{}, err
+		}
+	}
+
+	return server.ListenArgs{
+		Type: server.ListenUnix,
+		Path: path,
+	}, nil
+}
+
+// chmodSocket sets the permissions of the socket at path once the server has
+// created it. The server creates the socket with the process umask applied and
+// does not expose the listener, so this is the only hook available.
+func chmodSocket(path string, mode os.FileMode) {
+	deadline := time.Now().Add(socketWait)
+	for time.Now().Before(deadline) {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Chmod(path, mode); err != nil {
+				log.Println("Error setting socket permissions:", err)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Println("Socket", path, "did not appear, permissions not set")
+}
@@ -0,0 +1,561 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// AdminHandler serves health, stats and operational endpoints for h:
+//
+//	GET  /healthz                        200 if the DB can be read, 503 if not
+//	GET  /readyz                         200 once the page cache is warm, 503 until then
+//	GET  /metrics                        Prometheus metrics of every store
+//	GET  /stats[?namespace=<name>]       memcached style stats, of all namespaces or one
+//	GET  /stats/sizes[?max=<n>]          histogram of item sizes, of up to n items
+//	GET  /readers                        the reader table: shard, pid, thread, txnid, lag
+//	POST /reap                           remove expired items now
+//	POST /reaper/pause[?for=<duration>]  pause the background reaper, for a while
+//	POST /reaper/resume                  resume it
+//	POST /backup?path=<dir>[&compact=1]  write a backup of the DB to dir
+//	POST /compact                        compact the data file
+//	POST /flush[?delay=<duration>]       remove all items, now or after delay
+//	     [&namespace=<name>]             or only those of one namespace
+//	GET  /dump                           all live items as memcached set commands
+//	GET  /events[?buffer=<n>]            stream keyspace events, one JSON object a line
+//	GET  /oplog?from=<seq>[&max=<n>]     oplog records from seq on, one JSON object a line
+//	     [&shard=<n>]                    of shard n, 0 if not given
+//	POST /invalidate?tag=<tag>           remove every item with a tag
+//	POST /delete?prefix=<prefix>         remove every item with a key prefix
+//	     or ?start=<key>[&end=<key>]     or in a key range, end excluded
+//	     [&dry_run=1]                    or only count them
+//	GET  /scan[?prefix=<prefix>]         a page of items, with their size, flags and exptime
+//	     [&limit=<n>][&cursor=<cursor>]  of up to n, after the page cursor came with
+//	GET  /item?key=<key>                 what is stored about an item, but its value
+//
+// If token is not empty, every endpoint but /healthz and /readyz requires it
+// as a bearer token: "Authorization: Bearer <token>". Use TLS in front of it
+// anywhere the token could be sniffed.
+func AdminHandler(h *Handler, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		// A read transaction fails once the store is closed or broken
+		for _, s := range h.shards {
+			if err := s.view(func(*lmdb.Txn) error { return nil }); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("OK\n"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !h.Warm() {
+			http.Error(w, "warming up", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	})
+
+	mux.Handle("/metrics", MetricsHandler())
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		var st Stats
+		var err error
+		if ns, ok := namespaceParam(r); ok {
+			st, err = h.NamespaceStats(ns)
+		} else {
+			st, err = h.Stats()
+		}
+		if err == errNoNamespace {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		st.WriteTo(w)
+	})
+
+	mux.HandleFunc("/stats/sizes", func(w http.ResponseWriter, r *http.Request) {
+		max, _ := strconv.Atoi(r.FormValue("max"))
+		ss, err := h.SizeStats(max)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		ss.WriteTo(w)
+	})
+
+	mux.HandleFunc("/readers", func(w http.ResponseWriter, r *http.Request) {
+		rs, err := h.Readers()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		for _, rd := range rs {
+			txnid := "-"
+			if rd.TxnID != 0 {
+				txnid = strconv.FormatUint(rd.TxnID, 10)
+			}
+			fmt.Fprintf(w, "%d %d %s %s %d\n", rd.Shard, rd.PID, rd.Thread, txnid, rd.Lag)
+		}
+	})
+
+	mux.HandleFunc("/reap", post(func(w http.ResponseWriter, r *http.Request) {
+		n, err := h.Reap()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "OK %d\n", n)
+	}))
+
+	mux.HandleFunc("/reaper/pause", post(func(w http.ResponseWriter, r *http.Request) {
+		var d time.Duration
+		if f := r.FormValue("for"); f != "" {
+			var err error
+			if d, err = time.ParseDuration(f); err != nil || d <= 0 {
+				http.Error(w, "invalid duration: "+f, http.StatusBadRequest)
+				return
+			}
+		}
+		h.PauseReaper(d)
+		w.Write([]byte("OK\n"))
+	}))
+
+	mux.HandleFunc("/reaper/resume", post(func(w http.ResponseWriter, r *http.Request) {
+		h.ResumeReaper()
+		w.Write([]byte("OK\n"))
+	}))
+
+	mux.HandleFunc("/backup", post(func(w http.ResponseWriter, r *http.Request) {
+		path := r.FormValue("path")
+		if path == "" {
+			http.Error(w, "missing path", http.StatusBadRequest)
+			return
+		}
+		compact, _ := strconv.ParseBool(r.FormValue("compact"))
+
+		if err := h.Backup(path, compact); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}))
+
+	mux.HandleFunc("/compact", post(func(w http.ResponseWriter, r *http.Request) {
+		if err := h.Compact(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}))
+
+	mux.HandleFunc("/flush", post(func(w http.ResponseWriter, r *http.Request) {
+		var delay time.Duration
+		if d := r.FormValue("delay"); d != "" {
+			var err error
+			if delay, err = time.ParseDuration(d); err != nil {
+				http.Error(w, "invalid delay: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var err error
+		if ns, ok := namespaceParam(r); ok {
+			err = h.FlushNamespace(ns, delay)
+		} else {
+			err = h.Flush(delay)
+		}
+		if err == errNoNamespace {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("OK\n"))
+	}))
+
+	mux.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := h.Dump(w); err != nil {
+			// Too late for an error status once the dump has started
+			h.shards[0].opts.Logger.Error("Error dumping database", "component", "admin", "error", err)
+		}
+	})
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		buffer := 1024
+		if v := r.URL.Query().Get("buffer"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "bad buffer", http.StatusBadRequest)
+				return
+			}
+			buffer = n
+		}
+
+		events, cancel := h.Subscribe(buffer)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case e := <-events:
+				err := enc.Encode(eventJSON{
+					Type:      e.Type.String(),
+					Namespace: e.Namespace,
+					Key:       string(e.Key),
+					Time:      e.Time.UnixNano(),
+				})
+				if err != nil {
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			case <-r.Context().Done():
+				return
+			case <-h.shards[0].done:
+				return
+			}
+		}
+	})
+
+	mux.HandleFunc("/invalidate", post(func(w http.ResponseWriter, r *http.Request) {
+		tag := r.FormValue("tag")
+		if tag == "" {
+			http.Error(w, "tag is required", http.StatusBadRequest)
+			return
+		}
+		n, err := h.InvalidateTag([]byte(tag))
+		switch err {
+		case nil:
+		case errNoTagIndex:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "OK %d\n", n)
+	}))
+
+	mux.HandleFunc("/delete", post(func(w http.ResponseWriter, r *http.Request) {
+		dryRun := r.FormValue("dry_run") == "1"
+		var n int
+		var err error
+		if prefix := r.FormValue("prefix"); prefix != "" {
+			n, err = h.DeletePrefix([]byte(prefix), dryRun)
+		} else if start := r.FormValue("start"); start != "" {
+			var end []byte
+			if v := r.FormValue("end"); v != "" {
+				end = []byte(v)
+			}
+			n, err = h.DeleteRange([]byte(start), end, dryRun)
+		} else {
+			http.Error(w, "prefix or start is required", http.StatusBadRequest)
+			return
+		}
+		switch err {
+		case nil:
+		case errBadRange:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "OK %d\n", n)
+	}))
+
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit := defaultScanLimit
+		if v := q.Get("limit"); v != "" {
+			var err error
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxScanLimit {
+				http.Error(w, "bad limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		items, cursor, err := h.Scan([]byte(q.Get("prefix")), q.Get("cursor"), limit)
+		switch err {
+		case nil:
+		case errBadCursor:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		page := scanJSON{Items: make([]scanItemJSON, len(items)), Cursor: cursor}
+		for i, it := range items {
+			page.Items[i] = scanItemJSON{
+				Key:       string(it.Key),
+				Namespace: it.Namespace,
+				Size:      it.Size,
+				Flags:     it.Flags,
+				Exptime:   it.Exptime,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})
+
+	mux.HandleFunc("/item", func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "key is required", http.StatusBadRequest)
+			return
+		}
+		info, err := h.Inspect([]byte(key))
+		switch err {
+		case nil:
+		case common.ErrKeyNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case common.ErrBadRequest:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(itemJSON{
+			Key:         string(info.Key),
+			Namespace:   info.Namespace,
+			Shard:       info.Shard,
+			Exptime:     unixMillis(info.Exptime),
+			TTL:         int64(info.TTL / time.Millisecond),
+			Expired:     info.Expired,
+			SoftExptime: unixMillis(info.SoftExptime),
+			Flags:       info.Flags,
+			CAS:         info.CAS,
+			Size:        info.Size,
+			StoredSize:  info.StoredSize,
+			Version:     info.Version,
+			Compressed:  info.Compressed,
+			Encrypted:   info.Encrypted,
+			Chunked:     info.Chunked,
+			Checksum:    info.Checksum,
+			HashedKey:   info.HashedKey,
+			Written:     unixMillis(info.Written),
+		})
+	})
+
+	mux.HandleFunc("/oplog", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		shard, max := 0, 1000
+		var from uint64
+		var err error
+		if v := q.Get("shard"); v != "" {
+			if shard, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "bad shard", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("from"); v != "" {
+			if from, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "bad from", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("max"); v != "" {
+			if max, err = strconv.Atoi(v); err != nil || max < 0 {
+				http.Error(w, "bad max", http.StatusBadRequest)
+				return
+			}
+		}
+
+		recs, err := h.Oplog(shard, from, max)
+		switch err {
+		case nil:
+		case ErrOplogTrimmed:
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		case errNoOplog, errNoShard:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		for _, rec := range recs {
+			enc.Encode(oplogJSON{
+				Seq:       rec.Seq,
+				Op:        rec.Op.String(),
+				Namespace: rec.Namespace,
+				Key:       string(rec.Key),
+				Time:      rec.Time.UnixNano(),
+				Flags:     rec.Flags,
+				Exptime:   rec.Exptime,
+				ValueHash: rec.ValueHash,
+				Value:     rec.Value,
+			})
+		}
+	})
+
+	return RequireToken(token, mux, "/healthz", "/readyz")
+}
+
+// eventJSON is an Event as streamed by /events. Time is in Unix nanoseconds.
+type eventJSON struct {
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+// oplogJSON is an OplogRecord as returned by /oplog. Value is base64 encoded.
+type oplogJSON struct {
+	Seq       uint64 `json:"seq"`
+	Op        string `json:"op"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key,omitempty"`
+	Time      int64  `json:"time"`
+	Flags     uint32 `json:"flags,omitempty"`
+	Exptime   uint64 `json:"exptime,omitempty"`
+	ValueHash uint64 `json:"hash,omitempty"`
+	Value     []byte `json:"value,omitempty"`
+}
+
+// scanJSON is a page of Scan as returned by /scan.
+type scanJSON struct {
+	Items  []scanItemJSON `json:"items"`
+	Cursor string         `json:"cursor,omitempty"`
+}
+
+type scanItemJSON struct {
+	Key       string `json:"key"`
+	Namespace string `json:"namespace"`
+	Size      int    `json:"size"`
+	Flags     uint32 `json:"flags"`
+	Exptime   uint32 `json:"exptime"`
+}
+
+// itemJSON is an ItemInfo as returned by /item. Times are in Unix
+// milliseconds, zero for none, and ttl is in milliseconds.
+type itemJSON struct {
+	Key         string `json:"key"`
+	Namespace   string `json:"namespace"`
+	Shard       int    `json:"shard"`
+	Exptime     int64  `json:"exptime"`
+	TTL         int64  `json:"ttl,omitempty"`
+	Expired     bool   `json:"expired"`
+	SoftExptime int64  `json:"soft_exptime,omitempty"`
+	Flags       uint32 `json:"flags"`
+	CAS         uint64 `json:"cas"`
+	Size        int    `json:"size"`
+	StoredSize  int    `json:"stored_size"`
+	Version     int    `json:"version"`
+	Compressed  bool   `json:"compressed"`
+	Encrypted   bool   `json:"encrypted"`
+	Chunked     bool   `json:"chunked"`
+	Checksum    bool   `json:"checksum"`
+	HashedKey   bool   `json:"hashed_key"`
+	Written     int64  `json:"written,omitempty"`
+}
+
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// RequireToken wraps next so requests must carry token as a bearer token,
+// except for the paths in open. An empty token lets everything through.
+func RequireToken(token string, next http.Handler, open ...string) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range open {
+			if r.URL.Path == p {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if !validToken(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rend-lmdb"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// namespaceParam returns the namespace asked for by r, if any. The default
+// namespace is asked for with an empty one.
+func namespaceParam(r *http.Request) (string, bool) {
+	r.ParseForm()
+	ns, ok := r.Form["namespace"]
+	if !ok {
+		return "", false
+	}
+	return ns[0], true
+}
+
+// post only lets POST requests through to fn, since they change things.
+func post(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func validToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
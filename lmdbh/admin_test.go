@@ -0,0 +1,242 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+const adminToken = "secret"
+
+// admin sends a request with the admin token to srv and returns the status and
+// body of the response.
+func admin(t *testing.T, srv http.Handler, method, target string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func expectStatus(t *testing.T, srv http.Handler, method, target string, code int) string {
+	t.Helper()
+	got, body := admin(t, srv, method, target)
+	if got != code {
+		t.Fatalf("%s %s: %d %q, want %d", method, target, got, body, code)
+	}
+	return body
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv := AdminHandler(testHandler(t, Options{DisableReaper: true}), adminToken)
+
+	for _, c := range []struct {
+		path, auth string
+		code       int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusOK},
+		{"/stats", "", http.StatusUnauthorized},
+		{"/stats", "Bearer wrong", http.StatusUnauthorized},
+		{"/stats", adminToken, http.StatusUnauthorized},
+		{"/stats", "Bearer " + adminToken, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", c.path, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != c.code {
+			t.Errorf("%s with %q: %d, want %d", c.path, c.auth, w.Code, c.code)
+		}
+	}
+
+	// Endpoints that change things only take POST
+	for _, path := range []string{"/reap", "/backup", "/compact", "/flush", "/delete", "/invalidate"} {
+		expectStatus(t, srv, "GET", path, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestAdminReap(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true})
+	srv := AdminHandler(h, adminToken)
+	mustSet(t, h, "short", []byte("v"), 0, 10)
+	mustSet(t, h, "long", []byte("v"), 0, 3600)
+	clock.advance(time.Minute)
+
+	if body := expectStatus(t, srv, "POST", "/reap", http.StatusOK); body != "OK 1\n" {
+		t.Fatalf("reap: %q", body)
+	}
+	if body := expectStatus(t, srv, "POST", "/reap", http.StatusOK); body != "OK 0\n" {
+		t.Fatalf("second reap: %q", body)
+	}
+	expectValue(t, h, "long", []byte("v"))
+}
+
+func TestAdminBackup(t *testing.T) {
+	h := testHandler(t, Options{DisableReaper: true})
+	srv := AdminHandler(h, adminToken)
+	mustSet(t, h, "k", value("k", 1, 100), 0, 0)
+
+	expectStatus(t, srv, "POST", "/backup", http.StatusBadRequest)
+	for _, compact := range []string{"0", "1"} {
+		dir := filepath.Join(tempDir(t), "backup")
+		expectStatus(t, srv, "POST", "/backup?path="+url.QueryEscape(dir)+"&compact="+compact, http.StatusOK)
+		expectValue(t, openHandler(t, Options{Path: dir, DisableReaper: true}), "k", value("k", 1, 100))
+	}
+}
+
+func TestAdminCompact(t *testing.T) {
+	h := testHandler(t, Options{DisableReaper: true})
+	srv := AdminHandler(h, adminToken)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		mustSet(t, h, key, value(key, 1, 1000), 0, 0)
+		if i < 90 {
+			expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte(key)}), nil)
+		}
+	}
+
+	expectStatus(t, srv, "POST", "/compact", http.StatusOK)
+	expectMiss(t, h, "key:0")
+	expectValue(t, h, "key:99", value("key:99", 1, 1000))
+}
+
+func TestAdminFlush(t *testing.T) {
+	h := testHandler(t, Options{DisableReaper: true, Namespaces: []Namespace{{Name: "a", Prefix: "a:"}}})
+	srv := AdminHandler(h, adminToken)
+	mustSet(t, h, "a:1", []byte("v"), 0, 0)
+	mustSet(t, h, "b:1", []byte("v"), 0, 0)
+
+	expectStatus(t, srv, "POST", "/flush?delay=soon", http.StatusBadRequest)
+	expectStatus(t, srv, "POST", "/flush?namespace=missing", http.StatusNotFound)
+
+	expectStatus(t, srv, "POST", "/flush?namespace=a", http.StatusOK)
+	expectMiss(t, h, "a:1")
+	expectValue(t, h, "b:1", []byte("v"))
+
+	expectStatus(t, srv, "POST", "/flush", http.StatusOK)
+	expectMiss(t, h, "b:1")
+}
+
+func TestAdminScan(t *testing.T) {
+	h := testHandler(t, Options{DisableReaper: true, Namespaces: []Namespace{{Name: "a", Prefix: "a:"}}})
+	srv := AdminHandler(h, adminToken)
+	for i := 1; i <= 3; i++ {
+		mustSet(t, h, fmt.Sprintf("a:%d", i), make([]byte, i), uint32(i), 0)
+	}
+	mustSet(t, h, "b:1", []byte("v"), 0, 0)
+
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("more than 3 pages: %q", keys)
+		}
+		body := expectStatus(t, srv, "GET", "/scan?prefix=a:&limit=2&cursor="+url.QueryEscape(cursor), http.StatusOK)
+		var page scanJSON
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatalf("%v: %q", err, body)
+		}
+		for _, it := range page.Items {
+			if it.Namespace != "a" || it.Size != int(it.Flags) || it.Key != fmt.Sprintf("a:%d", it.Flags) {
+				t.Errorf("scanned %+v", it)
+			}
+			keys = append(keys, it.Key)
+		}
+		if cursor = page.Cursor; cursor == "" {
+			break
+		}
+	}
+	if strings.Join(keys, ",") != "a:1,a:2,a:3" {
+		t.Fatalf("scanned %q", keys)
+	}
+
+	expectStatus(t, srv, "GET", "/scan?limit=0", http.StatusBadRequest)
+	expectStatus(t, srv, "GET", "/scan?cursor=!", http.StatusBadRequest)
+}
+
+func TestAdminInspect(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, Checksums: true})
+	srv := AdminHandler(h, adminToken)
+	mustSet(t, h, "k", value("k", 1, 100), 7, 60)
+
+	body := expectStatus(t, srv, "GET", "/item?key=k", http.StatusOK)
+	var info itemJSON
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatalf("%v: %q", err, body)
+	}
+	if info.Key != "k" || info.Size != 100 || info.Flags != 7 || !info.Checksum || info.Expired ||
+		info.Exptime != clock.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond) || info.TTL != 60000 {
+		t.Fatalf("item: %+v", info)
+	}
+
+	expectStatus(t, srv, "GET", "/item", http.StatusBadRequest)
+	expectStatus(t, srv, "GET", "/item?key=missing", http.StatusNotFound)
+}
+
+// metricValues matches the values of series that depend on timing or on the
+// platform, which are left out of the golden file.
+var metricValues = regexp.MustCompile(`(?m)^((?:rendlmdb_op_duration_seconds|rendlmdb_txn_wait_seconds)_(?:bucket|sum)|` +
+	`rendlmdb_(?:page_size_bytes|pages_used|freelist_pages|readers_used|readers_max|reader_lag_transactions))(\{.*\}) .*$`)
+
+func TestWriteMetrics(t *testing.T) {
+	dir := tempDir(t)
+	h := openHandler(t, Options{Path: dir, MapSize: 1 << 20, DisableReaper: true,
+		Namespaces: []Namespace{{Name: "a", Prefix: "a:"}}})
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	mustSet(t, h, "a:1", []byte("v"), 0, 3600)
+	expectValue(t, h, "k", []byte("v"))
+	expectMiss(t, h, "a:2")
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	got := strings.Replace(buf.String(), dir, "PATH", -1)
+	got = metricValues.ReplaceAllString(got, "$1$2 X")
+
+	golden := filepath.Join("testdata", "metrics.golden")
+	if *updateGolden {
+		if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Fatalf("metrics differ from %s, rerun with -update to see how:\n%s", golden, got)
+	}
+}
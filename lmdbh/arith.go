@@ -0,0 +1,102 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// Incr adds delta to the decimal number stored at key and returns the new
+// value. Like memcached, the value wraps around at 2^64.
+func (h *Handler) Incr(key []byte, delta uint64) (uint64, error) {
+	return h.arith(key, opIncr, func(cur uint64) uint64 {
+		return cur + delta
+	})
+}
+
+// Decr subtracts delta from the decimal number stored at key and returns the
+// new value. Like memcached, the value does not go below 0.
+func (h *Handler) Decr(key []byte, delta uint64) (uint64, error) {
+	return h.arith(key, opDecr, func(cur uint64) uint64 {
+		if delta > cur {
+			return 0
+		}
+		return cur - delta
+	})
+}
+
+// arith applies fn to the stored counter at key in a single write transaction
+// so concurrent increments are never lost. The item keeps its flags and
+// expiration and gets a new CAS token. o is Incr or Decr.
+func (h *Handler) arith(key []byte, o op, fn func(uint64) uint64) (uint64, error) {
+	s := h.shard(key)
+	t := s.startOp(o, len(key), 0)
+	defer t.done()
+
+	if err := s.checkKey(key); err != nil {
+		return 0, err
+	}
+	key = s.detach(key)
+	dk, long := s.dbKey(key)
+
+	var val uint64
+
+	err := s.write(t, func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
+		if err != nil {
+			return err
+		}
+
+		prev, err := s.decodeEntry(txn, dk, buf)
+		if err != nil {
+			return err
+		}
+		if !prev.isFor(long) || s.hasExpired(prev.exptime) {
+			return common.ErrKeyNotFound
+		}
+
+		cur, err := strconv.ParseUint(string(bytes.TrimRight(prev.data, " ")), 10, 64)
+		if err != nil {
+			return common.ErrBadIncDecValue
+		}
+
+		val = fn(cur)
+
+		e := entry{
+			exptime: prev.exptime,
+			soft:    prev.soft,
+			flags:   prev.flags,
+			cas:     s.nextCAS(),
+			data:    strconv.AppendUint(nil, val, 10),
+			key:     long,
+		}
+
+		if e, err = s.prepareEntry(e); err != nil {
+			return err
+		}
+
+		return s.putEntry(txn, dk, e, 0)
+	})
+
+	if err != nil {
+		// val may still be set by a write given up on
+		return 0, s.decodeErr(err)
+	}
+	return val, nil
+}
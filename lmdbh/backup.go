@@ -0,0 +1,183 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// Backup writes a consistent snapshot of the environment to a data.mdb file in
+// the directory path, creating the directory if needed. The copy runs inside a
+// read transaction, so traffic carries on as normal while it is made. With
+// compact set, free pages are left out of the copy, which makes it smaller but
+// slower to produce.
+//
+// The map cannot be grown while a backup is running, so writes that need the
+// map to grow wait for the backup to finish.
+//
+// With Shards, each shard is written to its own directory under path, one
+// after the other, so the shards are not a snapshot of the same moment.
+// RestoreFrom takes the same layout.
+func (h *Handler) Backup(path string, compact bool) error {
+	if len(h.shards) == 1 {
+		return h.shards[0].backup(path, compact)
+	}
+	for i, s := range h.shards {
+		if err := s.backup(filepath.Join(path, shardDir(i)), compact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) backup(path string, compact bool) error {
+	if err := os.MkdirAll(path, s.opts.DirMode); err != nil {
+		return err
+	}
+
+	var flags uint
+	if compact {
+		flags |= lmdb.CopyCompact
+	}
+
+	start := time.Now()
+
+	s.resizeLock.RLock()
+	defer s.resizeLock.RUnlock()
+
+	if s.closed {
+		return errClosed
+	}
+
+	if err := s.env.CopyFlag(s.opts.copyPath(path), flags); err != nil {
+		s.opts.Logger.Error("Error writing backup", "component", "backup", "path", path, "error", err)
+		return err
+	}
+	if s.opts.ExactModes {
+		if err := os.Chmod(path, s.opts.DirMode); err != nil {
+			return err
+		}
+	}
+	if err := s.opts.copyMode(filepath.Join(path, dataFile)); err != nil {
+		return err
+	}
+
+	s.opts.Logger.Info("Wrote backup", "component", "backup", "path", path,
+		"compact", compact, "duration", time.Since(start))
+	return nil
+}
+
+// snapshotPrefix starts the name of every scheduled snapshot directory. The rest
+// is the UTC time it was taken, so the names sort oldest first.
+const (
+	snapshotPrefix     = "snapshot-"
+	snapshotTimeFormat = "20060102T150405Z"
+	partialSuffix      = ".partial"
+)
+
+// backupScheduler takes a snapshot every BackupInterval, either into
+// BackupSink or into BackupDir, pruning old ones in BackupDir down to
+// BackupKeep.
+func backupScheduler(s *store) {
+	for {
+		select {
+		case <-time.After(s.opts.BackupInterval):
+		case <-s.done:
+			return
+		}
+
+		if s.opts.BackupSink != nil {
+			name := snapshotPrefix + time.Now().UTC().Format(snapshotTimeFormat) + ".mdb"
+			if err := s.backupToSink(s.opts.BackupSink, name, s.opts.BackupCompact); err != nil {
+				s.opts.Logger.Error("Error taking scheduled backup", "component", "backup", "error", err)
+			}
+			continue
+		}
+
+		if err := s.snapshot(); err != nil {
+			s.opts.Logger.Error("Error taking scheduled backup", "component", "backup", "error", err)
+			continue
+		}
+
+		if err := s.pruneSnapshots(); err != nil {
+			s.opts.Logger.Error("Error removing old backups", "component", "backup", "error", err)
+		}
+	}
+}
+
+// snapshot writes a backup to a partial directory and renames it into place
+// once it is complete, so a crash mid copy never leaves something that looks
+// like a good snapshot.
+func (s *store) snapshot() error {
+	name := snapshotPrefix + time.Now().UTC().Format(snapshotTimeFormat)
+	final := filepath.Join(s.opts.BackupDir, name)
+	partial := final + partialSuffix
+
+	if err := os.RemoveAll(partial); err != nil {
+		return err
+	}
+	if err := s.backup(partial, s.opts.BackupCompact); err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+	return os.Rename(partial, final)
+}
+
+// snapshots returns the complete snapshot directories in BackupDir, oldest
+// first.
+func snapshots(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() && strings.HasPrefix(name, snapshotPrefix) && !strings.HasSuffix(name, partialSuffix) {
+			names = append(names, name)
+		}
+	}
+
+	// ReadDir sorts by name, which sorts by time
+	return names, nil
+}
+
+func (s *store) pruneSnapshots() error {
+	if s.opts.BackupKeep <= 0 {
+		return nil
+	}
+
+	names, err := snapshots(s.opts.BackupDir)
+	if err != nil {
+		return err
+	}
+
+	for len(names) > s.opts.BackupKeep {
+		if err := os.RemoveAll(filepath.Join(s.opts.BackupDir, names[0])); err != nil {
+			return err
+		}
+		s.opts.Logger.Debug("Removed old backup", "component", "backup", "name", names[0])
+		names = names[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// BackupSink stores streamed snapshots somewhere other than the local disk,
+// e.g. an object store. Each snapshot is a single data.mdb image.
+type BackupSink interface {
+	// Create starts a new snapshot called name.
+	Create(name string) (BackupWriter, error)
+}
+
+// BackupWriter receives the contents of one snapshot. Exactly one of Commit or
+// Abort is called once writing is over. Only a committed snapshot may be
+// treated as complete.
+type BackupWriter interface {
+	io.Writer
+	Commit() error
+	Abort() error
+}
+
+// BackupTo streams a consistent snapshot of the environment to w, as a single
+// data.mdb image. See Backup for the effect of compact and the impact on
+// writes. Sharded handlers can't be streamed, use Backup instead.
+func (h *Handler) BackupTo(w io.Writer, compact bool) error {
+	if len(h.shards) > 1 {
+		return errShardedSink
+	}
+	return h.shards[0].backupTo(w, compact)
+}
+
+// backupTo feeds the copy through a pipe since LMDB only writes to file
+// descriptors.
+func (s *store) backupTo(w io.Writer, compact bool) error {
+	var flags uint
+	if compact {
+		flags |= lmdb.CopyCompact
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, pr)
+		if err != nil {
+			// Keep reading until LMDB is done. Closing the pipe under it would
+			// kill the process with SIGPIPE.
+			io.Copy(ioutil.Discard, pr)
+		}
+		copied <- err
+	}()
+
+	start := time.Now()
+
+	s.resizeLock.RLock()
+	if s.closed {
+		err = errClosed
+	} else {
+		err = s.env.CopyFDFlag(pw.Fd(), flags)
+	}
+	s.resizeLock.RUnlock()
+
+	// EOF for the reader
+	pw.Close()
+
+	if cerr := <-copied; err == nil {
+		err = cerr
+	}
+	if err != nil {
+		s.opts.Logger.Error("Error streaming backup", "component", "backup", "error", err)
+		return err
+	}
+
+	s.opts.Logger.Info("Streamed backup", "component", "backup",
+		"compact", compact, "duration", time.Since(start))
+	return nil
+}
+
+// backupToSink streams a snapshot called name to sink.
+func (s *store) backupToSink(sink BackupSink, name string, compact bool) error {
+	bw, err := sink.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if err := s.backupTo(bw, compact); err != nil {
+		bw.Abort()
+		return err
+	}
+
+	return bw.Commit()
+}
+
+// DirSink is a BackupSink that writes each snapshot to a file in a local
+// directory. It is mostly useful for testing a remote sink's setup locally.
+type DirSink string
+
+func (d DirSink) Create(name string) (BackupWriter, error) {
+	if err := os.MkdirAll(string(d), 0774); err != nil {
+		return nil, err
+	}
+
+	final := filepath.Join(string(d), name)
+	f, err := os.Create(final + partialSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dirWriter{File: f, final: final}, nil
+}
+
+type dirWriter struct {
+	*os.File
+	final string
+}
+
+func (w *dirWriter) Commit() error {
+	if err := w.Sync(); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), w.final)
+}
+
+func (w *dirWriter) Abort() error {
+	w.Close()
+	return os.Remove(w.Name())
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const defaultWriteBatchDelay = 200 * time.Microsecond
+
+// batchOp is a single mutation waiting for the batch writer
+type batchOp struct {
+	fn  lmdb.TxnOp
+	err chan error
+}
+
+// write runs a client mutation of the operation t times, after committing any
+// staged sets. With batching enabled it is handed to the batch writer and committed
+// along with whatever other mutations arrive at about the same time, otherwise
+// it gets its own write transaction. Operations in SyncOps always get their
+// own, and are synced before returning, see commitSync.
+//
+// Batched ops share a transaction without being isolated from each other
+// (nested transactions don't work with WriteMap), so fn must not write
+// anything before returning an error like a missing or existing key.
+func (s *store) write(t *opTimer, fn lmdb.TxnOp) error {
+	called := time.Now()
+	timed := func(txn *lmdb.Txn) error {
+		t.waited(called)
+		return fn(txn)
+	}
+	return s.withTimeout(s.opts.WriteTimeout, func() error {
+		return s.writeNow(t.o, timed)
+	})
+}
+
+func (s *store) writeNow(o op, fn lmdb.TxnOp) error {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+
+	if s.closed {
+		return errClosed
+	}
+	if err := s.allowWrite(false); err != nil {
+		return err
+	}
+	defer s.endTrial()
+	if s.staging != nil {
+		// So fn sees them
+		if err := s.commitStaged(); err != nil {
+			return err
+		}
+	}
+	if s.syncOps[o] {
+		return s.commitSync(fn)
+	}
+	if s.batch == nil {
+		return s.update(fn)
+	}
+
+	bop := batchOp{
+		fn:  fn,
+		err: make(chan error, 1),
+	}
+	s.batch <- bop
+	return <-bop.err
+}
+
+// batchWriter commits batches until the store is closed. Closing waits for all
+// client writes to finish first, so there is nothing left to flush by then.
+func batchWriter(s *store) {
+	for {
+		var first batchOp
+		select {
+		case first = <-s.batch:
+		case <-s.done:
+			return
+		}
+
+		ops := []batchOp{first}
+		timer := time.NewTimer(s.opts.WriteBatchDelay)
+
+	collect:
+		for len(ops) < s.opts.WriteBatchSize {
+			select {
+			case op := <-s.batch:
+				ops = append(ops, op)
+			case <-timer.C:
+				break collect
+			}
+		}
+
+		timer.Stop()
+		s.commitBatch(ops)
+	}
+}
+
+func (s *store) commitBatch(ops []batchOp) {
+	errs := make([]error, len(ops))
+
+	err := s.update(func(txn *lmdb.Txn) error {
+		for i, op := range ops {
+			errs[i] = op.fn(txn)
+			if txnFatal(errs[i]) {
+				return errs[i]
+			}
+		}
+		return nil
+	})
+
+	// Too much in one transaction, fall back to one each
+	if lmdb.IsErrno(err, lmdb.TxnFull) && len(ops) > 1 {
+		for _, op := range ops {
+			op.err <- s.update(op.fn)
+		}
+		return
+	}
+
+	for i, op := range ops {
+		if err != nil {
+			op.err <- err
+		} else {
+			op.err <- errs[i]
+		}
+	}
+}
+
+// txnFatal returns whether err leaves the transaction it happened in unusable.
+// Missing and existing keys are normal outcomes for a single op, and errors
+// from outside LMDB are returned by the ops themselves before writing.
+func txnFatal(err error) bool {
+	oe, ok := err.(*lmdb.OpError)
+	if !ok {
+		return false
+	}
+	return oe.Errno != lmdb.NotFound && oe.Errno != lmdb.KeyExist
+}
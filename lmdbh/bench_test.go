@@ -0,0 +1,185 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+const benchKeys = 10000
+
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("key:%08d", i%benchKeys))
+}
+
+// fill stores benchKeys items of size bytes with exptime.
+func fill(b *testing.B, h *Handler, size int, exptime uint32) {
+	data := make([]byte, size)
+	for i := 0; i < benchKeys; i++ {
+		if err := h.Set(common.SetRequest{Key: benchKey(i), Data: data, Exptime: exptime}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchSet(b *testing.B, opts Options, size int) {
+	h := testHandler(b, opts)
+	data := make([]byte, size)
+	var n int64
+
+	// Enough writers to fill batches
+	if opts.WriteBatchSize > 1 {
+		b.SetParallelism(opts.WriteBatchSize)
+	}
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(atomic.AddInt64(&n, 1))
+			if err := h.Set(common.SetRequest{Key: benchKey(i), Data: data}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkSet100(b *testing.B)     { benchSet(b, Options{}, 100) }
+func BenchmarkSet10K(b *testing.B)     { benchSet(b, Options{}, 10*1024) }
+func BenchmarkSetBatched(b *testing.B) { benchSet(b, Options{WriteBatchSize: 64}, 100) }
+func BenchmarkSetChunked(b *testing.B) { benchSet(b, Options{ChunkSize: 4096}, 64*1024) }
+
+func BenchmarkGet(b *testing.B) {
+	h := testHandler(b, Options{})
+	fill(b, h, 100, 0)
+	var n int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(atomic.AddInt64(&n, 1))
+			data, errs := h.Get(getRequest(benchKey(i)))
+			for range data {
+			}
+			if err := <-errs; err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func benchGetEMulti(b *testing.B, keys int) {
+	h := testHandler(b, Options{})
+	fill(b, h, 100, 0)
+	var n int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ks := make([][]byte, keys)
+		for pb.Next() {
+			i := int(atomic.AddInt64(&n, int64(keys)))
+			for j := range ks {
+				ks[j] = benchKey(i + j*31)
+			}
+			data, errs := h.GetE(getRequest(ks...))
+			for range data {
+			}
+			if err := <-errs; err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkGetEMulti4(b *testing.B)   { benchGetEMulti(b, 4) }
+func BenchmarkGetEMulti100(b *testing.B) { benchGetEMulti(b, 100) }
+
+func BenchmarkGAT(b *testing.B) {
+	h := testHandler(b, Options{})
+	fill(b, h, 10*1024, 0)
+	var n int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(atomic.AddInt64(&n, 1))
+			if _, err := h.GAT(common.GATRequest{Key: benchKey(i), Exptime: 3600}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkAppend(b *testing.B) {
+	h := testHandler(b, Options{})
+	fill(b, h, 0, 0)
+	suffix := []byte("x")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Start the values over before they get big
+		if i > 0 && i%benchKeys == 0 {
+			b.StopTimer()
+			fill(b, h, 0, 0)
+			b.StartTimer()
+		}
+		if err := h.Append(common.SetRequest{Key: benchKey(i), Data: suffix}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReapUnderLoad times reaping benchKeys expired items while sets of
+// other keys keep the writer busy. Each op is one reap of all of them.
+func BenchmarkReapUnderLoad(b *testing.B) {
+	h := testHandler(b, Options{DisableReaper: true})
+	data := make([]byte, 100)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("load:%08d", i%benchKeys)), Data: data})
+		}
+	}()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		// Absolute exptimes a second in the past are already expired
+		fill(b, h, 100, uint32(time.Now().Unix())-1)
+		b.StartTimer()
+
+		n, err := h.Reap()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n < benchKeys {
+			b.Fatalf("reaped %d of %d items", n, benchKeys)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// With BloomFilterItems, each namespace keeps a bloom filter of the keys of its
+// data DB in memory, so reads of keys that were never stored miss without
+// touching the map. It is built by scanning the DB on open, and every write
+// adds its key before it commits, see written, so a read never misses a key
+// that is there. Deleted keys can't be taken out, so once half the bits are
+// set the filter is rebuilt from the DB in the background, sized for at least
+// twice the items there are by then. Writes during a rebuild go into both
+// filters.
+//
+// Writes by other processes sharing the environment aren't added, so it must
+// not be used with any, and it isn't used in read-only mode.
+const (
+	bloomFalsePositives = 0.01
+	bloomHashes         = 7
+)
+
+type bloomFilter struct {
+	bits []uint64
+	set  uint64 // bits set, read and written atomically
+}
+
+func newBloomFilter(items int) *bloomFilter {
+	// m = -n ln p / (ln 2)^2, about 9.6 bits an item at 1%
+	n := -float64(items) * math.Log(bloomFalsePositives) / (math.Ln2 * math.Ln2)
+	return &bloomFilter{bits: make([]uint64, int(n)/64+1)}
+}
+
+// positions calls fn with each bit position of key, by double hashing one
+// 64 bit hash.
+func (f *bloomFilter) positions(key []byte, fn func(word int, bit uint64) bool) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) % m
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(key []byte) {
+	f.positions(key, func(word int, bit uint64) bool {
+		addr := &f.bits[word]
+		for {
+			old := atomic.LoadUint64(addr)
+			if old&bit != 0 {
+				return true
+			}
+			if atomic.CompareAndSwapUint64(addr, old, old|bit) {
+				atomic.AddUint64(&f.set, 1)
+				return true
+			}
+		}
+	})
+}
+
+func (f *bloomFilter) has(key []byte) bool {
+	has := true
+	f.positions(key, func(word int, bit uint64) bool {
+		has = atomic.LoadUint64(&f.bits[word])&bit != 0
+		return has
+	})
+	return has
+}
+
+// full reports whether half the bits are set, past which the filter no
+// longer gives its false positive rate.
+func (f *bloomFilter) full() bool {
+	return atomic.LoadUint64(&f.set) > uint64(len(f.bits))*32
+}
+
+// bloom is a store's filter, and the one being built to replace it.
+type bloom struct {
+	lock    sync.RWMutex
+	current *bloomFilter
+	next    *bloomFilter
+
+	// rebuild asks bloomRebuilder for a new filter
+	rebuild chan struct{}
+}
+
+func (b *bloom) filters() (*bloomFilter, *bloomFilter) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.current, b.next
+}
+
+// add adds key to the filters, asking for a rebuild if the current one is
+// full.
+func (b *bloom) add(key []byte) {
+	current, next := b.filters()
+	current.add(key)
+	if next != nil {
+		next.add(key)
+	} else if current.full() {
+		select {
+		case b.rebuild <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *bloom) has(key []byte) bool {
+	current, _ := b.filters()
+	return current.has(key)
+}
+
+// buildBloom replaces the store's filter with one built from the data DB. The
+// new filter takes writes before the DB is read, so none are left out. A write
+// in progress when it is installed may have added its key to the old filter
+// only, so the DB is read once LMDB's writer lock has been taken and given
+// back, by which time that write has committed or aborted.
+func (s *store) buildBloom() error {
+	var items uint64
+	err := s.view(func(txn *lmdb.Txn) error {
+		stat, err := txn.Stat(s.dbi)
+		items = stat.Entries
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	size := s.opts.BloomFilterItems
+	if n := int(2 * items); n > size {
+		size = n
+	}
+	next := newBloomFilter(size)
+
+	b := s.bloom
+	b.lock.Lock()
+	if b.current == nil {
+		b.current = next
+	} else {
+		b.next = next
+	}
+	b.lock.Unlock()
+
+	err = s.update(func(*lmdb.Txn) error { return nil })
+	if err == nil {
+		err = s.view(func(txn *lmdb.Txn) error {
+			return s.scanBloom(txn, next)
+		})
+	}
+
+	b.lock.Lock()
+	if err == nil {
+		b.current = next
+	}
+	b.next = nil
+	b.lock.Unlock()
+	return err
+}
+
+// scanBloom adds every key of the data DB to f.
+func (s *store) scanBloom(txn *lmdb.Txn, f *bloomFilter) error {
+	txn.RawRead = true
+	cur, err := txn.OpenCursor(s.dbi)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	for {
+		key, _, err := cur.Get(nil, nil, lmdb.Next)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f.add(key)
+	}
+}
+
+// bloomRebuilder rebuilds the filter whenever it fills up.
+func bloomRebuilder(s *store) {
+	for {
+		select {
+		case <-s.bloom.rebuild:
+		case <-s.done:
+			return
+		}
+
+		if err := s.buildBloom(); err != nil {
+			s.opts.Logger.Error("Error rebuilding bloom filter", "component", "bloom", "error", err)
+		}
+	}
+}
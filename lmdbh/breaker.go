@@ -0,0 +1,216 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// The breaker watches every write transaction of an environment. A write is
+// bad if it takes longer than BreakerLatency or fails in the OS, e.g. with
+// EIO, and the breaker opens once BreakerErrorRate of the last BreakerWindow
+// writes were bad, or as soon as a write has been in progress for
+// BreakerLatency, since LMDB has one writer at a time and everything else
+// would queue behind it. While it is open client writes fail straight away
+// with ErrBreakerOpen. After BreakerCooldown one client write is let through,
+// and the next write to finish closes the breaker, or opens it again if it was
+// bad. Background writes are never refused.
+const (
+	defaultBreakerWindow    = 20
+	defaultBreakerErrorRate = 0.5
+	defaultBreakerCooldown  = 5 * time.Second
+)
+
+// ErrBreakerOpen is returned by writes while the breaker is open, so callers
+// can skip the store rather than wait on it.
+var ErrBreakerOpen = errors.New("Rend LMDB writes are failing fast while the breaker is open")
+
+type breaker struct {
+	latency  time.Duration
+	rate     float64
+	cooldown time.Duration
+
+	lock sync.Mutex
+	// outcomes are those of the last writes, true for bad ones, n of them
+	// recorded and bad of those bad. next is where the next one goes.
+	outcomes    []bool
+	next, n     int
+	bad         int
+	inflight    int
+	lastAdvance time.Time
+
+	// openUntil is zero while closed, and trial set while a write tests the
+	// breaker after its cooldown
+	openUntil time.Time
+	trial     bool
+}
+
+func newBreaker(opts Options) *breaker {
+	if opts.BreakerLatency <= 0 && opts.BreakerErrorRate <= 0 {
+		return nil
+	}
+	return &breaker{
+		latency:  opts.BreakerLatency,
+		rate:     opts.BreakerErrorRate,
+		cooldown: opts.BreakerCooldown,
+		outcomes: make([]bool, opts.BreakerWindow),
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.openUntil = now.Add(b.cooldown)
+	b.trial = false
+	b.next, b.n, b.bad = 0, 0, 0
+}
+
+// BreakerOpen reports whether client writes are failing fast, see
+// Options.BreakerLatency.
+func (h *Handler) BreakerOpen() bool {
+	for _, s := range h.shards {
+		if s.breakerOpen() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *store) breakerOpen() bool {
+	b := s.breaker
+	if b == nil {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return !b.openUntil.IsZero()
+}
+
+// allowWrite returns ErrBreakerOpen if a client write must fail fast. Unless
+// staged, whatever it allows must be followed by endTrial.
+func (s *store) allowWrite(staged bool) error {
+	b := s.breaker
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if b.openUntil.IsZero() {
+		if b.latency <= 0 || b.inflight == 0 || now.Sub(b.lastAdvance) <= b.latency {
+			return nil
+		}
+		b.open(now)
+		s.breakerTripped("write stalled")
+	} else if !staged && !b.trial && !now.Before(b.openUntil) {
+		b.trial = true
+		return nil
+	}
+
+	root := s.namespaces[0]
+	root.count(&root.stats.breakerRejects, MetricBreakerRejects)
+	return ErrBreakerOpen
+}
+
+// endTrial lets another write test the breaker if the one allowed never got
+// to commit.
+func (s *store) endTrial() {
+	if b := s.breaker; b != nil {
+		b.lock.Lock()
+		b.trial = false
+		b.lock.Unlock()
+	}
+}
+
+// beginWrite records that a write transaction is starting.
+func (s *store) beginWrite() time.Time {
+	now := time.Now()
+	if b := s.breaker; b != nil {
+		b.lock.Lock()
+		if b.inflight == 0 {
+			b.lastAdvance = now
+		}
+		b.inflight++
+		b.lock.Unlock()
+	}
+	return now
+}
+
+// endWrite records how the write transaction begun at start went.
+func (s *store) endWrite(start time.Time, err error) {
+	b := s.breaker
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	bad := b.latency > 0 && now.Sub(start) > b.latency || osError(err)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.inflight--
+	b.lastAdvance = now
+	if !b.openUntil.IsZero() {
+		if !b.trial && now.Before(b.openUntil) {
+			return
+		}
+		if bad {
+			b.open(now)
+			return
+		}
+		b.openUntil = time.Time{}
+		b.trial = false
+		s.opts.Logger.Info("Write breaker closed", "component", "breaker", "path", s.path)
+		return
+	}
+
+	if b.outcomes[b.next] {
+		b.bad--
+	}
+	b.outcomes[b.next] = bad
+	if bad {
+		b.bad++
+	}
+	b.next = (b.next + 1) % len(b.outcomes)
+	if b.n < len(b.outcomes) {
+		b.n++
+	}
+	if b.rate > 0 && b.n == len(b.outcomes) && float64(b.bad) >= b.rate*float64(b.n) {
+		b.open(now)
+		s.breakerTripped("bad writes")
+	}
+}
+
+func (s *store) breakerTripped(reason string) {
+	root := s.namespaces[0]
+	root.count(&root.stats.breakerTrips, MetricBreakerTrips)
+	s.opts.Logger.Warn("Write breaker open, failing writes fast", "component", "breaker", "path", s.path,
+		"reason", reason, "cooldown", s.opts.BreakerCooldown)
+}
+
+// osError reports whether err is the OS failing a write, rather than LMDB or
+// the operation.
+func osError(err error) bool {
+	oe, ok := err.(*lmdb.OpError)
+	if !ok {
+		return false
+	}
+	_, ok = oe.Errno.(syscall.Errno)
+	return ok
+}
@@ -0,0 +1,146 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// GetsResponse is a GetEResponse that also carries the CAS token of the item,
+// for use with CompareAndSwap, and whether it is stale, see SetSoft.
+type GetsResponse struct {
+	common.GetEResponse
+	Cas   uint64
+	Stale bool
+}
+
+// Gets is like GetE, but includes each item's current CAS token and flags
+// stale items. Refreshing a stale item with CompareAndSwap keeps a newer value
+// stored in the meantime.
+func (h *Handler) Gets(cmd common.GetRequest) (<-chan GetsResponse, <-chan error) {
+	dataOut := make(chan GetsResponse, len(cmd.Keys))
+	if len(cmd.Keys) == 1 {
+		err := getsShard(h.shard(cmd.Keys[0]), cmd, dataOut)
+		close(dataOut)
+		return dataOut, errorsOf(err)
+	}
+
+	errorOut := make(chan error, 1)
+	go realHandleGets(h, cmd, dataOut, errorOut)
+	return dataOut, errorOut
+}
+
+func realHandleGets(h *Handler, cmd common.GetRequest, dataOut chan GetsResponse, errorOut chan error) {
+	for _, p := range h.splitGet(cmd) {
+		if err := getsShard(p.s, p.cmd, dataOut); err != nil {
+			errorOut <- err
+			break
+		}
+	}
+
+	close(dataOut)
+	close(errorOut)
+}
+
+func getsShard(s *store, cmd common.GetRequest, dataOut chan<- GetsResponse) error {
+	t := s.startOp(opGets, keyBytes(cmd.Keys), 0)
+	defer t.done()
+
+	return s.readKeys(t, cmd.Keys, func(idx int, dk, long []byte, e *entry) {
+		if e == nil || !s.live(*e, dk, long) {
+			s.count(&s.stats.misses, MetricMisses)
+			dataOut <- GetsResponse{
+				GetEResponse: common.GetEResponse{
+					Miss:   true,
+					Quiet:  cmd.Quiet[idx],
+					Opaque: cmd.Opaques[idx],
+					Key:    cmd.Keys[idx],
+				},
+			}
+			return
+		}
+
+		s.hit(dk)
+
+		dataOut <- GetsResponse{
+			GetEResponse: common.GetEResponse{
+				Miss:    false,
+				Quiet:   cmd.Quiet[idx],
+				Opaque:  cmd.Opaques[idx],
+				Exptime: clientExptime(e.exptime),
+				Flags:   e.flags,
+				Key:     cmd.Keys[idx],
+				Data:    e.data,
+			},
+			Cas:   e.cas,
+			Stale: s.isStale(*e),
+		}
+	})
+}
+
+// CompareAndSwap stores the item only if the CAS token currently stored for the
+// key matches cas. It returns common.ErrKeyNotFound if the key does not exist
+// and common.ErrKeyExists if the item has been modified since cas was read.
+func (h *Handler) CompareAndSwap(cmd common.SetRequest, cas uint64) error {
+	s := h.shard(cmd.Key)
+	t := s.startOp(opCas, len(cmd.Key), len(cmd.Data))
+	defer t.done()
+
+	if err := s.checkItem(cmd.Key, cmd.Data); err != nil {
+		return err
+	}
+	cmd.Key, cmd.Data = s.detach(cmd.Key), s.detach(cmd.Data)
+	dk, long := s.dbKey(cmd.Key)
+
+	err := s.write(t, func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
+		if err != nil {
+			return err
+		}
+
+		prev, err := s.decodeEntry(txn, dk, buf)
+		if err != nil {
+			return err
+		}
+		if !prev.isFor(long) || s.hasExpired(prev.exptime) {
+			return common.ErrKeyNotFound
+		}
+		if prev.cas != cas {
+			return common.ErrKeyExists
+		}
+
+		e := entry{
+			exptime: s.exptime(cmd.Exptime),
+			flags:   cmd.Flags,
+			cas:     s.nextCAS(),
+			data:    cmd.Data,
+			key:     long,
+		}
+		e.soft = s.softExptime(e.exptime, 0)
+
+		if e, err = s.prepareEntry(e); err != nil {
+			return err
+		}
+
+		return s.putEntry(txn, dk, e, 0)
+	})
+
+	if err == nil {
+		s.count(&s.stats.sets, MetricSets)
+	}
+
+	return s.decodeErr(err)
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Entries written with Options.Checksums set have fmtChecksum in their format
+// byte and a CRC-32C right after the header. It covers everything in the entry
+// but the exptime, which GAT and Touch overwrite in place, and the checksum
+// itself.
+const checksumLen = 4
+
+var errChecksum = errors.New("Rend LMDB stored value failed its checksum")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// entryChecksum covers the header from the cas on, and what follows the
+// checksum.
+func entryChecksum(buf []byte) uint32 {
+	crc := crc32.Update(0, crcTable, buf[offCas:headerLen])
+	return crc32.Update(crc, crcTable, buf[headerLen+checksumLen:])
+}
+
+func putChecksum(buf []byte) {
+	binary.BigEndian.PutUint32(buf[headerLen:], entryChecksum(buf))
+}
+
+func checkChecksum(buf []byte) error {
+	if binary.BigEndian.Uint32(buf[headerLen:]) != entryChecksum(buf) {
+		return errChecksum
+	}
+	return nil
+}
+
+// corruptOnRead records that the entry at key failed its checksum and, with
+// DeleteCorrupt set, queues it for deletion like expiredOnRead.
+func (s *store) corruptOnRead(key []byte) {
+	s.count(&s.stats.corrupt, MetricCorrupt)
+	s.opts.Logger.Warn("Stored value failed its checksum", "component", "checksum", "key", string(key))
+
+	if s.corrupt == nil {
+		return
+	}
+
+	select {
+	case s.corrupt <- append([]byte(nil), key...):
+	default:
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// LMDB stores a large value in a run of contiguous overflow pages, which gets
+// hard to find in a fragmented file and is copied whole into the write
+// transaction. With Options.ChunkSize set, put splits entries bigger than that
+// into chunks stored in a third DB, keyed by the item key followed by the big
+// endian chunk number. The chunk number being fixed width keeps the chunks of
+// different keys apart. The main DB then holds a manifest: an entry with
+// fmtChunked in its format byte, the item's exptime, flags and cas, and
+//
+//	0       4        8
+//	| count | length |
+//
+// as its data. The chunks concatenated are the whole serialized entry, which
+// is decoded as usual except that the manifest's exptime wins, since GAT and
+// Touch only rewrite the manifest.
+//
+// With Options.SeparateValues every entry is stored this way, in one chunk if
+// ChunkSize is not set. The main DB then holds only the small manifests, so
+// touches and the reaper, which only need the header, never read or write a
+// value's pages, at the cost of a second lookup for each read.
+const (
+	chunkDBSuffix = "_chunks"
+	manifestLen   = 8
+)
+
+func chunkKey(key []byte, n uint32) []byte {
+	buf := make([]byte, len(key)+4)
+	copy(buf, key)
+	binary.BigEndian.PutUint32(buf[len(key):], n)
+	return buf
+}
+
+// entryChunked returns whether buf is a manifest.
+func entryChunked(buf []byte) bool {
+	_, err := entryVersionOf(buf)
+	return err == nil && buf[offFormat]&fmtChunked != 0
+}
+
+// chunkSize is the size of the chunks buf is split into.
+func (s *store) chunkSize(buf []byte) int {
+	if s.opts.ChunkSize > 0 {
+		return s.opts.ChunkSize
+	}
+	return len(buf)
+}
+
+// manifest returns the serialized manifest for buf, split into chunks.
+func (s *store) manifest(buf []byte) []byte {
+	size := s.chunkSize(buf)
+	data := make([]byte, manifestLen)
+	binary.BigEndian.PutUint32(data[0:4], uint32((len(buf)+size-1)/size))
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(buf)))
+
+	return entryToBuf(entry{
+		exptime:  binary.BigEndian.Uint64(buf[offExptime:]),
+		flags:    binary.BigEndian.Uint32(buf[offFlags:]),
+		cas:      binary.BigEndian.Uint64(buf[offCas:]),
+		data:     data,
+		checksum: s.opts.Checksums,
+		chunked:  true,
+	})
+}
+
+// putChunks stores buf in chunks for key.
+func (s *store) putChunks(txn *lmdb.Txn, key, buf []byte) error {
+	size := s.chunkSize(buf)
+	for n := 0; n*size < len(buf); n++ {
+		end := (n + 1) * size
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if err := txn.Put(s.chunkdbi, chunkKey(key, uint32(n)), buf[n*size:end], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getChunks reassembles the entry described by manifest.
+func (s *store) getChunks(txn *lmdb.Txn, key, manifest []byte) ([]byte, error) {
+	if len(manifest) != manifestLen {
+		return nil, errCorruptValue
+	}
+	n := binary.BigEndian.Uint32(manifest[0:4])
+	length := binary.BigEndian.Uint32(manifest[4:8])
+
+	buf := make([]byte, 0, length)
+	for i := uint32(0); i < n; i++ {
+		chunk, err := txn.Get(s.chunkdbi, chunkKey(key, i))
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return nil, errCorruptValue
+			}
+			return nil, err
+		}
+		buf = append(buf, chunk...)
+	}
+
+	if uint32(len(buf)) != length {
+		return nil, errCorruptValue
+	}
+	return buf, nil
+}
+
+// delChunks removes all of the chunks of key.
+func (s *store) delChunks(txn *lmdb.Txn, key []byte) error {
+	cur, err := txn.OpenCursor(s.chunkdbi)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	// Chunks of longer keys with the same prefix can sort in between
+	ck, _, err := cur.Get(chunkKey(key, 0), nil, lmdb.SetRange)
+	for err == nil && bytes.HasPrefix(ck, key) {
+		if len(ck) == len(key)+4 {
+			if err = cur.Del(0); err != nil {
+				return err
+			}
+		}
+		ck, _, err = cur.Get(nil, nil, lmdb.Next)
+	}
+	if err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import "time"
+
+// Clock tells the time that items expire by, see Options.Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// now is the current unix time in milliseconds by the store's clock, as
+// exptimes are stored.
+func (s *store) now() uint64 {
+	return uint64(s.opts.Clock.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// hasExpired returns whether an item stored with exptime has expired.
+func (s *store) hasExpired(exptime uint64) bool {
+	return exptime != 0 && exptime < s.now()
+}
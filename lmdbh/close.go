@@ -0,0 +1,104 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import "errors"
+
+var errClosed = errors.New("Rend LMDB handler is closed")
+
+// Close releases this handler's reference to its stores. An LMDB environment
+// is closed once the last handler for its path is closed. Closing a handler
+// more than once has no further effect.
+func (h *Handler) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		for _, s := range h.shards {
+			if rerr := s.release(); rerr != nil {
+				err = rerr
+			}
+		}
+	})
+	return err
+}
+
+// CloseAll closes every open LMDB environment, regardless of how many handlers
+// are still using them, after letting in-flight requests finish. Handlers used
+// after this return errors, as does creating new ones, so new connections are
+// turned away. It is meant for process shutdown.
+func CloseAll() error {
+	storesLock.Lock()
+	shutdown = true
+	all := stores
+	stores = make(map[string]*store)
+	storesLock.Unlock()
+
+	var err error
+	for _, s := range all {
+		if cerr := s.close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *store) release() error {
+	storesLock.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last && stores[s.path] == s {
+		delete(stores, s.path)
+	}
+	storesLock.Unlock()
+
+	if !last {
+		return nil
+	}
+	return s.close()
+}
+
+// close stops the background goroutines, waits for in-flight writes, syncs
+// and closes the environment.
+func (s *store) close() error {
+	// Waits for in-flight client writes and blocks new ones
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	close(s.done)
+	s.bg.Wait()
+
+	for _, ns := range s.namespaces {
+		ns.flushLock.Lock()
+		if ns.flushTimer != nil {
+			ns.flushTimer.Stop()
+		}
+		ns.flushLock.Unlock()
+	}
+
+	s.resizeLock.Lock()
+	defer s.resizeLock.Unlock()
+
+	s.closed = true
+
+	// Flush anything left unsynced by NoSync or MapAsync
+	if err := s.env.Sync(true); err != nil {
+		s.opts.Logger.Error("Error syncing LMDB environment", "component", "close", "path", s.path, "error", err)
+	}
+
+	return s.env.Close()
+}
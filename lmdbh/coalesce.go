@@ -0,0 +1,204 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// With CoalesceGets, concurrent gets of the same single key share one read.
+// The first to miss the read cache reads the key in a transaction and hands
+// what it found to the gets that arrive while it does, so hundreds of
+// connections asking for a hot key as it expires cost one read transaction
+// rather than hundreds.
+//
+// A get must not be handed an item older than a write that finished before it
+// arrived, so it only joins a read whose snapshot includes the last write
+// transaction to touch any key of the stripe, tracked as in the negative
+// cache, see written. It isn't used in read-only mode, where writes by other
+// processes can't be seen.
+const flightStripes = 64
+
+type flights struct {
+	stripes [flightStripes]flightStripe
+}
+
+type flightStripe struct {
+	sync.Mutex
+	lastWrite uintptr
+	// reads are the reads in progress that gets may still join, by key
+	reads map[string]*flight
+}
+
+// flight is one read of a key, shared by the gets that join it.
+type flight struct {
+	// readID is the ID of the last write transaction the read's snapshot
+	// includes, zero until its transaction has begun
+	readID  uintptr
+	waiters int
+	done    chan struct{}
+
+	// The result, set before done is closed
+	e   *entry
+	err error
+}
+
+func newFlights(opts Options) *flights {
+	if !opts.CoalesceGets {
+		return nil
+	}
+
+	fs := &flights{}
+	for i := range fs.stripes {
+		fs.stripes[i].reads = make(map[string]*flight)
+	}
+	return fs
+}
+
+func (fs *flights) stripe(key []byte) *flightStripe {
+	h := fnv.New32a()
+	h.Write(key)
+	return &fs.stripes[h.Sum32()%flightStripes]
+}
+
+// join returns the read of key to wait for, or if there is none that can be
+// joined, a new one for the caller to lead.
+func (fs *flights) join(key []byte) (f *flight, lead bool) {
+	st := fs.stripe(key)
+	st.Lock()
+	defer st.Unlock()
+
+	if f := st.reads[string(key)]; f != nil && f.readID != 0 && f.readID >= st.lastWrite {
+		f.waiters++
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	st.reads[string(key)] = f
+	return f, true
+}
+
+// begin records that f reads key in a transaction that sees up to the write
+// transaction readID.
+func (fs *flights) begin(key []byte, f *flight, readID uintptr) {
+	st := fs.stripe(key)
+	st.Lock()
+	f.readID = readID
+	st.Unlock()
+}
+
+// land stops any more gets joining f, returning how many did.
+func (fs *flights) land(key []byte, f *flight) int {
+	st := fs.stripe(key)
+	st.Lock()
+	defer st.Unlock()
+
+	if st.reads[string(key)] == f {
+		delete(st.reads, string(key))
+	}
+	return f.waiters
+}
+
+// written stops gets joining reads of key's stripe that don't see the write
+// transaction writeID.
+func (fs *flights) written(key []byte, writeID uintptr) {
+	st := fs.stripe(key)
+	st.Lock()
+	if writeID > st.lastWrite {
+		st.lastWrite = writeID
+	}
+	st.Unlock()
+}
+
+// flushed stops gets joining any read that doesn't see the write transaction
+// writeID, which removes every key.
+func (fs *flights) flushed(writeID uintptr) {
+	for i := range fs.stripes {
+		st := &fs.stripes[i]
+		st.Lock()
+		if writeID > st.lastWrite {
+			st.lastWrite = writeID
+		}
+		st.Unlock()
+	}
+}
+
+// readCoalesced reads key for readKeys, sharing the read with any concurrent
+// gets of it.
+func (s *store) readCoalesced(t *opTimer, key []byte, fn func(idx int, dk, long []byte, e *entry)) error {
+	if err := s.checkKey(key); err != nil {
+		return err
+	}
+	dk, long := s.dbKey(key)
+
+	e, ok := s.stagedEntry(dk)
+	if !ok {
+		e, ok = s.cached(dk)
+	}
+	if ok {
+		fn(0, dk, long, &e)
+		return nil
+	}
+
+	called := time.Now()
+	f, lead := s.flights.join(dk)
+	if !lead {
+		<-f.done
+		t.waited(called)
+		s.count(&s.stats.coalesced, MetricCoalesced)
+		if f.err != nil {
+			return f.err
+		}
+		e := f.e
+		if e != nil {
+			c := *e
+			e = &c
+		}
+		fn(0, dk, long, e)
+		return nil
+	}
+
+	err := s.view(func(txn *lmdb.Txn) error {
+		t.waited(called)
+		txn.RawRead = true
+		s.flights.begin(dk, f, txn.ID())
+
+		e, err := s.readEntry(txn, dk)
+		if err != nil {
+			return err
+		}
+
+		// The map may be reused once txn is done, so the others get a copy
+		if s.flights.land(dk, f) > 0 && e != nil {
+			c := *e
+			c.data = append([]byte(nil), e.data...)
+			if e.key != nil {
+				c.key = append([]byte(nil), e.key...)
+			}
+			f.e = &c
+		}
+		fn(0, dk, long, e)
+		return nil
+	})
+	if err != nil {
+		s.flights.land(dk, f)
+		f.err = err
+	}
+	close(f.done)
+	return err
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/netflix/rend/metrics"
+)
+
+// Codec compresses values before they are stored, see Options.Compression.
+// Compressed values are tagged with the codec's ID so they can be read back
+// no matter which codec is configured later, as long as it is registered.
+type Codec interface {
+	// ID identifies the codec in stored values. It must never change once
+	// values have been written with it. IDs below 16 are reserved for the
+	// codecs in this package.
+	ID() byte
+	Name() string
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = make(map[byte]Codec)
+)
+
+// RegisterCodec makes c available for reading values. A codec passed as
+// Options.Compression is registered automatically, but a codec that is no
+// longer written with must still be registered to read old values.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	codecs[c.ID()] = c
+	codecsLock.Unlock()
+}
+
+func codecByID(id byte) (Codec, bool) {
+	codecsLock.RLock()
+	c, ok := codecs[id]
+	codecsLock.RUnlock()
+	return c, ok
+}
+
+func init() {
+	RegisterCodec(Deflate)
+	RegisterCodec(Snappy)
+}
+
+var errCorruptValue = errors.New("Rend LMDB stored value could not be decoded")
+
+// Deflate compresses with compress/flate at its fastest level. It needs
+// nothing outside the standard library. Other codecs, like zstd, can be plugged
+// in by implementing Codec.
+var Deflate Codec = deflateCodec{}
+
+type deflateCodec struct{}
+
+func (deflateCodec) ID() byte     { return 1 }
+func (deflateCodec) Name() string { return "deflate" }
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+func (deflateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Snappy compresses with github.com/golang/snappy. It is several times faster
+// than Deflate, at the cost of a worse ratio.
+var Snappy Codec = snappyCodec{}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte     { return 2 }
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) Encode(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCodec) Decode(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// compress returns the stored form of data: the codec ID followed by the
+// encoded data. ok is false if compression is off, the value is too small, or
+// it did not get any smaller.
+func (s *store) compress(data []byte) ([]byte, bool) {
+	c := s.opts.Compression
+	if c == nil || len(data) < s.opts.CompressionThreshold {
+		return nil, false
+	}
+
+	enc, err := c.Encode(data)
+	if err != nil {
+		s.opts.Logger.Warn("Error compressing value, storing as is", "component", "codec",
+			"codec", c.Name(), "error", err)
+		return nil, false
+	}
+	if len(enc)+1 >= len(data) {
+		return nil, false
+	}
+
+	atomic.AddUint64(&s.stats.compressIn, uint64(len(data)))
+	atomic.AddUint64(&s.stats.compressOut, uint64(len(enc)+1))
+	metrics.IncCounterBy(MetricCompressIn, uint64(len(data)))
+	metrics.IncCounterBy(MetricCompressOut, uint64(len(enc)+1))
+
+	return append([]byte{c.ID()}, enc...), true
+}
+
+func decompress(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errCorruptValue
+	}
+
+	c, ok := codecByID(stored[0])
+	if !ok {
+		return nil, fmt.Errorf("Rend LMDB stored value uses unregistered codec %d", stored[0])
+	}
+
+	data, err := c.Decode(stored[1:])
+	if err != nil {
+		return nil, errCorruptValue
+	}
+	return data, nil
+}
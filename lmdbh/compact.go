@@ -0,0 +1,213 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// LMDB never gives pages back to the file system, so churn leaves data.mdb at
+// its high water mark with a large freelist. Compaction copies the live pages
+// into a new file and swaps it in:
+//
+//  1. Client and background writes are held off so nothing is committed
+//     that the copy would miss. Reads carry on.
+//  2. The environment is copied with MDB_CP_COMPACT into a temporary
+//     directory next to data.mdb.
+//  3. With all transactions held off, the environment is closed, the new file
+//     is renamed over the old one and the environment is reopened.
+//
+// Reads only pause for step 3. Only this process may have the environment
+// open, since others would keep using the old file, so compaction is refused
+// when the reader table has slots of another, see readers.go.
+
+const compactDir = "compact.tmp"
+
+// Compact rewrites the data file without its free pages, see above. Shards
+// are compacted one at a time.
+func (h *Handler) Compact() error {
+	for _, s := range h.shards {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) compact() error {
+	if s.opts.ReadOnly {
+		return errReadOnly
+	}
+	if s.opts.SharedReaders {
+		return errCompactShared
+	}
+
+	// Waits for in-flight client writes and blocks new ones
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+
+	if err := s.otherReaders(); err != nil {
+		return err
+	}
+
+	// Blocks background writes, see update
+	s.resizeLock.Lock()
+	if s.closed {
+		s.resizeLock.Unlock()
+		return errClosed
+	}
+	compacting := make(chan struct{})
+	s.compacting = compacting
+	s.resizeLock.Unlock()
+
+	defer func() {
+		s.resizeLock.Lock()
+		s.compacting = nil
+		s.resizeLock.Unlock()
+		close(compacting)
+	}()
+
+	start := time.Now()
+	data := s.opts.dataPath(s.path)
+	tmp := filepath.Join(s.path, compactDir)
+	if s.opts.NoSubdir {
+		// Next to the file, apart from any other shard's
+		tmp = s.path + "-" + compactDir
+	}
+
+	before, err := os.Stat(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, s.opts.DirMode); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	s.resizeLock.RLock()
+	err = s.env.CopyFlag(s.opts.copyPath(tmp), lmdb.CopyCompact)
+	s.resizeLock.RUnlock()
+	if err != nil {
+		s.opts.Logger.Error("Error copying for compaction", "component", "compact", "error", err)
+		return err
+	}
+
+	s.resizeLock.Lock()
+	defer s.resizeLock.Unlock()
+
+	s.env.Close()
+
+	// The copy keeps the mode of the file it replaces. If the rename fails
+	// the old file is still in place and is reopened.
+	renameErr := os.Chmod(filepath.Join(tmp, dataFile), before.Mode().Perm())
+	if renameErr == nil {
+		renameErr = os.Rename(filepath.Join(tmp, dataFile), data)
+	}
+
+	env, d, err := openEnv(s.path, s.opts, s.mapSize)
+	if err != nil {
+		// Nothing can be done with the store now
+		s.closed = true
+		s.opts.Logger.Error("Error reopening environment after compaction, store is closed",
+			"component", "compact", "error", err)
+		return err
+	}
+	s.env = env
+	s.setDBIs(d)
+	for _, ns := range s.namespaces {
+		ns.txnIDsReset()
+	}
+
+	if renameErr != nil {
+		s.opts.Logger.Error("Error swapping in compacted data file", "component", "compact", "error", renameErr)
+		return renameErr
+	}
+
+	var after int64
+	if fi, err := os.Stat(data); err == nil {
+		after = fi.Size()
+	}
+
+	s.opts.Logger.Info("Compacted data file", "component", "compact",
+		"bytes_before", before.Size(), "bytes_after", after, "duration", time.Since(start))
+	return nil
+}
+
+// otherReaders returns errCompactReaders if another process has the
+// environment open, once the slots of dead ones are cleared.
+func (s *store) otherReaders() error {
+	s.resizeLock.RLock()
+	err := errClosed
+	if !s.closed {
+		_, err = s.checkReaders()
+	}
+	s.resizeLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	rs, err := s.readers()
+	if err != nil {
+		return err
+	}
+	pid := os.Getpid()
+	for _, r := range rs {
+		if r.PID != pid {
+			return errCompactReaders
+		}
+	}
+	return nil
+}
+
+// compactor compacts every CompactInterval once at least CompactMinFree of the
+// pages in the file are free.
+//
+// It is not tracked by s.bg: a compaction holds closeLock, which close needs
+// before it waits for the background goroutines. Instead compact checks for
+// a closed store once it has the lock.
+func compactor(s *store) {
+	for {
+		select {
+		case <-time.After(s.opts.CompactInterval):
+		case <-s.done:
+			return
+		}
+
+		es, err := s.envStats()
+		if err != nil {
+			if err != errClosed {
+				s.opts.Logger.Error("Error reading stats for compaction", "component", "compact", "error", err)
+			}
+			continue
+		}
+
+		if free := float64(es.freePages) / float64(es.pagesUsed); free < s.opts.CompactMinFree {
+			s.opts.Logger.Debug("Skipping compaction", "component", "compact", "free_ratio", free)
+			continue
+		}
+
+		if err := s.compact(); err != nil && err != errClosed {
+			s.opts.Logger.Error("Error compacting", "component", "compact", "error", err)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// TestConcurrentReadersAndWriters has writers rewrite a set of keys with newer
+// versions while readers check that every value they see is whole and never
+// older than one they saw before.
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	const (
+		keys     = 20
+		writers  = 4
+		readers  = 8
+		versions = 50
+		size     = 1000
+	)
+
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		var wg sync.WaitGroup
+		errs := make(chan error, writers+readers)
+		done := make(chan struct{})
+
+		// Each writer owns every writers-th key, so versions only go up
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for v := 1; v <= versions; v++ {
+					for k := w; k < keys; k += writers {
+						key := fmt.Sprintf("key:%d", k)
+						if err := h.Set(common.SetRequest{Key: []byte(key), Data: value(key, v, size)}); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}
+			}(w)
+		}
+
+		var rwg sync.WaitGroup
+		for r := 0; r < readers; r++ {
+			rwg.Add(1)
+			go func() {
+				defer rwg.Done()
+				seen := make(map[string]int)
+				all := make([][]byte, keys)
+				for k := range all {
+					all[k] = []byte(fmt.Sprintf("key:%d", k))
+				}
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					data, gerrs := h.GetE(getRequest(all...))
+					for res := range data {
+						if res.Miss {
+							continue
+						}
+						key := string(res.Key)
+						v, err := version(key, res.Data)
+						if err != nil || !bytes.Equal(res.Data, value(key, v, size)) {
+							errs <- fmt.Errorf("%q has a torn value", key)
+							return
+						}
+						if v < seen[key] {
+							errs <- fmt.Errorf("%q went from version %d to %d", key, seen[key], v)
+							return
+						}
+						seen[key] = v
+					}
+					if err := <-gerrs; err != nil {
+						errs <- err
+						return
+					}
+					// Yield, or on one CPU readers served from memory starve the writers
+					runtime.Gosched()
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(done)
+		rwg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("key:%d", k)
+			expectValue(t, h, key, value(key, versions, size))
+		}
+	})
+}
+
+// version parses the version out of a value made by value.
+func version(key string, data []byte) (int, error) {
+	prefix := key + "/"
+	if !bytes.HasPrefix(data, []byte(prefix)) {
+		return 0, fmt.Errorf("no version")
+	}
+	rest := data[len(prefix):]
+	end := bytes.IndexByte(rest, ':')
+	if end < 0 {
+		return 0, fmt.Errorf("no version")
+	}
+	return strconv.Atoi(string(rest[:end]))
+}
+
+// TestConcurrentIncr checks no increments are lost when many clients update
+// the same counters at once.
+func TestConcurrentIncr(t *testing.T) {
+	const (
+		counters = 4
+		clients  = 8
+		incrs    = 100
+	)
+
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		for c := 0; c < counters; c++ {
+			mustSet(t, h, fmt.Sprintf("n:%d", c), []byte("0"), 0, 0)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, clients)
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < incrs; j++ {
+					key := []byte(fmt.Sprintf("n:%d", (i+j)%counters))
+					if _, err := h.Incr(key, 1); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+
+		want := strconv.Itoa(clients * incrs / counters)
+		for c := 0; c < counters; c++ {
+			expectValue(t, h, fmt.Sprintf("n:%d", c), []byte(want))
+		}
+	})
+}
+
+// TestConcurrentAdd checks exactly one of many racing adds of a key wins.
+func TestConcurrentAdd(t *testing.T) {
+	const clients = 16
+
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		var wg sync.WaitGroup
+		results := make(chan error, clients)
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results <- h.Add(common.SetRequest{Key: []byte("k"), Data: []byte(strconv.Itoa(i))})
+			}(i)
+		}
+		wg.Wait()
+		close(results)
+
+		won := 0
+		for err := range results {
+			switch err {
+			case nil:
+				won++
+			case common.ErrKeyExists:
+			default:
+				t.Fatal(err)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("%d adds won", won)
+		}
+	})
+}
+
+// TestConcurrentReap reaps while items are being written and read.
+func TestConcurrentReap(t *testing.T) {
+	h := testHandler(t, Options{DisableReaper: true, ReaperBatchSize: 10})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("live:%d", i)
+		mustSet(t, h, key, value(key, 0, 100), 0, 0)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			key := fmt.Sprintf("live:%d", i%100)
+			h.Set(common.SetRequest{Key: []byte(key), Data: value(key, i, 100)})
+			h.GetE(getRequest([]byte(key)))
+		}
+	}()
+
+	for i := 0; i < 500; i++ {
+		mustSet(t, h, fmt.Sprintf("dead:%d", i), []byte("v"), 0, now()-10)
+	}
+	n, err := h.Reap()
+	close(done)
+	wg.Wait()
+
+	if err != nil || n != 500 {
+		t.Fatalf("reaped %d, %v, want 500", n, err)
+	}
+	for i := 0; i < 100; i++ {
+		if r := getE(t, h, fmt.Sprintf("live:%d", i)); r.Miss {
+			t.Fatalf("live:%d was reaped", i)
+		}
+	}
+}
+
+// TestConcurrentNegativeCache has readers look up keys over and over while
+// they are added, so misses are cached from snapshots taken before the writes
+// commit. Once every key is written, each must be found.
+func TestConcurrentNegativeCache(t *testing.T) {
+	const (
+		keys    = 500
+		readers = 8
+	)
+
+	for _, batch := range []int{0, 8} {
+		h := testHandler(t, Options{NegativeCacheTTL: time.Hour, WriteBatchSize: batch})
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+
+		for r := 0; r < readers; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for i := r; ; i = (i + 1) % keys {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					data, errs := h.GetE(getRequest([]byte(fmt.Sprintf("key:%d", i))))
+					for range data {
+					}
+					<-errs
+					runtime.Gosched()
+				}
+			}(r)
+		}
+
+		for i := 0; i < keys; i++ {
+			mustSet(t, h, fmt.Sprintf("key:%d", i), []byte("v"), 0, 0)
+		}
+		close(done)
+		wg.Wait()
+
+		for i := 0; i < keys; i++ {
+			expectValue(t, h, fmt.Sprintf("key:%d", i), []byte("v"))
+		}
+		expectMiss(t, h, "never")
+		expectMiss(t, h, "never")
+		if st, err := h.Stats(); err != nil || st.NegHits == 0 {
+			t.Fatalf("batch %d: negative hits %d, %v", batch, st.NegHits, err)
+		}
+	}
+}
+
+// TestConcurrentReadCache checks no read caches an item a concurrent write is
+// replacing.
+func TestConcurrentReadCache(t *testing.T) {
+	const (
+		keys    = 200
+		readers = 8
+	)
+
+	for _, batch := range []int{0, 8} {
+		h := testHandler(t, Options{ReadCacheBytes: 1 << 20, WriteBatchSize: batch})
+		for i := 0; i < keys; i++ {
+			mustSet(t, h, fmt.Sprintf("key:%d", i), []byte("old"), 0, 0)
+		}
+
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for r := 0; r < readers; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for i := r; ; i = (i + 1) % keys {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					data, errs := h.GetE(getRequest([]byte(fmt.Sprintf("key:%d", i))))
+					for range data {
+					}
+					<-errs
+					runtime.Gosched()
+				}
+			}(r)
+		}
+
+		for i := 0; i < keys; i++ {
+			mustSet(t, h, fmt.Sprintf("key:%d", i), []byte("new"), 0, 0)
+		}
+		close(done)
+		wg.Wait()
+
+		// Twice, so the second comes from the cache
+		for n := 0; n < 2; n++ {
+			for i := 0; i < keys; i++ {
+				expectValue(t, h, fmt.Sprintf("key:%d", i), []byte("new"))
+			}
+		}
+		if st, err := h.Stats(); err != nil || st.CacheHits < keys {
+			t.Fatalf("batch %d: read cache hits %d, %v", batch, st.CacheHits, err)
+		}
+	}
+}
+
+// TestConcurrentCoalescedGets checks a get sharing another's read never sees
+// an older version than one set before it started.
+func TestConcurrentCoalescedGets(t *testing.T) {
+	const (
+		readers  = 8
+		versions = 200
+	)
+
+	h := testHandler(t, Options{CoalesceGets: true})
+	var latest int64
+	errs := make(chan error, readers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				min := int(atomic.LoadInt64(&latest))
+				data, gerrs := h.Get(getRequest([]byte("hot")))
+				for res := range data {
+					if res.Miss {
+						if min > 0 {
+							errs <- fmt.Errorf("miss after version %d", min)
+							return
+						}
+						continue
+					}
+					if v, err := version("hot", res.Data); err != nil || v < min {
+						errs <- fmt.Errorf("version %d after %d", v, min)
+						return
+					}
+				}
+				if err := <-gerrs; err != nil {
+					errs <- err
+					return
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	for v := 1; v <= versions; v++ {
+		mustSet(t, h, "hot", value("hot", v, 100), 0, 0)
+		atomic.StoreInt64(&latest, int64(v))
+		runtime.Gosched()
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentWriteBehind checks sets are never lost or reordered on their
+// way from being staged to committed, and that concurrent gets see each
+// acknowledged one.
+func TestConcurrentWriteBehind(t *testing.T) {
+	const (
+		keys     = 10
+		writers  = 4
+		versions = 50
+	)
+
+	opts := Options{Path: tempDir(t), WriteBehind: 16, WriteBehindDelay: time.Millisecond}
+	h := openHandler(t, opts)
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for v := 1; v <= versions; v++ {
+				for k := w; k < keys; k += writers {
+					key := fmt.Sprintf("key:%d", k)
+					if err := h.Set(common.SetRequest{Key: []byte(key), Data: value(key, v, 100)}); err != nil {
+						errs <- err
+						return
+					}
+					data, gerrs := h.Get(getRequest([]byte(key)))
+					for res := range data {
+						if got, err := version(key, res.Data); res.Miss || err != nil || got != v {
+							errs <- fmt.Errorf("%q read back version %d after setting %d", key, got, v)
+							return
+						}
+					}
+					if err := <-gerrs; err != nil {
+						errs <- err
+						return
+					}
+				}
+				runtime.Gosched()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h = openHandler(t, opts)
+	for k := 0; k < keys; k++ {
+		key := fmt.Sprintf("key:%d", k)
+		expectValue(t, h, key, value(key, versions, 100))
+	}
+}
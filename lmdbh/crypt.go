@@ -0,0 +1,189 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// KeyProvider supplies the AES keys values are encrypted with, see
+// Options.Encryption. Keys are 16, 24 or 32 bytes, for AES-128, AES-192 or
+// AES-256. Every encrypted value records the ID of its key, so keys can be
+// rotated by changing the current key while keeping the old ones available
+// until every value written with them has expired or been rewritten.
+//
+// Each key is only asked for once per ID and then cached, so a provider
+// backed by a remote KMS is called rarely.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the key to encrypt new values with.
+	CurrentKeyID() (uint32, error)
+
+	// Key returns the key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys.
+type StaticKeys struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+func (k StaticKeys) CurrentKeyID() (uint32, error) {
+	return k.Current, nil
+}
+
+func (k StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Rend LMDB has no encryption key with ID %d", id)
+	}
+	return key, nil
+}
+
+// KeyFuncs is a KeyProvider backed by callbacks, e.g. into a KMS client.
+type KeyFuncs struct {
+	CurrentKeyIDFunc func() (uint32, error)
+	KeyFunc          func(id uint32) ([]byte, error)
+}
+
+func (k KeyFuncs) CurrentKeyID() (uint32, error) { return k.CurrentKeyIDFunc() }
+func (k KeyFuncs) Key(id uint32) ([]byte, error) { return k.KeyFunc(id) }
+
+// EnvKeys reads keys from the environment. The current key ID is in
+// <prefix>CURRENT and each key is base64 encoded in <prefix><id>, e.g. with the
+// prefix RENDLMDB_KEY_:
+//
+//	RENDLMDB_KEY_CURRENT=2
+//	RENDLMDB_KEY_1=...
+//	RENDLMDB_KEY_2=...
+func EnvKeys(prefix string) (KeyProvider, error) {
+	cur := os.Getenv(prefix + "CURRENT")
+	id, err := strconv.ParseUint(cur, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %sCURRENT %q", prefix, cur)
+	}
+
+	return KeyFuncs{
+		CurrentKeyIDFunc: func() (uint32, error) { return uint32(id), nil },
+		KeyFunc: func(id uint32) ([]byte, error) {
+			name := prefix + strconv.FormatUint(uint64(id), 10)
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				return nil, fmt.Errorf("Rend LMDB has no encryption key in %s", name)
+			}
+			return base64.StdEncoding.DecodeString(val)
+		},
+	}, nil
+}
+
+var errNoKeys = errors.New("Rend LMDB stored value is encrypted but no KeyProvider is set")
+
+// Encrypted data is laid out as:
+//
+//	0        4       16
+//	| key id | nonce | ciphertext and tag ... |
+const (
+	cryptKeyIDLen  = 4
+	cryptNonceLen  = 12
+	cryptHeaderLen = cryptKeyIDLen + cryptNonceLen
+)
+
+// crypter encrypts values with AES-GCM, caching a cipher per key ID.
+type crypter struct {
+	keys KeyProvider
+
+	mu    sync.RWMutex
+	aeads map[uint32]cipher.AEAD
+}
+
+func newCrypter(keys KeyProvider) *crypter {
+	return &crypter{
+		keys:  keys,
+		aeads: make(map[uint32]cipher.AEAD),
+	}
+}
+
+func (c *crypter) aead(id uint32) (cipher.AEAD, error) {
+	c.mu.RLock()
+	a, ok := c.aeads[id]
+	c.mu.RUnlock()
+	if ok {
+		return a, nil
+	}
+
+	key, err := c.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if a, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.aeads[id] = a
+	c.mu.Unlock()
+
+	return a, nil
+}
+
+func (c *crypter) encrypt(plain []byte) ([]byte, error) {
+	id, err := c.keys.CurrentKeyID()
+	if err != nil {
+		return nil, err
+	}
+	a, err := c.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, cryptHeaderLen, cryptHeaderLen+len(plain)+a.Overhead())
+	binary.BigEndian.PutUint32(out, id)
+	nonce := out[cryptKeyIDLen:cryptHeaderLen]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return a.Seal(out, nonce, plain, nil), nil
+}
+
+func (c *crypter) decrypt(stored []byte) ([]byte, error) {
+	if len(stored) < cryptHeaderLen {
+		return nil, errCorruptValue
+	}
+
+	a, err := c.aead(binary.BigEndian.Uint32(stored))
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := a.Open(nil, stored[cryptKeyIDLen:cryptHeaderLen], stored[cryptHeaderLen:], nil)
+	if err != nil {
+		return nil, errCorruptValue
+	}
+	return plain, nil
+}
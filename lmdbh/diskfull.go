@@ -0,0 +1,109 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// When a commit fails because the file system is full, the environment is
+// degraded rather than left to fail every write at the disk: writes fail
+// straight away with errDiskFull, gets are still served, and the background
+// writers stand down. diskFullProber tries a throwaway write every
+// DiskFullProbeInterval, and the first to commit ends it.
+const (
+	defaultDiskFullProbeInterval = 10 * time.Second
+
+	// diskProbeSize is how much the probe writes, so a few freed pages
+	// aren't taken for room
+	diskProbeSize = 64 * 1024
+)
+
+// diskProbeKey is deleted in the transaction that writes it, so it is never
+// seen.
+var diskProbeKey = []byte("\x00rend-lmdb-disk-probe")
+
+var errDiskFull = errors.New("Rend LMDB file system is full, writes are off until there is room")
+
+// DiskFull reports whether writes are off because the file system filled up.
+func (h *Handler) DiskFull() bool {
+	for _, s := range h.shards {
+		if s.diskFull() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *store) diskFull() bool {
+	return atomic.LoadInt32(&s.outOfDisk) != 0
+}
+
+// degrade turns writes off after err, if it is the file system filling up,
+// and returns the error to fail the write with.
+func (s *store) degrade(err error) error {
+	if oe, ok := err.(*lmdb.OpError); !ok || oe.Errno != syscall.ENOSPC {
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&s.outOfDisk, 0, 1) {
+		root := s.namespaces[0]
+		root.count(&root.stats.diskFulls, MetricDiskFulls)
+		s.opts.Logger.Error("File system full, writes are off", "component", "diskfull", "path", s.path, "error", err)
+	}
+	return errDiskFull
+}
+
+// diskFullProber probes for room every DiskFullProbeInterval while writes are
+// off.
+func diskFullProber(s *store) {
+	ticker := time.NewTicker(s.opts.DiskFullProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		if !s.diskFull() {
+			continue
+		}
+		if err := s.probeDisk(); err != nil {
+			if err != errClosed {
+				s.opts.Logger.Debug("File system still full", "component", "diskfull", "path", s.path, "error", err)
+			}
+			continue
+		}
+		atomic.StoreInt32(&s.outOfDisk, 0)
+		s.opts.Logger.Info("File system has room, writes are on", "component", "diskfull", "path", s.path)
+	}
+}
+
+// probeDisk commits a write big enough to need new pages.
+func (s *store) probeDisk() error {
+	root := s.namespaces[0]
+	return s.tryUpdate(func(txn *lmdb.Txn) error {
+		if err := txn.Put(root.dbi, diskProbeKey, make([]byte, diskProbeSize), 0); err != nil {
+			return err
+		}
+		return txn.Del(root.dbi, diskProbeKey, nil)
+	})
+}
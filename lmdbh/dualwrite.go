@@ -0,0 +1,175 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// DualWrite is for moving a cache from one handler to another, e.g. from
+// memcached to this one, without a flag day. It answers every request from the
+// primary, and once the primary has taken a write makes the same change to
+// the secondary, so the secondary fills with what clients write. Reads go to
+// the primary only. Flipping the two over, then dropping the wrapper, finishes
+// the move.
+//
+// The conditional writes are mirrored as the change they made: an add or
+// replace that the primary took as a set, since the secondary may not agree
+// on whether the key is there. An append or prepend the secondary can't apply
+// deletes the key from it instead, so it never serves a value the primary
+// doesn't have. Errors from the secondary are logged and counted, never
+// returned.
+type DualWrite struct {
+	primary, secondary handlers.Handler
+	logger             Logger
+}
+
+// NewDualWrite returns a HandlerConst of DualWrites over the handlers that
+// primary and secondary make. Errors from the secondary go to logger, or to
+// standard error if it is nil.
+func NewDualWrite(primary, secondary handlers.HandlerConst, logger Logger) handlers.HandlerConst {
+	if logger == nil {
+		logger = defaultLogger
+	}
+	return func() (handlers.Handler, error) {
+		p, err := primary()
+		if err != nil {
+			return nil, err
+		}
+		s, err := secondary()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		return &DualWrite{primary: p, secondary: s, logger: logger}, nil
+	}
+}
+
+// mirrored reports an error of the secondary, for the write op of key.
+func (d *DualWrite) mirrored(op string, key []byte, err error) {
+	if err == nil {
+		return
+	}
+	metrics.IncCounter(MetricDualWriteErrors)
+	d.logger.Warn("Error writing to secondary", "component", "dualwrite", "op", op, "key", string(key), "error", err)
+}
+
+func (d *DualWrite) Set(cmd common.SetRequest) error {
+	if err := d.primary.Set(cmd); err != nil {
+		return err
+	}
+	d.mirrored("set", cmd.Key, d.secondary.Set(cmd))
+	return nil
+}
+
+func (d *DualWrite) Add(cmd common.SetRequest) error {
+	if err := d.primary.Add(cmd); err != nil {
+		return err
+	}
+	d.mirrored("add", cmd.Key, d.secondary.Set(cmd))
+	return nil
+}
+
+func (d *DualWrite) Replace(cmd common.SetRequest) error {
+	if err := d.primary.Replace(cmd); err != nil {
+		return err
+	}
+	d.mirrored("replace", cmd.Key, d.secondary.Set(cmd))
+	return nil
+}
+
+func (d *DualWrite) Append(cmd common.SetRequest) error {
+	if err := d.primary.Append(cmd); err != nil {
+		return err
+	}
+	d.mirrorConcat("append", cmd, d.secondary.Append(cmd))
+	return nil
+}
+
+func (d *DualWrite) Prepend(cmd common.SetRequest) error {
+	if err := d.primary.Prepend(cmd); err != nil {
+		return err
+	}
+	d.mirrorConcat("prepend", cmd, d.secondary.Prepend(cmd))
+	return nil
+}
+
+// mirrorConcat deletes the key of an append or prepend from the secondary if
+// the secondary failed it.
+func (d *DualWrite) mirrorConcat(op string, cmd common.SetRequest, err error) {
+	if err == nil {
+		return
+	}
+	if err != common.ErrItemNotStored && err != common.ErrKeyNotFound {
+		d.mirrored(op, cmd.Key, err)
+	}
+	if err := d.secondary.Delete(common.DeleteRequest{Key: cmd.Key}); err != common.ErrKeyNotFound {
+		d.mirrored("delete", cmd.Key, err)
+	}
+}
+
+func (d *DualWrite) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	return d.primary.Get(cmd)
+}
+
+func (d *DualWrite) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return d.primary.GetE(cmd)
+}
+
+// GAT mirrors a hit as a touch.
+func (d *DualWrite) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := d.primary.GAT(cmd)
+	if err != nil || res.Miss {
+		return res, err
+	}
+	err = d.secondary.Touch(common.TouchRequest{Key: cmd.Key, Exptime: cmd.Exptime})
+	if err != common.ErrKeyNotFound {
+		d.mirrored("touch", cmd.Key, err)
+	}
+	return res, nil
+}
+
+// Delete deletes from the secondary even if the primary didn't have the key.
+func (d *DualWrite) Delete(cmd common.DeleteRequest) error {
+	err := d.primary.Delete(cmd)
+	if err != nil && err != common.ErrKeyNotFound {
+		return err
+	}
+	if serr := d.secondary.Delete(cmd); serr != common.ErrKeyNotFound {
+		d.mirrored("delete", cmd.Key, serr)
+	}
+	return err
+}
+
+func (d *DualWrite) Touch(cmd common.TouchRequest) error {
+	if err := d.primary.Touch(cmd); err != nil {
+		return err
+	}
+	if err := d.secondary.Touch(cmd); err != common.ErrKeyNotFound {
+		d.mirrored("touch", cmd.Key, err)
+	}
+	return nil
+}
+
+// Close closes both handlers, returning the primary's error if both fail.
+func (d *DualWrite) Close() error {
+	err := d.primary.Close()
+	if serr := d.secondary.Close(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// Dump writes every live item as a memcached text protocol set command:
+//
+//	set <key> <flags> <exptime> <bytes>\r\n<data>\r\n
+//
+// Expired items are skipped. The exptime is the time left to live in seconds,
+// or the absolute unix time for items with more than 30 days left, which is how
+// memcached interprets it. It returns the number of items written.
+//
+// The dump is a consistent snapshot taken in one read transaction per shard,
+// so the map cannot grow until it is done, see Backup.
+func (h *Handler) Dump(w io.Writer) (int, error) {
+	bw := bufio.NewWriter(w)
+	n := 0
+
+	for _, s := range h.all() {
+		m, err := s.dump(bw)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, bw.Flush()
+}
+
+func (s *store) dump(bw *bufio.Writer) (int, error) {
+	n := 0
+
+	err := s.view(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+
+		cur, err := txn.OpenCursor(s.dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		now := s.now()
+		var line []byte
+
+		for i := 1; ; i++ {
+			if i%abortCheckEvery == 0 && s.readAborted(txn) {
+				return errReadAborted
+			}
+
+			key, buf, err := cur.Get(nil, nil, lmdb.Next)
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			e, err := s.decodeEntry(txn, key, buf)
+			if err != nil {
+				return err
+			}
+			if s.hasExpired(e.exptime) {
+				continue
+			}
+			if e.key != nil {
+				key = e.key
+			}
+
+			// In seconds, rounding what is left up so nothing dumped as
+			// live is loaded as never expiring
+			exptime := clientExptime(e.exptime)
+			if e.exptime != 0 && e.exptime-now <= maxRelativeExptime*1000 {
+				exptime = uint32((e.exptime - now + 999) / 1000)
+				// 0 would mean never
+				if exptime == 0 {
+					exptime = 1
+				}
+			}
+
+			line = append(line[:0], "set "...)
+			line = append(line, key...)
+			line = append(line, ' ')
+			line = strconv.AppendUint(line, uint64(e.flags), 10)
+			line = append(line, ' ')
+			line = strconv.AppendUint(line, uint64(exptime), 10)
+			line = append(line, ' ')
+			line = strconv.AppendInt(line, int64(len(e.data)), 10)
+			line = append(line, "\r\n"...)
+
+			bw.Write(line)
+			bw.Write(e.data)
+			if _, err := bw.WriteString("\r\n"); err != nil {
+				return err
+			}
+			n++
+		}
+	})
+
+	return n, err
+}
@@ -0,0 +1,99 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// ParseSyncOps parses a comma separated list of operation names for
+// Options.SyncOps, e.g. "delete,cas".
+func ParseSyncOps(list string) ([]string, error) {
+	var ops []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, err := opNamed(name); err != nil {
+			return nil, err
+		}
+		ops = append(ops, name)
+	}
+	return ops, nil
+}
+
+func opNamed(name string) (op, error) {
+	for o, n := range opNames {
+		if n == name {
+			return op(o), nil
+		}
+	}
+	return 0, fmt.Errorf("Rend LMDB has no operation %q", name)
+}
+
+// lazySync reports whether commits leave syncing to later, so that a durable
+// operation must sync itself.
+func (o Options) lazySync() bool {
+	return o.NoSync || o.NoMetaSync || o.MapAsync
+}
+
+// commitSync commits fn in a write transaction of its own and, if commits
+// don't sync, syncs the environment before returning, for the operations in
+// SyncOps.
+func (s *store) commitSync(fn lmdb.TxnOp) error {
+	if err := s.update(fn); err != nil {
+		return err
+	}
+	if !s.opts.lazySync() {
+		return nil
+	}
+	s.count(&s.stats.syncs, MetricSyncs)
+	return s.degrade(s.sync())
+}
+
+// sync flushes everything committed to disk.
+func (s *store) sync() error {
+	s.resizeLock.RLock()
+	defer s.resizeLock.RUnlock()
+
+	if s.closed {
+		return errClosed
+	}
+	return s.env.Sync(true)
+}
+
+// syncer syncs the environment every SyncInterval, bounding what a crash can
+// lose with NoSync.
+func syncer(s *store) {
+	ticker := time.NewTicker(s.opts.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.count(&s.stats.syncs, MetricSyncs)
+		if err := s.sync(); err != nil && err != errClosed {
+			s.opts.Logger.Error("Error syncing LMDB environment", "component", "sync", "path", s.path, "error", err)
+		}
+	}
+}
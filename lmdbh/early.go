@@ -0,0 +1,37 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// expiresEarly decides whether a read of an item with exptime, which has not
+// expired, misses anyway, see Options.EarlyExpiration. As in XFetch, it does
+// when -EarlyExpiration*ln(u) reaches the time left, for u uniform in (0, 1],
+// which happens with probability exp(-left/EarlyExpiration): rarely while the
+// item has long to live, and for nearly every read at the end.
+func (s *store) expiresEarly(exptime uint64) bool {
+	window := s.opts.EarlyExpiration
+	if window <= 0 || exptime == 0 {
+		return false
+	}
+
+	left := time.Duration(exptime-s.now()) * time.Millisecond
+	u := 1 - rand.Float64()
+	return -float64(window)*math.Log(u) >= float64(left)
+}
@@ -0,0 +1,405 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// Serialized entry layout:
+//
+//	0         8       16        17       18      22         26
+//	| exptime | cas   | version | format | flags | checksum | data ... |
+//
+// with a 64 bit exptime in unix milliseconds. The checksum is only there if
+// the format says so, see checksum.go. So are the soft exptime, see soft.go,
+// the time of the write, see Options.WriteTimes, and the item's key, see
+// keyhash.go, which go after the checksum:
+//
+//	| soft exptime | written | key length | key ... | data ... |
+//
+// with an 8 byte soft exptime, an 8 byte write time in unix milliseconds and
+// a 2 byte key length. Large entries may be split into chunks, see chunk.go.
+//
+// The original layout of the first release has only the exptime and flags
+// before the data, see originalToEntry. Nothing in its bytes tells it from
+// this one, so the format records of migrate.go say which DBs still hold it.
+// The exptime stays at the front, GAT, Touch, eviction and the TTL index read
+// and overwrite it in place.
+const (
+	offExptime = 0
+	offCas     = 8
+	offVersion = 16
+	offFormat  = 17
+	offFlags   = 18
+
+	headerLen = 22
+
+	// offFlagsOriginal and headerLenOriginal are those of the original
+	// layout, see originalToEntry
+	offFlagsOriginal  = 4
+	headerLenOriginal = 8
+)
+
+const entryVersion = 1
+
+// Bits of the format byte.
+const (
+	fmtCompressed = 1 << 0
+	fmtEncrypted  = 1 << 1
+	fmtChecksum   = 1 << 2
+	fmtChunked    = 1 << 3
+	fmtKey        = 1 << 4
+	fmtSoft       = 1 << 5
+	fmtWritten    = 1 << 6
+)
+
+var errUnknownVersion = errors.New("Rend LMDB stored value has an unknown format version")
+
+type entry struct {
+	// exptime is in unix milliseconds, zero for never.
+	exptime uint64
+	flags   uint32
+	cas     uint64
+	data    []byte
+
+	// The form data is in. Only entryToBuf, writeEntry and bufToEntry deal
+	// in anything but plain data, everything else goes through encodeEntry or
+	// prepareEntry and decodeEntry.
+	compressed bool
+	encrypted  bool
+
+	// checksum is set to have entryToBuf add a checksum. bufToEntry checks
+	// it if there is one.
+	checksum bool
+
+	// chunked marks a manifest, whose data says where the real entry is
+	// stored, see chunk.go.
+	chunked bool
+
+	// key is the item's key if it is stored under a hashed one, see
+	// keyhash.go.
+	key []byte
+
+	// soft is when the item goes stale, in unix milliseconds, zero for
+	// never, see soft.go.
+	soft uint64
+
+	// written is when the item was written, in unix milliseconds, zero if
+	// not recorded, see Options.WriteTimes.
+	written uint64
+}
+
+// maxRelativeExptime is the largest exptime memcached treats as an offset from
+// now. Anything larger is an absolute unix time.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// absExptime converts an exptime from a client to the absolute unix time in
+// milliseconds that is stored, given the time now, also in milliseconds. Zero
+// means the item never expires.
+func absExptime(exptime uint32, now uint64) uint64 {
+	if exptime == 0 || exptime > maxRelativeExptime {
+		return secondsExptime(uint64(exptime))
+	}
+	return now + uint64(exptime)*1000
+}
+
+// secondsExptime converts an absolute exptime in seconds to milliseconds. As
+// in memcached, the item lives through the whole of that second.
+func secondsExptime(exptime uint64) uint64 {
+	if exptime == 0 {
+		return 0
+	}
+	return exptime*1000 + 999
+}
+
+// clientExptime is a stored exptime as rend reports it, in seconds and 32 bits.
+// Times past what fits are reported as the last one that does.
+func clientExptime(exptime uint64) uint32 {
+	exptime /= 1000
+	if exptime > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(exptime)
+}
+
+// entryExptime reads the exptime of the serialized entry b without decoding
+// the rest.
+func entryExptime(b []byte) uint64 {
+	if len(b) < headerLen {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b[offExptime:])
+}
+
+// entryToBuf serializes e.
+func entryToBuf(e entry) []byte {
+	buf := make([]byte, entryLen(e))
+	writeEntry(buf, e)
+	return buf
+}
+
+// entryHeaderLen is the length of everything entryToBuf writes before the data.
+func entryHeaderLen(e entry) int {
+	n := headerLen
+	if e.checksum {
+		n += checksumLen
+	}
+	if e.soft != 0 {
+		n += 8
+	}
+	if e.written != 0 {
+		n += 8
+	}
+	if e.key != nil {
+		n += 2 + len(e.key)
+	}
+	return n
+}
+
+// entryLen is the length of e serialized.
+func entryLen(e entry) int {
+	return entryHeaderLen(e) + len(e.data)
+}
+
+// writeEntry serializes e into buf, which must be entryLen(e) long.
+func writeEntry(buf []byte, e entry) {
+	n := entryHeaderLen(e)
+
+	binary.BigEndian.PutUint64(buf[offExptime:], e.exptime)
+	binary.BigEndian.PutUint64(buf[offCas:], e.cas)
+	buf[offVersion] = entryVersion
+	binary.BigEndian.PutUint32(buf[offFlags:], e.flags)
+
+	var format byte
+	if e.compressed {
+		format |= fmtCompressed
+	}
+	if e.encrypted {
+		format |= fmtEncrypted
+	}
+	if e.checksum {
+		format |= fmtChecksum
+	}
+	if e.chunked {
+		format |= fmtChunked
+	}
+	at := headerLen
+	if e.checksum {
+		at += checksumLen
+	}
+	if e.soft != 0 {
+		format |= fmtSoft
+		binary.BigEndian.PutUint64(buf[at:], e.soft)
+		at += 8
+	}
+	if e.written != 0 {
+		format |= fmtWritten
+		binary.BigEndian.PutUint64(buf[at:], e.written)
+	}
+	if e.key != nil {
+		format |= fmtKey
+		binary.BigEndian.PutUint16(buf[n-2-len(e.key):], uint16(len(e.key)))
+		copy(buf[n-len(e.key):], e.key)
+	}
+	buf[offFormat] = format
+
+	copy(buf[n:], e.data)
+	if e.checksum {
+		putChecksum(buf)
+	}
+}
+
+// entryVersionOf returns the version b is serialized in, which must be the
+// current one.
+func entryVersionOf(b []byte) (byte, error) {
+	if len(b) < headerLen {
+		return 0, errCorruptValue
+	}
+	if b[offVersion] != entryVersion {
+		return b[offVersion], errUnknownVersion
+	}
+	return b[offVersion], nil
+}
+
+// bufToEntry decodes b into a new entry. The data is always copied into a
+// fresh allocation, so b may point straight into the memory map (RawRead).
+// The data can't come from a pool because it is handed to rend in a response
+// and there is no signal for when rend is done with it.
+func bufToEntry(b []byte) (entry, error) {
+	if _, err := entryVersionOf(b); err != nil {
+		return entry{}, err
+	}
+
+	format := b[offFormat]
+	e := entry{
+		exptime:    binary.BigEndian.Uint64(b[offExptime:]),
+		cas:        binary.BigEndian.Uint64(b[offCas:]),
+		flags:      binary.BigEndian.Uint32(b[offFlags:]),
+		compressed: format&fmtCompressed != 0,
+		encrypted:  format&fmtEncrypted != 0,
+		checksum:   format&fmtChecksum != 0,
+		chunked:    format&fmtChunked != 0,
+	}
+	data := b[headerLen:]
+
+	if e.checksum {
+		if len(b) < headerLen+checksumLen {
+			return e, errCorruptValue
+		}
+		if err := checkChecksum(b); err != nil {
+			return e, err
+		}
+		data = b[headerLen+checksumLen:]
+	}
+
+	if format&fmtSoft != 0 {
+		if len(data) < 8 {
+			return e, errCorruptValue
+		}
+		e.soft = binary.BigEndian.Uint64(data)
+		data = data[8:]
+	}
+
+	if format&fmtWritten != 0 {
+		if len(data) < 8 {
+			return e, errCorruptValue
+		}
+		e.written = binary.BigEndian.Uint64(data)
+		data = data[8:]
+	}
+
+	if format&fmtKey != 0 {
+		if len(data) < 2 || len(data)-2 < int(binary.BigEndian.Uint16(data)) {
+			return e, errCorruptValue
+		}
+		n := 2 + int(binary.BigEndian.Uint16(data))
+		e.key = append([]byte(nil), data[2:n]...)
+		data = data[n:]
+	}
+
+	e.data = make([]byte, len(data))
+	copy(e.data, data)
+
+	return e, nil
+}
+
+// originalToEntry decodes b in the layout of the first release,
+//
+//	0         4       8
+//	| exptime | flags | data ... |
+//
+// with the exptime in seconds. Nothing in b tells it from the current layout,
+// so it is only used on the entries migrateOriginal finds. They have no CAS
+// token.
+func originalToEntry(b []byte) (entry, error) {
+	if len(b) < headerLenOriginal {
+		return entry{}, errCorruptValue
+	}
+	e := entry{
+		exptime: secondsExptime(uint64(binary.BigEndian.Uint32(b[offExptime:]))),
+		flags:   binary.BigEndian.Uint32(b[offFlagsOriginal:]),
+		data:    make([]byte, len(b)-headerLenOriginal),
+	}
+	copy(e.data, b[headerLenOriginal:])
+	return e, nil
+}
+
+// encodeEntry serializes e, compressing and then encrypting its data and
+// adding a checksum as configured.
+func (s *store) encodeEntry(e entry) ([]byte, error) {
+	e, err := s.prepareEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	return entryToBuf(e), nil
+}
+
+// prepareEntry is encodeEntry short of serializing e, for putEntry.
+func (s *store) prepareEntry(e entry) (entry, error) {
+	e.checksum = s.opts.Checksums
+	if s.opts.WriteTimes {
+		e.written = s.now()
+	}
+
+	if data, ok := s.compress(e.data); ok {
+		e.data = data
+		e.compressed = true
+	}
+
+	if s.crypt != nil {
+		data, err := s.crypt.encrypt(e.data)
+		if err != nil {
+			return e, err
+		}
+		e.data = data
+		e.encrypted = true
+	}
+
+	return e, nil
+}
+
+// decodeEntry is bufToEntry that also reassembles chunked entries and decrypts
+// and decompresses the data. b is what is stored at key in the main DB, read
+// in txn. It returns errChecksum for entries whose checksum does not match.
+func (s *store) decodeEntry(txn *lmdb.Txn, key, b []byte) (entry, error) {
+	e, err := bufToEntry(b)
+	if err != nil {
+		return e, err
+	}
+
+	if e.chunked {
+		whole, err := s.getChunks(txn, key, e.data)
+		if err != nil {
+			return e, err
+		}
+		inner, err := bufToEntry(whole)
+		if err != nil {
+			return e, err
+		}
+		if inner.chunked {
+			return e, errCorruptValue
+		}
+		inner.exptime = e.exptime
+		e = inner
+	}
+
+	if e.encrypted {
+		if s.crypt == nil {
+			return e, errNoKeys
+		}
+		data, err := s.crypt.decrypt(e.data)
+		if err != nil {
+			return e, err
+		}
+		e.data = data
+		e.encrypted = false
+	}
+
+	if e.compressed {
+		data, err := decompress(e.data)
+		if err != nil {
+			return e, err
+		}
+		e.data = data
+		e.compressed = false
+	}
+
+	return e, nil
+}
@@ -0,0 +1,390 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// putRaw stores buf at key as is, indexed by its exptime.
+func putRaw(t *testing.T, h *Handler, key string, buf []byte) {
+	t.Helper()
+	s := h.shard([]byte(key))
+	err := s.update(func(txn *lmdb.Txn) error {
+		if err := txn.Put(s.dbi, []byte(key), buf, 0); err != nil {
+			return err
+		}
+		return s.reindex(txn, []byte(key), 0, entryExptime(buf), false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedVersion returns the version of the entry stored at key.
+func storedVersion(t *testing.T, h *Handler, key string) byte {
+	t.Helper()
+	s := h.shard([]byte(key))
+	var version byte
+	err := s.view(func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, []byte(key))
+		if err != nil {
+			return err
+		}
+		version, err = entryVersionOf(buf)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// entryOriginal serializes an entry in the layout of the first release.
+func entryOriginal(exptime, flags uint32, data []byte) []byte {
+	buf := make([]byte, headerLenOriginal+len(data))
+	binary.BigEndian.PutUint32(buf[offExptime:], exptime)
+	binary.BigEndian.PutUint32(buf[offFlagsOriginal:], flags)
+	copy(buf[headerLenOriginal:], data)
+	return buf
+}
+
+// updateRaw runs fn in a write transaction of the environment at dir, opened
+// the way the first release did, with the main DB created.
+func updateRaw(t *testing.T, dir string, fn func(txn *lmdb.Txn, dbi lmdb.DBI) error) {
+	t.Helper()
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Close()
+	if err := env.SetMaxDBs(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Open(dir, 0, 0664); err != nil {
+		t.Fatal(err)
+	}
+	err = env.Update(func(txn *lmdb.Txn) error {
+		dbi, err := txn.CreateDBI(defaultDBName)
+		if err != nil {
+			return err
+		}
+		return fn(txn, dbi)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putOriginal stores items at dir the way the first release did.
+func putOriginal(t *testing.T, dir string, items map[string][]byte) {
+	t.Helper()
+	updateRaw(t, dir, func(txn *lmdb.Txn, dbi lmdb.DBI) error {
+		for key, buf := range items {
+			if err := txn.Put(dbi, []byte(key), buf, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestOriginalEntries(t *testing.T) {
+	clock := newFakeClock()
+	exptime := clock.unix() + 3600
+	dir := tempDir(t)
+	putOriginal(t, dir, map[string][]byte{
+		"empty":   entryOriginal(0, 1, nil),
+		"short":   entryOriginal(0, 2, []byte("abc")),
+		"expires": entryOriginal(exptime, 3, []byte("a longer value")),
+	})
+
+	h := openHandler(t, Options{Path: dir, Clock: clock, DisableReaper: true})
+	for key, want := range map[string]string{"empty": "", "short": "abc", "expires": "a longer value"} {
+		r := getE(t, h, key)
+		if r.Miss || string(r.Data) != want {
+			t.Fatalf("%s read as %+v", key, r)
+		}
+	}
+	if r := getE(t, h, "expires"); r.Flags != 3 || r.Exptime != exptime {
+		t.Fatalf("read as %+v", r)
+	}
+	if cas := gets(t, h, "short"); cas == 0 {
+		t.Fatal("no CAS token")
+	}
+
+	// They were rewritten, and indexed for the reaper
+	if v := storedVersion(t, h, "short"); v != entryVersion {
+		t.Fatalf("entry is in version %d", v)
+	}
+	clock.advance(2 * time.Hour)
+	if n, err := h.Reap(); err != nil || n != 1 {
+		t.Fatalf("reaped %d, %v", n, err)
+	}
+}
+
+// TestOriginalEntriesLookCurrent checks entries in the original layout are
+// read as that even where their data reads as the current version.
+func TestOriginalEntriesLookCurrent(t *testing.T) {
+	dir := tempDir(t)
+	data := bytes.Repeat([]byte{entryVersion}, 16)
+	putOriginal(t, dir, map[string][]byte{"k": entryOriginal(0, 7, data)})
+
+	if _, err := New(Options{Path: dir, ReadOnly: true, NoSync: true})(); err != errOriginalFormat {
+		t.Fatalf("read-only open: %v, want %v", err, errOriginalFormat)
+	}
+
+	h := openHandler(t, Options{Path: dir, DisableReaper: true})
+	if r := getE(t, h, "k"); r.Miss || r.Flags != 7 || !bytes.Equal(r.Data, data) {
+		t.Fatalf("read as %+v", r)
+	}
+}
+
+// TestOriginalEntriesEncrypted checks entries in the original layout are
+// rewritten encrypted, with a checksum, when the store says so.
+func TestOriginalEntriesEncrypted(t *testing.T) {
+	dir := tempDir(t)
+	putOriginal(t, dir, map[string][]byte{"k": entryOriginal(0, 4, []byte("plaintext"))})
+
+	h := openHandler(t, Options{
+		Path:          dir,
+		DisableReaper: true,
+		Checksums:     true,
+		Encryption:    StaticKeys{Current: 1, Keys: map[uint32][]byte{1: make([]byte, 32)}},
+	})
+	s := h.shard([]byte("k"))
+	var buf []byte
+	err := s.view(func(txn *lmdb.Txn) (err error) {
+		buf, err = txn.Get(s.dbi, []byte("k"))
+		buf = append([]byte(nil), buf...)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := bufToEntry(buf)
+	if err != nil || !e.encrypted || !e.checksum || bytes.Contains(buf, []byte("plaintext")) {
+		t.Fatalf("rewritten as %+v, %v", e, err)
+	}
+	if r := getE(t, h, "k"); r.Miss || r.Flags != 4 || string(r.Data) != "plaintext" {
+		t.Fatalf("read as %+v", r)
+	}
+}
+
+// TestOriginalEntriesChecked checks the integrity check on startup reads
+// entries in the original layout as that, so none of the policies mistake
+// them for corruption, and then the rewritten ones as those.
+func TestOriginalEntriesChecked(t *testing.T) {
+	for _, policy := range []CorruptionPolicy{CorruptRestore, CorruptFail, CorruptWipe} {
+		dir := tempDir(t)
+		items := make(map[string][]byte)
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			items[key] = entryOriginal(0, 1, value(key, 1, 100))
+		}
+		putOriginal(t, dir, items)
+
+		opts := Options{Path: dir, DisableReaper: true, CheckEntries: 50, CheckChecksums: true, OnCorruption: policy}
+		for i := 0; i < 2; i++ {
+			h := openHandler(t, opts)
+			expectValue(t, h, "k07", value("k07", 1, 100))
+			h.Close()
+		}
+	}
+}
+
+// TestOriginalEntriesResume checks a rewrite of entries in the original
+// layout cut short carries on after the last one it rewrote.
+func TestOriginalEntriesResume(t *testing.T) {
+	dir := tempDir(t)
+	updateRaw(t, dir, func(txn *lmdb.Txn, dbi lmdb.DBI) error {
+		if err := txn.Put(dbi, []byte("a"), entryToBuf(entry{flags: 1, cas: 5, data: []byte("new")}), 0); err != nil {
+			return err
+		}
+		if err := txn.Put(dbi, []byte("b"), entryOriginal(0, 2, []byte("old")), 0); err != nil {
+			return err
+		}
+		formatdbi, err := txn.CreateDBI(defaultDBName + formatDBSuffix)
+		if err != nil {
+			return err
+		}
+		return txn.Put(formatdbi, []byte(defaultDBName), []byte("a"), 0)
+	})
+
+	// The check on startup reads each in its own layout
+	h := openHandler(t, Options{Path: dir, DisableReaper: true, CheckEntries: 10, CheckChecksums: true})
+	if r := getE(t, h, "a"); r.Miss || r.Flags != 1 || string(r.Data) != "new" {
+		t.Fatalf("a read as %+v", r)
+	}
+	if cas := gets(t, h, "a"); cas != 5 {
+		t.Fatalf("a has CAS %d, want 5", cas)
+	}
+	if r := getE(t, h, "b"); r.Miss || r.Flags != 2 || string(r.Data) != "old" {
+		t.Fatalf("b read as %+v", r)
+	}
+}
+
+func TestEntryChecksum(t *testing.T) {
+	h := testHandler(t, Options{})
+	buf := entryToBuf(entry{cas: 1, data: []byte("checked"), checksum: true})
+	buf[len(buf)-1] ^= 0xff
+	putRaw(t, h, "k", buf)
+
+	data, errs := h.GetE(getRequest([]byte("k")))
+	for range data {
+	}
+	expectErr(t, "get", <-errs, errChecksum)
+}
+
+// TestExptimesPast32Bits runs the clock up to where exptimes no longer fit in
+// a signed, and then an unsigned, 32 bit number.
+func TestExptimesPast32Bits(t *testing.T) {
+	for _, start := range []int64{math.MaxInt32 - 50, math.MaxUint32 - 50} {
+		clock := &fakeClock{now: time.Unix(start, 0)}
+		h := testHandler(t, Options{Clock: clock, DisableReaper: true, Checksums: true})
+
+		mustSet(t, h, "soon", []byte("v"), 0, 10)
+		mustSet(t, h, "later", []byte("v"), 0, 100)
+		mustSet(t, h, "touched", []byte("v"), 0, 0)
+		if err := h.Touch(common.TouchRequest{Key: []byte("touched"), Exptime: 100}); err != nil {
+			t.Fatal(err)
+		}
+
+		want := uint32(start + 100)
+		if start+100 > math.MaxUint32 {
+			want = math.MaxUint32
+		}
+		if r := getE(t, h, "later"); r.Exptime != want {
+			t.Fatalf("from %d: exptime %d, want %d", start, r.Exptime, want)
+		}
+
+		clock.advance(11 * time.Second)
+		expectMiss(t, h, "soon")
+		expectValue(t, h, "later", []byte("v"))
+		expectValue(t, h, "touched", []byte("v"))
+		if n, err := h.Reap(); err != nil || n != 1 {
+			t.Fatalf("from %d: reaped %d, %v, want 1", start, n, err)
+		}
+
+		clock.advance(90 * time.Second)
+		expectMiss(t, h, "later")
+		expectMiss(t, h, "touched")
+		if n, err := h.Reap(); err != nil || n != 2 {
+			t.Fatalf("from %d: reaped %d, %v, want 2", start, n, err)
+		}
+	}
+}
+
+func TestMillisecondExptimes(t *testing.T) {
+	clock := newFakeClock()
+	clock.advance(400 * time.Millisecond)
+	h := testHandler(t, Options{
+		Clock:         clock,
+		DisableReaper: true,
+		Namespaces:    []Namespace{{Name: "ms", Prefix: "ms:", ExptimeMillis: true}},
+	})
+
+	// Relative seconds count from now, to the millisecond
+	mustSet(t, h, "secs", []byte("v"), 0, 2)
+	// Absolute ones last through their second
+	mustSet(t, h, "abs", []byte("v"), 0, clock.unix()+1)
+	mustSet(t, h, "ms:short", []byte("v"), 0, 250)
+
+	if r := getE(t, h, "ms:short"); r.Exptime != clock.unix() {
+		t.Fatalf("exptime %d, want %d", r.Exptime, clock.unix())
+	}
+
+	clock.advance(249 * time.Millisecond)
+	expectValue(t, h, "ms:short", []byte("v"))
+	clock.advance(2 * time.Millisecond)
+	expectMiss(t, h, "ms:short")
+
+	// now 1500000000.651
+	clock.advance(1348 * time.Millisecond)
+	expectValue(t, h, "abs", []byte("v"))
+	expectValue(t, h, "secs", []byte("v"))
+	clock.advance(2 * time.Millisecond)
+	expectMiss(t, h, "abs")
+	clock.advance(398 * time.Millisecond)
+	expectValue(t, h, "secs", []byte("v"))
+	clock.advance(2 * time.Millisecond)
+	expectMiss(t, h, "secs")
+
+	if n, err := h.Reap(); err != nil || n != 3 {
+		t.Fatalf("reaped %d, %v, want 3", n, err)
+	}
+}
+
+// TestExptimeMillisOption checks Options.ExptimeMillis applies to items
+// outside any namespace.
+func TestExptimeMillisOption(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, ExptimeMillis: true})
+
+	mustSet(t, h, "short", []byte("v"), 0, 250)
+	if err := h.Touch(common.TouchRequest{Key: []byte("short"), Exptime: 500}); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(499 * time.Millisecond)
+	expectValue(t, h, "short", []byte("v"))
+	clock.advance(2 * time.Millisecond)
+	expectMiss(t, h, "short")
+
+	if n, err := h.Reap(); err != nil || n != 1 {
+		t.Fatalf("reaped %d, %v, want 1", n, err)
+	}
+}
+
+func TestParseExptimeMillis(t *testing.T) {
+	nss, err := ParseNamespaces("a=a:;exptime-ms=true,b=b:")
+	if err != nil || !nss[0].ExptimeMillis || nss[1].ExptimeMillis {
+		t.Fatalf("parsed %+v, %v", nss, err)
+	}
+	if _, err := ParseNamespaces("a=a:;exptime-ms=sometimes"); err == nil {
+		t.Fatal("bad exptime-ms parsed")
+	}
+}
+
+func TestEntryRoundTrip(t *testing.T) {
+	cases := []entry{
+		{},
+		{exptime: math.MaxUint64, flags: math.MaxUint32, cas: math.MaxUint64, data: []byte("data")},
+		{exptime: 1 << 40, checksum: true, data: bytes.Repeat([]byte("x"), 1000)},
+		{compressed: true, encrypted: true, chunked: true, key: []byte("long key"), data: []byte("d")},
+		{soft: 1 << 41, checksum: true, key: []byte("k"), data: []byte("soft")},
+		{soft: 1 << 41, written: 1 << 40, key: []byte("k"), data: []byte("written")},
+		{written: 1 << 40, checksum: true, data: []byte("written")},
+	}
+	for i, e := range cases {
+		got, err := bufToEntry(entryToBuf(e))
+		if err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if got.exptime != e.exptime || got.flags != e.flags || got.cas != e.cas ||
+			got.compressed != e.compressed || got.encrypted != e.encrypted || got.checksum != e.checksum ||
+			got.chunked != e.chunked || !bytes.Equal(got.key, e.key) || !bytes.Equal(got.data, e.data) || got.soft != e.soft ||
+			got.written != e.written {
+			t.Fatalf("case %d: %+v came back as %+v", i, e, got)
+		}
+	}
+}
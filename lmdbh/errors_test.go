@@ -0,0 +1,529 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+func TestDecode(t *testing.T) {
+	other := errors.New("other")
+	unmapped := &lmdb.OpError{Op: "mdb_txn_commit", Errno: syscall.EIO}
+
+	cases := []struct {
+		err  error
+		want error
+	}{
+		{nil, nil},
+		{&lmdb.OpError{Op: "mdb_put", Errno: lmdb.KeyExist}, common.ErrKeyExists},
+		{&lmdb.OpError{Op: "mdb_get", Errno: lmdb.NotFound}, common.ErrKeyNotFound},
+		{&lmdb.OpError{Op: "mdb_put", Errno: lmdb.MapFull}, common.ErrNoMem},
+		{&lmdb.OpError{Op: "mdb_dbi_open", Errno: lmdb.DBsFull}, common.ErrInternal},
+		{&lmdb.OpError{Op: "mdb_put", Errno: lmdb.TxnFull}, common.ErrNoMem},
+		{&lmdb.OpError{Op: "mdb_put", Errno: lmdb.BadValSize}, common.ErrValueTooBig},
+		{&lmdb.OpError{Op: "mdb_txn_commit", Errno: syscall.ENOSPC}, common.ErrNoMem},
+		{&lmdb.OpError{Op: "mdb_txn_begin", Errno: lmdb.ReadersFull}, common.ErrBusy},
+		{&lmdb.OpError{Op: "mdb_txn_begin", Errno: lmdb.MapResized}, common.ErrTempFailure},
+		{&lmdb.OpError{Op: "mdb_get", Errno: lmdb.Corrupted}, errCorruptEnv},
+		{&lmdb.OpError{Op: "mdb_get", Errno: lmdb.PageNotFound}, errCorruptEnv},
+		{&lmdb.OpError{Op: "mdb_env_open", Errno: lmdb.VersionMismatch}, errCorruptEnv},
+		{&lmdb.OpError{Op: "mdb_get", Errno: lmdb.BadDBI}, common.ErrInternal},
+		{&lmdb.OpError{Op: "mdb_put", Errno: syscall.EACCES}, common.ErrInternal},
+		// Errors without a rend equivalent, or not from LMDB, pass through
+		{unmapped, unmapped},
+		{other, other},
+		{common.ErrKeyNotFound, common.ErrKeyNotFound},
+	}
+	for _, c := range cases {
+		if got := decode(c.err); got != c.want {
+			t.Errorf("decode(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+
+	// Only errors that aren't the client's doing are counted
+	h := testHandler(t, Options{})
+	s := h.shards[0]
+	for _, err := range []error{
+		&lmdb.OpError{Op: "mdb_get", Errno: lmdb.NotFound},
+		&lmdb.OpError{Op: "mdb_get", Errno: lmdb.Corrupted},
+		&lmdb.OpError{Op: "mdb_put", Errno: lmdb.MapFull},
+		&lmdb.OpError{Op: "mdb_put", Errno: lmdb.TxnFull},
+		&lmdb.OpError{Op: "mdb_txn_begin", Errno: lmdb.ReadersFull},
+		&lmdb.OpError{Op: "mdb_get", Errno: lmdb.BadTxn},
+		unmapped,
+		common.ErrNoMem,
+	} {
+		s.decodeErr(err)
+	}
+	st, err := h.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ErrCorrupt != 1 || st.ErrFull != 2 || st.ErrBusy != 1 || st.ErrInternal != 2 {
+		t.Errorf("counted %d corrupt, %d full, %d busy and %d internal", st.ErrCorrupt, st.ErrFull, st.ErrBusy, st.ErrInternal)
+	}
+}
+
+func TestKeyAndValueLimits(t *testing.T) {
+	h := testHandler(t, Options{MaxKeySize: 10, MaxValueSize: 100})
+
+	for _, key := range [][]byte{nil, []byte("12345678901")} {
+		set := common.SetRequest{Key: key, Data: []byte("v")}
+		expectErr(t, "set", h.Set(set), common.ErrBadRequest)
+		expectErr(t, "add", h.Add(set), common.ErrBadRequest)
+		expectErr(t, "replace", h.Replace(set), common.ErrBadRequest)
+		expectErr(t, "append", h.Append(set), common.ErrBadRequest)
+		expectErr(t, "prepend", h.Prepend(set), common.ErrBadRequest)
+		expectErr(t, "CAS", h.CompareAndSwap(set, 1), common.ErrBadRequest)
+		expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: key}), common.ErrBadRequest)
+		expectErr(t, "touch", h.Touch(common.TouchRequest{Key: key}), common.ErrBadRequest)
+		if _, err := h.GAT(common.GATRequest{Key: key}); err != common.ErrBadRequest {
+			t.Fatalf("GAT: %v", err)
+		}
+		if _, err := h.Incr(key, 1); err != common.ErrBadRequest {
+			t.Fatalf("incr: %v", err)
+		}
+		data, errs := h.GetE(getRequest(key))
+		for range data {
+		}
+		expectErr(t, "get", <-errs, common.ErrBadRequest)
+	}
+
+	// The longest key and value allowed are fine
+	mustSet(t, h, "1234567890", make([]byte, 100), 0, 0)
+
+	big := common.SetRequest{Key: []byte("k"), Data: make([]byte, 101)}
+	expectErr(t, "set too big", h.Set(big), common.ErrValueTooBig)
+	expectMiss(t, h, "k")
+
+	// Appends can't grow a value past the limit either
+	mustSet(t, h, "k", make([]byte, 60), 0, 0)
+	expectErr(t, "append too big", h.Append(common.SetRequest{Key: []byte("k"), Data: make([]byte, 41)}), common.ErrValueTooBig)
+	expectErr(t, "prepend too big", h.Prepend(common.SetRequest{Key: []byte("k"), Data: make([]byte, 41)}), common.ErrValueTooBig)
+	expectValue(t, h, "k", make([]byte, 60))
+	expectErr(t, "append to the limit", h.Append(common.SetRequest{Key: []byte("k"), Data: make([]byte, 40)}), nil)
+}
+
+func TestMapFull(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 1 << 20})
+	data := make([]byte, 10*1024)
+
+	var err error
+	stored := 0
+	for ; stored < 1000; stored++ {
+		if err = h.Set(common.SetRequest{Key: benchKey(stored), Data: data}); err != nil {
+			break
+		}
+	}
+	expectErr(t, "set into a full map", err, common.ErrNoMem)
+
+	// A full map still serves reads and deletes, which make room again
+	expectValue(t, h, string(benchKey(0)), data)
+	for i := 0; i < stored/2; i++ {
+		if err := h.Delete(common.DeleteRequest{Key: benchKey(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustSet(t, h, "k", data, 0, 0)
+}
+
+func TestMapGrowth(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 1 << 20, MaxMapSize: 8 << 20})
+	data := make([]byte, 10*1024)
+
+	// About 4MB, more than the starting map
+	for i := 0; i < 400; i++ {
+		if err := h.Set(common.SetRequest{Key: benchKey(i), Data: data}); err != nil {
+			t.Fatalf("set %d: %v", i, err)
+		}
+	}
+	expectValue(t, h, string(benchKey(0)), data)
+}
+
+func TestClosed(t *testing.T) {
+	h := testHandler(t, Options{})
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectErr(t, "close again", h.Close(), nil)
+
+	expectErr(t, "set", h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("v")}), errClosed)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("k")}), errClosed)
+	data, errs := h.Get(getRequest([]byte("k")))
+	for range data {
+	}
+	expectErr(t, "get", <-errs, errClosed)
+}
+
+func TestReadOnly(t *testing.T) {
+	opts := Options{Path: tempDir(t)}
+	h := openHandler(t, opts)
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	h.Close()
+
+	opts.ReadOnly = true
+	h = openHandler(t, opts)
+	expectValue(t, h, "k", []byte("v"))
+	expectErr(t, "set", h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("w")}), errReadOnly)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("k")}), errReadOnly)
+	expectErr(t, "flush", h.Flush(0), errReadOnly)
+	expectValue(t, h, "k", []byte("v"))
+}
+
+func TestNoLock(t *testing.T) {
+	opts := Options{Path: tempDir(t)}
+	h := openHandler(t, opts)
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	h.Close()
+
+	// As if the file system were read only
+	lock := filepath.Join(opts.Path, lockFile)
+	if err := os.Remove(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.ReadOnly = true
+	opts.NoLock = true
+	h = openHandler(t, opts)
+	expectValue(t, h, "k", []byte("v"))
+	if _, err := h.Readers(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock file: %v", err)
+	}
+}
+
+// TestCompactOtherReaders checks compaction is refused while another process
+// has the environment open, which it runs this test in again to do.
+func TestCompactOtherReaders(t *testing.T) {
+	if dir := os.Getenv("LMDBH_TEST_READER"); dir != "" {
+		env, err := lmdb.NewEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer env.Close()
+		if err := env.Open(dir, lmdb.Readonly, 0644); err != nil {
+			t.Fatal(err)
+		}
+		txn, err := env.BeginTxn(nil, lmdb.Readonly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer txn.Abort()
+		os.Stdout.WriteString("reading\n")
+		ioutil.ReadAll(os.Stdin)
+		return
+	}
+
+	opts := Options{Path: tempDir(t)}
+	h := openHandler(t, opts)
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCompactOtherReaders$")
+	cmd.Env = append(os.Environ(), "LMDBH_TEST_READER="+opts.Path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); line != "reading\n" {
+		t.Fatalf("reader: %q, %v", line, err)
+	}
+
+	expectErr(t, "compact", h.Compact(), errCompactReaders)
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	expectErr(t, "compact", h.Compact(), nil)
+	expectValue(t, h, "k", []byte("v"))
+
+	h = testHandler(t, Options{SharedReaders: true})
+	expectErr(t, "compact with shared readers", h.Compact(), errCompactShared)
+}
+
+func TestDiskFull(t *testing.T) {
+	h := openHandler(t, Options{Path: tempDir(t), DiskFullProbeInterval: 10 * time.Millisecond})
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+
+	// As if the commit had failed at the disk
+	s := h.shards[0]
+	full := &lmdb.OpError{Op: "mdb_txn_commit", Errno: syscall.ENOSPC}
+	expectErr(t, "full write", s.update(func(*lmdb.Txn) error { return full }), errDiskFull)
+	if !h.DiskFull() {
+		t.Fatal("not degraded")
+	}
+	if st, err := h.Stats(); err != nil || !st.DiskFull || st.DiskFulls != 1 {
+		t.Errorf("stats: %v %+v", err, st)
+	}
+	expectErr(t, "set", h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("w")}), errDiskFull)
+	expectValue(t, h, "k", []byte("v"))
+
+	// The disk has room, so the next probe turns writes back on
+	deadline := time.Now().Add(5 * time.Second)
+	for h.DiskFull() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h.DiskFull() {
+		t.Fatal("still degraded")
+	}
+	mustSet(t, h, "k", []byte("w"), 0, 0)
+	expectValue(t, h, "k", []byte("w"))
+	if st, _ := h.Stats(); st.Items != 1 {
+		t.Errorf("items: %d", st.Items)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	opts := Options{Path: tempDir(t), BreakerLatency: 50 * time.Millisecond, BreakerWindow: 2, BreakerCooldown: 50 * time.Millisecond}
+	h := openHandler(t, opts)
+	s := h.shards[0]
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	set := func() error { return h.Set(common.SetRequest{Key: []byte("k"), Data: []byte("w")}) }
+
+	// Writes failing at the disk
+	eio := &lmdb.OpError{Op: "mdb_txn_commit", Errno: syscall.EIO}
+	for i := 0; i < 2; i++ {
+		s.update(func(*lmdb.Txn) error { return eio })
+	}
+	if !h.BreakerOpen() {
+		t.Fatal("not open after failed writes")
+	}
+	expectErr(t, "set", set(), ErrBreakerOpen)
+	expectValue(t, h, "k", []byte("v"))
+	if st, err := h.Stats(); err != nil || !st.BreakerOpen || st.BreakerTrips != 1 || st.BreakerRejects != 1 {
+		t.Errorf("stats: %v %+v", err, st)
+	}
+
+	time.Sleep(opts.BreakerCooldown)
+	mustSet(t, h, "k", []byte("w"), 0, 0)
+	if h.BreakerOpen() {
+		t.Fatal("still open after a good write")
+	}
+
+	// A write stuck at the disk
+	stuck := make(chan struct{})
+	go func() {
+		s.update(func(*lmdb.Txn) error {
+			time.Sleep(4 * opts.BreakerLatency)
+			return nil
+		})
+		close(stuck)
+	}()
+	time.Sleep(2 * opts.BreakerLatency)
+	start := time.Now()
+	expectErr(t, "set while stuck", set(), ErrBreakerOpen)
+	if d := time.Since(start); d > opts.BreakerLatency {
+		t.Errorf("set waited %v", d)
+	}
+	<-stuck
+
+	time.Sleep(2 * opts.BreakerCooldown)
+	mustSet(t, h, "k", []byte("x"), 0, 0)
+	expectValue(t, h, "k", []byte("x"))
+}
+
+func TestWriteTimeout(t *testing.T) {
+	h := openHandler(t, Options{Path: tempDir(t), WriteTimeout: 50 * time.Millisecond})
+	s := h.shards[0]
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+
+	// Hold the writer lock
+	release, held := make(chan struct{}), make(chan struct{})
+	go s.update(func(*lmdb.Txn) error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+
+	key, data := []byte("k"), []byte("w")
+	expectErr(t, "set", h.Set(common.SetRequest{Key: key, Data: data}), ErrTimeout)
+	expectValue(t, h, "k", []byte("v"))
+	if st, err := h.Stats(); err != nil || st.Timeouts != 1 {
+		t.Errorf("stats: %v %+v", err, st)
+	}
+
+	// The request's buffers are free to be reused, and the write goes ahead
+	copy(data, "x")
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for string(getE(t, h, "k").Data) != "w" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectValue(t, h, "k", []byte("w"))
+}
+
+func TestBadOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"read-only write map", Options{ReadOnly: true, WriteMap: true}, "WriteMap"},
+		{"unnamed namespace", Options{Namespaces: []Namespace{{Prefix: "a:"}}}, "names"},
+		{"duplicate prefix", Options{Namespaces: []Namespace{{Name: "a", Prefix: "p:"}, {Name: "b", Prefix: "p:"}}}, "prefixes"},
+		{"unknown sync op", Options{SyncOps: []string{"delete", "frobnicate"}}, "frobnicate"},
+		{"directory without subdir", Options{NoSubdir: true}, "directory"},
+		{"writer without lock", Options{NoLock: true}, "ReadOnly"},
+		{"compacting reader", Options{ReadOnly: true, CompactInterval: time.Hour}, "compaction"},
+		{"compacting shared writer", Options{SharedReaders: true, CompactInterval: time.Hour}, "compaction"},
+	}
+	for _, c := range cases {
+		opts := c.opts
+		opts.Path = tempDir(t)
+		if h, err := New(opts)(); err == nil {
+			h.(*Handler).Close()
+			t.Errorf("%s: opened", c.name)
+		} else if !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func TestCorruptValue(t *testing.T) {
+	h := testHandler(t, Options{Checksums: true})
+	mustSet(t, h, "k", value("k", 1, 100), 0, 0)
+
+	// Flip a byte of the stored value behind the handler's back
+	s := h.shard([]byte("k"))
+	dk, _ := s.dbKey([]byte("k"))
+	err := s.update(func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
+		if err != nil {
+			return err
+		}
+		buf = append([]byte(nil), buf...)
+		buf[len(buf)-1] ^= 0xff
+		return txn.Put(s.dbi, dk, buf, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, errs := h.GetE(getRequest([]byte("k")))
+	for range data {
+	}
+	expectErr(t, "get", <-errs, errChecksum)
+}
+
+func TestCorruptDataFile(t *testing.T) {
+	dir, backup := tempDir(t), tempDir(t)
+	h := openHandler(t, Options{Path: dir, Checksums: true})
+	mustSet(t, h, "k", value("k", 1, 100), 0, 0)
+	if err := h.Backup(backup, false); err != nil {
+		t.Fatal(err)
+	}
+
+	s := h.shards[0]
+	dk, _ := s.dbKey([]byte("k"))
+	err := s.update(func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
+		if err != nil {
+			return err
+		}
+		buf = append([]byte(nil), buf...)
+		buf[len(buf)-1] ^= 0xff
+		return txn.Put(s.dbi, dk, buf, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	open := func(opts Options) (*Handler, error) {
+		opts.Path = dir
+		opts.Logger = NewLogger(ioutil.Discard, LevelError, false)
+		hi, err := New(opts)()
+		if err != nil {
+			return nil, err
+		}
+		return hi.(*Handler), nil
+	}
+
+	// The roots are fine, only reading the entry finds it
+	h, err = open(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+
+	check := Options{CheckEntries: 1, CheckChecksums: true}
+	for _, policy := range []CorruptionPolicy{CorruptFail, CorruptRestore} {
+		opts := check
+		opts.OnCorruption = policy
+		if h, err := open(opts); err == nil {
+			h.Close()
+			t.Errorf("policy %d: opened", policy)
+		} else if !strings.Contains(err.Error(), "integrity") {
+			t.Errorf("policy %d: %v", policy, err)
+		}
+	}
+
+	opts := check
+	opts.RestoreFrom = backup
+	if h, err = open(opts); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, h, "k", value("k", 1, 100))
+	h.Close()
+
+	// Break the meta pages, which fails the check with any policy
+	f, err := os.OpenFile(filepath.Join(dir, dataFile), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 2*os.Getpagesize()), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if h, err := open(Options{}); err == nil {
+		h.Close()
+		t.Error("opened with broken meta pages")
+	}
+
+	if h, err = open(Options{OnCorruption: CorruptWipe}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	expectMiss(t, h, "k")
+
+	moved, err := filepath.Glob(filepath.Join(dir, dataFile+".corrupt-*"))
+	if err != nil || len(moved) != 2 {
+		t.Errorf("moved aside: %v, %v", moved, err)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// Events are gathered by the write transaction that causes them and handed to
+// the subscribers once it has committed, so a subscriber never hears of a
+// change that was rolled back. Nothing is gathered while there are no
+// subscribers. Delivery never blocks a write: an event a subscriber has no
+// room for is dropped and counted.
+
+// EventType is what happened to a key, see Event.
+type EventType uint8
+
+const (
+	// EventSet is a client storing an item, by any command
+	EventSet EventType = iota
+	// EventDelete is a client deleting an item
+	EventDelete
+	// EventExpire is an expired item being removed, by the reaper or when
+	// read
+	EventExpire
+	// EventEvict is an item evicted to make room
+	EventEvict
+	// EventFlush is every item of a namespace being removed. Its key is nil.
+	EventFlush
+	// EventTouch is a client changing only the exptime of an item
+	EventTouch
+)
+
+var eventNames = [...]string{
+	EventSet:    "set",
+	EventDelete: "delete",
+	EventExpire: "expire",
+	EventEvict:  "evict",
+	EventFlush:  "flush",
+	EventTouch:  "touch",
+}
+
+func (t EventType) String() string {
+	if int(t) < len(eventNames) {
+		return eventNames[t]
+	}
+	return "unknown"
+}
+
+// Event is a change to the keyspace, see Handler.Subscribe.
+type Event struct {
+	Type      EventType
+	Namespace string
+	// Key is the key as stored, which for a long key with HashLongKeys is
+	// its hashed form
+	Key []byte
+	// Time is when the change committed
+	Time time.Time
+}
+
+type eventHub struct {
+	// subs counts the subscribers, and txns the transactions with events
+	// pending, so writes can skip the lock while there are none. Only
+	// accessed atomically.
+	subs int32
+	txns int32
+
+	lock        sync.Mutex
+	subscribers map[chan Event]struct{}
+	pending     map[*lmdb.Txn][]Event
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[chan Event]struct{}),
+		pending:     make(map[*lmdb.Txn][]Event),
+	}
+}
+
+// Subscribe returns a channel of every change to the keys of every shard and
+// namespace from now on, buffered to hold buffer of them, and a func that
+// stops them and closes the channel. Events that don't fit in the buffer are
+// dropped, and counted in Stats. The events of each shard arrive in the order
+// they committed.
+func (h *Handler) Subscribe(buffer int) (<-chan Event, func()) {
+	c := make(chan Event, buffer)
+	for _, s := range h.shards {
+		s.events.lock.Lock()
+		s.events.subscribers[c] = struct{}{}
+		atomic.AddInt32(&s.events.subs, 1)
+		s.events.lock.Unlock()
+	}
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			for _, s := range h.shards {
+				s.events.lock.Lock()
+				delete(s.events.subscribers, c)
+				atomic.AddInt32(&s.events.subs, -1)
+				s.events.lock.Unlock()
+			}
+			close(c)
+		})
+	}
+}
+
+// emit records that txn changed key, in the oplog and for the subscribers to
+// hear of once it commits.
+func (s *store) emit(txn *lmdb.Txn, t EventType, key []byte) error {
+	if s.oplog != nil {
+		if err := s.logOp(txn, t, key); err != nil {
+			return err
+		}
+	}
+
+	hub := s.events
+	if atomic.LoadInt32(&hub.subs) == 0 {
+		return nil
+	}
+
+	e := Event{Type: t, Namespace: s.name}
+	if key != nil {
+		e.Key = append([]byte(nil), key...)
+	}
+
+	hub.lock.Lock()
+	if _, ok := hub.pending[txn]; !ok {
+		atomic.AddInt32(&hub.txns, 1)
+	}
+	hub.pending[txn] = append(hub.pending[txn], e)
+	hub.lock.Unlock()
+	return nil
+}
+
+// delEvent is del, emitting t for key.
+func (s *store) delEvent(txn *lmdb.Txn, key []byte, t EventType) error {
+	if err := s.del(txn, key); err != nil {
+		return err
+	}
+	return s.emit(txn, t, key)
+}
+
+// commit runs fn in a write transaction and hands the events it emitted to
+// the subscribers if it commits.
+func (s *store) commit(fn lmdb.TxnOp) error {
+	var cur *lmdb.Txn
+	err := s.env.Update(func(txn *lmdb.Txn) error {
+		cur = txn
+		return fn(txn)
+	})
+	s.settleHand(cur, err)
+
+	hub := s.events
+	if atomic.LoadInt32(&hub.txns) == 0 {
+		return err
+	}
+
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	events, ok := hub.pending[cur]
+	if !ok {
+		return err
+	}
+	delete(hub.pending, cur)
+	atomic.AddInt32(&hub.txns, -1)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	root := s.namespaces[0]
+	for _, e := range events {
+		e.Time = now
+		for c := range hub.subscribers {
+			select {
+			case c <- e:
+			default:
+				root.count(&root.stats.eventsDropped, MetricEventsDropped)
+			}
+		}
+	}
+	return nil
+}
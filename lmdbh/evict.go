@@ -0,0 +1,378 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/metrics"
+)
+
+// EvictionPolicy selects what happens to writes when the map is full and
+// cannot be grown any further.
+type EvictionPolicy int
+
+const (
+	// EvictNone rejects writes with common.ErrNoMem when the map is full.
+	EvictNone EvictionPolicy = iota
+	// EvictSoonestExpiring removes the items closest to expiring first, then
+	// items that never expire, in key order. Removing scattered small items
+	// frees little whole pages, so this works best when values are large
+	// (more than about half a page).
+	EvictSoonestExpiring
+	// EvictClock sweeps a hand through the keyspace in key order, removing
+	// every item it passes and carrying on from there the next time. Removing
+	// runs of neighbouring keys empties whole pages, which suits small values.
+	EvictClock
+	// EvictLRU is EvictClock, but passes over items read since the hand last
+	// went by them, so cold items go first. Hits are tracked in a DB of their
+	// own, see lru.go.
+	EvictLRU
+)
+
+// The amount evicted before a failed write is retried is 1/64th of the map,
+// but at least minEvictBytes. Freeing a good chunk at once matters because
+// the eviction itself needs a few new pages and pages it frees only become
+// reusable two transactions later.
+const (
+	evictFraction = 64
+	minEvictBytes = 256 * 1024
+)
+
+// maxEvictRounds is the most times a single write evicts before it gives up.
+// A value too big for what eviction can free would otherwise empty the
+// namespace before failing.
+const maxEvictRounds = 4
+
+// minEvictSlack is the least the map may grow past its configured size, or
+// MaxMapSize if that is larger, to make room for evictions. Otherwise the
+// slack is 1/16th of that size.
+const minEvictSlack = 1024 * 1024
+
+// evict removes a batch of items according to the eviction policy and returns
+// whether anything was removed.
+//
+// Deletes need free pages too, and a completely full map may have none. So
+// when an eviction itself runs out of room, the map is allowed to grow a
+// little, within a bounded slack. Shrinking the map back afterwards is not
+// safe while its pages are still referenced, so the slack is never given back.
+// Every round of eviction on a full map uses a little of the slack, so under
+// sustained write pressure writes eventually fail with common.ErrNoMem again.
+func (s *store) evict() bool {
+	if s.opts.Eviction == EvictNone {
+		return false
+	}
+
+	s.lockResize()
+	defer s.resizeLock.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	target := int(s.mapSize / evictFraction)
+	if target < minEvictBytes {
+		target = minEvictBytes
+	}
+
+	var n int
+	var err error
+	for target > 0 {
+		err = s.commit(func(txn *lmdb.Txn) error {
+			keys, err := s.evictionCandidates(txn, target)
+			if err != nil {
+				return err
+			}
+			n, err = s.evictKeys(txn, keys)
+			return err
+		})
+
+		if !lmdb.IsMapFull(err) {
+			break
+		}
+
+		// Make some room for the eviction itself, or failing that try a
+		// smaller batch that needs fewer new pages
+		if !s.extendForEviction() {
+			target /= 2
+		}
+	}
+
+	if err != nil {
+		s.opts.Logger.Error("Error while evicting", "component", "evict", "error", err)
+		return false
+	}
+
+	s.countEvictions(n)
+	return n > 0
+}
+
+// evictKeys deletes the items at keys and returns how many of them were
+// there to delete.
+func (s *store) evictKeys(txn *lmdb.Txn, keys [][]byte) (int, error) {
+	n := 0
+	for _, key := range keys {
+		err := s.del(txn, key)
+		if lmdb.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := s.emit(txn, EventEvict, key); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// countEvictions adds n evicted items to the stats.
+func (s *store) countEvictions(n int) {
+	atomic.AddUint64(&s.evictions, uint64(n))
+	metrics.IncCounterBy(MetricEvictions, uint64(n))
+}
+
+// extendForEviction grows the map by a small step while within the eviction
+// slack and returns whether it did. The caller must hold resizeLock
+// exclusively.
+func (s *store) extendForEviction() bool {
+	ceiling := s.opts.MapSize
+	if s.opts.MaxMapSize > ceiling {
+		ceiling = s.opts.MaxMapSize
+	}
+	if ceiling/16 > minEvictSlack {
+		ceiling += ceiling / 16
+	} else {
+		ceiling += minEvictSlack
+	}
+
+	// Writes use up whatever an eviction leaves of the step, so keep it small
+	step := s.mapSize / 1024
+	if step < minEvictSlack/16 {
+		step = minEvictSlack / 16
+	}
+	if step > ceiling-s.mapSize {
+		step = ceiling - s.mapSize
+	}
+	if step <= 0 {
+		return false
+	}
+
+	if err := s.env.SetMapSize(s.mapSize + step); err != nil {
+		s.opts.Logger.Error("Error extending map for eviction", "component", "evict", "error", err)
+		return false
+	}
+	s.mapSize += step
+	return true
+}
+
+// evictionCandidates picks keys to evict until their items add up to at least
+// target bytes. The keys are copied out before returning, so deleting them
+// does not disturb the cursors they were read with.
+func (s *store) evictionCandidates(txn *lmdb.Txn, target int) ([][]byte, error) {
+	return s.candidates(txn, s.opts.Eviction, target)
+}
+
+// candidates is evictionCandidates with the given policy.
+func (s *store) candidates(txn *lmdb.Txn, policy EvictionPolicy, target int) ([][]byte, error) {
+	raw := txn.RawRead
+	txn.RawRead = true
+	defer func() { txn.RawRead = raw }()
+
+	switch policy {
+	case EvictClock:
+		return s.clockCandidates(txn, target, false)
+	case EvictLRU:
+		return s.clockCandidates(txn, target, true)
+	}
+	return s.ttlCandidates(txn, target)
+}
+
+// ttlCandidates returns the soonest expiring keys, then keys that never expire
+func (s *store) ttlCandidates(txn *lmdb.Txn, target int) ([][]byte, error) {
+	var keys [][]byte
+	size := 0
+
+	ttlcur, err := txn.OpenCursor(s.ttldbi)
+	if err != nil {
+		return nil, err
+	}
+	defer ttlcur.Close()
+
+	for size < target {
+		tk, err := ttlRecord(txn, ttlcur, nil, lmdb.Next)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				break
+			}
+			return nil, err
+		}
+		_, key := parseTTLKey(tk)
+		buf, err := txn.Get(s.dbi, key)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		keys = append(keys, append([]byte(nil), key...))
+		size += len(key) + storedSize(buf)
+	}
+
+	if size >= target {
+		return keys, nil
+	}
+
+	// Not enough items with a TTL, fall back to ones that never expire
+	cur, err := txn.OpenCursor(s.dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	for size < target {
+		key, buf, err := cur.Get(nil, nil, lmdb.Next)
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				break
+			}
+			return nil, err
+		}
+		if entryExptime(buf) == 0 {
+			keys = append(keys, append([]byte(nil), key...))
+			size += len(key) + storedSize(buf)
+		}
+	}
+
+	return keys, nil
+}
+
+// clockCandidates returns the keys following the clock hand, wrapping around
+// to the start of the keyspace, and moves the hand past them. txn must be a
+// write transaction, and the hand only moves once it commits, see settleHand,
+// so keys an aborted eviction passed are looked at again. With
+// second set, items with their reference bit set are passed over, and the bit
+// cleared, so the hand may go around twice, taking the items it passed over
+// the first time. The walk stops when it gets back to the key it started from
+// for the last time, so no key is returned twice.
+func (s *store) clockCandidates(txn *lmdb.Txn, target int, second bool) ([][]byte, error) {
+	var keys [][]byte
+	size := 0
+
+	cur, err := txn.OpenCursor(s.dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	s.handLock.Lock()
+	hand, moved := s.movedHands[txn]
+	if !moved {
+		hand = s.evictHand
+	}
+	s.handLock.Unlock()
+
+	var key, buf []byte
+	if hand != nil {
+		key, buf, err = cur.Get(hand, nil, lmdb.SetRange)
+	} else {
+		key, buf, err = cur.Get(nil, nil, lmdb.First)
+	}
+
+	laps, maxLaps := 0, 1
+	if second {
+		maxLaps = 2
+	}
+	var start, passed []byte
+	taken := make(map[string]bool)
+	wrapped := false
+	for size < target {
+		if lmdb.IsNotFound(err) {
+			// Past the end twice without a key means the DB is empty
+			if wrapped && start == nil {
+				break
+			}
+			wrapped = true
+			key, buf, err = cur.Get(nil, nil, lmdb.First)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if start == nil {
+			start = append([]byte(nil), key...)
+		} else if bytes.Equal(key, start) {
+			if laps++; laps == maxLaps {
+				break
+			}
+		}
+
+		if taken[string(key)] {
+			passed = append(passed[:0], key...)
+			key, buf, err = cur.Get(nil, nil, lmdb.Next)
+			continue
+		}
+
+		if second {
+			ref, err := s.secondChance(txn, key)
+			if err != nil {
+				return nil, err
+			}
+			if ref {
+				passed = append(passed[:0], key...)
+				key, buf, err = cur.Get(nil, nil, lmdb.Next)
+				continue
+			}
+		}
+
+		keys = append(keys, append([]byte(nil), key...))
+		taken[string(key)] = true
+		size += len(key) + storedSize(buf)
+		passed = append(passed[:0], key...)
+		key, buf, err = cur.Get(nil, nil, lmdb.Next)
+	}
+
+	if passed != nil {
+		// Start just past the last key passed next time
+		s.handLock.Lock()
+		if s.movedHands == nil {
+			s.movedHands = make(map[*lmdb.Txn][]byte)
+		}
+		s.movedHands[txn] = append(passed, 0)
+		s.handLock.Unlock()
+	}
+
+	return keys, nil
+}
+
+// settleHand moves the clock hand to where txn left it, once txn has ended
+// with err.
+func (s *store) settleHand(txn *lmdb.Txn, err error) {
+	s.handLock.Lock()
+	defer s.handLock.Unlock()
+
+	hand, ok := s.movedHands[txn]
+	if !ok {
+		return
+	}
+	delete(s.movedHands, txn)
+	if err == nil {
+		s.evictHand = hand
+	}
+}
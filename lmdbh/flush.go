@@ -0,0 +1,106 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// Flush removes every item, like memcached's flush_all. With a delay, the
+// items are removed once it has passed instead, including any stored in the
+// meantime. A later Flush replaces a pending delayed one. Pending flushes are
+// not persisted, so a restart cancels them.
+//
+// The DBs are emptied in one write transaction per namespace of each shard, so
+// readers of a namespace see either all of its items in that shard or none.
+// The file keeps its size, see Compact.
+func (h *Handler) Flush(delay time.Duration) error {
+	for _, s := range h.all() {
+		if err := s.flushAfter(delay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *store) flushAfter(delay time.Duration) error {
+	if s.opts.ReadOnly {
+		return errReadOnly
+	}
+
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+
+	if delay <= 0 {
+		return s.flush()
+	}
+
+	s.flushTimer = time.AfterFunc(delay, func() {
+		if err := s.flush(); err != nil && err != errClosed {
+			s.opts.Logger.Error("Error flushing", "component", "flush", "error", err)
+		}
+	})
+	s.opts.Logger.Info("Flush scheduled", "component", "flush", "delay", delay)
+	return nil
+}
+
+func (s *store) flush() error {
+	if s.staging != nil && s.commitStaged() != nil {
+		// They'd be flushed anyway, and the flush may be what makes room
+		s.dropStaged()
+	}
+
+	var n uint64
+	err := s.update(func(txn *lmdb.Txn) error {
+		stats, err := txn.Stat(s.dbi)
+		if err != nil {
+			return err
+		}
+		n = stats.Entries
+
+		dbis := []lmdb.DBI{s.dbi, s.ttldbi, s.chunkdbi, s.refdbi, s.leasedbi}
+		if s.tagdbi != 0 {
+			dbis = append(dbis, s.tagdbi)
+		}
+		for _, dbi := range dbis {
+			if err := txn.Drop(dbi, false); err != nil {
+				return err
+			}
+		}
+		if err := s.emit(txn, EventFlush, nil); err != nil {
+			return err
+		}
+		if s.recent != nil {
+			s.recent.clear(txn.ID())
+		}
+		if s.flights != nil {
+			s.flights.flushed(txn.ID())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.opts.Logger.Info("Flushed all items", "component", "flush", "items", n)
+	return nil
+}
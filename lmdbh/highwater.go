@@ -0,0 +1,129 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	defaultEvictCheckInterval = time.Second
+	// defaultLowWaterGap is how far below EvictHighWater the low-water mark is
+	// by default
+	defaultLowWaterGap = 0.05
+)
+
+// highWater checks how full the map is every EvictCheckInterval and, once the
+// pages in use pass EvictHighWater of the most the map can grow to, evicts
+// items until they are below EvictLowWater. Evicting ahead of time keeps
+// writes from running into a full map and having to evict while clients wait.
+//
+// Items are evicted with the Eviction policy, or EvictSoonestExpiring if it is
+// EvictNone, from every namespace in turn. Each round of evictions is a write
+// transaction of its own, of at most 1/64th of the map, and removing scattered
+// small items frees few whole pages, so a check stops after 64 rounds even if
+// the map is still above the low-water mark.
+func highWater(s *store) {
+	for {
+		select {
+		case <-time.After(s.opts.EvictCheckInterval):
+		case <-s.done:
+			return
+		}
+
+		if err := s.evictToLowWater(); err != nil && err != errClosed && err != errDiskFull {
+			s.opts.Logger.Error("Error while evicting", "component", "evict", "error", err)
+		}
+	}
+}
+
+func (s *store) evictToLowWater() error {
+	used, limit, err := s.utilization()
+	if err != nil || used < s.opts.EvictHighWater*limit {
+		return err
+	}
+
+	start := time.Now()
+	before := used
+	low := s.opts.EvictLowWater * limit
+	policy := s.opts.Eviction
+	if policy == EvictNone {
+		policy = EvictSoonestExpiring
+	}
+
+	evicted := 0
+	for round := 0; round < evictFraction && used >= low; round++ {
+		target := used - low
+		if max := limit / evictFraction; target > max {
+			target = max
+		}
+		// Split evenly between the namespaces
+		per := int(target) / len(s.namespaces)
+		if per < 1 {
+			per = 1
+		}
+
+		n := 0
+		for _, ns := range s.namespaces {
+			err := ns.update(func(txn *lmdb.Txn) error {
+				keys, err := ns.candidates(txn, policy, per)
+				if err != nil {
+					return err
+				}
+				evicted, err := ns.evictKeys(txn, keys)
+				if err != nil {
+					return err
+				}
+				ns.countEvictions(evicted)
+				n += evicted
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		evicted += n
+		if n == 0 {
+			break
+		}
+
+		if used, _, err = s.utilization(); err != nil {
+			return err
+		}
+	}
+
+	s.opts.Logger.Info("Evicted down to low-water mark", "component", "evict",
+		"evicted", evicted, "used_before", int64(before), "used_after", int64(used),
+		"limit", int64(limit), "duration", time.Since(start))
+	return nil
+}
+
+// utilization returns the bytes of the pages in use and the most the map can
+// grow to.
+func (s *store) utilization() (used, limit float64, err error) {
+	es, err := s.envStats()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	limit = float64(es.mapSize)
+	if max := float64(s.opts.MaxMapSize); max > limit {
+		limit = max
+	}
+	used = float64((es.pagesUsed - es.freePages) * es.pageSize)
+	return used, limit, nil
+}
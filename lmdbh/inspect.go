@@ -0,0 +1,146 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// ItemInfo is what Inspect finds out about an item.
+type ItemInfo struct {
+	Key       []byte
+	Namespace string
+	Shard     int
+
+	// Exptime is when the item expires, zero for never, and TTL how long it
+	// has left, negative once it has expired but not been removed yet
+	Exptime time.Time
+	TTL     time.Duration
+	Expired bool
+
+	// SoftExptime is when the item goes stale, zero for never, see SetSoft
+	SoftExptime time.Time
+
+	Flags uint32
+	CAS   uint64
+
+	// Size is the length of the value, and StoredSize what the item takes
+	// in the main DB and its chunks
+	Size       int
+	StoredSize int
+
+	// How the item is stored: the version of the entry layout, see entry.go,
+	// and whether its value is compressed, encrypted, chunked and has a
+	// checksum, and its key is hashed
+	Version    int
+	Compressed bool
+	Encrypted  bool
+	Chunked    bool
+	Checksum   bool
+	HashedKey  bool
+
+	// Written is when the item was last written, zero unless that was with
+	// Options.WriteTimes
+	Written time.Time
+}
+
+// Inspect returns what is stored about key, without its value, for debugging.
+// Unlike a get it finds items that have expired but not been removed yet,
+// and leaves them, and their reference bits, as they are. It returns
+// common.ErrKeyNotFound if there is no item.
+func (h *Handler) Inspect(key []byte) (ItemInfo, error) {
+	s := h.shard(key)
+	if err := s.checkKey(key); err != nil {
+		return ItemInfo{}, err
+	}
+	dk, long := s.dbKey(key)
+
+	info := ItemInfo{
+		Key:       append([]byte(nil), key...),
+		Namespace: s.name,
+		Shard:     h.shardIndex(key),
+		HashedKey: long != nil,
+	}
+	err := s.view(func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
+		if err != nil {
+			return err
+		}
+		version, err := entryVersionOf(buf)
+		if err != nil {
+			return err
+		}
+		info.Version = int(version)
+		info.StoredSize = len(buf)
+
+		// How the value is stored is up to the entry the chunks hold
+		form, err := bufToEntry(buf)
+		if err != nil {
+			return err
+		}
+		if form.chunked {
+			if len(form.data) != manifestLen {
+				return errCorruptValue
+			}
+			info.Chunked = true
+			info.StoredSize += int(binary.BigEndian.Uint32(form.data[4:8]))
+			whole, err := s.getChunks(txn, dk, form.data)
+			if err != nil {
+				return err
+			}
+			if form, err = bufToEntry(whole); err != nil {
+				return err
+			}
+		}
+		info.Compressed, info.Encrypted, info.Checksum = form.compressed, form.encrypted, form.checksum
+
+		e, err := s.decodeEntry(txn, dk, buf)
+		if err != nil {
+			return err
+		}
+		if !e.isFor(long) {
+			return &lmdb.OpError{Op: "mdb_get", Errno: lmdb.NotFound}
+		}
+		info.Flags, info.CAS, info.Size = e.flags, e.cas, len(e.data)
+		if e.exptime != 0 {
+			info.Exptime = msTime(e.exptime)
+			info.TTL = info.Exptime.Sub(s.opts.Clock.Now())
+			info.Expired = s.hasExpired(e.exptime)
+		}
+		if e.soft != 0 {
+			info.SoftExptime = msTime(e.soft)
+		}
+		if e.written != 0 {
+			info.Written = msTime(e.written)
+		}
+		return nil
+	})
+	if lmdb.IsNotFound(err) {
+		return ItemInfo{}, common.ErrKeyNotFound
+	}
+	if err != nil {
+		return ItemInfo{}, s.decodeErr(err)
+	}
+	return info, nil
+}
+
+// msTime is the time of a stored time in unix milliseconds.
+func msTime(ms uint64) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
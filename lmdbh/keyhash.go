@@ -0,0 +1,95 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// With Options.HashLongKeys set, keys too long for LMDB are stored under the
+// start of the key followed by its SHA-256, exactly hashedKeyLen bytes in all.
+// Every key shorter than that is stored as is, so a hashed key can only ever
+// be mistaken for another hashed key. The entry holds the whole key too, see
+// fmtKey, which reads check to rule that out and the dump uses.
+//
+// The store's hashedKeyLen is set when it is opened, from LMDB's limit less
+// the keyOverhead of the TTL index and chunks.
+
+// maxEmbeddedKey is the longest key an entry can hold.
+const maxEmbeddedKey = 1<<16 - 1
+
+// dbKey returns the key key is stored under in LMDB and, if that is a hashed
+// key, key itself, for the entry to hold.
+func (s *store) dbKey(key []byte) (dk, long []byte) {
+	if !s.opts.HashLongKeys || len(key) < s.hashedKeyLen {
+		return key, nil
+	}
+
+	sum := sha256.Sum256(key)
+	dk = make([]byte, s.hashedKeyLen)
+	n := copy(dk, key[:s.hashedKeyLen-len(sum)])
+	copy(dk[n:], sum[:])
+	return dk, key
+}
+
+// isFor returns whether e is the item for the key that dbKey gave long for.
+func (e entry) isFor(long []byte) bool {
+	return bytes.Equal(e.key, long)
+}
+
+// otherKey returns whether the item stored at dk, if there is one, is for
+// another key than the one dbKey gave long for, for the commands that don't
+// otherwise decode it. Only hashed keys can be mistaken for one another, so
+// only their entries are decoded.
+func (s *store) otherKey(txn *lmdb.Txn, dk, long []byte) (bool, error) {
+	if long == nil {
+		return false, nil
+	}
+	buf, err := txn.Get(s.dbi, dk)
+	if lmdb.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	e, err := s.decodeEntry(txn, dk, buf)
+	if err != nil {
+		return false, err
+	}
+	return !e.isFor(long), nil
+}
+
+// live returns whether e, found at dk, is a current item for the key that
+// dbKey gave long for. Expired items are queued for deletion.
+func (s *store) live(e entry, dk, long []byte) bool {
+	if !e.isFor(long) {
+		return false
+	}
+	if s.hasExpired(e.exptime) {
+		s.expiredOnRead(dk)
+		return false
+	}
+	if s.expiresEarly(e.exptime) {
+		s.count(&s.stats.earlyMisses, MetricEarlyMisses)
+		return false
+	}
+	if s.isStale(e) {
+		s.count(&s.stats.staleHits, MetricStaleHits)
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+const expiredQueueLen = 1024
+
+// expiredOnRead queues key for deletion. Reads happen inside a read-only
+// transaction, so the delete has to happen elsewhere. If the queue is full the
+// key is dropped and left for the reaper.
+func (s *store) expiredOnRead(key []byte) {
+	s.count(&s.stats.expirations, MetricExpirations)
+
+	if s.expired == nil {
+		return
+	}
+
+	select {
+	case s.expired <- append([]byte(nil), key...):
+	default:
+	}
+}
+
+// lazyDeleter deletes the keys queued by expiredOnRead and corruptOnRead.
+func lazyDeleter(s *store) {
+	for {
+		var key []byte
+		var corrupt bool
+		select {
+		case key = <-s.expired:
+		case key = <-s.corrupt:
+			corrupt = true
+		case <-s.done:
+			return
+		}
+
+		err := s.update(func(txn *lmdb.Txn) error {
+			if corrupt {
+				return s.delCorrupt(txn, key)
+			}
+
+			// The item may have been rewritten since it was read
+			exptime, found, err := s.storedExptime(txn, key)
+			if err != nil || !found {
+				return err
+			}
+			if s.hasExpired(exptime) {
+				return s.delEvent(txn, key, EventExpire)
+			}
+			return nil
+		})
+
+		if de := s.decodeErr(err); de != nil && de != common.ErrKeyNotFound && de != errDiskFull {
+			s.opts.Logger.Error("Error while deleting item", "component", "lazy_expire", "error", err)
+		}
+	}
+}
+
+// delCorrupt deletes key if it still fails its checksum.
+func (s *store) delCorrupt(txn *lmdb.Txn, key []byte) error {
+	buf, err := txn.Get(s.dbi, key)
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := s.decodeEntry(txn, key, buf); err != errChecksum {
+		return nil
+	}
+	return s.delEvent(txn, key, EventDelete)
+}
@@ -0,0 +1,252 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// Leases keep a miss from sending every client to recompute the same value.
+// GetL hands the first reader of a key that is missing or stale a lease token,
+// and the others none until it is used or expires, so they wait and retry or
+// serve the stale value instead. SetL stores the new value only if the lease
+// is still held. Deleting the key takes the lease back, so a value read
+// before the delete can't be stored after it.
+//
+// Leases are kept in a DB of their own, keyed like the data DB, with values of
+// the 64 bit big endian unix time in milliseconds the lease expires after,
+// followed by the 64 bit token. Tokens come from the CAS counter. Expired
+// leases are removed by the reaper.
+const (
+	leaseDBSuffix = "_leases"
+	leaseLen      = 16
+
+	defaultLeaseTTL = 10 * time.Second
+)
+
+// LeaseResponse is a GetsResponse that may carry a lease, see GetL.
+type LeaseResponse struct {
+	GetsResponse
+
+	// Lease is the token to store a new value for the key with, see SetL.
+	// It is only handed out for a miss or a stale item, and zero if another
+	// reader already holds the lease.
+	Lease uint64
+}
+
+// GetL is Gets for one key that also hands out a lease if the item is missing
+// or stale. A miss without a lease means another client is already fetching
+// the value, so the caller should wait and try again.
+func (h *Handler) GetL(key []byte) (LeaseResponse, error) {
+	s := h.shard(key)
+	t := s.startOp(opGetL, len(key), 0)
+	defer t.done()
+
+	if err := s.checkKey(key); err != nil {
+		return LeaseResponse{}, err
+	}
+	key = s.detach(key)
+	dk, long := s.dbKey(key)
+
+	// Most reads find a fresh item, so look without the writer lock first,
+	// unless a set of it is staged and only the write sees it, see write
+	var r LeaseResponse
+	var fresh bool
+	var err error
+	if _, staged := s.stagedEntry(dk); !staged {
+		err = s.view(func(txn *lmdb.Txn) (err error) {
+			r, fresh, err = s.readLeased(txn, key, dk, long)
+			return
+		})
+	}
+	if err == nil && !fresh {
+		err = s.write(t, func(txn *lmdb.Txn) (err error) {
+			// The item may have been stored since
+			if r, fresh, err = s.readLeased(txn, key, dk, long); err != nil || fresh {
+				return
+			}
+			r.Lease, err = s.lease(txn, dk)
+			return
+		})
+	}
+	if err != nil {
+		return LeaseResponse{}, s.decodeErr(err)
+	}
+
+	if r.Miss {
+		s.count(&s.stats.misses, MetricMisses)
+	} else {
+		s.hit(dk)
+		if r.Stale {
+			s.count(&s.stats.staleHits, MetricStaleHits)
+		}
+	}
+	return r, nil
+}
+
+// readLeased reads the item at dk for GetL, and whether it is there and
+// fresh, which needs no lease.
+func (s *store) readLeased(txn *lmdb.Txn, key, dk, long []byte) (LeaseResponse, bool, error) {
+	var r LeaseResponse
+	r.Key, r.Miss = key, true
+
+	buf, err := txn.Get(s.dbi, dk)
+	if lmdb.IsNotFound(err) {
+		return r, false, nil
+	}
+	if err != nil {
+		return r, false, err
+	}
+
+	e, err := s.decodeEntry(txn, dk, buf)
+	if err != nil {
+		if err == errChecksum {
+			s.corruptOnRead(dk)
+		}
+		return r, false, err
+	}
+	if !e.isFor(long) || s.hasExpired(e.exptime) {
+		return r, false, nil
+	}
+
+	r.Miss = false
+	r.Exptime = clientExptime(e.exptime)
+	r.Flags = e.flags
+	r.Data = e.data
+	r.Cas = e.cas
+	r.Stale = s.isStale(e)
+	return r, !r.Stale, nil
+}
+
+// lease hands out a new lease on dk, or returns zero if one is held.
+func (s *store) lease(txn *lmdb.Txn, dk []byte) (uint64, error) {
+	now := s.now()
+
+	held, err := txn.Get(s.leasedbi, dk)
+	switch {
+	case err == nil:
+		if len(held) == leaseLen && binary.BigEndian.Uint64(held[0:8]) >= now {
+			return 0, nil
+		}
+	case !lmdb.IsNotFound(err):
+		return 0, err
+	}
+
+	token := s.nextCAS()
+	val := make([]byte, leaseLen)
+	binary.BigEndian.PutUint64(val[0:8], now+uint64(s.opts.LeaseTTL/time.Millisecond))
+	binary.BigEndian.PutUint64(val[8:16], token)
+	return token, txn.Put(s.leasedbi, dk, val, 0)
+}
+
+// SetL is Set if lease, from GetL, is still held for the key, and gives the
+// lease up. It returns common.ErrKeyExists if the lease has expired, the key
+// was deleted or another lease was handed out since.
+func (h *Handler) SetL(cmd common.SetRequest, lease uint64) error {
+	s := h.shard(cmd.Key)
+	t := s.startOp(opSetL, len(cmd.Key), len(cmd.Data))
+	defer t.done()
+
+	if err := s.checkItem(cmd.Key, cmd.Data); err != nil {
+		return err
+	}
+	cmd.Key, cmd.Data = s.detach(cmd.Key), s.detach(cmd.Data)
+	dk, long := s.dbKey(cmd.Key)
+
+	e := entry{
+		exptime: s.exptime(cmd.Exptime),
+		flags:   cmd.Flags,
+		cas:     s.nextCAS(),
+		data:    cmd.Data,
+		key:     long,
+	}
+	e.soft = s.softExptime(e.exptime, 0)
+
+	e, err := s.prepareEntry(e)
+	if err != nil {
+		return err
+	}
+
+	err = s.write(t, func(txn *lmdb.Txn) error {
+		held, err := txn.Get(s.leasedbi, dk)
+		if lmdb.IsNotFound(err) {
+			return common.ErrKeyExists
+		}
+		if err != nil {
+			return err
+		}
+		if len(held) != leaseLen || binary.BigEndian.Uint64(held[8:16]) != lease ||
+			binary.BigEndian.Uint64(held[0:8]) < s.now() {
+			return common.ErrKeyExists
+		}
+
+		if err := txn.Del(s.leasedbi, dk, nil); err != nil {
+			return err
+		}
+		return s.putEntry(txn, dk, e, 0)
+	})
+
+	if err == nil {
+		s.count(&s.stats.sets, MetricSets)
+	}
+
+	return s.decodeErr(err)
+}
+
+// delLease takes back any lease on dk.
+func (s *store) delLease(txn *lmdb.Txn, dk []byte) error {
+	if err := txn.Del(s.leasedbi, dk, nil); err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// reapLeases removes the leases that have expired, returning how many. Only
+// leases that are handed out and never used are left to expire, so there are
+// few enough to go through them all.
+func (s *store) reapLeases() (int, error) {
+	n := 0
+	err := s.update(func(txn *lmdb.Txn) error {
+		n = 0
+		cur, err := txn.OpenCursor(s.leasedbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		now := s.now()
+		for {
+			_, val, err := cur.Get(nil, nil, lmdb.Next)
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(val) == leaseLen && binary.BigEndian.Uint64(val[0:8]) >= now {
+				continue
+			}
+			if err := cur.Del(0); err != nil {
+				return err
+			}
+			n++
+		}
+	})
+	return n, err
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import "github.com/netflix/rend/common"
+
+// The memcached defaults
+const (
+	defaultMaxKeySize   = 250
+	defaultMaxValueSize = 1024 * 1024
+)
+
+// keyOverhead is the most bytes added to a key to make the key of a TTL index
+// record or a chunk.
+const keyOverhead = 8
+
+// checkKey rejects keys the client can't use, before LMDB gets to and fails
+// with a less helpful MDB_BAD_VALSIZE.
+func (s *store) checkKey(key []byte) error {
+	if len(key) == 0 || len(key) > s.opts.MaxKeySize {
+		return common.ErrBadRequest
+	}
+	return nil
+}
+
+// checkValue rejects values of more than MaxValueSize bytes.
+func (s *store) checkValue(size int) error {
+	if size > s.opts.MaxValueSize {
+		return common.ErrValueTooBig
+	}
+	return nil
+}
+
+// checkItem is checkKey and checkValue for a new item.
+func (s *store) checkItem(key, data []byte) error {
+	if err := s.checkKey(key); err != nil {
+		return err
+	}
+	return s.checkValue(len(data))
+}
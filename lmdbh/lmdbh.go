@@ -15,10 +15,9 @@
 package lmdbh
 
 import (
-	"encoding/binary"
-	"log"
-	"os"
+	"errors"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bmatsuo/lmdb-go/lmdb"
@@ -26,476 +25,630 @@ import (
 	"github.com/netflix/rend/handlers"
 )
 
-type entry struct {
-	exptime uint32
-	flags   uint32
-	data    []byte
-}
-
-func (e entry) expired() bool {
-	return e.exptime != 0 && e.exptime < uint32(time.Now().Unix())
-}
-
-func entryToBuf(e entry) []byte {
-	// If this changes, make sure to update the GAT function below
-	// The GAT function directly overwrites the exptime field
-	buf := make([]byte, 8+len(e.data))
-	binary.BigEndian.PutUint32(buf[0:4], e.exptime)
-	binary.BigEndian.PutUint32(buf[4:8], e.flags)
-	copy(buf[8:], e.data)
-	return buf
-}
+var errCorruptEnv = errors.New("Rend LMDB environment is corrupt")
 
-func bufToEntry(b []byte) entry {
-	e := entry{
-		exptime: binary.BigEndian.Uint32(b[0:4]),
-		flags:   binary.BigEndian.Uint32(b[4:8]),
-		data:    make([]byte, len(b)-8),
+// decode maps the errors of LMDB to those rend answers clients with. A
+// corrupt environment gets errCorruptEnv, and misuse of the API, which is a
+// bug here, common.ErrInternal. Errors not from LMDB, or unknown to it, pass
+// through.
+func decode(err error) error {
+	oe, ok := err.(*lmdb.OpError)
+	if !ok {
+		return err
 	}
 
-	copy(e.data, b[8:])
-
-	return e
+	switch oe.Errno {
+	case lmdb.KeyExist:
+		return common.ErrKeyExists
+	case lmdb.NotFound:
+		return common.ErrKeyNotFound
+	case lmdb.MapFull, lmdb.TxnFull, syscall.ENOSPC:
+		return common.ErrNoMem
+	case lmdb.BadValSize:
+		return common.ErrValueTooBig
+	case lmdb.ReadersFull:
+		return common.ErrBusy
+	case lmdb.MapResized:
+		// Only left after the new size couldn't be adopted, see view
+		return common.ErrTempFailure
+	case lmdb.Corrupted, lmdb.PageNotFound, lmdb.Panic, lmdb.VersionMismatch, lmdb.Invalid, lmdb.Incompatible:
+		return errCorruptEnv
+	case lmdb.DBsFull, lmdb.TLSFull, lmdb.CursorFull, lmdb.PageFull, lmdb.BadRSlot, lmdb.BadTxn, lmdb.BadDBI,
+		syscall.EINVAL, syscall.EACCES:
+		return common.ErrInternal
+	}
+	return err
 }
 
-func decode(err error) error {
-	if err == nil {
-		return err
+// decodeErr is decode that counts the LMDB errors that aren't down to the
+// client by class, and logs those that need looking into.
+func (s *store) decodeErr(err error) error {
+	de := decode(err)
+	if _, ok := err.(*lmdb.OpError); !ok {
+		return de
 	}
 
-	if oe, ok := err.(*lmdb.OpError); ok {
-		switch oe.Errno {
-		case lmdb.KeyExist: //MDB_KEYEXIST
-			return common.ErrKeyExists
-		case lmdb.NotFound: //MDB_NOTFOUND
-			return common.ErrKeyNotFound
-		//case lmdb.PageNotFound: //MDB_PAGE_NOTFOUND
-		//case lmdb.Corrupted: //MDB_CORRUPTED
-		//case lmdb.Panic: //MDB_PANIC
-		//case lmdb.VersionMismatch: //MDB_VERSION_MISMATCH
-		//case lmdb.Invalid: //MDB_INVALID
-		//case lmdb.MapFull: //MDB_MAP_FULL
-		//case lmdb.DBsFull: //MDB_DBS_FULL
-		//case lmdb.ReadersFull: //MDB_READERS_FULL
-		//case lmdb.TLSFull: //MDB_TLS_FULL
-		//case lmdb.TxnFull: //MDB_TXN_FULL
-		//case lmdb.CursorFull: //MDB_CURSOR_FULL
-		//case lmdb.PageFull: //MDB_PAGE_FULL
-		//case lmdb.MapResized: //MDB_MAP_RESIZED
-		//case lmdb.Incompatible: //MDB_INCOMPATIBLE
-		//case lmdb.BadRSlot: //MDB_BAD_RSLOT
-		//case lmdb.BadTxn: //MDB_BAD_TXN
-		//case lmdb.BadValSize: //MDB_BAD_VALSIZE
-		//case lmdb.BadDBI: //MDB_BAD_DBI
-		// not sure is these should go here or if the return could be these
-		//case syscall.EINVAL:
-		//case syscall.EACCES:
-		default:
-			log.Println(err.Error)
-		}
+	switch de {
+	case common.ErrKeyExists, common.ErrKeyNotFound, common.ErrValueTooBig:
+		return de
+	case common.ErrNoMem:
+		s.count(&s.stats.errFull, MetricErrFull)
+		return de
+	case common.ErrBusy, common.ErrTempFailure:
+		s.count(&s.stats.errBusy, MetricErrBusy)
+		return de
+	case errCorruptEnv:
+		s.count(&s.stats.errCorrupt, MetricErrCorrupt)
+	default:
+		// Misuse of the API, or an errno decode doesn't know, e.g. EIO
+		s.count(&s.stats.errInternal, MetricErrInternal)
 	}
 
-	return err
+	s.opts.Logger.Error("LMDB error", "component", "lmdb", "namespace", s.name, "error", err)
+	return de
 }
 
+// Handler implements handlers.Handler on top of an LMDB environment, or one
+// per shard, see Options.Shards. Every Handler created for the same path
+// shares the same underlying stores.
 type Handler struct {
-	env *lmdb.Env
-	dbi lmdb.DBI
+	shards    []*store
+	closeOnce sync.Once
 }
 
-var once = &sync.Once{}
-var singleton *Handler
-
-func reaper(env *lmdb.Env, dbi lmdb.DBI) {
-	for {
-		<-time.After(30 * time.Second)
-		start := time.Now()
-		log.Printf("[REAPER] Reaper started at %v\n", start)
-
-		err := env.View(func(txn *lmdb.Txn) error {
-			txn.RawRead = true
-			cur, err := txn.OpenCursor(dbi)
-			if err != nil {
-				return err
-			}
-
-			stats, err := txn.Stat(dbi)
-			if err != nil {
-				return err
-			}
-			log.Printf("[REAPER] Items before: %d", stats.Entries)
-
-			// reap all items whose TTL has passed
-			for {
-				key, buf, err := cur.Get(nil, nil, lmdb.Next)
-				if err != nil {
-					if lmdb.IsNotFound(err) {
-						break
-					}
-					return err
-				}
-
-				e := entry{
-					exptime: binary.BigEndian.Uint32(buf[0:4]),
-				}
-				if e.expired() {
-					// Mini update transaction here to avoid blocking other writers
-					err = env.Update(func(t *lmdb.Txn) error {
-						// double check the expire time after getting txn lock
-						buf, err := t.Get(dbi, key)
-						if err != nil {
-							return err
-						}
-						e := entry{
-							exptime: binary.BigEndian.Uint32(buf[0:4]),
-						}
-						if e.expired() {
-							return t.Del(dbi, key, nil)
-						}
-						return nil
-					})
-
-					if de := decode(err); de != nil && de != common.ErrKeyNotFound {
-						return err
-					}
-				}
-			}
-
-			return nil
-		})
-
-		if err != nil {
-			log.Printf("[REAPER] Error while reaping: %v\n", err.Error())
-		}
-
-		err = env.View(func(txn *lmdb.Txn) error {
-			stats, err := txn.Stat(dbi)
-			if err != nil {
-				return err
-			}
-			log.Printf("[REAPER] Items after: %d\n", stats.Entries)
-			return nil
-		})
+// New returns a HandlerConst that opens (or creates) the LMDB environment
+// described by opts. Fields left at their zero value in opts are defaulted.
+//
+// Handlers for the same path share a single environment, so the options of
+// the first handler opened for a path are the ones that take effect. Handlers
+// for different paths are fully independent.
+func New(opts Options) handlers.HandlerConst {
+	opts = opts.withDefaults()
+	if opts.Compression != nil {
+		RegisterCodec(opts.Compression)
+	}
 
+	return func() (handlers.Handler, error) {
+		shards, err := getShards(opts)
 		if err != nil {
-			log.Printf("[REAPER] Error while reaping: %v\n", err.Error())
+			return nil, err
 		}
 
-		end := time.Now()
-		durms := float64(end.UnixNano()-start.UnixNano()) / 1000000.0
-		log.Printf("[REAPER] Reaper ended at %v and took %vms to run\n", end, durms)
+		return &Handler{shards: shards}, nil
 	}
 }
 
-func New(path string, size int64) handlers.HandlerConst {
-	return func() (handlers.Handler, error) {
-		once.Do(func() {
-			// initialize the LMDB environment and DB
-			env, err := lmdb.NewEnv()
-			if err != nil {
-				panic(err)
-			}
-
-			// apply size limit, one DB only
-			if err := env.SetMapSize(size); err != nil {
-				panic(err)
-			}
-			if err := env.SetMaxDBs(1); err != nil {
-				panic(err)
-			}
+func (h *Handler) Set(cmd common.SetRequest) error {
+	return h.set(cmd, 0, nil)
+}
 
-			// Create the db dir if it doesn't already exist
-			fs, err := os.Stat(path)
-			if err != nil {
-				if os.IsNotExist(err) {
-					if err := os.MkdirAll(path, 0774); err != nil {
-						panic(err)
-					}
-				} else {
-					panic(err)
-				}
-			}
+// set is Set with the soft TTL of SetSoft.
+func (h *Handler) set(cmd common.SetRequest, softTTL time.Duration, tags [][]byte) error {
+	s := h.shard(cmd.Key)
+	t := s.startOp(opSet, len(cmd.Key), len(cmd.Data))
+	defer t.done()
 
-			// Don't correct for a file already existing, let the user deal with it.
-			if fs != nil && !fs.IsDir() {
-				panic("Rend LMDB path exists and is a file")
-			}
+	if err := s.checkItem(cmd.Key, cmd.Data); err != nil {
+		return err
+	}
+	staged := s.staging != nil && !s.syncOps[opSet] && len(tags) == 0
+	if staged {
+		// Staged sets outlive the request
+		cmd.Key = append([]byte(nil), cmd.Key...)
+		cmd.Data = append([]byte(nil), cmd.Data...)
+	} else {
+		cmd.Key, cmd.Data = s.detach(cmd.Key), s.detach(cmd.Data)
+	}
+	dk, long := s.dbKey(cmd.Key)
+	if len(tags) > 0 {
+		if err := s.checkTags(dk, tags); err != nil {
+			return err
+		}
+	}
 
-			if err := env.Open(path, 0, 0664); err != nil {
-				panic(err)
-			}
+	plain := entry{
+		exptime: s.exptime(cmd.Exptime),
+		flags:   cmd.Flags,
+		cas:     s.nextCAS(),
+		data:    cmd.Data,
+		key:     long,
+	}
+	plain.soft = s.softExptime(plain.exptime, softTTL)
 
-			var dbi lmdb.DBI
-			err = env.Update(func(txn *lmdb.Txn) (err error) {
-				dbi, err = txn.CreateDBI("rendb")
-				return
-			})
-			if err != nil {
-				panic(err)
-			}
+	e, err := s.prepareEntry(plain)
+	if err != nil {
+		return err
+	}
 
-			singleton = &Handler{
-				env: env,
-				dbi: dbi,
+	if staged {
+		err = s.stage(dk, e, plain)
+	} else {
+		err = s.write(t, func(txn *lmdb.Txn) error {
+			if err := s.putEntry(txn, dk, e, 0); err != nil {
+				return err
 			}
-
-			go reaper(env, dbi)
+			return s.tag(txn, dk, tags)
 		})
-
-		return singleton, nil
 	}
-}
 
-func (h *Handler) Set(cmd common.SetRequest) error {
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
-	}
-	e := entry{
-		exptime: exptime,
-		flags:   cmd.Flags,
-		data:    cmd.Data,
+	if err == nil {
+		s.count(&s.stats.sets, MetricSets)
 	}
 
-	buf := entryToBuf(e)
-
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		return txn.Put(h.dbi, cmd.Key, buf, 0)
-	})
-
-	return decode(err)
+	return s.decodeErr(err)
 }
 
 func (h *Handler) Add(cmd common.SetRequest) error {
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
+	s := h.shard(cmd.Key)
+	t := s.startOp(opAdd, len(cmd.Key), len(cmd.Data))
+	defer t.done()
+
+	if err := s.checkItem(cmd.Key, cmd.Data); err != nil {
+		return err
 	}
+	cmd.Key, cmd.Data = s.detach(cmd.Key), s.detach(cmd.Data)
+	dk, long := s.dbKey(cmd.Key)
+
 	e := entry{
-		exptime: exptime,
+		exptime: s.exptime(cmd.Exptime),
 		flags:   cmd.Flags,
+		cas:     s.nextCAS(),
 		data:    cmd.Data,
+		key:     long,
 	}
+	e.soft = s.softExptime(e.exptime, 0)
 
-	buf := entryToBuf(e)
+	e, err := s.prepareEntry(e)
+	if err != nil {
+		return err
+	}
+
+	err = s.write(t, func(txn *lmdb.Txn) error {
+		// An expired item is as good as missing
+		exptime, found, err := s.storedExptime(txn, dk)
+		if err != nil {
+			return err
+		}
+		if found && !s.hasExpired(exptime) {
+			return common.ErrKeyExists
+		}
 
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		return txn.Put(h.dbi, cmd.Key, buf, lmdb.NoOverwrite)
+		return s.putEntry(txn, dk, e, 0)
 	})
 
-	return decode(err)
+	if err == nil {
+		s.count(&s.stats.sets, MetricSets)
+	}
+
+	return s.decodeErr(err)
 }
 
 func (h *Handler) Replace(cmd common.SetRequest) error {
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
+	s := h.shard(cmd.Key)
+	t := s.startOp(opReplace, len(cmd.Key), len(cmd.Data))
+	defer t.done()
+
+	if err := s.checkItem(cmd.Key, cmd.Data); err != nil {
+		return err
 	}
+	cmd.Key, cmd.Data = s.detach(cmd.Key), s.detach(cmd.Data)
+	dk, long := s.dbKey(cmd.Key)
+
 	e := entry{
-		exptime: exptime,
+		exptime: s.exptime(cmd.Exptime),
 		flags:   cmd.Flags,
+		cas:     s.nextCAS(),
 		data:    cmd.Data,
+		key:     long,
 	}
+	e.soft = s.softExptime(e.exptime, 0)
 
-	buf := entryToBuf(e)
+	e, err := s.prepareEntry(e)
+	if err != nil {
+		return err
+	}
 
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		if _, err := txn.Get(h.dbi, cmd.Key); err != nil {
+	err = s.write(t, func(txn *lmdb.Txn) error {
+		exptime, found, err := s.storedExptime(txn, dk)
+		if err != nil {
 			return err
 		}
+		if !found || s.hasExpired(exptime) {
+			return common.ErrKeyNotFound
+		}
 
-		return txn.Put(h.dbi, cmd.Key, buf, 0)
+		return s.putEntry(txn, dk, e, 0)
 	})
 
-	return decode(err)
+	if err == nil {
+		s.count(&s.stats.sets, MetricSets)
+	}
+
+	return s.decodeErr(err)
 }
 
 func (h *Handler) Append(cmd common.SetRequest) error {
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		buf, err := txn.Get(h.dbi, cmd.Key)
+	s := h.shard(cmd.Key)
+	t := s.startOp(opAppend, len(cmd.Key), len(cmd.Data))
+	defer t.done()
+
+	if err := s.checkItem(cmd.Key, cmd.Data); err != nil {
+		return err
+	}
+	cmd.Key, cmd.Data = s.detach(cmd.Key), s.detach(cmd.Data)
+	dk, long := s.dbKey(cmd.Key)
+
+	err := s.write(t, func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
 		if err != nil {
 			return err
 		}
 
-		prev := bufToEntry(buf)
+		prev, err := s.decodeEntry(txn, dk, buf)
+		if err != nil {
+			return err
+		}
+		if !prev.isFor(long) || s.hasExpired(prev.exptime) {
+			return common.ErrKeyNotFound
+		}
+		if err := s.checkValue(len(prev.data) + len(cmd.Data)); err != nil {
+			return err
+		}
 
 		e := entry{
 			exptime: prev.exptime,
+			soft:    prev.soft,
 			flags:   prev.flags,
+			cas:     s.nextCAS(),
 			data:    append(prev.data, cmd.Data...),
+			key:     long,
 		}
 
-		buf = entryToBuf(e)
+		if e, err = s.prepareEntry(e); err != nil {
+			return err
+		}
 
-		return txn.Put(h.dbi, cmd.Key, buf, 0)
+		return s.putEntry(txn, dk, e, 0)
 	})
 
-	return decode(err)
+	if err == nil {
+		s.count(&s.stats.sets, MetricSets)
+	}
+
+	return s.decodeErr(err)
 }
 
 func (h *Handler) Prepend(cmd common.SetRequest) error {
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		buf, err := txn.Get(h.dbi, cmd.Key)
+	s := h.shard(cmd.Key)
+	t := s.startOp(opPrepend, len(cmd.Key), len(cmd.Data))
+	defer t.done()
+
+	if err := s.checkItem(cmd.Key, cmd.Data); err != nil {
+		return err
+	}
+	cmd.Key, cmd.Data = s.detach(cmd.Key), s.detach(cmd.Data)
+	dk, long := s.dbKey(cmd.Key)
+
+	err := s.write(t, func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
 		if err != nil {
 			return err
 		}
 
-		prev := bufToEntry(buf)
+		prev, err := s.decodeEntry(txn, dk, buf)
+		if err != nil {
+			return err
+		}
+		if !prev.isFor(long) || s.hasExpired(prev.exptime) {
+			return common.ErrKeyNotFound
+		}
+		if err := s.checkValue(len(prev.data) + len(cmd.Data)); err != nil {
+			return err
+		}
 
 		e := entry{
 			exptime: prev.exptime,
+			soft:    prev.soft,
 			flags:   prev.flags,
+			cas:     s.nextCAS(),
 			data:    append(cmd.Data, prev.data...),
+			key:     long,
 		}
 
-		buf = entryToBuf(e)
+		if e, err = s.prepareEntry(e); err != nil {
+			return err
+		}
 
-		return txn.Put(h.dbi, cmd.Key, buf, 0)
+		return s.putEntry(txn, dk, e, 0)
 	})
 
-	return decode(err)
+	if err == nil {
+		s.count(&s.stats.sets, MetricSets)
+	}
+
+	return s.decodeErr(err)
 }
 
+// A get of a single key is done before returning instead of in a goroutine of
+// its own. Its one response fits in the buffer of the data channel, so nothing
+// blocks, and the channels read the same either way.
 func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
 	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	if len(cmd.Keys) == 1 {
+		err := getShard(h.shard(cmd.Keys[0]), cmd, dataOut)
+		close(dataOut)
+		return dataOut, errorsOf(err)
+	}
+
 	errorOut := make(chan error, 1)
 	go realHandleGet(h, cmd, dataOut, errorOut)
 	return dataOut, errorOut
 }
 
+// noErrors is the error channel of every single key get that succeeded, so
+// they don't each need one.
+var noErrors = func() chan error {
+	c := make(chan error)
+	close(c)
+	return c
+}()
+
+// errorsOf returns a closed error channel that yields err, if not nil.
+func errorsOf(err error) <-chan error {
+	if err == nil {
+		return noErrors
+	}
+	c := make(chan error, 1)
+	c <- err
+	close(c)
+	return c
+}
+
 func realHandleGet(h *Handler, cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error) {
-	err := h.env.View(func(txn *lmdb.Txn) error {
-		for idx, key := range cmd.Keys {
-			buf, err := txn.Get(h.dbi, key)
-			if de := decode(err); de != nil {
-				if de == common.ErrKeyNotFound {
-					dataOut <- common.GetResponse{
-						Miss:   true,
-						Quiet:  cmd.Quiet[idx],
-						Opaque: cmd.Opaques[idx],
-						Key:    key,
-					}
-					continue
-				} else {
-					return de
-				}
-			}
+	for _, p := range h.splitGet(cmd) {
+		if err := getShard(p.s, p.cmd, dataOut); err != nil {
+			errorOut <- err
+			break
+		}
+	}
 
-			e := bufToEntry(buf)
+	close(dataOut)
+	close(errorOut)
+}
 
-			if e.expired() {
-				dataOut <- common.GetResponse{
-					Miss:   true,
-					Quiet:  cmd.Quiet[idx],
-					Opaque: cmd.Opaques[idx],
-					Key:    key,
-				}
-				continue
-			}
+func getShard(s *store, cmd common.GetRequest, dataOut chan<- common.GetResponse) error {
+	t := s.startOp(opGet, keyBytes(cmd.Keys), 0)
+	defer t.done()
 
+	return s.readKeys(t, cmd.Keys, func(idx int, dk, long []byte, e *entry) {
+		if e == nil || !s.live(*e, dk, long) {
+			s.count(&s.stats.misses, MetricMisses)
 			dataOut <- common.GetResponse{
-				Miss:   false,
+				Miss:   true,
 				Quiet:  cmd.Quiet[idx],
 				Opaque: cmd.Opaques[idx],
-				Flags:  e.flags,
-				Key:    key,
-				Data:   e.data,
+				Key:    cmd.Keys[idx],
 			}
+			return
+		}
+
+		s.hit(dk)
+
+		dataOut <- common.GetResponse{
+			Miss:   false,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  e.flags,
+			Key:    cmd.Keys[idx],
+			Data:   e.data,
+		}
+	})
+}
+
+// readKeys reads each of keys for a client get, calling fn with its index, its
+// DB and full keys, see dbKey, and the entry stored for it, nil if there is
+// none. The keys staged or in the read cache are served without a
+// transaction, up to the first one that isn't, and gets of one key may share
+// a read, see coalesce.go. With ReadTimeout, it gives up after that, see
+// timeout.go. The sizes of the values found and the wait for the transaction
+// are recorded in t.
+func (s *store) readKeys(t *opTimer, keys [][]byte, fn func(idx int, dk, long []byte, e *entry)) error {
+	found := func(idx int, dk, long []byte, e *entry) {
+		if e != nil {
+			t.addValue(len(e.data))
+		}
+		fn(idx, dk, long, e)
+	}
+	if s.opts.ReadTimeout > 0 {
+		return s.readKeysTimed(t, keys, found)
+	}
+	return s.readKeysNow(t, keys, found)
+}
+
+func (s *store) readKeysNow(t *opTimer, keys [][]byte, fn func(idx int, dk, long []byte, e *entry)) error {
+	if len(keys) == 1 && s.flights != nil {
+		return s.readCoalesced(t, keys[0], fn)
+	}
+
+	idx := 0
+	for ; idx < len(keys); idx++ {
+		if s.checkKey(keys[idx]) != nil {
+			break
+		}
+		dk, long := s.dbKey(keys[idx])
+		e, ok := s.stagedEntry(dk)
+		if !ok {
+			e, ok = s.cached(dk)
+		}
+		if !ok {
+			break
+		}
+		fn(idx, dk, long, &e)
+	}
+	if idx == len(keys) {
+		return nil
+	}
+
+	// Before the view begins, or a set committed since may be missed
+	staged := s.stagedEntries(keys)
+
+	// idx only moves on once a key is answered, so a retried view picks up
+	// where it left off
+	called := time.Now()
+	return s.view(func(txn *lmdb.Txn) error {
+		t.waited(called)
+		txn.RawRead = true
+		for ; idx < len(keys); idx++ {
+			if err := s.checkKey(keys[idx]); err != nil {
+				return err
+			}
+			dk, long := s.dbKey(keys[idx])
+
+			if e, ok := staged[idx]; ok {
+				fn(idx, dk, long, &e)
+				continue
+			}
+			if e, ok := s.cached(dk); ok {
+				fn(idx, dk, long, &e)
+				continue
+			}
+
+			e, err := s.readEntry(txn, dk)
+			if err != nil {
+				return err
+			}
+			fn(idx, dk, long, e)
 		}
 		return nil
 	})
+}
 
-	if err != nil {
-		errorOut <- err
+// readEntry reads the entry stored at dk for a client get, nil if there is
+// none, and adds it to the read cache.
+func (s *store) readEntry(txn *lmdb.Txn, dk []byte) (*entry, error) {
+	buf, err := s.lookup(txn, nil, dk)
+	if de := s.decodeErr(err); de != nil {
+		if de == common.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, de
 	}
 
-	close(dataOut)
-	close(errorOut)
+	e, err := s.decodeEntry(txn, dk, buf)
+	if err != nil {
+		if err == errChecksum {
+			s.corruptOnRead(dk)
+		}
+		return nil, err
+	}
+	s.cache(txn, dk, e)
+	return &e, nil
 }
 
 func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if len(cmd.Keys) >= batchMinKeys {
+		return h.GetEBatch(cmd)
+	}
+
 	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	if len(cmd.Keys) == 1 {
+		err := getEShard(h.shard(cmd.Keys[0]), cmd, dataOut)
+		close(dataOut)
+		return dataOut, errorsOf(err)
+	}
+
 	errorOut := make(chan error, 1)
 	go realHandleGetE(h, cmd, dataOut, errorOut)
 	return dataOut, errorOut
 }
 
 func realHandleGetE(h *Handler, cmd common.GetRequest, dataOut chan common.GetEResponse, errorOut chan error) {
-	err := h.env.View(func(txn *lmdb.Txn) error {
-		for idx, key := range cmd.Keys {
-			buf, err := txn.Get(h.dbi, key)
-			if de := decode(err); de != nil {
-				if de == common.ErrKeyNotFound {
-					dataOut <- common.GetEResponse{
-						Miss:   true,
-						Quiet:  cmd.Quiet[idx],
-						Opaque: cmd.Opaques[idx],
-						Key:    key,
-					}
-					continue
-				} else {
-					return de
-				}
-			}
+	for _, p := range h.splitGet(cmd) {
+		if err := getEShard(p.s, p.cmd, dataOut); err != nil {
+			errorOut <- err
+			break
+		}
+	}
 
-			e := bufToEntry(buf)
+	close(dataOut)
+	close(errorOut)
+}
 
-			if e.expired() {
-				dataOut <- common.GetEResponse{
-					Miss:   true,
-					Quiet:  cmd.Quiet[idx],
-					Opaque: cmd.Opaques[idx],
-					Key:    key,
-				}
-				continue
-			}
+func getEShard(s *store, cmd common.GetRequest, dataOut chan<- common.GetEResponse) error {
+	t := s.startOp(opGetE, keyBytes(cmd.Keys), 0)
+	defer t.done()
 
+	return s.readKeys(t, cmd.Keys, func(idx int, dk, long []byte, e *entry) {
+		if e == nil || !s.live(*e, dk, long) {
+			s.count(&s.stats.misses, MetricMisses)
 			dataOut <- common.GetEResponse{
-				Miss:    false,
-				Quiet:   cmd.Quiet[idx],
-				Opaque:  cmd.Opaques[idx],
-				Exptime: e.exptime,
-				Flags:   e.flags,
-				Key:     key,
-				Data:    e.data,
+				Miss:   true,
+				Quiet:  cmd.Quiet[idx],
+				Opaque: cmd.Opaques[idx],
+				Key:    cmd.Keys[idx],
 			}
+			return
 		}
-		return nil
-	})
 
-	if err != nil {
-		errorOut <- err
-	}
+		s.hit(dk)
 
-	close(dataOut)
-	close(errorOut)
+		dataOut <- common.GetEResponse{
+			Miss:    false,
+			Quiet:   cmd.Quiet[idx],
+			Opaque:  cmd.Opaques[idx],
+			Exptime: clientExptime(e.exptime),
+			Flags:   e.flags,
+			Key:     cmd.Keys[idx],
+			Data:    e.data,
+		}
+	})
 }
 
 func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	s := h.shard(cmd.Key)
+	t := s.startOp(opGAT, len(cmd.Key), 0)
+	defer t.done()
+
+	if err := s.checkKey(cmd.Key); err != nil {
+		return common.GetResponse{}, err
+	}
+	cmd.Key = s.detach(cmd.Key)
+	dk, long := s.dbKey(cmd.Key)
+
 	var e entry
+	var expired bool
 
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		buf, err := txn.Get(h.dbi, cmd.Key)
+	err := s.write(t, func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dk)
 		if err != nil {
 			return err
 		}
 
-		e = bufToEntry(buf)
-
-		// If the item is expired, proactively delete it
-		if e.expired() {
-			return txn.Del(h.dbi, cmd.Key, nil)
+		e, err = s.decodeEntry(txn, dk, buf)
+		if err != nil {
+			return err
+		}
+		if !e.isFor(long) {
+			return common.ErrKeyNotFound
 		}
 
-		// set the new expiration time
-		exptime := uint32(time.Now().Unix()) + cmd.Exptime
-		binary.BigEndian.PutUint32(buf[0:4], exptime)
+		// If the item is expired, proactively delete it. Batched writes must
+		// not fail after writing, so the miss is reported below.
+		if s.hasExpired(e.exptime) {
+			expired = true
+			return s.delEvent(txn, dk, EventExpire)
+		}
 
-		return txn.Put(h.dbi, cmd.Key, buf, 0)
+		return s.setExptime(txn, dk, buf, s.exptime(cmd.Exptime))
 	})
 
-	if de := decode(err); de != nil {
+	if err == nil && expired {
+		err = common.ErrKeyNotFound
+	}
+
+	if de := s.decodeErr(err); de != nil {
 		if de == common.ErrKeyNotFound {
+			s.count(&s.stats.misses, MetricMisses)
 			return common.GetResponse{
 				Miss:   true,
 				Opaque: cmd.Opaque,
@@ -506,6 +659,8 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 		}
 	}
 
+	s.hit(dk)
+
 	return common.GetResponse{
 		Miss:   false,
 		Opaque: cmd.Opaque,
@@ -516,31 +671,88 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 }
 
 func (h *Handler) Delete(cmd common.DeleteRequest) error {
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		return txn.Del(h.dbi, cmd.Key, nil)
+	s := h.shard(cmd.Key)
+	t := s.startOp(opDelete, len(cmd.Key), 0)
+	defer t.done()
+
+	if err := s.checkKey(cmd.Key); err != nil {
+		return err
+	}
+	cmd.Key = s.detach(cmd.Key)
+	dk, long := s.dbKey(cmd.Key)
+
+	var expired, missing bool
+
+	err := s.write(t, func(txn *lmdb.Txn) error {
+		if other, err := s.otherKey(txn, dk, long); err != nil {
+			return err
+		} else if other {
+			return common.ErrKeyNotFound
+		}
+
+		// An expired item is still deleted, but reported as missing
+		exptime, found, err := s.storedExptime(txn, dk)
+		if err != nil {
+			return err
+		}
+		expired = found && s.hasExpired(exptime)
+
+		// Even a missing key's lease is taken back
+		if err := s.delLease(txn, dk); err != nil {
+			return err
+		}
+		if !found {
+			missing = true
+			return nil
+		}
+		if expired {
+			return s.delEvent(txn, dk, EventExpire)
+		}
+		return s.delEvent(txn, dk, EventDelete)
 	})
 
-	return decode(err)
+	if err == nil {
+		if expired || missing {
+			return common.ErrKeyNotFound
+		}
+		s.count(&s.stats.deletes, MetricDeletes)
+	}
+
+	return s.decodeErr(err)
 }
 
 func (h *Handler) Touch(cmd common.TouchRequest) error {
-	err := h.env.Update(func(txn *lmdb.Txn) error {
-		buf, err := txn.Get(h.dbi, cmd.Key)
-		if err != nil {
+	s := h.shard(cmd.Key)
+	t := s.startOp(opTouch, len(cmd.Key), 0)
+	defer t.done()
+
+	if err := s.checkKey(cmd.Key); err != nil {
+		return err
+	}
+	cmd.Key = s.detach(cmd.Key)
+	dk, long := s.dbKey(cmd.Key)
+
+	err := s.write(t, func(txn *lmdb.Txn) error {
+		if other, err := s.otherKey(txn, dk, long); err != nil {
 			return err
+		} else if other {
+			return common.ErrKeyNotFound
 		}
 
-		// set the new expiration time
-		exptime := uint32(time.Now().Unix()) + cmd.Exptime
-		binary.BigEndian.PutUint32(buf[0:4], exptime)
+		// Only the header is read, and the value is copied within LMDB
+		raw := txn.RawRead
+		txn.RawRead = true
+		buf, err := txn.Get(s.dbi, dk)
+		txn.RawRead = raw
+		if err != nil {
+			return err
+		}
+		if s.hasExpired(entryExptime(buf)) {
+			return common.ErrKeyNotFound
+		}
 
-		return txn.Put(h.dbi, cmd.Key, buf, 0)
+		return s.setExptime(txn, dk, buf, s.exptime(cmd.Exptime))
 	})
 
-	return decode(err)
-}
-
-func (h *Handler) Close() error {
-	// Singleton means don't close until the program shuts down
-	return nil
+	return s.decodeErr(err)
 }
@@ -0,0 +1,2618 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// tempDir returns a new directory that is removed when the test is done.
+func tempDir(tb testing.TB) string {
+	dir, err := ioutil.TempDir("", "lmdbh-test")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// openHandler opens a handler with opts, which must have a Path, and closes it
+// when the test is done. Syncing is off and only errors are logged unless opts
+// say otherwise.
+func openHandler(tb testing.TB, opts Options) *Handler {
+	opts.NoSync = true
+	if opts.Logger == nil {
+		opts.Logger = NewLogger(ioutil.Discard, LevelError, false)
+	}
+
+	hi, err := New(opts)()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	h := hi.(*Handler)
+	tb.Cleanup(func() { h.Close() })
+	return h
+}
+
+// testHandler opens a handler with opts on an environment of its own.
+func testHandler(tb testing.TB, opts Options) *Handler {
+	opts.Path = tempDir(tb)
+	return openHandler(tb, opts)
+}
+
+// configs are option sets that change how items are stored. Tests of the
+// client facing behaviour run against each of them, since none may change it.
+var configs = []struct {
+	name string
+	opts Options
+}{
+	{"default", Options{}},
+	{"shards", Options{Shards: 4}},
+	{"batched", Options{WriteBatchSize: 8}},
+	{"chunked", Options{ChunkSize: 64}},
+	{"separate", Options{SeparateValues: true}},
+	{"compressed", Options{Compression: Deflate, CompressionThreshold: 1}},
+	{"snappy", Options{Compression: Snappy, CompressionThreshold: 1}},
+	{"encrypted", Options{Encryption: StaticKeys{Current: 1, Keys: map[uint32][]byte{1: make([]byte, 32)}}}},
+	{"checksums", Options{Checksums: true}},
+	{"negative cache", Options{NegativeCacheTTL: time.Minute}},
+	{"bloom filter", Options{BloomFilterItems: 1000}},
+	{"read cache", Options{ReadCacheBytes: 1 << 20}},
+	{"coalesced gets", Options{CoalesceGets: true}},
+	{"write behind", Options{WriteBehind: 64}},
+	{"synced deletes", Options{SyncOps: []string{"delete"}, WriteBatchSize: 8}},
+	{"timeouts", Options{ReadTimeout: time.Minute, WriteTimeout: time.Minute}},
+	{"oplog", Options{OplogSize: 100, OplogValues: true, ChunkSize: 1024}},
+}
+
+func forEachConfig(t *testing.T, fn func(t *testing.T, h *Handler)) {
+	for _, c := range configs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			fn(t, testHandler(t, c.opts))
+		})
+	}
+}
+
+func getRequest(keys ...[]byte) common.GetRequest {
+	opaques := make([]uint32, len(keys))
+	for i := range opaques {
+		opaques[i] = uint32(i)
+	}
+	return common.GetRequest{
+		Keys:    keys,
+		Opaques: opaques,
+		Quiet:   make([]bool, len(keys)),
+	}
+}
+
+// value returns a value of size bytes that differs by key and version, and
+// isn't all one byte, so misplaced chunks or a stale value are noticed.
+func value(key string, version, size int) []byte {
+	v := []byte(fmt.Sprintf("%s/%d:", key, version))
+	for len(v) < size {
+		v = append(v, byte(len(v)))
+	}
+	return v[:size]
+}
+
+func mustSet(t testing.TB, h *Handler, key string, data []byte, flags, exptime uint32) {
+	t.Helper()
+	if err := h.Set(common.SetRequest{Key: []byte(key), Data: data, Flags: flags, Exptime: exptime}); err != nil {
+		t.Fatalf("set %q: %v", key, err)
+	}
+}
+
+// getE returns the response to a GetE of key.
+func getE(t testing.TB, h *Handler, key string) common.GetEResponse {
+	t.Helper()
+	data, errs := h.GetE(getRequest([]byte(key)))
+	var res []common.GetEResponse
+	for r := range data {
+		res = append(res, r)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("get %q: %v", key, err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("get %q: %d responses", key, len(res))
+	}
+	return res[0]
+}
+
+func expectValue(t testing.TB, h *Handler, key string, data []byte) {
+	t.Helper()
+	r := getE(t, h, key)
+	if r.Miss {
+		t.Fatalf("get %q: miss", key)
+	}
+	if !bytes.Equal(r.Data, data) {
+		t.Fatalf("get %q: %q, want %q", key, r.Data, data)
+	}
+}
+
+func expectMiss(t testing.TB, h *Handler, key string) {
+	t.Helper()
+	if r := getE(t, h, key); !r.Miss {
+		t.Fatalf("get %q: %q, want a miss", key, r.Data)
+	}
+}
+
+func expectErr(t testing.TB, what string, err, want error) {
+	t.Helper()
+	if err != want {
+		t.Fatalf("%s: %v, want %v", what, err, want)
+	}
+}
+
+// now is the current unix time, as stored in exptimes.
+func now() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+func TestSetGet(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		for _, size := range []int{0, 1, 100, 1000, 100 * 1024} {
+			key := fmt.Sprintf("size:%d", size)
+			mustSet(t, h, key, value(key, 1, size), 7, 0)
+			expectValue(t, h, key, value(key, 1, size))
+		}
+
+		// Overwrites replace the whole value, smaller or bigger
+		mustSet(t, h, "size:1000", value("x", 2, 10), 0, 0)
+		expectValue(t, h, "size:1000", value("x", 2, 10))
+		mustSet(t, h, "size:1", value("y", 2, 5000), 0, 0)
+		expectValue(t, h, "size:1", value("y", 2, 5000))
+
+		if r := getE(t, h, "size:100"); r.Flags != 7 || r.Exptime != 0 {
+			t.Fatalf("flags %d and exptime %d, want 7 and 0", r.Flags, r.Exptime)
+		}
+		expectMiss(t, h, "missing")
+	})
+}
+
+func TestGetMultipleKeys(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		var keys [][]byte
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key:%d", i)
+			keys = append(keys, []byte(key))
+			if i%2 == 0 {
+				mustSet(t, h, key, value(key, 1, 200), uint32(i), 0)
+			}
+		}
+
+		data, errs := h.Get(getRequest(keys...))
+		seen := make(map[string]bool)
+		for r := range data {
+			key := string(r.Key)
+			if seen[key] {
+				t.Fatalf("%q returned twice", key)
+			}
+			seen[key] = true
+
+			i, _ := strconv.Atoi(key[len("key:"):])
+			if r.Opaque != uint32(i) {
+				t.Fatalf("%q has opaque %d, want %d", key, r.Opaque, i)
+			}
+			if r.Miss != (i%2 == 1) {
+				t.Fatalf("%q miss is %v", key, r.Miss)
+			}
+			if !r.Miss && (!bytes.Equal(r.Data, value(key, 1, 200)) || r.Flags != uint32(i)) {
+				t.Fatalf("%q has the wrong value or flags", key)
+			}
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != len(keys) {
+			t.Fatalf("%d responses for %d keys", len(seen), len(keys))
+		}
+	})
+}
+
+func TestAddReplace(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("k")
+
+		expectErr(t, "replace missing", h.Replace(common.SetRequest{Key: key, Data: []byte("a")}), common.ErrKeyNotFound)
+		expectMiss(t, h, "k")
+
+		expectErr(t, "add missing", h.Add(common.SetRequest{Key: key, Data: []byte("b")}), nil)
+		expectValue(t, h, "k", []byte("b"))
+
+		expectErr(t, "add existing", h.Add(common.SetRequest{Key: key, Data: []byte("c")}), common.ErrKeyExists)
+		expectValue(t, h, "k", []byte("b"))
+
+		expectErr(t, "replace existing", h.Replace(common.SetRequest{Key: key, Data: []byte("d"), Flags: 3}), nil)
+		if r := getE(t, h, "k"); string(r.Data) != "d" || r.Flags != 3 {
+			t.Fatalf("replaced item is %q with flags %d", r.Data, r.Flags)
+		}
+	})
+}
+
+func TestAppendPrepend(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("k")
+
+		expectErr(t, "append missing", h.Append(common.SetRequest{Key: key, Data: []byte("x")}), common.ErrKeyNotFound)
+		expectErr(t, "prepend missing", h.Prepend(common.SetRequest{Key: key, Data: []byte("x")}), common.ErrKeyNotFound)
+		expectMiss(t, h, "k")
+
+		exptime := now() + 3600
+		mustSet(t, h, "k", []byte("middle"), 9, exptime)
+		expectErr(t, "append", h.Append(common.SetRequest{Key: key, Data: []byte("-end"), Flags: 1}), nil)
+		expectErr(t, "prepend", h.Prepend(common.SetRequest{Key: key, Data: []byte("start-"), Flags: 1}), nil)
+
+		// The flags and exptime of the request are ignored
+		r := getE(t, h, "k")
+		if string(r.Data) != "start-middle-end" || r.Flags != 9 || r.Exptime != exptime {
+			t.Fatalf("item is %q with flags %d and exptime %d", r.Data, r.Flags, r.Exptime)
+		}
+
+		// Growing across chunk boundaries
+		big := value("big", 1, 1000)
+		mustSet(t, h, "big", big[:10], 0, 0)
+		for i := 10; i < len(big); i += 99 {
+			end := i + 99
+			if end > len(big) {
+				end = len(big)
+			}
+			if err := h.Append(common.SetRequest{Key: []byte("big"), Data: big[i:end]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expectValue(t, h, "big", big)
+	})
+}
+
+func TestDelete(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("k")
+
+		expectErr(t, "delete missing", h.Delete(common.DeleteRequest{Key: key}), common.ErrKeyNotFound)
+
+		mustSet(t, h, "k", value("k", 1, 5000), 0, now()+3600)
+		expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: key}), nil)
+		expectMiss(t, h, "k")
+		expectErr(t, "delete again", h.Delete(common.DeleteRequest{Key: key}), common.ErrKeyNotFound)
+
+		// Nothing of the item is left behind to be found again
+		mustSet(t, h, "k", []byte("new"), 0, 0)
+		expectValue(t, h, "k", []byte("new"))
+	})
+}
+
+func TestTouch(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("k")
+
+		expectErr(t, "touch missing", h.Touch(common.TouchRequest{Key: key, Exptime: 100}), common.ErrKeyNotFound)
+
+		data := value("k", 1, 3000)
+		mustSet(t, h, "k", data, 5, 0)
+
+		before := now()
+		expectErr(t, "touch", h.Touch(common.TouchRequest{Key: key, Exptime: 100}), nil)
+		r := getE(t, h, "k")
+		if r.Exptime < before+100 || r.Exptime > now()+100 {
+			t.Fatalf("exptime %d, want about %d", r.Exptime, before+100)
+		}
+		if !bytes.Equal(r.Data, data) || r.Flags != 5 {
+			t.Fatalf("touch changed the value or flags")
+		}
+
+		// Touching to 0 makes the item never expire
+		expectErr(t, "touch to 0", h.Touch(common.TouchRequest{Key: key}), nil)
+		if r := getE(t, h, "k"); r.Exptime != 0 {
+			t.Fatalf("exptime %d, want 0", r.Exptime)
+		}
+	})
+}
+
+func TestGAT(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("k")
+
+		r, err := h.GAT(common.GATRequest{Key: key, Exptime: 100, Opaque: 4})
+		if err != nil || !r.Miss || r.Opaque != 4 {
+			t.Fatalf("GAT of a missing key: %+v, %v", r, err)
+		}
+
+		data := value("k", 1, 3000)
+		mustSet(t, h, "k", data, 5, 0)
+
+		abs := now() + 7200
+		r, err = h.GAT(common.GATRequest{Key: key, Exptime: abs, Opaque: 4})
+		if err != nil || r.Miss || !bytes.Equal(r.Data, data) || r.Flags != 5 || r.Opaque != 4 {
+			t.Fatalf("GAT: %+v, %v", r, err)
+		}
+		if e := getE(t, h, "k"); e.Exptime != abs || !bytes.Equal(e.Data, data) {
+			t.Fatalf("exptime %d after GAT, want %d", e.Exptime, abs)
+		}
+	})
+}
+
+func TestIncrDecr(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("n")
+
+		if _, err := h.Incr(key, 1); err != common.ErrKeyNotFound {
+			t.Fatalf("incr missing: %v", err)
+		}
+
+		exptime := now() + 3600
+		mustSet(t, h, "n", []byte("10"), 2, exptime)
+
+		cases := []struct {
+			op    func([]byte, uint64) (uint64, error)
+			delta uint64
+			want  uint64
+		}{
+			{h.Incr, 5, 15},
+			{h.Decr, 3, 12},
+			// Decrements stop at 0
+			{h.Decr, 100, 0},
+			{h.Incr, 1<<64 - 1, 1<<64 - 1},
+			// Increments wrap around
+			{h.Incr, 2, 1},
+		}
+		for i, c := range cases {
+			got, err := c.op(key, c.delta)
+			if err != nil || got != c.want {
+				t.Fatalf("case %d: %d, %v, want %d", i, got, err, c.want)
+			}
+		}
+
+		r := getE(t, h, "n")
+		if string(r.Data) != "1" || r.Flags != 2 || r.Exptime != exptime {
+			t.Fatalf("counter is %q with flags %d and exptime %d", r.Data, r.Flags, r.Exptime)
+		}
+
+		// Trailing spaces, as left by memcached's in place decrements, are fine
+		mustSet(t, h, "n", []byte("100  "), 0, 0)
+		if got, err := h.Decr(key, 1); err != nil || got != 99 {
+			t.Fatalf("decr of a padded value: %d, %v", got, err)
+		}
+
+		mustSet(t, h, "n", []byte("ten"), 0, 0)
+		if _, err := h.Incr(key, 1); err != common.ErrBadIncDecValue {
+			t.Fatalf("incr of a non-number: %v", err)
+		}
+		expectValue(t, h, "n", []byte("ten"))
+	})
+}
+
+// gets returns the CAS token of key, or 0 on a miss.
+func gets(t *testing.T, h *Handler, key string) uint64 {
+	t.Helper()
+	data, errs := h.Gets(getRequest([]byte(key)))
+	r := <-data
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if r.Miss {
+		return 0
+	}
+	return r.Cas
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("k")
+
+		expectErr(t, "CAS missing", h.CompareAndSwap(common.SetRequest{Key: key, Data: []byte("a")}, 1), common.ErrKeyNotFound)
+		if cas := gets(t, h, "k"); cas != 0 {
+			t.Fatalf("missing key has CAS %d", cas)
+		}
+
+		mustSet(t, h, "k", []byte("a"), 0, 0)
+		first := gets(t, h, "k")
+		if first == 0 {
+			t.Fatal("no CAS token")
+		}
+
+		// Every write gives the item a new token
+		mustSet(t, h, "k", []byte("b"), 0, 0)
+		second := gets(t, h, "k")
+		if second == first {
+			t.Fatal("set kept the CAS token")
+		}
+
+		expectErr(t, "CAS stale", h.CompareAndSwap(common.SetRequest{Key: key, Data: []byte("c")}, first), common.ErrKeyExists)
+		expectValue(t, h, "k", []byte("b"))
+
+		expectErr(t, "CAS", h.CompareAndSwap(common.SetRequest{Key: key, Data: []byte("c"), Flags: 8}, second), nil)
+		if r := getE(t, h, "k"); string(r.Data) != "c" || r.Flags != 8 {
+			t.Fatalf("swapped item is %q with flags %d", r.Data, r.Flags)
+		}
+		if gets(t, h, "k") == second {
+			t.Fatal("CAS kept the CAS token")
+		}
+
+		// Touching keeps the token, appending doesn't
+		third := gets(t, h, "k")
+		if err := h.Touch(common.TouchRequest{Key: key, Exptime: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if gets(t, h, "k") != third {
+			t.Fatal("touch changed the CAS token")
+		}
+		if err := h.Append(common.SetRequest{Key: key, Data: []byte("d")}); err != nil {
+			t.Fatal(err)
+		}
+		if gets(t, h, "k") == third {
+			t.Fatal("append kept the CAS token")
+		}
+	})
+}
+
+func TestExptimes(t *testing.T) {
+	h := testHandler(t, Options{DisableReaper: true})
+	before := now()
+
+	cases := []struct {
+		name    string
+		exptime uint32
+		min     uint32
+		max     uint32
+	}{
+		{"never", 0, 0, 0},
+		{"relative", 100, before + 100, now() + 100},
+		{"longest relative", maxRelativeExptime, before + maxRelativeExptime, now() + maxRelativeExptime},
+		{"absolute", before + 2*maxRelativeExptime, before + 2*maxRelativeExptime, before + 2*maxRelativeExptime},
+	}
+	for _, c := range cases {
+		mustSet(t, h, c.name, []byte("v"), 0, c.exptime)
+		r := getE(t, h, c.name)
+		if r.Miss {
+			t.Fatalf("%s: miss", c.name)
+		}
+		if r.Exptime < c.min || r.Exptime > c.max {
+			t.Fatalf("%s: exptime %d, want %d to %d", c.name, r.Exptime, c.min, c.max)
+		}
+	}
+
+	// Just over 30 days is an absolute time in 1970, so long expired
+	mustSet(t, h, "shortest absolute", []byte("v"), 0, maxRelativeExptime+1)
+	expectMiss(t, h, "shortest absolute")
+}
+
+func TestDefaultAndMaxTTL(t *testing.T) {
+	h := testHandler(t, Options{Namespaces: []Namespace{
+		{Name: "ttl", Prefix: "ttl:", DefaultTTL: time.Hour, MaxTTL: 2 * time.Hour},
+	}})
+	before := now()
+
+	mustSet(t, h, "ttl:default", []byte("v"), 0, 0)
+	if r := getE(t, h, "ttl:default"); r.Exptime < before+3600 || r.Exptime > now()+3600 {
+		t.Fatalf("exptime %d, want the default TTL", r.Exptime)
+	}
+
+	mustSet(t, h, "ttl:capped", []byte("v"), 0, 3*3600)
+	if r := getE(t, h, "ttl:capped"); r.Exptime < before+7200 || r.Exptime > now()+7200 {
+		t.Fatalf("exptime %d, want the max TTL", r.Exptime)
+	}
+
+	// Keys outside the namespace are unaffected
+	mustSet(t, h, "other", []byte("v"), 0, 0)
+	if r := getE(t, h, "other"); r.Exptime != 0 {
+		t.Fatalf("exptime %d outside the namespace", r.Exptime)
+	}
+}
+
+// TestHashedKeys checks that an item stored under the hashed key of another
+// is treated as missing by every command that finds it.
+func TestHashedKeys(t *testing.T) {
+	h := testHandler(t, Options{HashLongKeys: true, MaxKeySize: 2000})
+	a, b := strings.Repeat("a", 1000), strings.Repeat("b", 1000)
+	mustSet(t, h, a, []byte("v"), 0, 0)
+	expectValue(t, h, a, []byte("v"))
+
+	// Have b's hashed key hold a's item, as a collision would
+	s := h.shard([]byte(a))
+	dka, _ := s.dbKey([]byte(a))
+	dkb, _ := s.dbKey([]byte(b))
+	err := s.update(func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(s.dbi, dka)
+		if err != nil {
+			return err
+		}
+		return txn.Put(s.dbi, dkb, buf, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMiss(t, h, b)
+	if r, err := h.GAT(common.GATRequest{Key: []byte(b), Exptime: 100}); err != nil || !r.Miss {
+		t.Fatalf("GAT: %+v, %v", r, err)
+	}
+	expectErr(t, "touch", h.Touch(common.TouchRequest{Key: []byte(b), Exptime: 100}), common.ErrKeyNotFound)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte(b)}), common.ErrKeyNotFound)
+	err = s.view(func(txn *lmdb.Txn) error {
+		_, err := txn.Get(s.dbi, dkb)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("delete removed the other item: %v", err)
+	}
+
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte(a)}), nil)
+	expectMiss(t, h, a)
+}
+
+func TestNamespaces(t *testing.T) {
+	h := testHandler(t, Options{Namespaces: []Namespace{
+		{Name: "a", Prefix: "a:"},
+		{Name: "ab", Prefix: "a:b:"},
+	}})
+
+	for _, key := range []string{"x", "a:x", "a:b:x"} {
+		mustSet(t, h, key, []byte(key), 0, 0)
+	}
+	if err := h.FlushNamespace("a", 0); err != nil {
+		t.Fatal(err)
+	}
+	// The longest matching prefix wins, so a:b:x is in ab
+	expectMiss(t, h, "a:x")
+	expectValue(t, h, "x", []byte("x"))
+	expectValue(t, h, "a:b:x", []byte("a:b:x"))
+
+	st, err := h.NamespaceStats("ab")
+	if err != nil || st.Items != 1 {
+		t.Fatalf("namespace ab has %d items, %v", st.Items, err)
+	}
+	if _, err := h.NamespaceStats("missing"); err != errNoNamespace {
+		t.Fatalf("stats of a missing namespace: %v", err)
+	}
+	if got := h.Namespaces(); len(got) != 3 {
+		t.Fatalf("namespaces %q", got)
+	}
+}
+
+// TestExpiredItems checks that an expired item, not yet reaped, acts as
+// missing for every command.
+func TestExpiredItems(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		key := []byte("k")
+		expire := func() {
+			t.Helper()
+			mustSet(t, h, "k", []byte("7"), 0, now()-10)
+		}
+
+		expire()
+		expectMiss(t, h, "k")
+		data, errs := h.Get(getRequest(key))
+		if r := <-data; !r.Miss || <-errs != nil {
+			t.Fatal("get of an expired item hit")
+		}
+		if gets(t, h, "k") != 0 {
+			t.Fatal("gets of an expired item hit")
+		}
+		if r, err := h.GAT(common.GATRequest{Key: key, Exptime: 100}); err != nil || !r.Miss {
+			t.Fatalf("GAT of an expired item: %+v, %v", r, err)
+		}
+
+		expire()
+		expectErr(t, "touch", h.Touch(common.TouchRequest{Key: key, Exptime: 100}), common.ErrKeyNotFound)
+		expectErr(t, "replace", h.Replace(common.SetRequest{Key: key, Data: []byte("x")}), common.ErrKeyNotFound)
+		expectErr(t, "append", h.Append(common.SetRequest{Key: key, Data: []byte("x")}), common.ErrKeyNotFound)
+		expectErr(t, "prepend", h.Prepend(common.SetRequest{Key: key, Data: []byte("x")}), common.ErrKeyNotFound)
+		expectErr(t, "CAS", h.CompareAndSwap(common.SetRequest{Key: key, Data: []byte("x")}, 1), common.ErrKeyNotFound)
+		if _, err := h.Incr(key, 1); err != common.ErrKeyNotFound {
+			t.Fatalf("incr: %v", err)
+		}
+		expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: key}), common.ErrKeyNotFound)
+
+		expire()
+		expectErr(t, "add", h.Add(common.SetRequest{Key: key, Data: []byte("x")}), nil)
+		expectValue(t, h, "k", []byte("x"))
+	})
+}
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1500000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func (c *fakeClock) unix() uint32 {
+	return uint32(c.Now().Unix())
+}
+
+func TestExpiresAfterTTL(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true})
+
+	mustSet(t, h, "relative", []byte("v"), 0, 100)
+	mustSet(t, h, "absolute", []byte("v"), 0, clock.unix()+50)
+	if r := getE(t, h, "relative"); r.Exptime != clock.unix()+100 {
+		t.Fatalf("exptime %d, want %d", r.Exptime, clock.unix()+100)
+	}
+
+	// An item lives through the second of its exptime
+	clock.advance(50 * time.Second)
+	expectValue(t, h, "absolute", []byte("v"))
+	clock.advance(time.Second)
+	expectMiss(t, h, "absolute")
+	expectValue(t, h, "relative", []byte("v"))
+
+	// Touching restarts the TTL from the clock's now
+	expectErr(t, "touch", h.Touch(common.TouchRequest{Key: []byte("relative"), Exptime: 100}), nil)
+	clock.advance(100 * time.Second)
+	expectValue(t, h, "relative", []byte("v"))
+	clock.advance(time.Second)
+	expectMiss(t, h, "relative")
+	expectErr(t, "add over expired", h.Add(common.SetRequest{Key: []byte("relative"), Data: []byte("w")}), nil)
+}
+
+func TestReapByClock(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true})
+
+	for i := 0; i < 30; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%d", i), []byte("v"), 0, uint32(10*(1+i%3)))
+	}
+
+	for _, c := range []struct {
+		advance time.Duration
+		reaped  int
+	}{
+		{5 * time.Second, 0},
+		{6 * time.Second, 10},
+		{10 * time.Second, 10},
+		{time.Hour, 10},
+		{time.Hour, 0},
+	} {
+		clock.advance(c.advance)
+		if n, err := h.Reap(); err != nil || n != c.reaped {
+			t.Fatalf("after %v more, reaped %d, %v, want %d", c.advance, n, err, c.reaped)
+		}
+	}
+}
+
+// TestReapStaleIndex checks index records left behind by an item are removed
+// but not counted as reaped.
+func TestReapStaleIndex(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true})
+	mustSet(t, h, "expires", []byte("v"), 0, 10)
+	mustSet(t, h, "kept", []byte("v"), 0, 0)
+
+	s := h.shards[0]
+	err := s.update(func(txn *lmdb.Txn) error {
+		for _, key := range []string{"kept", "gone"} {
+			if err := txn.Put(s.ttldbi, ttlKey(s.now()+5000, []byte(key)), nil, 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.advance(time.Minute)
+	if n, err := h.Reap(); err != nil || n != 1 {
+		t.Fatalf("reaped %d, %v, want 1", n, err)
+	}
+	st, err := h.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ReaperDeleted != 1 || st.ReaperStale != 2 {
+		t.Errorf("reaper deleted %d and removed %d stale records", st.ReaperDeleted, st.ReaperStale)
+	}
+	expectValue(t, h, "kept", []byte("v"))
+}
+
+func TestWarmUp(t *testing.T) {
+	h := testHandler(t, Options{NoReadahead: true})
+	if !h.Warm() {
+		t.Error("not warm without WarmUp")
+	}
+	for i := 0; i < 100; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%d", i), value("v", i, 10000), 0, 0)
+	}
+	path := h.shards[0].path
+	h.Close()
+
+	h = openHandler(t, Options{Path: path, WarmUp: true})
+	for deadline := time.Now().Add(10 * time.Second); !h.Warm(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("never warm")
+		}
+	}
+	expectValue(t, h, "key:99", value("v", 99, 10000))
+}
+
+func TestSlowOps(t *testing.T) {
+	var log bytes.Buffer
+	h := openHandler(t, Options{Path: tempDir(t), SlowOpThreshold: time.Nanosecond, Logger: NewLogger(&log, LevelWarn, false)})
+	mustSet(t, h, "key", []byte("value"), 0, 0)
+	expectValue(t, h, "key", []byte("value"))
+
+	st, err := h.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.SlowOps != 2 {
+		t.Errorf("slow ops: %d", st.SlowOps)
+	}
+	h.Close()
+
+	for _, want := range []string{"op=set", "op=gete", "key_bytes=3", "value_bytes=5", "txn_wait="} {
+		if !bytes.Contains(log.Bytes(), []byte(want)) {
+			t.Errorf("no %s in %s", want, log.String())
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true})
+	events, cancel := h.Subscribe(16)
+
+	mustSet(t, h, "a", []byte("v"), 0, 0)
+	mustSet(t, h, "b", []byte("v"), 0, 10)
+	expectErr(t, "add existing", h.Add(common.SetRequest{Key: []byte("a"), Data: []byte("v")}), common.ErrKeyExists)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("a")}), nil)
+	expectErr(t, "delete missing", h.Delete(common.DeleteRequest{Key: []byte("a")}), common.ErrKeyNotFound)
+	clock.advance(time.Minute)
+	if n, err := h.Reap(); err != nil || n != 1 {
+		t.Fatalf("reaped %d, %v", n, err)
+	}
+	if err := h.Flush(0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		typ EventType
+		key string
+	}{
+		{EventSet, "a"},
+		{EventSet, "b"},
+		{EventDelete, "a"},
+		{EventExpire, "b"},
+		{EventFlush, ""},
+	} {
+		select {
+		case e := <-events:
+			if e.Type != want.typ || string(e.Key) != want.key || e.Time.IsZero() {
+				t.Fatalf("got %v %q, want %v %q", e.Type, e.Key, want.typ, want.key)
+			}
+		default:
+			t.Fatalf("no %v event", want.typ)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected %v event", e.Type)
+	default:
+	}
+
+	// Events that don't fit are dropped, not waited for
+	for i := 0; i < 20; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%d", i), []byte("v"), 0, 0)
+	}
+	if st, err := h.Stats(); err != nil || st.EventsDropped != 4 {
+		t.Fatalf("%d events dropped, %v", st.EventsDropped, err)
+	}
+
+	cancel()
+	cancel()
+	n := 0
+	for range events {
+		n++
+	}
+	if n != 16 {
+		t.Fatalf("%d events buffered", n)
+	}
+}
+
+func TestOplog(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, OplogSize: 5, OplogValues: true})
+	if _, err := h.Oplog(0, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	mustSet(t, h, "a", []byte("one"), 7, 0)
+	mustSet(t, h, "b", []byte("two"), 0, 10)
+	expectErr(t, "touch", h.Touch(common.TouchRequest{Key: []byte("a"), Exptime: 100}), nil)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("a")}), nil)
+	clock.advance(time.Minute)
+	if n, err := h.Reap(); err != nil || n != 1 {
+		t.Fatalf("reaped %d, %v", n, err)
+	}
+
+	recs, err := h.Oplog(0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EventType{EventSet, EventSet, EventTouch, EventDelete, EventExpire}
+	if len(recs) != len(want) {
+		t.Fatalf("%d records", len(recs))
+	}
+	for i, r := range recs {
+		if r.Seq != uint64(i+1) || r.Op != want[i] {
+			t.Errorf("record %d is %d %v, want %v", i, r.Seq, r.Op, want[i])
+		}
+	}
+	if r := recs[0]; string(r.Key) != "a" || string(r.Value) != "one" || r.Flags != 7 || r.ValueHash == 0 {
+		t.Errorf("set record: %+v", r)
+	}
+	if r := recs[2]; r.Exptime == 0 || r.Value != nil {
+		t.Errorf("touch record: %+v", r)
+	}
+
+	// Only the last OplogSize are kept
+	mustSet(t, h, "c", []byte("three"), 0, 0)
+	if seq, err := h.OplogSeq(0); err != nil || seq != 6 {
+		t.Fatalf("last seq %d, %v", seq, err)
+	}
+	if _, err := h.Oplog(0, 1, 10); err != ErrOplogTrimmed {
+		t.Fatalf("got %v for a trimmed record", err)
+	}
+	recs, err = h.Oplog(0, 5, 10)
+	if err != nil || len(recs) != 2 || recs[1].Seq != 6 || string(recs[1].Key) != "c" {
+		t.Fatalf("tail: %+v, %v", recs, err)
+	}
+}
+
+// TestOplogCompact checks changes are still logged once compaction has
+// reopened the environment.
+func TestOplogCompact(t *testing.T) {
+	h := testHandler(t, Options{OplogSize: 10})
+	mustSet(t, h, "a", []byte("one"), 0, 0)
+	expectErr(t, "compact", h.Compact(), nil)
+	mustSet(t, h, "b", []byte("two"), 0, 0)
+
+	recs, err := h.Oplog(0, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 2 || string(recs[0].Key) != "a" || string(recs[1].Key) != "b" {
+		t.Fatalf("records: %+v", recs)
+	}
+}
+
+// fakePeer is enough of a memcached text protocol server to replicate to. It
+// fails the first set, so the replicator has to retry.
+type fakePeer struct {
+	net.Listener
+	lock  sync.Mutex
+	items map[string]string
+	fails int
+}
+
+func newFakePeer(t *testing.T) *fakePeer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePeer{Listener: ln, items: make(map[string]string), fails: 1}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakePeer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		reply := "ERROR"
+
+		p.lock.Lock()
+		switch f[0] {
+		case "set":
+			n, _ := strconv.Atoi(f[4])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				p.lock.Unlock()
+				return
+			}
+			if p.fails > 0 {
+				p.fails--
+				reply = "SERVER_ERROR busy"
+				break
+			}
+			p.items[f[1]] = string(data[:n])
+			reply = "STORED"
+		case "delete":
+			reply = "NOT_FOUND"
+			if _, ok := p.items[f[1]]; ok {
+				delete(p.items, f[1])
+				reply = "DELETED"
+			}
+		case "touch":
+			reply = "TOUCHED"
+		case "flush_all":
+			p.items = make(map[string]string)
+			reply = "OK"
+		}
+		p.lock.Unlock()
+
+		if _, err := conn.Write([]byte(reply + "\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+func (p *fakePeer) get(key string) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	v, ok := p.items[key]
+	return v, ok
+}
+
+func TestReplication(t *testing.T) {
+	peer := newFakePeer(t)
+	path := tempDir(t)
+	opts := Options{Path: path, OplogSize: 100, OplogValues: true, ReplicaAddr: peer.Addr().String()}
+	h := openHandler(t, opts)
+
+	mustSet(t, h, "a", []byte("one"), 0, 0)
+	mustSet(t, h, "b", []byte("two"), 0, 0)
+	mustSet(t, h, "has space", []byte("skipped"), 0, 0)
+	expectErr(t, "touch", h.Touch(common.TouchRequest{Key: []byte("b"), Exptime: 100}), nil)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("a")}), nil)
+
+	var st Stats
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if st, err = h.Stats(); err != nil {
+			t.Fatal(err)
+		}
+		if st.Replicated == 4 && st.ReplicaLag == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replicated %d, %d behind", st.Replicated, st.ReplicaLag)
+		}
+	}
+	if st.ReplicaErrors != 1 || st.ReplicaSkipped != 1 {
+		t.Errorf("%d errors, %d skipped", st.ReplicaErrors, st.ReplicaSkipped)
+	}
+	if v, ok := peer.get("b"); !ok || v != "two" {
+		t.Errorf("peer has %q for b", v)
+	}
+	if _, ok := peer.get("a"); ok {
+		t.Error("deleted key still on the peer")
+	}
+	h.Close()
+
+	// Progress is saved
+	h = openHandler(t, opts)
+	if acked := atomic.LoadUint64(&h.shards[0].replica.acked); acked != 5 {
+		t.Errorf("carried on from %d", acked)
+	}
+}
+
+// TestReplicationCompact checks records are still sent on, and progress
+// saved, once compaction has reopened the environment.
+func TestReplicationCompact(t *testing.T) {
+	peer := newFakePeer(t)
+	path := tempDir(t)
+	opts := Options{Path: path, OplogSize: 100, OplogValues: true, ReplicaAddr: peer.Addr().String()}
+	h := openHandler(t, opts)
+
+	replicated := func(n uint64) {
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			st, err := h.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Replicated == n && st.ReplicaLag == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("replicated %d, %d behind", st.Replicated, st.ReplicaLag)
+			}
+		}
+	}
+
+	mustSet(t, h, "a", []byte("one"), 0, 0)
+	replicated(1)
+	expectErr(t, "compact", h.Compact(), nil)
+	mustSet(t, h, "b", []byte("two"), 0, 0)
+	replicated(2)
+	if v, ok := peer.get("b"); !ok || v != "two" {
+		t.Errorf("peer has %q for b", v)
+	}
+	h.Close()
+
+	h = openHandler(t, opts)
+	if acked := atomic.LoadUint64(&h.shards[0].replica.acked); acked != 2 {
+		t.Errorf("carried on from %d", acked)
+	}
+}
+
+func TestDualWrite(t *testing.T) {
+	primary, secondary := testHandler(t, Options{}), testHandler(t, Options{})
+	var log bytes.Buffer
+	dh, err := NewDualWrite(
+		func() (handlers.Handler, error) { return primary, nil },
+		func() (handlers.Handler, error) { return secondary, nil },
+		NewLogger(&log, LevelWarn, false),
+	)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := dh.(*DualWrite)
+	req := func(key, data string) common.SetRequest {
+		return common.SetRequest{Key: []byte(key), Data: []byte(data)}
+	}
+
+	expectErr(t, "set", d.Set(req("a", "one")), nil)
+	expectValue(t, secondary, "a", []byte("one"))
+
+	// The secondary takes what the primary was left with
+	mustSet(t, secondary, "b", []byte("stale"), 0, 0)
+	expectErr(t, "add", d.Add(req("b", "two")), nil)
+	expectValue(t, secondary, "b", []byte("two"))
+	expectErr(t, "add existing", d.Add(req("a", "x")), common.ErrKeyExists)
+	expectValue(t, secondary, "a", []byte("one"))
+
+	// An append the secondary can't apply leaves it without the key
+	mustSet(t, primary, "c", []byte("three"), 0, 0)
+	expectErr(t, "append", d.Append(req("c", "!")), nil)
+	expectValue(t, primary, "c", []byte("three!"))
+	expectMiss(t, secondary, "c")
+	expectErr(t, "append", d.Append(req("a", "!")), nil)
+	expectValue(t, secondary, "a", []byte("one!"))
+
+	// Reads are from the primary only
+	mustSet(t, secondary, "d", []byte("secondary only"), 0, 0)
+	data, errs := d.GetE(getRequest([]byte("d")))
+	for r := range data {
+		if !r.Miss {
+			t.Errorf("read %q from the secondary", r.Data)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	expectErr(t, "delete", d.Delete(common.DeleteRequest{Key: []byte("d")}), common.ErrKeyNotFound)
+	expectMiss(t, secondary, "d")
+	expectErr(t, "delete", d.Delete(common.DeleteRequest{Key: []byte("a")}), nil)
+	expectMiss(t, secondary, "a")
+
+	if log.Len() != 0 {
+		t.Errorf("logged %s", log.String())
+	}
+}
+
+func TestReadThrough(t *testing.T) {
+	local, origin := testHandler(t, Options{}), testHandler(t, Options{})
+	rh, err := NewReadThrough(
+		func() (handlers.Handler, error) { return local, nil },
+		func() (handlers.Handler, error) { return origin, nil },
+		ReadThroughOptions{TTL: time.Hour},
+	)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rh.(*ReadThrough)
+
+	mustSet(t, origin, "a", []byte("one"), 5, 0)
+	mustSet(t, origin, "b", []byte("two"), 0, 60)
+	mustSet(t, local, "c", []byte("local"), 0, 0)
+	data, errs := r.GetE(getRequest([]byte("a"), []byte("b"), []byte("c"), []byte("d")))
+	got := make(map[string]string)
+	for d := range data {
+		if !d.Miss {
+			got[string(d.Key)] = string(d.Data)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got["a"] != "one" || got["b"] != "two" || got["c"] != "local" {
+		t.Fatalf("got %v", got)
+	}
+
+	// Fetched items are kept, for no longer than the TTL or the origin has
+	if e := getE(t, local, "a"); e.Miss || string(e.Data) != "one" || e.Flags != 5 || e.Exptime > now()+3600 || e.Exptime < now()+3590 {
+		t.Errorf("local a: %+v", e)
+	}
+	if e := getE(t, local, "b"); e.Miss || e.Exptime > now()+60 {
+		t.Errorf("local b: %+v", e)
+	}
+
+	expectErr(t, "set", r.Set(common.SetRequest{Key: []byte("a"), Data: []byte("new")}), nil)
+	expectValue(t, origin, "a", []byte("new"))
+	expectValue(t, local, "a", []byte("new"))
+	expectErr(t, "append", r.Append(common.SetRequest{Key: []byte("a"), Data: []byte("!")}), nil)
+	expectValue(t, origin, "a", []byte("new!"))
+	expectMiss(t, local, "a")
+	expectErr(t, "delete", r.Delete(common.DeleteRequest{Key: []byte("b")}), nil)
+	expectMiss(t, origin, "b")
+	expectMiss(t, local, "b")
+}
+
+func TestPurgeOnOpen(t *testing.T) {
+	clock := newFakeClock()
+	opts := Options{Path: tempDir(t), Clock: clock, DisableReaper: true}
+	h := openHandler(t, opts)
+	for i := 0; i < 30; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%d", i), []byte("v"), 0, uint32(10*(i%3)))
+	}
+	h.Close()
+
+	// The limits of a reaper run don't apply
+	clock.advance(15 * time.Second)
+	opts.PurgeOnOpen = true
+	opts.ReaperMaxDeletes = 1
+	h = openHandler(t, opts)
+
+	st, err := h.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Items != 20 {
+		t.Fatalf("%d items left, want 20", st.Items)
+	}
+	expectValue(t, h, "key:0", []byte("v"))
+	expectValue(t, h, "key:2", []byte("v"))
+}
+
+func TestReap(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		h.PauseReaper(0)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key:%d", i)
+			exptime := now() + 3600
+			if i%4 == 0 {
+				exptime = now() - 10
+			}
+			mustSet(t, h, key, value(key, 1, 300), 0, exptime)
+		}
+
+		// Reaping ignores the pause
+		n, err := h.Reap()
+		if err != nil || n != 25 {
+			t.Fatalf("reaped %d, %v, want 25", n, err)
+		}
+		st, err := h.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Items != 75 {
+			t.Fatalf("%d items left, want 75", st.Items)
+		}
+		if n, err := h.Reap(); err != nil || n != 0 {
+			t.Fatalf("second reap deleted %d, %v", n, err)
+		}
+		expectValue(t, h, "key:1", value("key:1", 1, 300))
+	})
+}
+
+func TestFlush(t *testing.T) {
+	forEachConfig(t, func(t *testing.T, h *Handler) {
+		for i := 0; i < 20; i++ {
+			mustSet(t, h, fmt.Sprintf("key:%d", i), value("v", i, 500), 0, 0)
+		}
+		if err := h.Flush(0); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			expectMiss(t, h, fmt.Sprintf("key:%d", i))
+		}
+		if st, err := h.Stats(); err != nil || st.Items != 0 {
+			t.Fatalf("%d items after a flush, %v", st.Items, err)
+		}
+
+		// Items stored before a delayed flush runs are flushed too
+		if err := h.Flush(200 * time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		mustSet(t, h, "k", []byte("v"), 0, 0)
+		expectValue(t, h, "k", []byte("v"))
+		time.Sleep(400 * time.Millisecond)
+		expectMiss(t, h, "k")
+	})
+}
+
+func TestReopen(t *testing.T) {
+	for _, c := range configs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opts := c.opts
+			opts.Path = tempDir(t)
+
+			h := openHandler(t, opts)
+			mustSet(t, h, "k", value("k", 1, 2000), 3, 0)
+			if err := h.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			h = openHandler(t, opts)
+			expectValue(t, h, "k", value("k", 1, 2000))
+			if r := getE(t, h, "k"); r.Flags != 3 {
+				t.Fatalf("flags %d after reopening", r.Flags)
+			}
+
+			// CAS tokens keep going up across restarts
+			cas := gets(t, h, "k")
+			mustSet(t, h, "k", []byte("v"), 0, 0)
+			if gets(t, h, "k") <= cas {
+				t.Fatal("CAS token went backwards after reopening")
+			}
+		})
+	}
+}
+
+func TestSharedEnvironment(t *testing.T) {
+	opts := Options{Path: tempDir(t)}
+	a := openHandler(t, opts)
+	b := openHandler(t, opts)
+
+	mustSet(t, a, "k", []byte("v"), 0, 0)
+	expectValue(t, b, "k", []byte("v"))
+
+	// The environment stays open while any handler uses it
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectValue(t, b, "k", []byte("v"))
+}
+
+// stale gets key with Gets and returns whether it was found stale.
+func stale(t *testing.T, h *Handler, key string) bool {
+	t.Helper()
+	data, errs := h.Gets(getRequest([]byte(key)))
+	r := <-data
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if r.Miss {
+		t.Fatalf("%s missed", key)
+	}
+	return r.Stale
+}
+
+func TestSoftTTL(t *testing.T) {
+	for _, c := range configs {
+		t.Run(c.name, func(t *testing.T) {
+			clock := newFakeClock()
+			opts := c.opts
+			opts.Clock, opts.DisableReaper = clock, true
+			opts.Namespaces = append(opts.Namespaces, Namespace{Name: "soft", Prefix: "soft:", SoftTTL: 10 * time.Second})
+			h := testHandler(t, opts)
+
+			if err := h.SetSoft(common.SetRequest{Key: []byte("k"), Data: value("k", 1, 100), Exptime: 60}, 10*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.SetSoft(common.SetRequest{Key: []byte("short"), Data: []byte("v"), Exptime: 5}, 10*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			mustSet(t, h, "soft:k", []byte("v"), 0, 0)
+			mustSet(t, h, "plain", []byte("v"), 0, 60)
+			if stale(t, h, "k") || stale(t, h, "soft:k") {
+				t.Fatal("stale right after set")
+			}
+
+			// Appending and touching keep the soft exptime
+			expectErr(t, "append", h.Append(common.SetRequest{Key: []byte("soft:k"), Data: []byte("w")}), nil)
+			expectErr(t, "touch", h.Touch(common.TouchRequest{Key: []byte("k"), Exptime: 100}), nil)
+
+			clock.advance(11 * time.Second)
+			expectValue(t, h, "k", value("k", 1, 100))
+			expectValue(t, h, "soft:k", []byte("vw"))
+			if !stale(t, h, "k") || !stale(t, h, "soft:k") || stale(t, h, "plain") {
+				t.Fatal("soft exptimes not applied")
+			}
+			// Its soft exptime was past its exptime
+			expectMiss(t, h, "short")
+
+			// Refreshing with the CAS token from the stale read freshens it
+			cas := gets(t, h, "k")
+			if err := h.CompareAndSwap(common.SetRequest{Key: []byte("k"), Data: value("k", 2, 100), Exptime: 60}, cas); err != nil {
+				t.Fatal(err)
+			}
+			if stale(t, h, "k") {
+				t.Fatal("stale after refresh")
+			}
+
+			if st, err := h.Stats(); err != nil || st.StaleHits == 0 {
+				t.Fatalf("stale hits %d, %v", st.StaleHits, err)
+			}
+		})
+	}
+}
+
+func TestEarlyExpiration(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, EarlyExpiration: 10 * time.Second})
+
+	const n = 1000
+	for i := 0; i < n; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%d", i), []byte("v"), 0, 300)
+	}
+	mustSet(t, h, "forever", []byte("v"), 0, 0)
+
+	misses := func() int {
+		missed := 0
+		for i := 0; i < n; i++ {
+			if getE(t, h, fmt.Sprintf("key:%d", i)).Miss {
+				missed++
+			}
+		}
+		return missed
+	}
+
+	// Far from the exptime next to none miss
+	if m := misses(); m > 1 {
+		t.Fatalf("%d of %d missed with 300s left", m, n)
+	}
+
+	// About half with ln(2) times the window left
+	clock.advance(300*time.Second - 6931*time.Millisecond)
+	if m := misses(); m < n*35/100 || m > n*65/100 {
+		t.Fatalf("%d of %d missed with 6.9s left", m, n)
+	}
+	expectValue(t, h, "forever", []byte("v"))
+
+	// And all of them at the end
+	clock.advance(6931 * time.Millisecond)
+	if m := misses(); m != n {
+		t.Fatalf("%d of %d missed at the exptime", m, n)
+	}
+
+	if st, err := h.Stats(); err != nil || st.EarlyMisses == 0 {
+		t.Fatalf("early misses %d, %v", st.EarlyMisses, err)
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, TTLJitter: 0.1})
+
+	low, high := uint32(1<<32-1), uint32(0)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		mustSet(t, h, key, []byte("v"), 0, 1000)
+		ttl := getE(t, h, key).Exptime - clock.unix()
+		if ttl < 900 || ttl > 1100 {
+			t.Fatalf("TTL %d, want 1000 give or take 100", ttl)
+		}
+		if ttl < low {
+			low = ttl
+		}
+		if ttl > high {
+			high = ttl
+		}
+	}
+	if low > 950 || high < 1050 {
+		t.Fatalf("TTLs only ranged from %d to %d", low, high)
+	}
+
+	// Nothing is made to expire
+	mustSet(t, h, "forever", []byte("v"), 0, 0)
+	if r := getE(t, h, "forever"); r.Exptime != 0 {
+		t.Fatalf("exptime %d, want none", r.Exptime)
+	}
+}
+
+func getL(t *testing.T, h *Handler, key string) LeaseResponse {
+	t.Helper()
+	r, err := h.GetL([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestLeases(t *testing.T) {
+	for _, c := range configs {
+		t.Run(c.name, func(t *testing.T) {
+			clock := newFakeClock()
+			opts := c.opts
+			opts.Clock, opts.DisableReaper = clock, true
+			h := testHandler(t, opts)
+			set := func(key string) common.SetRequest {
+				return common.SetRequest{Key: []byte(key), Data: value(key, 1, 100), Exptime: 60}
+			}
+
+			// Only the first miss gets the lease
+			first := getL(t, h, "k")
+			if !first.Miss || first.Lease == 0 {
+				t.Fatalf("first GetL: %+v", first)
+			}
+			if r := getL(t, h, "k"); !r.Miss || r.Lease != 0 {
+				t.Fatalf("second GetL: %+v", r)
+			}
+			expectErr(t, "setl with another lease", h.SetL(set("k"), first.Lease+1), common.ErrKeyExists)
+			expectErr(t, "setl", h.SetL(set("k"), first.Lease), nil)
+			expectErr(t, "setl with a used lease", h.SetL(set("k"), first.Lease), common.ErrKeyExists)
+			if r := getL(t, h, "k"); r.Miss || r.Lease != 0 || !bytes.Equal(r.Data, value("k", 1, 100)) {
+				t.Fatalf("GetL after SetL: %+v", r)
+			}
+
+			// Deleting takes the lease back, even of a missing key
+			r := getL(t, h, "deleted")
+			expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("deleted")}), common.ErrKeyNotFound)
+			expectErr(t, "setl after delete", h.SetL(set("deleted"), r.Lease), common.ErrKeyExists)
+
+			// An expired lease is handed out again
+			old := getL(t, h, "expiring")
+			clock.advance(defaultLeaseTTL + time.Millisecond)
+			renewed := getL(t, h, "expiring")
+			if renewed.Lease == 0 || renewed.Lease == old.Lease {
+				t.Fatalf("GetL after the lease expired: %+v", renewed)
+			}
+			expectErr(t, "setl with an expired lease", h.SetL(set("expiring"), old.Lease), common.ErrKeyExists)
+			expectErr(t, "setl", h.SetL(set("expiring"), renewed.Lease), nil)
+
+			// Stale items are served along with the lease
+			if err := h.SetSoft(set("stale"), time.Second); err != nil {
+				t.Fatal(err)
+			}
+			clock.advance(2 * time.Second)
+			if r := getL(t, h, "stale"); r.Miss || !r.Stale || r.Lease == 0 {
+				t.Fatalf("GetL of a stale item: %+v", r)
+			}
+			if r := getL(t, h, "stale"); r.Miss || r.Lease != 0 {
+				t.Fatalf("second GetL of a stale item: %+v", r)
+			}
+
+			// The reaper clears out leases that were never used
+			getL(t, h, "abandoned")
+			clock.advance(defaultLeaseTTL + time.Millisecond)
+			if _, err := h.Reap(); err != nil {
+				t.Fatal(err)
+			}
+			s := h.shard([]byte("abandoned"))
+			err := s.view(func(txn *lmdb.Txn) error {
+				stat, err := txn.Stat(s.leasedbi)
+				if err == nil && stat.Entries != 0 {
+					t.Errorf("%d leases left", stat.Entries)
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, NegativeCacheTTL: time.Second})
+	negHits := func() uint64 {
+		st, err := h.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.NegHits
+	}
+
+	expectMiss(t, h, "k")
+	expectMiss(t, h, "k")
+	if n := negHits(); n != 1 {
+		t.Fatalf("%d negative hits, want 1", n)
+	}
+
+	// Writes take the tombstone away
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectValue(t, h, "k", []byte("v"))
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("k")}), nil)
+	expectMiss(t, h, "k")
+	expectErr(t, "add", h.Add(common.SetRequest{Key: []byte("k"), Data: []byte("w")}), nil)
+	expectValue(t, h, "k", []byte("w"))
+
+	// And tombstones expire
+	expectMiss(t, h, "other")
+	clock.advance(2 * time.Second)
+	expectMiss(t, h, "other")
+	if n := negHits(); n != 1 {
+		t.Fatalf("%d negative hits, want 1", n)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	h := testHandler(t, Options{BloomFilterItems: 10})
+	bloomMisses := func() uint64 {
+		st, err := h.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.BloomMisses
+	}
+
+	expectMiss(t, h, "k")
+	if n := bloomMisses(); n != 1 {
+		t.Fatalf("%d bloom misses, want 1", n)
+	}
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectValue(t, h, "k", []byte("v"))
+
+	// Filling the filter past half its bits rebuilds it bigger, from the
+	// keys stored by then
+	b := h.shards[0].bloom
+	first, _ := b.filters()
+	for i := 0; i < 100; i++ {
+		mustSet(t, h, fmt.Sprint("key", i), []byte("v"), 0, 0)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if current, _ := b.filters(); len(current.bits) > len(first.bits) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bloom filter not rebuilt")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		expectValue(t, h, fmt.Sprint("key", i), []byte("v"))
+	}
+	expectValue(t, h, "k", []byte("v"))
+}
+
+func TestReadCache(t *testing.T) {
+	h := testHandler(t, Options{ReadCacheBytes: 64 << 10})
+	cacheStats := func() (uint64, uint64) {
+		st, err := h.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.CacheHits, st.CacheMisses
+	}
+
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectValue(t, h, "k", []byte("v"))
+	expectValue(t, h, "k", []byte("v"))
+	if hits, misses := cacheStats(); hits != 1 || misses != 1 {
+		t.Fatalf("%d hits and %d misses, want 1 each", hits, misses)
+	}
+
+	// Every write drops the cached entry
+	expectErr(t, "append", h.Append(common.SetRequest{Key: []byte("k"), Data: []byte("w")}), nil)
+	expectValue(t, h, "k", []byte("vw"))
+	expectErr(t, "touch", h.Touch(common.TouchRequest{Key: []byte("k"), Exptime: 100}), nil)
+	if r := getE(t, h, "k"); r.Exptime == 0 {
+		t.Fatal("cached exptime not dropped by touch")
+	}
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("k")}), nil)
+	expectMiss(t, h, "k")
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectValue(t, h, "k", []byte("v"))
+	expectErr(t, "flush", h.Flush(0), nil)
+	expectMiss(t, h, "k")
+
+	// Items past the size of a stripe aren't cached, and lesser ones push
+	// out the least recently read
+	mustSet(t, h, "big", make([]byte, 8<<10), 0, 0)
+	for i := 0; i < 2; i++ {
+		expectValue(t, h, "big", make([]byte, 8<<10))
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key", i)
+		mustSet(t, h, key, value(key, 1, 1000), 0, 0)
+		expectValue(t, h, key, value(key, 1, 1000))
+	}
+	size := 0
+	for i := range h.shards[0].recent.stripes {
+		st := &h.shards[0].recent.stripes[i]
+		if st.size > h.shards[0].recent.max {
+			t.Fatalf("stripe %d holds %d bytes, over %d", i, st.size, h.shards[0].recent.max)
+		}
+		size += st.size
+	}
+	if size > 64<<10 || size == 0 {
+		t.Fatalf("read cache holds %d bytes", size)
+	}
+
+	// Compaction starts the transaction IDs over, which mustn't stop items
+	// being cached
+	expectErr(t, "compact", h.Compact(), nil)
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectValue(t, h, "k", []byte("v"))
+	hits, _ := cacheStats()
+	expectValue(t, h, "k", []byte("v"))
+	if n, _ := cacheStats(); n != hits+1 {
+		t.Fatal("nothing cached after compacting")
+	}
+}
+
+func TestNoSubdir(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "rendb")
+	opts := Options{Path: path, NoSubdir: true, Shards: 2, WarmUp: true}
+	h := openHandler(t, opts)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("key", i)
+		mustSet(t, h, key, value(key, 1, 1000), 0, 0)
+	}
+	expectErr(t, "compact", h.Compact(), nil)
+	expectErr(t, "backup", h.Backup(filepath.Join(dir, "backup"), false), nil)
+	h.Close()
+
+	for _, name := range []string{"rendb-shard-00", "rendb-shard-01-lock", "backup/shard-01/data.mdb"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Restored into a fresh file from the backup
+	opts.Path = filepath.Join(dir, "restored")
+	opts.RestoreFrom = filepath.Join(dir, "backup")
+	h = openHandler(t, opts)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("key", i)
+		expectValue(t, h, key, value(key, 1, 1000))
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	dir := tempDir(t)
+	expectMode := func(name string, want os.FileMode) {
+		t.Helper()
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm() != want {
+			t.Errorf("%s has mode %o, want %o", name, fi.Mode().Perm(), want)
+		}
+	}
+
+	// The umask can only take bits away
+	h := openHandler(t, Options{Path: filepath.Join(dir, "masked"), FileMode: 0600, DirMode: 0700})
+	expectErr(t, "backup", h.Backup(filepath.Join(dir, "masked-backup"), false), nil)
+	for _, name := range []string{"masked/data.mdb", "masked-backup/data.mdb", "masked", "masked-backup"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		} else if fi.Mode().Perm()&0077 != 0 {
+			t.Errorf("%s has mode %o", name, fi.Mode().Perm())
+		}
+	}
+	h.Close()
+
+	if err := os.Mkdir(filepath.Join(dir, "exact"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Path: filepath.Join(dir, "exact"), FileMode: 0640, DirMode: 0750, ExactModes: true}
+	h = openHandler(t, opts)
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectErr(t, "compact", h.Compact(), nil)
+	expectErr(t, "backup", h.Backup(filepath.Join(dir, "backup"), false), nil)
+	expectMode("exact", 0750)
+	expectMode("exact/data.mdb", 0640)
+	expectMode("exact/lock.mdb", 0640)
+	expectMode("backup", 0750)
+	expectMode("backup/data.mdb", 0640)
+}
+
+func TestCoalescedGets(t *testing.T) {
+	h := testHandler(t, Options{CoalesceGets: true})
+	s := h.shards[0]
+	dk, _ := s.dbKey([]byte("k"))
+	var readID uintptr
+	if err := s.view(func(txn *lmdb.Txn) error {
+		readID = txn.ID()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A get joins a read in progress and takes what it found
+	f, lead := s.flights.join(dk)
+	if !lead {
+		t.Fatal("first get did not lead")
+	}
+	s.flights.begin(dk, f, readID)
+	got := make(chan []byte)
+	go func() {
+		data, errs := h.Get(getRequest([]byte("k")))
+		for r := range data {
+			got <- r.Data
+		}
+		<-errs
+	}()
+	st := s.flights.stripe(dk)
+	for {
+		st.Lock()
+		n := f.waiters
+		st.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f.e = &entry{data: []byte("shared")}
+	s.flights.land(dk, f)
+	close(f.done)
+	if data := <-got; string(data) != "shared" {
+		t.Fatalf("joined get got %q", data)
+	}
+	if st, err := h.Stats(); err != nil || st.Coalesced != 1 {
+		t.Fatalf("%d coalesced gets, %v", st.Coalesced, err)
+	}
+
+	// But not one that started before a write
+	f, _ = s.flights.join(dk)
+	s.flights.begin(dk, f, readID)
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectValue(t, h, "k", []byte("v"))
+	s.flights.land(dk, f)
+	close(f.done)
+}
+
+func TestWriteBehind(t *testing.T) {
+	opts := Options{Path: tempDir(t), WriteBehind: 3, WriteBehindDelay: time.Hour}
+	h := openHandler(t, opts)
+	s := h.shards[0]
+	committed := func(key string) bool {
+		dk, _ := s.dbKey([]byte(key))
+		err := s.view(func(txn *lmdb.Txn) error {
+			_, err := txn.Get(s.dbi, dk)
+			return err
+		})
+		if err != nil && !lmdb.IsNotFound(err) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// Staged sets are served before they're committed
+	mustSet(t, h, "a", []byte("1"), 5, 0)
+	mustSet(t, h, "a", []byte("2"), 5, 0)
+	if committed("a") {
+		t.Fatal("set committed straight away")
+	}
+	expectValue(t, h, "a", []byte("2"))
+	if r := getE(t, h, "a"); r.Flags != 5 {
+		t.Fatalf("staged flags %d", r.Flags)
+	}
+	data, errs := h.GetE(getRequest([]byte("x"), []byte("a"), []byte("y")))
+	for r := range data {
+		if string(r.Key) == "a" && string(r.Data) != "2" {
+			t.Fatalf("multiget got %q", r.Data)
+		}
+	}
+	expectErr(t, "multiget", <-errs, nil)
+
+	// Other mutations commit them first
+	expectErr(t, "append", h.Append(common.SetRequest{Key: []byte("a"), Data: []byte("3")}), nil)
+	if !committed("a") {
+		t.Fatal("append didn't commit the staged set")
+	}
+	expectValue(t, h, "a", []byte("23"))
+
+	// Filling the buffer commits it without waiting for the delay
+	for _, key := range []string{"b", "c", "d"} {
+		mustSet(t, h, key, []byte("v"), 0, 0)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !committed("d") {
+		if time.Now().After(deadline) {
+			t.Fatal("full buffer not committed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// And closing commits what's left
+	mustSet(t, h, "e", []byte("v"), 0, 0)
+	mustSet(t, h, "f", []byte("v"), 0, 0)
+	expectErr(t, "flush", h.Flush(0), nil)
+	expectMiss(t, h, "e")
+	mustSet(t, h, "g", []byte("v"), 0, 0)
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h = openHandler(t, opts)
+	expectValue(t, h, "g", []byte("v"))
+	expectMiss(t, h, "f")
+}
+
+// TestWriteBehindQuota checks a set that would go over a quota is refused
+// before it is staged, counting the sets staged before it.
+func TestWriteBehindQuota(t *testing.T) {
+	h := testHandler(t, Options{WriteBehind: 100, WriteBehindDelay: time.Hour,
+		Namespaces: []Namespace{{Name: "q", Prefix: "q:", MaxItems: 2}}})
+
+	mustSet(t, h, "q:a", []byte("v"), 0, 0)
+	mustSet(t, h, "q:b", []byte("v"), 0, 0)
+	err := h.Set(common.SetRequest{Key: []byte("q:c"), Data: []byte("v")})
+	expectErr(t, "set over the quota", err, common.ErrNoMem)
+	expectMiss(t, h, "q:c")
+	expectValue(t, h, "q:b", []byte("v"))
+	if st, err := h.NamespaceStats("q"); err != nil || st.StagedErrs != 0 {
+		t.Fatalf("%d staged sets failed, %v", st.StagedErrs, err)
+	}
+}
+
+// TestWriteBehindFull checks staged sets that don't fit in the map stay staged
+// until there is room, and that sets are refused rather than acknowledged
+// meanwhile.
+func TestWriteBehindFull(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{MapSize: 1 << 20, WriteBehind: 50, WriteBehindDelay: 10 * time.Millisecond,
+		Clock: clock, DisableReaper: true})
+	s := h.shards[0]
+	committed := func(key string) bool {
+		dk, _ := s.dbKey([]byte(key))
+		err := s.view(func(txn *lmdb.Txn) error {
+			_, err := txn.Get(s.dbi, dk)
+			return err
+		})
+		return err == nil
+	}
+
+	// The first items expire soon, so reaping them makes room
+	var err error
+	stored := 0
+	for ; stored < 1000; stored++ {
+		exptime := uint32(3600)
+		if stored < 150 {
+			exptime = 60
+		}
+		key := fmt.Sprintf("key:%03d", stored)
+		if err = h.Set(common.SetRequest{Key: []byte(key), Data: value("v", stored, 4000), Exptime: exptime}); err != nil {
+			break
+		}
+	}
+	expectErr(t, "set into a full map", err, common.ErrNoMem)
+	last := fmt.Sprintf("key:%03d", stored-1)
+	if committed(last) {
+		t.Fatalf("%s committed into a full map", last)
+	}
+	for i := 150; i < stored; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		expectValue(t, h, key, value("v", i, 4000))
+	}
+
+	clock.advance(time.Minute + time.Second)
+	if _, err := h.Reap(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); !committed(last); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never committed", last)
+		}
+	}
+	for i := 150; i < stored; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		expectValue(t, h, key, value("v", i, 4000))
+	}
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	if st, err := h.Stats(); err != nil || st.StagedErrs != 0 {
+		t.Fatalf("%d staged sets failed, %v", st.StagedErrs, err)
+	}
+}
+
+// TestWriteBehindFullFlush checks a flush goes ahead of staged sets that don't
+// fit, and drops them.
+func TestWriteBehindFullFlush(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 1 << 20, WriteBehind: 50, WriteBehindDelay: time.Hour})
+
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		err = h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("key:%03d", i)), Data: value("v", i, 4000)})
+	}
+	expectErr(t, "set into a full map", err, common.ErrNoMem)
+	expectErr(t, "delete with sets kept staged", h.Delete(common.DeleteRequest{Key: []byte("key:000")}), common.ErrNoMem)
+
+	expectErr(t, "flush", h.Flush(0), nil)
+	expectMiss(t, h, "key:000")
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	expectValue(t, h, "k", []byte("v"))
+}
+
+func TestSyncOps(t *testing.T) {
+	if ops, err := ParseSyncOps("delete, cas,"); err != nil || len(ops) != 2 || ops[1] != "cas" {
+		t.Fatalf("parsed %q, %v", ops, err)
+	}
+	if _, err := ParseSyncOps("delete,sets"); err == nil {
+		t.Fatal("parsed an unknown op")
+	}
+
+	// Handlers in tests run with NoSync
+	h := testHandler(t, Options{SyncOps: []string{"delete", "set"}, WriteBehind: 16, WriteBehindDelay: time.Hour})
+	syncs := func() uint64 {
+		st, err := h.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Syncs
+	}
+
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+	if n := syncs(); n != 1 {
+		t.Fatalf("%d syncs after a synced set, want 1", n)
+	}
+	if _, staged := h.shards[0].stagedEntry([]byte("k")); staged {
+		t.Fatal("synced set was staged")
+	}
+	expectErr(t, "add", h.Add(common.SetRequest{Key: []byte("a"), Data: []byte("v")}), nil)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("k")}), nil)
+	if n := syncs(); n != 2 {
+		t.Fatalf("%d syncs after an add and a delete, want 2", n)
+	}
+
+	// And SyncInterval syncs in the background
+	h = testHandler(t, Options{SyncInterval: time.Millisecond})
+	deadline := time.Now().Add(5 * time.Second)
+	for syncs() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no background sync")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTags(t *testing.T) {
+	h := testHandler(t, Options{TagIndex: true, Namespaces: []Namespace{{Name: "a", Prefix: "a:"}}})
+	set := func(key string, tags ...string) {
+		var tb [][]byte
+		for _, tag := range tags {
+			tb = append(tb, []byte(tag))
+		}
+		if err := h.SetTagged(common.SetRequest{Key: []byte(key), Data: []byte(key)}, tb...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set("x", "red", "blue")
+	set("y", "red")
+	set("a:z", "red")
+	set("rewritten", "red")
+	set("deleted", "red")
+	set("blue", "blue")
+	mustSet(t, h, "rewritten", []byte("v"), 0, 0)
+	expectErr(t, "delete", h.Delete(common.DeleteRequest{Key: []byte("deleted")}), nil)
+	set("deleted")
+	expectErr(t, "empty tag", h.SetTagged(common.SetRequest{Key: []byte("k"), Data: []byte("v")}, nil), errBadTag)
+
+	if n, err := h.InvalidateTag([]byte("red")); err != nil || n != 3 {
+		t.Fatalf("invalidated %d, %v", n, err)
+	}
+	for _, key := range []string{"x", "y", "a:z"} {
+		expectMiss(t, h, key)
+	}
+	expectValue(t, h, "rewritten", []byte("v"))
+	expectValue(t, h, "deleted", []byte("deleted"))
+	expectValue(t, h, "blue", []byte("blue"))
+	// x took its blue tag with it
+	if n, err := h.InvalidateTag([]byte("blue")); err != nil || n != 1 {
+		t.Fatalf("invalidated %d, %v", n, err)
+	}
+	if n, err := h.InvalidateTag([]byte("red")); err != nil || n != 0 {
+		t.Fatalf("invalidated %d again, %v", n, err)
+	}
+
+	plain := testHandler(t, Options{})
+	expectErr(t, "untagged", plain.SetTagged(common.SetRequest{Key: []byte("k"), Data: []byte("v")}, []byte("t")), errNoTagIndex)
+	if _, err := plain.InvalidateTag([]byte("t")); err != errNoTagIndex {
+		t.Fatalf("InvalidateTag without the index: %v", err)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, HashLongKeys: true, MaxKeySize: 2000,
+		Namespaces: []Namespace{{Name: "a", Prefix: "a:"}}})
+	long := strings.Repeat("x", 1000)
+	keep := []string{"t", "t0", "t2:x", "u1:x", "t1" + long[:1]}
+	gone := []string{"t1:", "t1:x", "t1:y", "t1:" + long, "t1:" + long + "y"}
+	for _, key := range append(append(keep, gone...), "t1:exp", "a:t1") {
+		mustSet(t, h, key, []byte("v"), 0, 0)
+	}
+	mustSet(t, h, "t1:exp", []byte("v"), 0, 10)
+	mustSet(t, h, "a:x", []byte("v"), 0, 0)
+	clock.advance(time.Minute)
+
+	if n, err := h.DeletePrefix([]byte("t1:"), true); err != nil || n != len(gone) {
+		t.Fatalf("dry run counted %d, %v", n, err)
+	}
+	expectValue(t, h, "t1:x", []byte("v"))
+	if n, err := h.DeletePrefix([]byte("t1:"), false); err != nil || n != len(gone) {
+		t.Fatalf("deleted %d, %v", n, err)
+	}
+	for _, key := range gone {
+		expectMiss(t, h, key)
+	}
+	for _, key := range keep {
+		expectValue(t, h, key, []byte("v"))
+	}
+	if n, err := h.DeletePrefix([]byte("t1:"), true); err != nil || n != 0 {
+		t.Fatalf("%d left, %v", n, err)
+	}
+
+	// Ranges span namespaces
+	if n, err := h.DeleteRange([]byte("a:t"), []byte("t1"), false); err != nil || n != 4 {
+		t.Fatalf("deleted %d in range, %v", n, err)
+	}
+	for _, key := range []string{"a:t1", "a:x", "t", "t0"} {
+		expectMiss(t, h, key)
+	}
+	expectValue(t, h, "t1"+long[:1], []byte("v"))
+	if n, err := h.DeleteRange([]byte("u"), nil, false); err != nil || n != 1 {
+		t.Fatalf("deleted %d to the end, %v", n, err)
+	}
+
+	if _, err := h.DeletePrefix(nil, false); err != errNoPrefix {
+		t.Fatalf("empty prefix: %v", err)
+	}
+	if _, err := h.DeleteRange([]byte("b"), []byte("a"), false); err != errBadRange {
+		t.Fatalf("backwards range: %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, HashLongKeys: true, MaxKeySize: 2000,
+		Namespaces: []Namespace{{Name: "a", Prefix: "k:a"}}})
+	want := map[string]bool{}
+	for i := 0; i < 250; i++ {
+		key := "k:" + strconv.Itoa(i)
+		mustSet(t, h, key, []byte(key), uint32(i), 0)
+		want[key] = true
+	}
+	long := "k:" + strings.Repeat("x", 1000)
+	mustSet(t, h, long, []byte("v"), 0, 0)
+	want[long] = true
+	for _, key := range []string{"k:a1", "k:a2"} {
+		mustSet(t, h, key, []byte(key), 0, 3600)
+		want[key] = true
+	}
+	mustSet(t, h, "k:expired", []byte("v"), 0, 10)
+	mustSet(t, h, "other", []byte("v"), 0, 0)
+	clock.advance(time.Minute)
+
+	got := map[string]bool{}
+	cursor, pages := "", 0
+	for {
+		items, next, err := h.Scan([]byte("k:"), cursor, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(items) > 100 {
+			t.Fatalf("page of %d", len(items))
+		}
+		for _, it := range items {
+			key := string(it.Key)
+			if got[key] || !want[key] {
+				t.Fatalf("scanned %q", key)
+			}
+			got[key] = true
+			if it.Size != len(key) && key != long {
+				t.Errorf("%q has size %d", key, it.Size)
+			}
+			if key == "k:7" && it.Flags != 7 || key == "k:a1" && (it.Namespace != "a" || it.Exptime == 0) {
+				t.Errorf("scanned %+v", it)
+			}
+		}
+		pages++
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if len(got) != len(want) || pages < 3 {
+		t.Fatalf("scanned %d of %d items in %d pages", len(got), len(want), pages)
+	}
+
+	if items, _, err := h.Scan(nil, "", 1000); err != nil || len(items) != len(want)+1 {
+		t.Fatalf("scanned %d items without a prefix, %v", len(items), err)
+	}
+	if _, _, err := h.Scan(nil, "!", 10); err != errBadCursor {
+		t.Fatalf("bad cursor: %v", err)
+	}
+}
+
+func TestSizeStats(t *testing.T) {
+	h := testHandler(t, Options{DisableReaper: true, ChunkSize: 1024, Namespaces: []Namespace{{Name: "a", Prefix: "a:"}}})
+	for i := 0; i < 3; i++ {
+		mustSet(t, h, fmt.Sprintf("small:%d", i), make([]byte, 150), 0, 0)
+	}
+	mustSet(t, h, "a:medium", make([]byte, 3000), 0, 0)
+	// Chunked entries count as a whole
+	mustSet(t, h, "a:big", make([]byte, 5000), 0, 0)
+
+	ss, err := h.SizeStats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{256, 3, 4096, 1, 8192, 1}
+	if len(ss.Buckets) != len(want)/2 || ss.Scanned != 5 || !ss.Complete {
+		t.Fatalf("sizes: %+v", ss)
+	}
+	for i, b := range ss.Buckets {
+		if b.Size != want[2*i] || b.Items != want[2*i+1] || b.Bytes <= b.Size/2*b.Items || b.Bytes > b.Size*b.Items {
+			t.Fatalf("bucket %d: %+v", i, b)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := ss.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "STAT 256 3\r\nSTAT 4096 1\r\nSTAT 8192 1\r\nEND\r\n" {
+		t.Fatalf("stats sizes: %q", buf.String())
+	}
+
+	if ss, err := h.SizeStats(2); err != nil || ss.Scanned != 2 || ss.Complete {
+		t.Fatalf("sizes of 2: %+v, %v", ss, err)
+	}
+}
+
+// TestSwitchCodec checks values stay readable when the codec they were
+// compressed with is no longer the one configured.
+func TestSwitchCodec(t *testing.T) {
+	dir := tempDir(t)
+	data := bytes.Repeat([]byte("compressible "), 100)
+	for _, c := range []Codec{Deflate, Snappy, nil} {
+		h := openHandler(t, Options{Path: dir, DisableReaper: true, Compression: c})
+		if c != nil {
+			mustSet(t, h, c.Name(), data, 0, 0)
+			if info, err := h.Inspect([]byte(c.Name())); err != nil || !info.Compressed || info.StoredSize >= len(data)/2 {
+				t.Fatalf("%s: %+v, %v", c.Name(), info, err)
+			}
+		}
+		expectValue(t, h, "deflate", data)
+		if c != Deflate {
+			expectValue(t, h, "snappy", data)
+		}
+		h.Close()
+	}
+}
+
+func TestInspect(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, WriteTimes: true, Checksums: true,
+		Compression: Deflate, CompressionThreshold: 100, ChunkSize: 1000})
+	data := bytes.Repeat([]byte("x"), 5000)
+	mustSet(t, h, "big", data, 7, 60)
+	mustSet(t, h, "small", []byte("v"), 0, 0)
+	noise := make([]byte, 5000)
+	for i, x := 0, uint32(1); i < len(noise); i++ {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		noise[i] = byte(x)
+	}
+	mustSet(t, h, "noise", noise, 0, 0)
+	written := clock.Now()
+
+	info, err := h.Inspect([]byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != len(data) || info.Flags != 7 || info.CAS == 0 || !info.Compressed || !info.Checksum ||
+		info.Version != entryVersion || info.Written.Unix() != written.Unix() || info.TTL <= 0 ||
+		info.Exptime.Unix() != written.Unix()+60 {
+		t.Fatalf("big: %+v", info)
+	}
+	if cas := gets(t, h, "big"); cas != info.CAS {
+		t.Fatalf("CAS %d, gets has %d", info.CAS, cas)
+	}
+
+	info, err = h.Inspect([]byte("small"))
+	if err != nil || info.Size != 1 || info.Compressed || info.Chunked || !info.Exptime.IsZero() {
+		t.Fatalf("small: %+v, %v", info, err)
+	}
+	info, err = h.Inspect([]byte("noise"))
+	if err != nil || !info.Chunked || info.Compressed || info.Size != len(noise) || info.StoredSize <= len(noise) {
+		t.Fatalf("noise: %+v, %v", info, err)
+	}
+
+	// Expired items are found until they are removed
+	clock.advance(2 * time.Minute)
+	if info, err := h.Inspect([]byte("big")); err != nil || !info.Expired || info.TTL >= 0 {
+		t.Fatalf("expired: %+v, %v", info, err)
+	}
+	if _, err := h.Inspect([]byte("missing")); err != common.ErrKeyNotFound {
+		t.Fatalf("missing: %v", err)
+	}
+}
+
+// TestEvictionRounds checks a write that can't fit however much is evicted
+// fails after a few rounds of eviction, instead of emptying the map first.
+func TestEvictionRounds(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 8 << 20, MaxValueSize: 16 << 20, Eviction: EvictSoonestExpiring,
+		DisableReaper: true})
+	stored := 1500
+	for i := 0; i < stored; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%04d", i), value("v", i, 4000), 0, 3600)
+	}
+
+	err := h.Set(common.SetRequest{Key: []byte("huge"), Data: make([]byte, 6<<20), Exptime: 3600})
+	expectErr(t, "set of more than eviction frees", err, common.ErrNoMem)
+
+	st, err := h.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Evictions == 0 || st.Items < uint64(stored)/2 || st.Items+st.Evictions != uint64(stored) {
+		t.Fatalf("%d items left after %d evictions of %d", st.Items, st.Evictions, stored)
+	}
+	expectValue(t, h, fmt.Sprintf("key:%04d", stored-1), value("v", stored-1, 4000))
+}
+
+// evictionStats returns the items left and the evictions so far, and checks
+// every evicted item was counted once.
+func evictionStats(t *testing.T, h *Handler, stored int) (items, evictions uint64) {
+	t.Helper()
+	st, err := h.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Evictions == 0 || st.Items+st.Evictions != uint64(stored) {
+		t.Fatalf("%d items left after %d evictions of %d", st.Items, st.Evictions, stored)
+	}
+	return st.Items, st.Evictions
+}
+
+func TestEvictSoonestExpiring(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 1 << 20, Eviction: EvictSoonestExpiring, DisableReaper: true})
+
+	// Keys sort in the opposite order to their exptimes, so key order
+	// wouldn't pick the same items
+	for i := 0; i < 20; i++ {
+		mustSet(t, h, fmt.Sprintf("a:%03d", i), value("a", i, 4000), 0, 7200)
+	}
+	for i := 0; i < 150; i++ {
+		mustSet(t, h, fmt.Sprintf("b:%03d", i), value("b", i, 4000), 0, uint32(600+i))
+	}
+	for i := 0; i < 70; i++ {
+		mustSet(t, h, fmt.Sprintf("c:%03d", i), value("c", i, 4000), 0, 7200)
+	}
+
+	_, evictions := evictionStats(t, h, 240)
+	if evictions >= 150 {
+		t.Fatalf("%d evictions, more than the items expiring soonest", evictions)
+	}
+	for i := 0; i < 20; i++ {
+		expectValue(t, h, fmt.Sprintf("a:%03d", i), value("a", i, 4000))
+	}
+	for i := 0; i < 150; i++ {
+		key := fmt.Sprintf("b:%03d", i)
+		if evicted := getE(t, h, key).Miss; evicted != (uint64(i) < evictions) {
+			t.Fatalf("%s evicted: %v, after %d evictions", key, evicted, evictions)
+		}
+	}
+	for i := 0; i < 70; i++ {
+		expectValue(t, h, fmt.Sprintf("c:%03d", i), value("c", i, 4000))
+	}
+}
+
+func TestEvictClock(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 1 << 20, Eviction: EvictClock, DisableReaper: true})
+	const stored = 300
+	for i := 0; i < stored; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%03d", i), value("v", i, 4000), 0, 0)
+	}
+
+	// The hand moves forward through the keys, so what was evicted is a run
+	// from the start that the hand has not come back to
+	_, evictions := evictionStats(t, h, stored)
+	if evictions >= stored/2 {
+		t.Fatalf("%d evictions of %d", evictions, stored)
+	}
+	for i := 0; i < stored; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		if evicted := getE(t, h, key).Miss; evicted != (uint64(i) < evictions) {
+			t.Fatalf("%s evicted: %v, after %d evictions", key, evicted, evictions)
+		}
+	}
+
+	// Asking for more than there is returns every key once
+	s := h.shard(nil)
+	for _, policy := range []EvictionPolicy{EvictClock, EvictLRU} {
+		err := s.update(func(txn *lmdb.Txn) error {
+			keys, err := s.candidates(txn, policy, 1<<30)
+			if err != nil {
+				return err
+			}
+			seen := make(map[string]bool)
+			for _, key := range keys {
+				if seen[string(key)] {
+					t.Errorf("policy %d: %q returned twice", policy, key)
+				}
+				seen[string(key)] = true
+			}
+			if uint64(len(seen)) != stored-evictions {
+				t.Errorf("policy %d: %d keys of %d", policy, len(seen), stored-evictions)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 1 << 20, Eviction: EvictLRU, DisableReaper: true})
+	const stored = 300
+	for i := 0; i < 200; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%03d", i), value("v", i, 4000), 0, 0)
+	}
+
+	// Read the first keys, which the hand comes to first, and wait for the
+	// reads to be recorded
+	for i := 0; i < 20; i++ {
+		expectValue(t, h, fmt.Sprintf("key:%03d", i), value("v", i, 4000))
+	}
+	s := h.shard(nil)
+	refs := func() uint64 {
+		var n uint64
+		err := s.view(func(txn *lmdb.Txn) error {
+			st, err := txn.Stat(s.refdbi)
+			n = st.Entries
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for deadline := time.Now().Add(10 * time.Second); refs() != 20; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d reads recorded, want 20", refs())
+		}
+	}
+
+	for i := 200; i < stored; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%03d", i), value("v", i, 4000), 0, 0)
+	}
+
+	// The keys read were passed over, and their bits cleared, and the cold
+	// ones after them evicted
+	_, evictions := evictionStats(t, h, stored)
+	if evictions >= stored-40 {
+		t.Fatalf("%d evictions of %d", evictions, stored)
+	}
+	if n := refs(); n != 0 {
+		t.Fatalf("%d reference bits left", n)
+	}
+	for i := 0; i < stored; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		if evicted := getE(t, h, key).Miss; evicted != (i >= 20 && uint64(i) < 20+evictions) {
+			t.Fatalf("%s evicted: %v, after %d evictions", key, evicted, evictions)
+		}
+	}
+}
+
+func TestEvictHighWater(t *testing.T) {
+	h := testHandler(t, Options{MapSize: 1 << 20, EvictHighWater: 0.5, EvictLowWater: 0.3,
+		EvictCheckInterval: time.Hour, DisableReaper: true})
+	const stored = 150
+	for i := 0; i < stored; i++ {
+		mustSet(t, h, fmt.Sprintf("key:%03d", i), value("v", i, 4000), 0, uint32(600+i))
+	}
+	s := h.shard(nil)
+	used, limit, err := s.utilization()
+	if err != nil || used < 0.5*limit {
+		t.Fatalf("%.0f of %.0f bytes used, %v", used, limit, err)
+	}
+
+	// Without an Eviction policy the soonest expiring go first, until the
+	// pages in use are below the low-water mark but no further
+	if err := s.evictToLowWater(); err != nil {
+		t.Fatal(err)
+	}
+	if used, _, err = s.utilization(); err != nil || used >= 0.3*limit {
+		t.Fatalf("%.0f of %.0f bytes used after evicting, %v", used, limit, err)
+	}
+	items, evictions := evictionStats(t, h, stored)
+	if float64(items*4000) < 0.2*limit {
+		t.Fatalf("evicted down to %d items", items)
+	}
+	for i := 0; i < stored; i++ {
+		key := fmt.Sprintf("key:%03d", i)
+		if evicted := getE(t, h, key).Miss; evicted != (uint64(i) < evictions) {
+			t.Fatalf("%s evicted: %v, after %d evictions", key, evicted, evictions)
+		}
+	}
+
+	// Below the high-water mark nothing is evicted
+	if err := s.evictToLowWater(); err != nil {
+		t.Fatal(err)
+	}
+	if _, n := evictionStats(t, h, stored); n != evictions {
+		t.Fatalf("%d more evictions below the high-water mark", n-evictions)
+	}
+}
+
+// TestEvictDuringCompaction checks an eviction waits for a compaction that is
+// under way, which would otherwise lose it with the old file.
+func TestEvictDuringCompaction(t *testing.T) {
+	h := testHandler(t, Options{Eviction: EvictClock})
+	mustSet(t, h, "k", []byte("v"), 0, 0)
+
+	s := h.shard(nil)
+	compacting := make(chan struct{})
+	s.resizeLock.Lock()
+	s.compacting = compacting
+	s.resizeLock.Unlock()
+
+	evicted := make(chan bool)
+	go func() { evicted <- s.evict() }()
+	select {
+	case <-evicted:
+		t.Fatal("evicted during a compaction")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	s.resizeLock.Lock()
+	s.compacting = nil
+	s.resizeLock.Unlock()
+	close(compacting)
+	if !<-evicted {
+		t.Fatal("nothing evicted after the compaction")
+	}
+	expectMiss(t, h, "k")
+}
+
+// loadSet is a set command of the format Load reads.
+func loadSet(key string, flags uint32, exptime int64, data string) string {
+	return fmt.Sprintf("set %s %d %d %d\r\n%s\r\n", key, flags, exptime, len(data), data)
+}
+
+func TestLoad(t *testing.T) {
+	clock := newFakeClock()
+	h := testHandler(t, Options{Clock: clock, DisableReaper: true, MaxValueSize: 100,
+		Namespaces: []Namespace{{Name: "ttl", Prefix: "ttl:", DefaultTTL: time.Hour, MaxTTL: 2 * time.Hour}}})
+	load := func(batch int, sets ...string) int {
+		t.Helper()
+		n, err := h.Load(strings.NewReader(strings.Join(sets, "")), batch)
+		if err != nil {
+			t.Fatalf("loaded %d: %v", n, err)
+		}
+		return n
+	}
+
+	// A sorted batch after every key stored is appended with MDB_APPEND,
+	// which would fail on one that is sorted but goes among them, or isn't
+	// sorted
+	for _, keys := range [][]string{{"b", "d"}, {"c", "e"}, {"z", "y"}} {
+		if n := load(2, loadSet(keys[0], 1, 0, keys[0]), loadSet(keys[1], 1, 0, keys[1])); n != 2 {
+			t.Fatalf("%q: loaded %d", keys, n)
+		}
+	}
+	for _, key := range []string{"b", "c", "d", "e", "y", "z"} {
+		if r := getE(t, h, key); r.Miss || string(r.Data) != key || r.Flags != 1 {
+			t.Fatalf("%s read as %+v", key, r)
+		}
+	}
+
+	// Expired items are skipped
+	past := int64(clock.unix()) - 10
+	if n := load(0, loadSet("neg", 0, -1, "v"), loadSet("past", 0, past, "v"), loadSet("rel", 0, 60, "v")); n != 1 {
+		t.Fatalf("loaded %d, want 1", n)
+	}
+	expectMiss(t, h, "neg")
+	expectMiss(t, h, "past")
+	if r := getE(t, h, "rel"); r.Miss || r.Exptime != clock.unix()+60 {
+		t.Fatalf("rel read as %+v", r)
+	}
+
+	// The namespace's TTLs apply
+	load(0, loadSet("ttl:none", 0, 0, "v"), loadSet("ttl:long", 0, 86400, "v"))
+	if r := getE(t, h, "ttl:none"); r.Exptime != clock.unix()+3600 {
+		t.Fatalf("exptime %d without one, want %d", r.Exptime, clock.unix()+3600)
+	}
+	if r := getE(t, h, "ttl:long"); r.Exptime != clock.unix()+7200 {
+		t.Fatalf("exptime %d past MaxTTL, want %d", r.Exptime, clock.unix()+7200)
+	}
+
+	// And so do the size limits
+	if _, err := h.Load(strings.NewReader(loadSet("big", 0, 0, strings.Repeat("x", 101))), 0); err == nil {
+		t.Fatal("loaded a value over MaxValueSize")
+	}
+	expectMiss(t, h, "big")
+}
+
+func TestDumpLoad(t *testing.T) {
+	clock := newFakeClock()
+	opts := Options{Clock: clock, DisableReaper: true, HashLongKeys: true, MaxKeySize: 1000, ChunkSize: 1024}
+	h := testHandler(t, opts)
+
+	long := strings.Repeat("k", 600)
+	abs := clock.unix() + 60*60*24*60
+	mustSet(t, h, long, value(long, 1, 100), 1, 0)
+	mustSet(t, h, "chunked", value("chunked", 1, 5000), 2, 0)
+	mustSet(t, h, "relative", value("relative", 1, 100), 3, 60)
+	mustSet(t, h, "absolute", value("absolute", 1, 100), 4, abs)
+	mustSet(t, h, "expired", value("expired", 1, 100), 5, 10)
+	clock.advance(20 * time.Second)
+
+	var buf bytes.Buffer
+	if n, err := h.Dump(&buf); err != nil || n != 4 {
+		t.Fatalf("dumped %d: %v", n, err)
+	}
+	if !strings.Contains(buf.String(), "set relative 3 40 100\r\n") {
+		t.Fatalf("relative exptime not dumped as the seconds left:\n%q", buf.String())
+	}
+	if !strings.Contains(buf.String(), fmt.Sprintf("set absolute 4 %d 100\r\n", abs)) {
+		t.Fatalf("absolute exptime not dumped as a unix time:\n%q", buf.String())
+	}
+
+	h2 := testHandler(t, opts)
+	if n, err := h2.Load(&buf, 2); err != nil || n != 4 {
+		t.Fatalf("loaded %d: %v", n, err)
+	}
+	for _, item := range []struct {
+		key     string
+		size    int
+		flags   uint32
+		exptime uint32
+	}{
+		{long, 100, 1, 0},
+		{"chunked", 5000, 2, 0},
+		{"relative", 100, 3, clock.unix() + 40},
+		{"absolute", 100, 4, abs},
+	} {
+		r := getE(t, h2, item.key)
+		if r.Miss || !bytes.Equal(r.Data, value(item.key, 1, item.size)) {
+			t.Fatalf("%.20s: miss or wrong value after the round trip", item.key)
+		}
+		if r.Flags != item.flags || r.Exptime != item.exptime {
+			t.Fatalf("%.20s: flags %d exptime %d, want %d and %d", item.key, r.Flags, r.Exptime, item.flags, item.exptime)
+		}
+	}
+	expectMiss(t, h2, "expired")
+}
@@ -0,0 +1,211 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	defaultLoadBatch = 10000
+
+	// loadBatchBytes bounds the data in one load transaction, which keeps it
+	// well clear of MDB_TXN_FULL
+	loadBatchBytes = 32 * 1024 * 1024
+)
+
+type loadItem struct {
+	key []byte
+	buf []byte
+}
+
+// Load reads set commands in the format written by Dump and stores the items,
+// up to batch items per write transaction. Zero uses a default batch size.
+// Items whose exptime has already passed are skipped. Like any other write,
+// items must be within the key and value size limits, and get the DefaultTTL
+// and MaxTTL of their namespace. It returns the number of items stored.
+//
+// When the keys arrive in sorted order and all come after the keys already in
+// the DB, as they do when loading a Dump into an empty DB, they are appended
+// with MDB_APPEND, which skips the tree search and packs pages full.
+func (h *Handler) Load(r io.Reader, batch int) (int, error) {
+	if batch <= 0 {
+		batch = defaultLoadBatch
+	}
+
+	br := bufio.NewReaderSize(r, 64*1024)
+	n := 0
+	// pending items and their size for each store
+	items := make(map[*store][]loadItem)
+	sizes := make(map[*store]int)
+
+	for {
+		key, e, live, err := readSet(br, int64(h.shards[0].now()))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if !live {
+			continue
+		}
+
+		s := h.shard(key)
+		if err := s.checkItem(key, e.data); err != nil {
+			return n, fmt.Errorf("invalid item %q: %v", key, err)
+		}
+		e.exptime = s.limitExptime(e.exptime, s.now())
+
+		key, e.key = s.dbKey(key)
+		e.cas = s.nextCAS()
+		buf, err := s.encodeEntry(e)
+		if err != nil {
+			return n, err
+		}
+
+		items[s] = append(items[s], loadItem{key: key, buf: buf})
+		sizes[s] += len(key) + len(buf)
+
+		if len(items[s]) >= batch || sizes[s] >= loadBatchBytes {
+			if err := s.loadBatch(items[s]); err != nil {
+				return n, s.decodeErr(err)
+			}
+			n += len(items[s])
+			items[s], sizes[s] = items[s][:0], 0
+		}
+	}
+
+	for _, s := range h.all() {
+		if len(items[s]) > 0 {
+			if err := s.loadBatch(items[s]); err != nil {
+				return n, s.decodeErr(err)
+			}
+			n += len(items[s])
+		}
+	}
+
+	return n, nil
+}
+
+func (s *store) loadBatch(items []loadItem) error {
+	sorted := true
+	for i := 1; i < len(items); i++ {
+		if bytes.Compare(items[i-1].key, items[i].key) >= 0 {
+			sorted = false
+			break
+		}
+	}
+
+	return s.update(func(txn *lmdb.Txn) error {
+		var flags uint
+		if sorted {
+			last, err := lastKey(txn, s.dbi)
+			if err != nil {
+				return err
+			}
+			if last == nil || bytes.Compare(last, items[0].key) < 0 {
+				flags = lmdb.Append
+			}
+		}
+
+		for _, item := range items {
+			if err := s.put(txn, item.key, item.buf, flags); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func lastKey(txn *lmdb.Txn, dbi lmdb.DBI) ([]byte, error) {
+	cur, err := txn.OpenCursor(dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	key, _, err := cur.Get(nil, nil, lmdb.Last)
+	if lmdb.IsNotFound(err) {
+		return nil, nil
+	}
+	return key, err
+}
+
+// readSet parses one set command, with relative exptimes taken from now, in
+// unix milliseconds. live is false if the item has already expired.
+func readSet(br *bufio.Reader, now int64) (key []byte, e entry, live bool, err error) {
+	line, err := br.ReadSlice('\n')
+	if err == io.EOF && len(line) == 0 {
+		return nil, e, false, io.EOF
+	}
+	if err != nil {
+		return nil, e, false, fmt.Errorf("reading command: %v", err)
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) != 5 || string(fields[0]) != "set" {
+		return nil, e, false, fmt.Errorf("invalid command %q", bytes.TrimSpace(line))
+	}
+
+	key = append([]byte(nil), fields[1]...)
+	flags, err := strconv.ParseUint(string(fields[2]), 10, 32)
+	if err != nil {
+		return nil, e, false, fmt.Errorf("invalid flags for %q: %v", key, err)
+	}
+	exptime, err := strconv.ParseInt(string(fields[3]), 10, 64)
+	if err != nil {
+		return nil, e, false, fmt.Errorf("invalid exptime for %q: %v", key, err)
+	}
+	length, err := strconv.ParseUint(string(fields[4]), 10, 32)
+	if err != nil {
+		return nil, e, false, fmt.Errorf("invalid length for %q: %v", key, err)
+	}
+
+	data := make([]byte, length+2)
+	if _, err = io.ReadFull(br, data); err != nil {
+		return nil, e, false, fmt.Errorf("reading data for %q: %v", key, err)
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return nil, e, false, fmt.Errorf("data for %q is not terminated by \\r\\n", key)
+	}
+
+	switch {
+	case exptime < 0:
+		return key, e, false, nil
+	case exptime > maxRelativeExptime:
+		// absolute
+		exptime = int64(secondsExptime(uint64(exptime)))
+		if exptime < now {
+			return key, e, false, nil
+		}
+	case exptime > 0:
+		exptime = now + exptime*1000
+	}
+
+	e = entry{
+		exptime: uint64(exptime),
+		flags:   uint32(flags),
+		data:    data[:length],
+	}
+
+	return key, e, true, nil
+}
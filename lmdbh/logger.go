@@ -0,0 +1,147 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logger receives the log output of a handler. Each call is one event; fields
+// are alternating keys and values that give its details, e.g.
+//
+//	l.Info("Grew map", "from", 1024, "to", 2048)
+//
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+}
+
+// Level is the minimum severity a logger made by NewLogger writes.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// NewLogger returns a Logger that writes events at or above level to w, one
+// per line, either as text or as JSON objects.
+func NewLogger(w io.Writer, level Level, asJSON bool) Logger {
+	return &writerLogger{w: w, level: level, json: asJSON}
+}
+
+// defaultLogger is used when Options.Logger is not set
+var defaultLogger = NewLogger(os.Stderr, LevelInfo, false)
+
+type writerLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+func (l *writerLogger) Debug(msg string, fields ...interface{}) { l.write(LevelDebug, msg, fields) }
+func (l *writerLogger) Info(msg string, fields ...interface{})  { l.write(LevelInfo, msg, fields) }
+func (l *writerLogger) Warn(msg string, fields ...interface{})  { l.write(LevelWarn, msg, fields) }
+func (l *writerLogger) Error(msg string, fields ...interface{}) { l.write(LevelError, msg, fields) }
+
+func (l *writerLogger) write(level Level, msg string, fields []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	now := time.Now()
+	var buf bytes.Buffer
+
+	if l.json {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fieldKey(fields, i))
+			buf.WriteByte(':')
+			writeJSON(&buf, fieldValue(fields, i))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s", now.Format("2006/01/02 15:04:05.000000"), level, msg)
+		for i := 0; i < len(fields); i += 2 {
+			fmt.Fprintf(&buf, " %s=%v", fieldKey(fields, i), fieldValue(fields, i))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	l.w.Write(buf.Bytes())
+	l.mu.Unlock()
+}
+
+func fieldKey(fields []interface{}, i int) string {
+	if k, ok := fields[i].(string); ok {
+		return k
+	}
+	return fmt.Sprint(fields[i])
+}
+
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i+1 >= len(fields) {
+		return nil
+	}
+	switch v := fields[i+1].(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,112 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"math/rand"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// EvictLRU keeps a reference bit for each item in a DB of its own, keyed like
+// the data DB: an item has a record there if it has been read since the clock
+// hand last passed it. Reads can't write, so hits are queued for
+// referenceWriter, which sets the bits in batches. A full queue drops them,
+// which only makes the item look colder than it is. The hand clears the bits
+// it passes instead of evicting those items, giving them a second chance.
+const (
+	refDBSuffix = "_refs"
+	refQueueLen = 1024
+	refBatch    = 256
+)
+
+// refValue is the value of every reference record. It isn't empty, since an
+// empty value at the very end of a page can't be read with RawRead.
+var refValue = []byte{1}
+
+// tracksReferences reports whether the store's eviction needs reference bits.
+func (s *store) tracksReferences() bool {
+	return s.opts.Eviction == EvictLRU || s.conf.QuotaEviction == EvictLRU
+}
+
+// hit counts a read that found key and queues setting its reference bit, for
+// one in LRUSampleRate of them.
+func (s *store) hit(key []byte) {
+	s.count(&s.stats.hits, MetricHits)
+
+	if s.referenced == nil {
+		return
+	}
+	if r := s.opts.LRUSampleRate; r > 1 && rand.Intn(r) != 0 {
+		return
+	}
+
+	select {
+	case s.referenced <- append([]byte(nil), key...):
+	default:
+	}
+}
+
+// referenceWriter sets the reference bits of the keys queued by hit, up to
+// refBatch of them per write transaction.
+func referenceWriter(s *store) {
+	for {
+		var keys [][]byte
+		select {
+		case key := <-s.referenced:
+			keys = append(keys, key)
+		case <-s.done:
+			return
+		}
+
+	more:
+		for len(keys) < refBatch {
+			select {
+			case key := <-s.referenced:
+				keys = append(keys, key)
+			default:
+				break more
+			}
+		}
+
+		err := s.update(func(txn *lmdb.Txn) error {
+			for _, key := range keys {
+				// The item may have been deleted since it was read
+				if _, err := txn.Get(s.dbi, key); lmdb.IsNotFound(err) {
+					continue
+				} else if err != nil {
+					return err
+				}
+				if err := txn.Put(s.refdbi, key, refValue, 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		if err != nil && err != errClosed && err != errDiskFull {
+			s.opts.Logger.Error("Error while recording reads", "component", "lru", "error", err)
+		}
+	}
+}
+
+// secondChance reports whether key's reference bit was set, clearing it.
+func (s *store) secondChance(txn *lmdb.Txn, key []byte) (bool, error) {
+	err := txn.Del(s.refdbi, key, nil)
+	if lmdb.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
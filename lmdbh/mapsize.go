@@ -0,0 +1,176 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import "github.com/bmatsuo/lmdb-go/lmdb"
+
+// LMDB only allows the map size to be changed while no transactions are
+// active in the process. Every transaction holds resizeLock for reading, and a
+// resize holds it for writing. Transactions must never be nested, otherwise a
+// pending resize deadlocks the outer transaction.
+
+func (s *store) view(fn lmdb.TxnOp) error {
+	for attempt := 0; ; attempt++ {
+		s.resizeLock.RLock()
+		if s.closed {
+			s.resizeLock.RUnlock()
+			return errClosed
+		}
+		err := s.env.View(s.tracked(fn))
+		s.resizeLock.RUnlock()
+
+		switch {
+		case lmdb.IsMapResized(err):
+			if !s.adoptMapSize() {
+				return err
+			}
+		case lmdb.IsErrno(err, lmdb.ReadersFull):
+			if !s.readersFull(attempt) {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// update runs fn in a write transaction. If the map is full, and it can be
+// grown or items can be evicted, fn is run again, so fn must be safe to retry.
+func (s *store) update(fn lmdb.TxnOp) error {
+	if s.opts.ReadOnly {
+		return errReadOnly
+	}
+	if s.diskFull() {
+		return errDiskFull
+	}
+	start := s.beginWrite()
+	err := s.tryUpdate(fn)
+	s.endWrite(start, err)
+	return s.degrade(err)
+}
+
+// tryUpdate runs fn in a write transaction whether or not writes are off for a
+// full disk, see update. A write that still doesn't fit after maxEvictRounds
+// rounds of eviction fails, rather than evicting everything in its way.
+func (s *store) tryUpdate(fn lmdb.TxnOp) error {
+	for rounds := 0; ; {
+		s.resizeLock.RLock()
+		if s.closed {
+			s.resizeLock.RUnlock()
+			return errClosed
+		}
+		if c := s.compacting; c != nil {
+			s.resizeLock.RUnlock()
+			<-c
+			continue
+		}
+		size := s.mapSize
+		err := s.commit(fn)
+		s.resizeLock.RUnlock()
+
+		if lmdb.IsMapResized(err) {
+			if !s.adoptMapSize() {
+				return err
+			}
+			continue
+		}
+
+		if !lmdb.IsMapFull(err) {
+			return err
+		}
+		if s.grow(size) {
+			continue
+		}
+		if rounds == maxEvictRounds || !s.evict() {
+			return err
+		}
+		rounds++
+	}
+}
+
+// grow doubles the map size, up to MaxMapSize, if it is still at the size from
+// when the failed write started. It returns whether the write should be tried
+// again.
+func (s *store) grow(from int64) bool {
+	s.lockResize()
+	defer s.resizeLock.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	// Another writer got here first
+	if s.mapSize != from {
+		return true
+	}
+
+	if s.mapSize >= s.opts.MaxMapSize {
+		return false
+	}
+
+	to := s.mapSize * 2
+	if to > s.opts.MaxMapSize {
+		to = s.opts.MaxMapSize
+	}
+
+	if err := s.env.SetMapSize(to); err != nil {
+		s.opts.Logger.Error("Error growing map", "component", "mapsize", "from", s.mapSize, "to", to, "error", err)
+		return false
+	}
+
+	s.opts.Logger.Info("Grew map", "component", "mapsize", "from", s.mapSize, "to", to)
+	s.mapSize = to
+	return true
+}
+
+// lockResize takes resizeLock for writing once no compaction is running, for
+// resizes and evictions. A compaction sets compacting from before its copy
+// until after the swap, see compact, and anything committed in between would
+// be lost with the old file.
+func (s *store) lockResize() {
+	s.resizeLock.Lock()
+	for c := s.compacting; c != nil; c = s.compacting {
+		s.resizeLock.Unlock()
+		<-c
+		s.resizeLock.Lock()
+	}
+}
+
+// adoptMapSize takes on the map size another process grew the map to. The
+// transaction that failed with MDB_MAP_RESIZED never started, so it is safe
+// to run again. It returns whether it should be.
+func (s *store) adoptMapSize() bool {
+	s.resizeLock.Lock()
+	defer s.resizeLock.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	// Zero picks up the size in the data file
+	if err := s.env.SetMapSize(0); err != nil {
+		s.opts.Logger.Error("Error adopting map size", "component", "mapsize", "error", err)
+		return false
+	}
+	info, err := s.env.Info()
+	if err != nil {
+		s.opts.Logger.Error("Error adopting map size", "component", "mapsize", "error", err)
+		return false
+	}
+
+	s.opts.Logger.Info("Adopted map size", "component", "mapsize", "from", s.mapSize, "to", info.MapSize)
+	s.mapSize = info.MapSize
+	return true
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import "github.com/netflix/rend/metrics"
+
+// These are reported through rend's metrics package alongside everything rend
+// itself records. Unlike the per-store stats they are process wide, like the
+// metrics of the rend memory handler. Latencies are in nanoseconds.
+var (
+	MetricHits        = metrics.AddCounter("lmdb_hits", nil)
+	MetricMisses      = metrics.AddCounter("lmdb_misses", nil)
+	MetricSets        = metrics.AddCounter("lmdb_sets", nil)
+	MetricDeletes     = metrics.AddCounter("lmdb_deletes", nil)
+	MetricExpirations = metrics.AddCounter("lmdb_expired_reads", nil)
+	MetricStaleHits   = metrics.AddCounter("lmdb_stale_hits", nil)
+	MetricEarlyMisses = metrics.AddCounter("lmdb_early_expirations", nil)
+	MetricNegHits     = metrics.AddCounter("lmdb_negative_hits", nil)
+	MetricBloomMisses = metrics.AddCounter("lmdb_bloom_misses", nil)
+	MetricCacheHits   = metrics.AddCounter("lmdb_read_cache_hits", nil)
+	MetricCacheMisses = metrics.AddCounter("lmdb_read_cache_misses", nil)
+	MetricCoalesced   = metrics.AddCounter("lmdb_coalesced_gets", nil)
+	MetricStagedErrs  = metrics.AddCounter("lmdb_write_behind_errors", nil)
+	MetricSyncs       = metrics.AddCounter("lmdb_syncs", nil)
+	MetricEvictions   = metrics.AddCounter("lmdb_evictions", nil)
+	MetricCorrupt     = metrics.AddCounter("lmdb_corrupt_reads", nil)
+	MetricErrCorrupt  = metrics.AddCounter("lmdb_errors_corrupt", nil)
+	MetricErrFull     = metrics.AddCounter("lmdb_errors_full", nil)
+	MetricErrBusy     = metrics.AddCounter("lmdb_errors_busy", nil)
+	MetricErrInternal = metrics.AddCounter("lmdb_errors_internal", nil)
+	MetricDiskFulls   = metrics.AddCounter("lmdb_disk_full", nil)
+	MetricLongReads   = metrics.AddCounter("lmdb_long_reads", nil)
+	MetricSlowOps     = metrics.AddCounter("lmdb_slow_ops", nil)
+
+	MetricBreakerTrips   = metrics.AddCounter("lmdb_breaker_trips", nil)
+	MetricBreakerRejects = metrics.AddCounter("lmdb_breaker_rejects", nil)
+	MetricTimeouts       = metrics.AddCounter("lmdb_timeouts", nil)
+	MetricEventsDropped  = metrics.AddCounter("lmdb_events_dropped", nil)
+
+	MetricReplicated     = metrics.AddCounter("lmdb_replicated", nil)
+	MetricReplicaErrors  = metrics.AddCounter("lmdb_replica_errors", nil)
+	MetricReplicaSkipped = metrics.AddCounter("lmdb_replica_skipped", nil)
+
+	// MetricDualWriteErrors counts writes a DualWrite's secondary failed
+	MetricDualWriteErrors = metrics.AddCounter("lmdb_dual_write_errors", nil)
+
+	// These count the items a ReadThrough fetched from its origin, the local
+	// misses the origin didn't have either, failed fetches and failed local
+	// writes
+	MetricOriginFills  = metrics.AddCounter("lmdb_origin_fills", nil)
+	MetricOriginMisses = metrics.AddCounter("lmdb_origin_misses", nil)
+	MetricOriginErrors = metrics.AddCounter("lmdb_origin_errors", nil)
+	MetricFillErrors   = metrics.AddCounter("lmdb_fill_errors", nil)
+
+	MetricReaperRuns    = metrics.AddCounter("lmdb_reaper_runs", nil)
+	MetricReaperDeleted = metrics.AddCounter("lmdb_reaper_deleted", nil)
+	MetricReaperScanned = metrics.AddCounter("lmdb_reaper_scanned", nil)
+	MetricReaperStale   = metrics.AddCounter("lmdb_reaper_stale_index", nil)
+	MetricReaperErrors  = metrics.AddCounter("lmdb_reaper_errors", nil)
+
+	// The duration of the last reaper run of any store, and the Unix time in
+	// seconds of the end of the last one without errors
+	MetricReaperDuration    = metrics.AddIntGauge("lmdb_reaper_last_duration", nil)
+	MetricReaperLastSuccess = metrics.AddIntGauge("lmdb_reaper_last_success", nil)
+
+	MetricCompressIn  = metrics.AddCounter("lmdb_compress_bytes_in", nil)
+	MetricCompressOut = metrics.AddCounter("lmdb_compress_bytes_out", nil)
+
+	opCmdMetrics  [numOps]uint32
+	opHistMetrics [numOps]uint32
+)
+
+func init() {
+	for o := op(0); o < numOps; o++ {
+		opCmdMetrics[o] = metrics.AddCounter("lmdb_cmd_"+opNames[o], nil)
+		opHistMetrics[o] = metrics.AddHistogram("lmdb_hist_"+opNames[o], false, nil)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// The entries of the first release, see originalToEntry, can't be told from
+// the current layout by their bytes. So the format DB has a record for each
+// main DB: none for one from before there were versions, the last key
+// rewritten while its entries are being rewritten, and empty once they all
+// have been. A DB without one is either new, and empty, or has only entries
+// in the original layout. They are rewritten when the DB is first opened for
+// writing, before anything reads them, in the transactions that move the
+// record along, so a rewrite cut short carries on where it stopped.
+const formatDBSuffix = "_format"
+
+// migrateChunk is the most entries looked at per write transaction.
+const migrateChunk = 256
+
+var errOriginalFormat = errors.New("Rend LMDB DB has entries in the original format, open it for writing once to rewrite them")
+
+// openFormatDB opens the format DB. Every writable open creates it, so a
+// read-only store without one is either new or from the first release, which
+// had none of the other DBs either, and fails with errOriginalFormat before
+// they are looked for.
+func openFormatDB(txn *lmdb.Txn, opts Options) (lmdb.DBI, error) {
+	if !opts.ReadOnly {
+		return txn.OpenDBI(opts.DBName+formatDBSuffix, lmdb.Create)
+	}
+	dbi, err := txn.OpenDBI(opts.DBName+formatDBSuffix, 0)
+	if !lmdb.IsNotFound(err) {
+		return dbi, err
+	}
+	main, err := txn.OpenDBI(opts.DBName, 0)
+	if err != nil {
+		return 0, err
+	}
+	stats, err := txn.Stat(main)
+	if err == nil && stats.Entries > 0 {
+		err = errOriginalFormat
+	}
+	return 0, err
+}
+
+// formatKey is the key of the format record of the main DB.
+func (s *store) formatKey() []byte {
+	if s.name == "" {
+		return []byte(s.opts.DBName)
+	}
+	return []byte(namespaceDBName(s.opts.DBName, s.name))
+}
+
+// originalLeft returns whether the main DB has entries in the original layout
+// left, those after last, and whether it has a format record.
+func (s *store) originalLeft(txn *lmdb.Txn) (last []byte, left, recorded bool, err error) {
+	if s.formatdbi != 0 {
+		rec, err := txn.Get(s.formatdbi, s.formatKey())
+		switch {
+		case err == nil:
+			return append([]byte(nil), rec...), len(rec) > 0, true, nil
+		case !lmdb.IsNotFound(err):
+			return nil, false, false, err
+		}
+	}
+	stats, err := txn.Stat(s.dbi)
+	if err != nil {
+		return nil, false, false, err
+	}
+	return nil, stats.Entries > 0, false, nil
+}
+
+// originalKeys returns which keys of the main DB called name hold entries in
+// the original layout, going by its format record in formatdbi, which is only
+// there if hasFormat. It is for reading an environment without a store, see
+// checkEnv; originalLeft is the same for a store.
+func originalKeys(txn *lmdb.Txn, formatdbi lmdb.DBI, hasFormat bool, name string) (func(key []byte) bool, error) {
+	all := func([]byte) bool { return true }
+	if !hasFormat {
+		return all, nil
+	}
+	rec, err := txn.Get(formatdbi, []byte(name))
+	switch {
+	case lmdb.IsNotFound(err):
+		return all, nil
+	case err != nil:
+		return nil, err
+	case len(rec) == 0:
+		return func([]byte) bool { return false }, nil
+	}
+	last := append([]byte(nil), rec...)
+	return func(key []byte) bool { return bytes.Compare(key, last) > 0 }, nil
+}
+
+// checkFormat rewrites the entries in the original layout, or fails a
+// read-only store that has them.
+func (s *store) checkFormat() error {
+	if !s.opts.ReadOnly {
+		_, err := s.migrateOriginal()
+		return err
+	}
+	return s.view(func(txn *lmdb.Txn) error {
+		_, left, _, err := s.originalLeft(txn)
+		if err == nil && left {
+			return errOriginalFormat
+		}
+		return err
+	})
+}
+
+// migrateOriginal rewrites the entries left in the original layout in the
+// current one, with new CAS tokens, and returns how many there were.
+func (s *store) migrateOriginal() (int, error) {
+	start := time.Now()
+	migrated := 0
+	key := s.formatKey()
+
+	for {
+		var n int
+		var done bool
+
+		err := s.update(func(txn *lmdb.Txn) error {
+			n, done = 0, false
+
+			last, left, recorded, err := s.originalLeft(txn)
+			if err != nil {
+				return err
+			}
+			if !left {
+				done = true
+				if recorded {
+					return nil
+				}
+				return txn.Put(s.formatdbi, key, nil, 0)
+			}
+
+			var old [][2][]byte
+			next, err := s.migrateScan(txn, last, &old)
+			if err != nil {
+				return err
+			}
+
+			// The original layout had no TTL index
+			for _, kv := range old {
+				if err := txn.Put(s.dbi, kv[0], kv[1], 0); err != nil {
+					return err
+				}
+				if err := s.reindex(txn, kv[0], 0, entryExptime(kv[1]), false); err != nil {
+					return err
+				}
+			}
+
+			n = len(old)
+			if next == nil {
+				done = true
+				return txn.Put(s.formatdbi, key, nil, 0)
+			}
+			return txn.Put(s.formatdbi, key, next, 0)
+		})
+		if err != nil {
+			return migrated, err
+		}
+
+		migrated += n
+		if done {
+			if migrated > 0 {
+				s.opts.Logger.Info("Rewrote entries in the original format", "component", "migrate",
+					"namespace", s.name, "migrated", migrated, "duration", time.Since(start))
+			}
+			return migrated, nil
+		}
+	}
+}
+
+// originalEntry appends key and buf, in the original layout, rewritten in the
+// current one to old. The data is compressed and encrypted as configured, like
+// that of any write.
+func (s *store) originalEntry(key, buf []byte, old *[][2][]byte) error {
+	e, err := originalToEntry(buf)
+	if err != nil {
+		return err
+	}
+	e.cas = s.nextCAS()
+	b, err := s.encodeEntry(e)
+	if err != nil {
+		return err
+	}
+	*old = append(*old, [2][]byte{key, b})
+	return nil
+}
+
+// migrateScan looks at up to migrateChunk entries after the key last and
+// appends them, rewritten, to old. It returns the last key looked at, or nil
+// at the end of the DB. The cursor is closed before anything is written.
+func (s *store) migrateScan(txn *lmdb.Txn, last []byte, old *[][2][]byte) ([]byte, error) {
+	cur, err := txn.OpenCursor(s.dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	var key, buf []byte
+	if last == nil {
+		key, buf, err = cur.Get(nil, nil, lmdb.First)
+	} else {
+		key, buf, err = cur.Get(last, nil, lmdb.SetRange)
+		// SetRange lands on last itself if it is still there
+		if err == nil && bytes.Equal(key, last) {
+			key, buf, err = cur.Get(nil, nil, lmdb.Next)
+		}
+	}
+
+	for i := 0; ; i++ {
+		if err != nil {
+			if lmdb.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		if err := s.originalEntry(key, buf, old); err != nil {
+			return nil, err
+		}
+
+		if i == migrateChunk-1 {
+			return key, nil
+		}
+		key, buf, err = cur.Get(nil, nil, lmdb.Next)
+	}
+}
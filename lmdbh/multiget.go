@@ -0,0 +1,167 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// batchMinKeys is the fewest keys in a GetE for it to be served by GetEBatch.
+// Below it sorting costs more than it saves.
+const batchMinKeys = 16
+
+// GetEBatch is GetE for many keys at once, as sent by rend's batching L1L2
+// orchestrator. The keys are looked up in sorted order with one cursor, so
+// neighbouring keys are found on pages already in hand instead of each
+// walking the tree from the root. Responses are streamed in that order rather
+// than the order of the request; each carries its key and opaque. GetE uses
+// it for requests of batchMinKeys keys or more.
+func (h *Handler) GetEBatch(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+	go realHandleGetEBatch(h, cmd, dataOut, errorOut)
+	return dataOut, errorOut
+}
+
+// multiKey is one key of a batch, with its index in the request.
+type multiKey struct {
+	idx      int
+	dk, long []byte
+}
+
+func realHandleGetEBatch(h *Handler, cmd common.GetRequest, dataOut chan common.GetEResponse, errorOut chan error) {
+	for _, p := range h.splitGet(cmd) {
+		if err := getEBatchShard(p.s, p.cmd, dataOut); err != nil {
+			errorOut <- err
+			break
+		}
+	}
+
+	close(dataOut)
+	close(errorOut)
+}
+
+func getEBatchShard(s *store, cmd common.GetRequest, dataOut chan<- common.GetEResponse) error {
+	t := s.startOp(opGetE, keyBytes(cmd.Keys), 0)
+	defer t.done()
+
+	if s.opts.ReadTimeout <= 0 {
+		return getEBatchShardNow(s, t, cmd, dataOut)
+	}
+
+	// Into a buffer of its own, as it may be given up on, see timeout.go
+	cmd.Keys = detachKeys(cmd.Keys)
+	out := make(chan common.GetEResponse, len(cmd.Keys))
+	err := s.withTimeout(s.opts.ReadTimeout, func() error {
+		return getEBatchShardNow(s, t, cmd, out)
+	})
+	if err == ErrTimeout {
+		return err
+	}
+	close(out)
+	for res := range out {
+		dataOut <- res
+	}
+	return err
+}
+
+func getEBatchShardNow(s *store, t *opTimer, cmd common.GetRequest, dataOut chan<- common.GetEResponse) error {
+	keys := make([]multiKey, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		if err := s.checkKey(key); err != nil {
+			return err
+		}
+		dk, long := s.dbKey(key)
+		keys[idx] = multiKey{idx: idx, dk: dk, long: long}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i].dk, keys[j].dk) < 0
+	})
+
+	// Before the view begins, or a set committed since may be missed, see
+	// writebehind.go
+	staged := s.stagedEntries(cmd.Keys)
+
+	called := time.Now()
+	return s.view(func(txn *lmdb.Txn) error {
+		t.waited(called)
+		txn.RawRead = true
+
+		cur, err := txn.OpenCursor(s.dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		for _, k := range keys {
+			miss := common.GetEResponse{
+				Miss:   true,
+				Quiet:  cmd.Quiet[k.idx],
+				Opaque: cmd.Opaques[k.idx],
+				Key:    cmd.Keys[k.idx],
+			}
+
+			e, ok := staged[k.idx]
+			if !ok {
+				e, ok = s.cached(k.dk)
+			}
+			if !ok {
+				buf, err := s.lookup(txn, cur, k.dk)
+				if de := s.decodeErr(err); de != nil {
+					if de == common.ErrKeyNotFound {
+						s.count(&s.stats.misses, MetricMisses)
+						dataOut <- miss
+						continue
+					}
+					return de
+				}
+
+				e, err = s.decodeEntry(txn, k.dk, buf)
+				if err != nil {
+					if err == errChecksum {
+						s.corruptOnRead(k.dk)
+					}
+					return err
+				}
+				s.cache(txn, k.dk, e)
+			}
+
+			if !s.live(e, k.dk, k.long) {
+				s.count(&s.stats.misses, MetricMisses)
+				dataOut <- miss
+				continue
+			}
+
+			s.hit(k.dk)
+			t.addValue(len(e.data))
+
+			dataOut <- common.GetEResponse{
+				Miss:    false,
+				Quiet:   cmd.Quiet[k.idx],
+				Opaque:  cmd.Opaques[k.idx],
+				Exptime: clientExptime(e.exptime),
+				Flags:   e.flags,
+				Key:     cmd.Keys[k.idx],
+				Data:    e.data,
+			}
+		}
+		return nil
+	})
+}
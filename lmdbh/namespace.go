@@ -0,0 +1,251 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Namespace is a set of keys, picked out by a prefix, kept in DBs of their
+// own. Each namespace can be flushed on its own, keeps its own stats, and is
+// reaped separately, but they all share one environment and its map. Keys are
+// stored whole, prefix included.
+type Namespace struct {
+	// Name identifies the namespace. The names of its DBs are made from it,
+	// so renaming a namespace loses its items.
+	Name string
+
+	// Prefix is what the keys of the namespace start with, e.g. "tenantA:".
+	// A key with more than one matching prefix goes to the longest.
+	Prefix string
+
+	// MaxItems and MaxBytes cap the number of items in the namespace and the
+	// bytes of its DBs' pages. A write that would go over either fails with
+	// common.ErrNoMem, unless QuotaEviction makes room in the namespace
+	// first. Zero means no limit.
+	MaxItems int
+	MaxBytes int64
+
+	// QuotaEviction selects which of the namespace's items are removed to
+	// keep it within its quota. Defaults to EvictNone, which fails the
+	// writes instead.
+	QuotaEviction EvictionPolicy
+
+	// DefaultTTL is given to items of the namespace stored without an
+	// exptime, and MaxTTL caps the time any of them can live. Zero means
+	// items never expire unless asked to and no cap.
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+
+	// ExptimeMillis takes every non-zero exptime set in the namespace as
+	// milliseconds from now, for clients that need finer TTLs than a second.
+	// Exptimes are still reported in seconds.
+	ExptimeMillis bool
+
+	// SoftTTL makes items stored in the namespace go stale that long after
+	// being set, see SetSoft. Zero means they don't.
+	SoftTTL time.Duration
+}
+
+var (
+	errNamespaceName   = errors.New("Rend LMDB namespaces need unique, non-empty names")
+	errNamespacePrefix = errors.New("Rend LMDB namespaces need unique, non-empty prefixes")
+	errNoNamespace     = errors.New("Rend LMDB has no such namespace")
+)
+
+// namespaceDBName is the name of the data DB of the namespace called name.
+// Its TTL index and chunk DBs add their suffixes to it.
+func namespaceDBName(dbName, name string) string {
+	return dbName + ":" + name
+}
+
+// ParseNamespaces parses a comma separated list of name=prefix pairs, e.g.
+// "a=tenantA:,b=tenantB:", as taken by command line flags. Each pair can be
+// followed by semicolon separated settings: max-items, max-bytes, evict
+// (none, soonest-expiring, clock or lru), default-ttl, max-ttl, soft-ttl and
+// exptime-ms, e.g. "a=tenantA:;max-bytes=1073741824;evict=clock;max-ttl=24h". An empty string
+// gives no namespaces.
+func ParseNamespaces(list string) ([]Namespace, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	var nss []Namespace
+	for _, spec := range strings.Split(list, ",") {
+		fields := strings.Split(spec, ";")
+		i := strings.IndexByte(fields[0], '=')
+		if i < 0 {
+			return nil, fmt.Errorf("Rend LMDB namespace %q is not name=prefix", spec)
+		}
+		n := Namespace{Name: fields[0][:i], Prefix: fields[0][i+1:]}
+		for _, f := range fields[1:] {
+			if err := n.set(f); err != nil {
+				return nil, err
+			}
+		}
+		nss = append(nss, n)
+	}
+	return nss, checkNamespaces(nss)
+}
+
+// set applies one key=value setting from ParseNamespaces.
+func (n *Namespace) set(setting string) error {
+	i := strings.IndexByte(setting, '=')
+	if i < 0 {
+		return fmt.Errorf("Rend LMDB namespace %s setting %q is not key=value", n.Name, setting)
+	}
+	key, val := setting[:i], setting[i+1:]
+
+	var err error
+	switch key {
+	case "max-items":
+		n.MaxItems, err = strconv.Atoi(val)
+	case "max-bytes":
+		n.MaxBytes, err = strconv.ParseInt(val, 10, 64)
+	case "default-ttl":
+		n.DefaultTTL, err = time.ParseDuration(val)
+	case "max-ttl":
+		n.MaxTTL, err = time.ParseDuration(val)
+	case "soft-ttl":
+		n.SoftTTL, err = time.ParseDuration(val)
+	case "exptime-ms":
+		n.ExptimeMillis, err = strconv.ParseBool(val)
+	case "evict":
+		switch val {
+		case "none":
+			n.QuotaEviction = EvictNone
+		case "soonest-expiring":
+			n.QuotaEviction = EvictSoonestExpiring
+		case "clock":
+			n.QuotaEviction = EvictClock
+		case "lru":
+			n.QuotaEviction = EvictLRU
+		default:
+			err = errors.New("no such eviction policy")
+		}
+	default:
+		return fmt.Errorf("Rend LMDB namespace %s has no setting %q", n.Name, key)
+	}
+	if err != nil {
+		return fmt.Errorf("Rend LMDB namespace %s setting %q: %v", n.Name, setting, err)
+	}
+	return nil
+}
+
+func checkNamespaces(nss []Namespace) error {
+	names := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	for _, n := range nss {
+		if n.Name == "" || names[n.Name] {
+			return errNamespaceName
+		}
+		if n.Prefix == "" || prefixes[n.Prefix] {
+			return errNamespacePrefix
+		}
+		names[n.Name], prefixes[n.Prefix] = true, true
+	}
+	return nil
+}
+
+// namespace returns the store of the namespace key belongs to, which is s
+// itself, the default namespace, if no prefix matches.
+func (s *store) namespace(key []byte) *store {
+	ns := s
+	for _, n := range s.namespaces[1:] {
+		if len(n.prefix) > len(ns.prefix) && bytes.HasPrefix(key, n.prefix) {
+			ns = n
+		}
+	}
+	return ns
+}
+
+// all returns the stores of every namespace of every shard.
+func (h *Handler) all() []*store {
+	if len(h.shards) == 1 {
+		return h.shards[0].namespaces
+	}
+	var all []*store
+	for _, s := range h.shards {
+		all = append(all, s.namespaces...)
+	}
+	return all
+}
+
+// named returns the stores of the namespace called name in every shard. The
+// default namespace is called "".
+func (h *Handler) named(name string) ([]*store, error) {
+	var named []*store
+	for _, s := range h.shards {
+		for _, ns := range s.namespaces {
+			if ns.name == name {
+				named = append(named, ns)
+			}
+		}
+	}
+	if len(named) == 0 {
+		return nil, errNoNamespace
+	}
+	return named, nil
+}
+
+// FlushNamespace is Flush for the items of one namespace only. The default
+// namespace, of keys with no namespace's prefix, is called "".
+func (h *Handler) FlushNamespace(name string, delay time.Duration) error {
+	named, err := h.named(name)
+	if err != nil {
+		return err
+	}
+	for _, s := range named {
+		if err := s.flushAfter(delay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NamespaceStats is Stats for one namespace. The counters and item counts are
+// the namespace's own; the space usage is of the whole environment, which the
+// namespaces share.
+func (h *Handler) NamespaceStats(name string) (Stats, error) {
+	named, err := h.named(name)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	var sum Stats
+	for _, s := range named {
+		st, err := s.statsSnapshot()
+		if err != nil {
+			return Stats{}, err
+		}
+		sum.add(st)
+	}
+	return sum, nil
+}
+
+// Namespaces returns the names of the handler's namespaces, starting with ""
+// for the default one.
+func (h *Handler) Namespaces() []string {
+	names := make([]string, 0, len(h.shards[0].namespaces))
+	for _, ns := range h.shards[0].namespaces {
+		names = append(names, ns.name)
+	}
+	return names
+}
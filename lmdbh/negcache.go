@@ -0,0 +1,197 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// The negative cache keeps tombstones for keys that reads recently found
+// missing, in memory, so looking them up again for NegativeCacheTTL answers a
+// miss without descending the B-tree and faulting in its cold pages.
+//
+// Every write to a key removes its tombstone, see put, putEntry, setExptime
+// and del. A read whose transaction started before a write committed still
+// sees the key missing, so each stripe also remembers the ID of the last
+// write transaction to touch any of its keys, before it commits, and a
+// tombstone is only added by a read whose snapshot includes that write.
+// Writes by other processes sharing the environment aren't seen, which is
+// what the TTL bounds, and it isn't used in read-only mode, where every write
+// is by another process.
+const (
+	negStripes = 64
+
+	defaultNegativeCacheSize = 100000
+)
+
+type negCache struct {
+	ttl     uint64 // milliseconds
+	max     int    // per stripe
+	stripes [negStripes]negStripe
+}
+
+type negStripe struct {
+	sync.Mutex
+	lastWrite uintptr
+	// tombstones maps keys to when they expire
+	tombstones map[string]uint64
+}
+
+func newNegCache(opts Options) *negCache {
+	if opts.NegativeCacheTTL <= 0 {
+		return nil
+	}
+	size := opts.NegativeCacheSize
+	if size <= 0 {
+		size = defaultNegativeCacheSize
+	}
+
+	c := &negCache{
+		ttl: uint64(opts.NegativeCacheTTL / time.Millisecond),
+		max: (size + negStripes - 1) / negStripes,
+	}
+	for i := range c.stripes {
+		c.stripes[i].tombstones = make(map[string]uint64)
+	}
+	return c
+}
+
+func (c *negCache) stripe(key []byte) *negStripe {
+	h := fnv.New32a()
+	h.Write(key)
+	return &c.stripes[h.Sum32()%negStripes]
+}
+
+// has returns whether key has a live tombstone at now.
+func (c *negCache) has(key []byte, now uint64) bool {
+	st := c.stripe(key)
+	st.Lock()
+	exp, ok := st.tombstones[string(key)]
+	if ok && exp < now {
+		delete(st.tombstones, string(key))
+		ok = false
+	}
+	st.Unlock()
+	return ok
+}
+
+// add records that a read in a transaction that sees up to the write
+// transaction readID found key missing at now.
+func (c *negCache) add(key []byte, readID uintptr, now uint64) {
+	st := c.stripe(key)
+	st.Lock()
+	defer st.Unlock()
+
+	if readID < st.lastWrite {
+		return
+	}
+	if len(st.tombstones) >= c.max {
+		// Make room with whichever comes first
+		for k := range st.tombstones {
+			delete(st.tombstones, k)
+			break
+		}
+	}
+	st.tombstones[string(key)] = now + c.ttl
+}
+
+// written removes the tombstone of key, which the write transaction writeID
+// is changing.
+func (c *negCache) written(key []byte, writeID uintptr) {
+	st := c.stripe(key)
+	st.Lock()
+	if writeID > st.lastWrite {
+		st.lastWrite = writeID
+	}
+	delete(st.tombstones, string(key))
+	st.Unlock()
+}
+
+// txnIDsReset tells the negative cache, read cache and coalesced gets that the
+// environment's transaction IDs have started over, as they do in a compacted
+// copy. No transactions may be open.
+func (s *store) txnIDsReset() {
+	if s.negative != nil {
+		for i := range s.negative.stripes {
+			s.negative.stripes[i].lastWrite = 0
+		}
+	}
+	if s.recent != nil {
+		for i := range s.recent.stripes {
+			s.recent.stripes[i].lastWrite = 0
+		}
+	}
+	if s.flights != nil {
+		for i := range s.flights.stripes {
+			s.flights.stripes[i].lastWrite = 0
+		}
+	}
+}
+
+// lookup reads the value stored at dk for a client read, missing straight away
+// if the bloom filter rules dk out or the negative cache has a tombstone for
+// it. cur, if not nil, is a cursor on the data DB to read with instead of txn.
+func (s *store) lookup(txn *lmdb.Txn, cur *lmdb.Cursor, dk []byte) ([]byte, error) {
+	if s.bloom != nil && !s.bloom.has(dk) {
+		s.count(&s.stats.bloomMisses, MetricBloomMisses)
+		return nil, &lmdb.OpError{Op: "mdb_get", Errno: lmdb.NotFound}
+	}
+	if s.negative == nil {
+		if cur != nil {
+			_, buf, err := cur.Get(dk, nil, lmdb.Set)
+			return buf, err
+		}
+		return txn.Get(s.dbi, dk)
+	}
+
+	now := s.now()
+	if s.negative.has(dk, now) {
+		s.count(&s.stats.negHits, MetricNegHits)
+		return nil, &lmdb.OpError{Op: "mdb_get", Errno: lmdb.NotFound}
+	}
+
+	var buf []byte
+	var err error
+	if cur != nil {
+		_, buf, err = cur.Get(dk, nil, lmdb.Set)
+	} else {
+		buf, err = txn.Get(s.dbi, dk)
+	}
+	if lmdb.IsNotFound(err) {
+		s.negative.add(dk, txn.ID(), now)
+	}
+	return buf, err
+}
+
+// written tells the bloom filter, negative cache, read cache and coalesced
+// gets that txn writes key.
+func (s *store) written(txn *lmdb.Txn, key []byte) {
+	if s.bloom != nil {
+		s.bloom.add(key)
+	}
+	if s.negative != nil {
+		s.negative.written(key, txn.ID())
+	}
+	if s.recent != nil {
+		s.recent.written(key, txn.ID())
+	}
+	if s.flights != nil {
+		s.flights.written(key, txn.ID())
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// With Options.OplogSize set, every change an environment commits is also
+// recorded in its oplog DB, in the same transaction, keyed by a big endian
+// sequence number that goes up by one with each record. Only the last
+// OplogSize records are kept. A record is
+//
+//	0    1      9       13        21     29
+//	| op | time | flags | exptime | hash | ns len | ns | key len | key | value |
+//
+// with the lengths two bytes each, the time in Unix nanoseconds, exptime in
+// milliseconds and hash the FNV-1a hash of the value, all of them big endian.
+// Only sets and touches have flags, an exptime and a hash, and only sets with
+// OplogValues a value, encrypted if values are. Evictions are not recorded:
+// they are up to each store, and recording them could need the room they are
+// making.
+const (
+	oplogDBSuffix = "_oplog"
+
+	offOplogTime    = 1
+	offOplogFlags   = 9
+	offOplogExptime = 13
+	offOplogHash    = 21
+	oplogHeaderLen  = 29
+)
+
+var (
+	// ErrOplogTrimmed is returned when the records asked for have already
+	// been trimmed from the oplog, so the caller has missed some.
+	ErrOplogTrimmed = errors.New("Rend LMDB oplog no longer has the records asked for")
+
+	errNoOplog = errors.New("Rend LMDB has no oplog, see Options.OplogSize")
+	errNoShard = errors.New("Rend LMDB has no such shard")
+)
+
+// OplogRecord is a change recorded in the oplog, see Handler.Oplog.
+type OplogRecord struct {
+	Seq       uint64
+	Op        EventType
+	Namespace string
+	Key       []byte
+	Time      time.Time
+
+	// Flags and Exptime, in Unix milliseconds or zero for never, are those
+	// of a set, and the exptime of a touch
+	Flags   uint32
+	Exptime uint64
+
+	// ValueHash is the FNV-1a hash of the value of a set, and Value the
+	// value itself with OplogValues
+	ValueHash uint64
+	Value     []byte
+}
+
+type oplog struct {
+	// dbi is opened by openEnv
+	dbi lmdb.DBI
+}
+
+func oplogKey(seq uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, seq)
+	return buf
+}
+
+// logOp records that txn made a change of type t to key.
+func (s *store) logOp(txn *lmdb.Txn, t EventType, key []byte) error {
+	if t == EventEvict {
+		return nil
+	}
+
+	var e entry
+	var value []byte
+	switch t {
+	case EventSet:
+		buf, err := txn.Get(s.dbi, key)
+		if err != nil {
+			return err
+		}
+		if e, err = s.decodeEntry(txn, key, buf); err != nil {
+			return err
+		}
+		if s.opts.OplogValues {
+			value = e.data
+			if s.crypt != nil {
+				if value, err = s.crypt.encrypt(value); err != nil {
+					return err
+				}
+			}
+		}
+	case EventTouch:
+		buf, err := txn.Get(s.dbi, key)
+		if err != nil {
+			return err
+		}
+		e.exptime = entryExptime(buf)
+	}
+
+	rec := make([]byte, oplogHeaderLen, oplogHeaderLen+4+len(s.name)+len(key)+len(value))
+	rec[0] = byte(t)
+	binary.BigEndian.PutUint64(rec[offOplogTime:], uint64(s.opts.Clock.Now().UnixNano()))
+	binary.BigEndian.PutUint32(rec[offOplogFlags:], e.flags)
+	binary.BigEndian.PutUint64(rec[offOplogExptime:], e.exptime)
+	if t == EventSet {
+		h := fnv.New64a()
+		h.Write(e.data)
+		binary.BigEndian.PutUint64(rec[offOplogHash:], h.Sum64())
+	}
+	rec = appendLenPrefixed(rec, []byte(s.name))
+	rec = appendLenPrefixed(rec, key)
+	rec = append(rec, value...)
+
+	cur, err := txn.OpenCursor(s.oplog.dbi)
+	if err != nil {
+		return err
+	}
+	defer cur.Close()
+
+	seq := uint64(1)
+	last, _, err := cur.Get(nil, nil, lmdb.Last)
+	switch {
+	case err == nil:
+		seq = binary.BigEndian.Uint64(last) + 1
+	case !lmdb.IsNotFound(err):
+		return err
+	}
+	if err := txn.Put(s.oplog.dbi, oplogKey(seq), rec, lmdb.Append); err != nil {
+		return err
+	}
+
+	// Usually one record goes, but more if OplogSize was lowered
+	for {
+		first, _, err := cur.Get(nil, nil, lmdb.First)
+		if err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint64(first)+uint64(s.opts.OplogSize) > seq {
+			return nil
+		}
+		if err := cur.Del(0); err != nil {
+			return err
+		}
+	}
+}
+
+func appendLenPrefixed(buf, b []byte) []byte {
+	var n [2]byte
+	binary.BigEndian.PutUint16(n[:], uint16(len(b)))
+	return append(append(buf, n[:]...), b...)
+}
+
+func readLenPrefixed(buf []byte) (b, rest []byte, err error) {
+	if len(buf) < 2 {
+		return nil, nil, errCorruptValue
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if len(buf) < 2+n {
+		return nil, nil, errCorruptValue
+	}
+	return buf[2 : 2+n], buf[2+n:], nil
+}
+
+func (s *store) parseOplogRecord(seq uint64, buf []byte) (OplogRecord, error) {
+	if len(buf) < oplogHeaderLen {
+		return OplogRecord{}, errCorruptValue
+	}
+	r := OplogRecord{
+		Seq:       seq,
+		Op:        EventType(buf[0]),
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(buf[offOplogTime:]))),
+		Flags:     binary.BigEndian.Uint32(buf[offOplogFlags:]),
+		Exptime:   binary.BigEndian.Uint64(buf[offOplogExptime:]),
+		ValueHash: binary.BigEndian.Uint64(buf[offOplogHash:]),
+	}
+
+	ns, rest, err := readLenPrefixed(buf[oplogHeaderLen:])
+	if err != nil {
+		return r, err
+	}
+	key, value, err := readLenPrefixed(rest)
+	if err != nil {
+		return r, err
+	}
+	r.Namespace = string(ns)
+	r.Key = append([]byte(nil), key...)
+
+	if r.Op == EventSet && s.opts.OplogValues {
+		if s.crypt != nil {
+			if value, err = s.crypt.decrypt(value); err != nil {
+				return r, err
+			}
+		}
+		r.Value = append([]byte{}, value...)
+	}
+	return r, nil
+}
+
+// Oplog returns up to max records of the oplog of shard, oldest first, from
+// sequence number from on, or from the oldest kept if from is zero. It returns
+// ErrOplogTrimmed if records from from on have been trimmed, so a tailer that
+// falls more than OplogSize records behind finds out. Tail the oplog by asking
+// for the records after the last one returned, starting from OplogSeq + 1.
+func (h *Handler) Oplog(shard int, from uint64, max int) ([]OplogRecord, error) {
+	s, err := h.oplogShard(shard)
+	if err != nil {
+		return nil, err
+	}
+	return s.oplogRecords(from, max)
+}
+
+func (s *store) oplogRecords(from uint64, max int) ([]OplogRecord, error) {
+	var recs []OplogRecord
+	err := s.view(func(txn *lmdb.Txn) error {
+		recs = recs[:0]
+		cur, err := txn.OpenCursor(s.oplog.dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		k, _, err := cur.Get(nil, nil, lmdb.First)
+		if lmdb.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if from != 0 && from < binary.BigEndian.Uint64(k) {
+			return ErrOplogTrimmed
+		}
+
+		k, v, err := cur.Get(oplogKey(from), nil, lmdb.SetRange)
+		for ; err == nil && len(recs) < max; k, v, err = cur.Get(nil, nil, lmdb.Next) {
+			r, err := s.parseOplogRecord(binary.BigEndian.Uint64(k), v)
+			if err != nil {
+				return err
+			}
+			recs = append(recs, r)
+		}
+		if err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// OplogSeq returns the sequence number of the last record in the oplog of
+// shard, zero if there are none yet.
+func (h *Handler) OplogSeq(shard int) (uint64, error) {
+	s, err := h.oplogShard(shard)
+	if err != nil {
+		return 0, err
+	}
+	return s.oplogSeq()
+}
+
+func (s *store) oplogSeq() (uint64, error) {
+	var seq uint64
+	err := s.view(func(txn *lmdb.Txn) error {
+		cur, err := txn.OpenCursor(s.oplog.dbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		k, _, err := cur.Get(nil, nil, lmdb.Last)
+		if err == nil {
+			seq = binary.BigEndian.Uint64(k)
+		} else if !lmdb.IsNotFound(err) {
+			return err
+		}
+		return nil
+	})
+	return seq, err
+}
+
+func (h *Handler) oplogShard(shard int) (*store, error) {
+	if shard < 0 || shard >= len(h.shards) {
+		return nil, errNoShard
+	}
+	s := h.shards[shard]
+	if s.oplog == nil {
+		return nil, errNoOplog
+	}
+	return s, nil
+}
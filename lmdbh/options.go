@@ -0,0 +1,585 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"os"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	defaultMapSize        = 2 * 1024 * 1024 * 1024
+	defaultDBName         = "rendb"
+	defaultReaperInterval = 30 * time.Second
+	defaultReaperBatch    = 64
+	defaultFileMode       = 0664
+	defaultDirMode        = 0774
+
+	defaultCompressionThreshold = 1024
+)
+
+// Options holds the configuration for an LMDB-backed handler. The only required
+// field is Path; any other field left at its zero value is given a default.
+type Options struct {
+	// Path is the directory the LMDB environment lives in, or with NoSubdir
+	// its data file. The directory is created if it does not already exist.
+	Path string
+
+	// FileMode is the permissions of the data and lock files and of restored
+	// data files, and DirMode of the directories created for the environment,
+	// backups and compaction. Both are masked by the process umask unless
+	// ExactModes is set, which also applies them to the environment's
+	// directory and files, and to backups, when they already exist. They
+	// default to 0664 and 0774.
+	FileMode   os.FileMode
+	DirMode    os.FileMode
+	ExactModes bool
+
+	// MapSize is the maximum size of the memory map, and thus the database, in
+	// bytes. Defaults to 2GB.
+	MapSize int64
+
+	// MaxMapSize allows the map to grow when it fills up. When a write fails
+	// because the map is full, the map size is doubled, up to MaxMapSize, and
+	// the write is retried. Zero, or anything not more than MapSize, disables
+	// growth.
+	MaxMapSize int64
+
+	// Eviction selects how room is made for new writes once the map is full
+	// and cannot grow. Defaults to EvictNone, which fails the writes.
+	Eviction EvictionPolicy
+
+	// LRUSampleRate only tracks one in this many hits for EvictLRU, for less
+	// write load. Defaults to every hit.
+	LRUSampleRate int
+
+	// EvictHighWater turns on evicting ahead of a full map: once the pages in
+	// use pass this fraction of MapSize, or MaxMapSize if larger, items are
+	// evicted until they are below EvictLowWater, see highwater.go. Zero
+	// only evicts when a write finds the map full.
+	EvictHighWater float64
+
+	// EvictLowWater is the fraction of the map eviction from EvictHighWater
+	// brings the pages in use down to. Defaults to 0.05 below EvictHighWater.
+	EvictLowWater float64
+
+	// EvictCheckInterval is the time between checks against EvictHighWater.
+	// Defaults to a second.
+	EvictCheckInterval time.Duration
+
+	// MaxReaders is the maximum number of concurrent read transactions, in
+	// this and any other processes with the environment open. Zero leaves the
+	// LMDB default (126) in place. A read that finds them all taken is retried
+	// for a few milliseconds before failing, after clearing any left by dead
+	// processes.
+	MaxReaders int
+
+	// MaxKeySize is the longest key, in bytes, accepted. Commands with longer
+	// or empty keys fail with common.ErrBadRequest. Defaults to memcached's
+	// 250, and can't be more than LMDB's limit less 4 bytes, usually 507,
+	// unless HashLongKeys is set.
+	MaxKeySize int
+
+	// HashLongKeys stores keys too long for LMDB under a fixed size key made
+	// from a SHA-256 of the key instead of rejecting them. MaxKeySize still
+	// applies, and can go up to 64KB. The whole key is stored with the value.
+	HashLongKeys bool
+
+	// MaxValueSize is the largest value, in bytes, accepted. Writes of larger
+	// values fail with common.ErrValueTooBig. Defaults to memcached's 1MB.
+	MaxValueSize int
+
+	// Shards splits the items across this many LMDB environments, each in
+	// its own directory under Path and with its own writer, reaper and
+	// background work, by a hash of the key. LMDB only allows one write
+	// transaction at a time per environment, so this raises the ceiling on
+	// write throughput. MapSize, MaxMapSize and MaxReaders apply to each
+	// shard, as do BackupDir and RestoreFrom, which get the same directory
+	// layout. BackupSink and RestoreSource can't be used with it. The items
+	// of a DB can't be read back with a different number of shards. Zero or
+	// one keeps everything in Path.
+	Shards int
+
+	// DBName is the name of the named database inside the environment that
+	// holds all of the entries. Defaults to "rendb".
+	DBName string
+
+	// Namespaces keeps the keys starting with each namespace's prefix in DBs
+	// of their own, see Namespace. Keys matching no prefix are in the default
+	// namespace, in DBName. Namespaces can be added later without losing
+	// anything, but a key moved into a namespace is not found in the DB it
+	// was in before.
+	Namespaces []Namespace
+
+	// ReaperInterval is the time between runs of the background reaper that
+	// removes expired items. Defaults to 30 seconds.
+	ReaperInterval time.Duration
+
+	// ReaperInitialDelay is the time before the first reaper run. Zero waits
+	// one ReaperInterval.
+	ReaperInitialDelay time.Duration
+
+	// ReaperJitter varies each wait between reaper runs, the first included,
+	// by a random amount up to this fraction of it either way, so the
+	// reapers of instances started together don't all run at once. 0.1 waits
+	// 27 to 33 seconds with the default interval. Zero always waits the same.
+	ReaperJitter float64
+
+	// ReaperMaxDeletes caps the number of items removed in one reaper run. Any
+	// remaining expired items are left for the next run. Zero means no limit.
+	ReaperMaxDeletes int
+
+	// ReaperMaxDuration caps the time spent in one reaper run. Zero means no
+	// limit.
+	ReaperMaxDuration time.Duration
+
+	// ReaperBatchSize is the most expired items the reaper removes per write
+	// transaction. Bigger batches share a commit between more deletes but
+	// hold the writer lock longer. Defaults to 64.
+	ReaperBatchSize int
+
+	// ReaperMaxRate caps the items the reaper removes per second, so a wave
+	// of expirations doesn't take the writer lock and the disk away from
+	// clients for long. Zero means no limit.
+	ReaperMaxRate int
+
+	// ReaperBatchPause is the least time the reaper waits between batches.
+	// Zero doesn't wait.
+	ReaperBatchPause time.Duration
+
+	// DisableReaper turns off the background reaper entirely. Expired items
+	// are still never returned, but they stay on disk until overwritten.
+	DisableReaper bool
+
+	// PurgeOnOpen removes every item that expired while the environment was
+	// closed before New returns, walking the TTL index in full without the
+	// reaper's limits or pacing, so a restarted instance starts out lean.
+	PurgeOnOpen bool
+
+	// DeleteExpiredOnRead queues expired items found by Get, GetE and Gets for
+	// deletion by a background goroutine instead of leaving them for the
+	// reaper.
+	DeleteExpiredOnRead bool
+
+	// EarlyExpiration makes reads miss a growing fraction of the time as
+	// items near their exptime, so the clients that refill them are spread
+	// out instead of all missing at once. A read with t left misses with
+	// probability exp(-t/EarlyExpiration): 37% with EarlyExpiration left
+	// and under 1% with five times that. Set it to around how long a client
+	// takes to refill an item. Zero disables it.
+	EarlyExpiration time.Duration
+
+	// TTLJitter varies the TTL of every item stored or touched by a random
+	// amount up to this fraction of it either way, so items written together
+	// don't all expire together. 0.1 gives an item set for an hour 54 to 66
+	// minutes. Zero keeps TTLs as they are asked for.
+	TTLJitter float64
+
+	// ExptimeMillis takes every non-zero exptime set outside a namespace as
+	// milliseconds from now, like Namespace.ExptimeMillis does for the items
+	// of a namespace.
+	ExptimeMillis bool
+
+	// LeaseTTL is how long a lease handed out by GetL is held for if SetL
+	// doesn't use it first. Defaults to 10 seconds.
+	LeaseTTL time.Duration
+
+	// NegativeCacheTTL keeps a tombstone in memory for that long for each
+	// key a read finds missing, so reading it again answers the miss without
+	// going to the B-tree, see negcache.go. Writes to a key remove its
+	// tombstone, but writes by other processes don't, so keep it short.
+	// NegativeCacheSize caps the tombstones of each namespace, defaulting to
+	// 100000. Zero disables it.
+	NegativeCacheTTL  time.Duration
+	NegativeCacheSize int
+
+	// ReadCacheBytes keeps up to that many bytes of recently read items of
+	// each namespace in memory, decoded, so gets of hot keys are served
+	// without a transaction, see readcache.go. Writes to a key drop it, but
+	// writes by other processes don't, so it must not be used with any
+	// sharing the environment. Zero disables it.
+	ReadCacheBytes int
+
+	// CoalesceGets has concurrent gets of the same single key share one read
+	// transaction, see coalesce.go. It is not used in read-only mode.
+	CoalesceGets bool
+
+	// BloomFilterItems keeps a bloom filter of each namespace's keys in
+	// memory, sized for at least this many items with 1% false positives,
+	// about 1.2 bytes an item, so reads of keys that aren't stored miss
+	// without touching the map, see bloom.go. It is built by scanning the
+	// keys on open. It misses writes by other processes, so it must not be
+	// used with any sharing the environment. Zero disables it.
+	BloomFilterItems int
+
+	// WriteBatchSize enables batching of client mutations. Up to this many
+	// mutations arriving within WriteBatchDelay of each other are committed in
+	// one write transaction, so they share one commit and fsync instead of
+	// queueing on LMDB's writer lock one at a time. Zero or one disables
+	// batching.
+	WriteBatchSize int
+
+	// WriteBatchDelay is the longest a mutation waits for others to batch
+	// with. Defaults to 200 microseconds.
+	WriteBatchDelay time.Duration
+
+	// WriteBehind acknowledges sets once they are staged in memory, and
+	// commits up to this many at a time in the background, see
+	// writebehind.go. Sets wait while that many are staged. Staged sets are
+	// lost if the process dies. Zero disables it.
+	WriteBehind int
+
+	// WriteBehindDelay is the longest a set stays staged before it is
+	// committed. Defaults to 100 milliseconds.
+	WriteBehindDelay time.Duration
+
+	// NoSync skips the fsync after each commit. This trades durability of the
+	// last few transactions for write throughput. (MDB_NOSYNC)
+	NoSync bool
+
+	// NoMetaSync skips the fsync of the meta page after each commit. The meta
+	// page is flushed with the next commit or explicit sync. (MDB_NOMETASYNC)
+	NoMetaSync bool
+
+	// WriteMap uses a writable memory map instead of write(2) for commits.
+	// Faster, but stray writes through the map can corrupt the DB.
+	// (MDB_WRITEMAP)
+	WriteMap bool
+
+	// MapAsync flushes the map asynchronously. Only has an effect along with
+	// WriteMap. (MDB_MAPASYNC)
+	MapAsync bool
+
+	// SyncOps names operations, e.g. "delete" or "cas", that are durable
+	// when they return even with NoSync, NoMetaSync or MapAsync: each gets
+	// a write transaction of its own, never batched or staged, and syncs the
+	// environment after committing, see durability.go. The names are those
+	// of the per operation stats, see ParseSyncOps.
+	SyncOps []string
+
+	// SyncInterval syncs the environment that often with NoSync, NoMetaSync
+	// or MapAsync, bounding the commits a crash can lose. Zero leaves it
+	// to the OS and Close.
+	SyncInterval time.Duration
+
+	// NoSubdir takes Path as the data file itself rather than a directory to
+	// keep data.mdb and lock.mdb in, and puts the lock file next to it, with
+	// "-lock" added to its name. With Shards, each shard gets a file of its
+	// own, named after Path. Backups are still directories. (MDB_NOSUBDIR)
+	NoSubdir bool
+
+	// NoReadahead turns off the OS's readahead on the map, which mostly reads
+	// in pages that aren't needed once the DB is bigger than memory.
+	// (MDB_NORDAHEAD)
+	NoReadahead bool
+
+	// WarmUp reads the data file in use into the page cache in the background
+	// once it is opened, so the first reads don't all wait on the disk. See
+	// Handler.Warm for when it is done.
+	WarmUp bool
+
+	// ReadOnly opens an existing environment without write access, e.g. to
+	// serve reads from a copy another process keeps writing to. Every
+	// mutation fails with an error, and the reaper, compaction, deletes on
+	// read and restores are off. Scheduled backups still run. It can't be
+	// used with WriteMap. See readers.go for sharing an environment with a
+	// writer in another process. (MDB_RDONLY)
+	ReadOnly bool
+
+	// NoLock opens a ReadOnly environment without the lock file, e.g. on a
+	// read-only file system where it can't be created. Nothing may write to
+	// the environment while it is open, see readers.go. (MDB_NOLOCK)
+	NoLock bool
+
+	// SharedReaders says other processes open the environment ReadOnly while
+	// this one writes to it, see readers.go. Compaction would replace the data
+	// file under them, so it can't be used with CompactInterval, and Compact
+	// fails.
+	SharedReaders bool
+
+	// ReadTimeout and WriteTimeout bound how long a get waits on its read
+	// and a mutation on its write, failing it with ErrTimeout instead, see
+	// timeout.go. A write that timed out may still be committed. Zero waits
+	// for as long as it takes.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// BreakerLatency and BreakerErrorRate put a circuit breaker around
+	// writes, see breaker.go: it opens when BreakerErrorRate of the last
+	// BreakerWindow writes took longer than BreakerLatency or failed in the
+	// OS, or a write has taken BreakerLatency so far, and client writes fail
+	// with ErrBreakerOpen for BreakerCooldown. Both zero leave it off.
+	// BreakerWindow defaults to 20, BreakerCooldown to 5 seconds and
+	// BreakerErrorRate to 0.5.
+	BreakerLatency   time.Duration
+	BreakerErrorRate float64
+	BreakerWindow    int
+	BreakerCooldown  time.Duration
+
+	// OplogSize makes every change to the environment be recorded in its
+	// oplog, keeping the last OplogSize records, see Handler.Oplog. Zero
+	// turns the oplog off. With OplogValues the values of sets are recorded
+	// too, rather than only their hashes.
+	OplogSize   int
+	OplogValues bool
+
+	// WriteTimes records the time of each write in the item, for Inspect,
+	// at 8 bytes an item. Items written before it was set have none.
+	WriteTimes bool
+
+	// TagIndex keeps an index of the tags of items set with SetTagged, so
+	// InvalidateTag can delete them, see tags.go.
+	TagIndex bool
+
+	// ReplicaAddr is the host:port of a server to send every change to, in
+	// the memcached text protocol, as a standby, see replicate.go. It needs
+	// OplogSize and OplogValues. ReplicaTimeout bounds each connect and
+	// batch, 5 seconds by default, and a failed batch is retried after a
+	// backoff growing up to ReplicaMaxBackoff, 10 seconds by default.
+	ReplicaAddr       string
+	ReplicaTimeout    time.Duration
+	ReplicaMaxBackoff time.Duration
+
+	// DiskFullProbeInterval is how often to check for room once writes are
+	// off because the file system filled up, see diskfull.go. Defaults to
+	// 10 seconds.
+	DiskFullProbeInterval time.Duration
+
+	// ReaderCheckInterval is the time between clearing the reader slots left
+	// in the lock file by processes that died with a transaction open. Slots
+	// are always cleared on startup. Zero only clears them then.
+	ReaderCheckInterval time.Duration
+
+	// LongReadThreshold is how long a read transaction can be open before it
+	// is logged and counted as a long read, see watchdog.go. Zero turns off
+	// tracking them.
+	LongReadThreshold time.Duration
+
+	// SlowOpThreshold logs, at Warn, each handler operation that takes that
+	// long or longer, with the sizes of its keys and values and how long it
+	// waited for its transaction to begin, and counts it as a slow op. Zero
+	// turns it off.
+	SlowOpThreshold time.Duration
+
+	// AbortLongReads ends long reads that scan the DB, like Dump, with an
+	// error instead of only reporting them.
+	AbortLongReads bool
+
+	// BackupInterval enables scheduled backups. Every BackupInterval a snapshot
+	// of the DB is written to a new directory under BackupDir named after the
+	// time it was taken. Zero disables scheduled backups.
+	BackupInterval time.Duration
+
+	// BackupDir is the directory scheduled snapshots are kept in. Either it or
+	// BackupSink is required when BackupInterval is set.
+	BackupDir string
+
+	// BackupSink receives scheduled snapshots instead of BackupDir, streamed
+	// as they are made. Retention is then up to the sink; BackupKeep only
+	// applies to BackupDir.
+	BackupSink BackupSink
+
+	// BackupKeep is the number of scheduled snapshots kept. Older ones are
+	// removed after each new one is taken. Zero keeps all of them.
+	BackupKeep int
+
+	// BackupCompact leaves free pages out of scheduled snapshots, see
+	// Handler.Backup.
+	BackupCompact bool
+
+	// RestoreFrom is a local backup to restore from when the data file is
+	// missing or fails a basic integrity check on startup. It can be a BackupDir
+	// of scheduled snapshots, whose newest is used, a directory written by
+	// Handler.Backup, or a data.mdb image. A corrupt data file is renamed aside
+	// rather than deleted.
+	RestoreFrom string
+
+	// RestoreSource is like RestoreFrom, but reads the snapshot from a
+	// BackupSource, e.g. the same store a BackupSink writes to. It takes
+	// precedence over RestoreFrom.
+	RestoreSource BackupSource
+
+	// OnCorruption selects what happens when the data file fails its
+	// integrity check on startup. It defaults to CorruptRestore.
+	OnCorruption CorruptionPolicy
+
+	// CheckEntries is how many entries, picked at random, the integrity check
+	// on startup reads on top of the roots of the DBs, and CheckChecksums has
+	// it decode them, checking the checksums of those stored with one.
+	CheckEntries   int
+	CheckChecksums bool
+
+	// CompactInterval enables periodic compaction of the data file, which
+	// gives the space held by free pages back to the file system. Writes wait
+	// while the DB is copied. Zero disables it. See Handler.Compact.
+	CompactInterval time.Duration
+
+	// CompactMinFree is the fraction of the file's pages that must be free for
+	// a periodic compaction to run. Zero always compacts.
+	CompactMinFree float64
+
+	// Compression compresses values of at least CompressionThreshold bytes
+	// before they are stored. Values that do not shrink are stored as they
+	// are. Nil disables compression. Values already stored compressed are
+	// readable either way, see RegisterCodec.
+	Compression Codec
+
+	// CompressionThreshold is the smallest value, in bytes, that is
+	// compressed. Defaults to 1KB.
+	CompressionThreshold int
+
+	// Encryption encrypts values with AES-GCM using keys from the provider.
+	// Keys and metadata are not encrypted, only values. Nil stores values in
+	// the clear, and fails reads of values that were stored encrypted.
+	Encryption KeyProvider
+
+	// ChunkSize splits entries bigger than this many bytes into chunks of
+	// this size, stored under separate keys in their own DB. This keeps huge
+	// values from needing long runs of contiguous pages. Zero disables it.
+	// Chunked entries are readable either way.
+	ChunkSize int
+
+	// SeparateValues stores every entry as it does chunked ones, with only
+	// the header and the chunk count in the main DB, so updates of the
+	// exptime and the reaper only touch small records. Reads need an extra
+	// lookup. Entries are readable either way.
+	SeparateValues bool
+
+	// Checksums stores a CRC-32C with each entry, which is checked on every
+	// read. An entry that fails it is reported as an error instead of being
+	// returned. Entries are checked whenever they have a checksum, whether or
+	// not this is set.
+	Checksums bool
+
+	// DeleteCorrupt queues entries that fail their checksum on a read for
+	// deletion, so later reads miss instead of failing again.
+	DeleteCorrupt bool
+
+	// Logger receives the handler's log output, tagged with a "component"
+	// field. Defaults to text on stderr at LevelInfo, see NewLogger.
+	Logger Logger
+
+	// Clock gives the time that exptimes are set from and checked against,
+	// by reads, writes, the reaper, dumps and loads. Defaults to the system
+	// clock. Tests can set one they move forward themselves to expire items
+	// without waiting.
+	Clock Clock
+}
+
+// envFlags translates the boolean options into the flags for lmdb.Env.Open
+func (o Options) envFlags() uint {
+	var flags uint
+	if o.NoSync {
+		flags |= lmdb.NoSync
+	}
+	if o.NoMetaSync {
+		flags |= lmdb.NoMetaSync
+	}
+	if o.WriteMap {
+		flags |= lmdb.WriteMap
+	}
+	if o.MapAsync {
+		flags |= lmdb.MapAsync
+	}
+	if o.NoReadahead {
+		flags |= lmdb.NoReadahead
+	}
+	if o.NoSubdir {
+		flags |= lmdb.NoSubdir
+	}
+	if o.ReadOnly {
+		flags |= lmdb.Readonly
+	}
+	if o.NoLock {
+		flags |= lmdb.NoLock
+	}
+	return flags
+}
+
+func (o Options) withDefaults() Options {
+	if o.MapSize <= 0 {
+		o.MapSize = defaultMapSize
+	}
+	if o.MaxKeySize <= 0 {
+		o.MaxKeySize = defaultMaxKeySize
+	}
+	if o.MaxValueSize <= 0 {
+		o.MaxValueSize = defaultMaxValueSize
+	}
+	if o.DBName == "" {
+		o.DBName = defaultDBName
+	}
+	if o.FileMode == 0 {
+		o.FileMode = defaultFileMode
+	}
+	if o.DirMode == 0 {
+		o.DirMode = defaultDirMode
+	}
+	if o.WriteBatchDelay <= 0 {
+		o.WriteBatchDelay = defaultWriteBatchDelay
+	}
+	if o.WriteBehindDelay <= 0 {
+		o.WriteBehindDelay = defaultWriteBehindDelay
+	}
+	if o.BreakerLatency > 0 || o.BreakerErrorRate > 0 {
+		if o.BreakerErrorRate <= 0 {
+			o.BreakerErrorRate = defaultBreakerErrorRate
+		}
+		if o.BreakerWindow <= 0 {
+			o.BreakerWindow = defaultBreakerWindow
+		}
+		if o.BreakerCooldown <= 0 {
+			o.BreakerCooldown = defaultBreakerCooldown
+		}
+	}
+	if o.DiskFullProbeInterval <= 0 {
+		o.DiskFullProbeInterval = defaultDiskFullProbeInterval
+	}
+	if o.ReplicaTimeout <= 0 {
+		o.ReplicaTimeout = defaultReplicaTimeout
+	}
+	if o.ReplicaMaxBackoff <= 0 {
+		o.ReplicaMaxBackoff = defaultReplicaMaxBackoff
+	}
+	if o.ReaperInterval <= 0 {
+		o.ReaperInterval = defaultReaperInterval
+	}
+	if o.ReaperBatchSize <= 0 {
+		o.ReaperBatchSize = defaultReaperBatch
+	}
+	if o.EvictHighWater > 0 {
+		if o.EvictLowWater <= 0 || o.EvictLowWater > o.EvictHighWater {
+			o.EvictLowWater = o.EvictHighWater - defaultLowWaterGap
+		}
+		if o.EvictCheckInterval <= 0 {
+			o.EvictCheckInterval = defaultEvictCheckInterval
+		}
+	}
+	if o.CompressionThreshold <= 0 {
+		o.CompressionThreshold = defaultCompressionThreshold
+	}
+	if o.Logger == nil {
+		o.Logger = defaultLogger
+	}
+	if o.LeaseTTL <= 0 {
+		o.LeaseTTL = defaultLeaseTTL
+	}
+	if o.Clock == nil {
+		o.Clock = systemClock{}
+	}
+	return o
+}
@@ -0,0 +1,232 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsHandler serves the stats of every open store in the Prometheus text
+// exposition format. Each series is labelled with the path of its store, and
+// the name of its namespace unless it is the default one. Gauges of the whole
+// environment are only given for the default namespace.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw)
+		bw.Flush()
+	})
+}
+
+type storeMetrics struct {
+	s  *store
+	es envStats
+}
+
+func (m storeMetrics) labels() string {
+	if m.s.name == "" {
+		return fmt.Sprintf("path=%q", m.s.path)
+	}
+	return fmt.Sprintf("path=%q,namespace=%q", m.s.path, m.s.name)
+}
+
+type counterMetric struct {
+	name, help string
+	val        func(m storeMetrics) uint64
+}
+
+var counterMetrics = []counterMetric{
+	{"rendlmdb_hits_total", "Keys found by get commands.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.hits) }},
+	{"rendlmdb_misses_total", "Keys not found, or found expired, by get commands.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.misses) }},
+	{"rendlmdb_sets_total", "Items successfully stored.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.sets) }},
+	{"rendlmdb_deletes_total", "Items removed by delete commands.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.deletes) }},
+	{"rendlmdb_expirations_total", "Expired items found by get commands.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.expirations) }},
+	{"rendlmdb_stale_hits_total", "Hits on items past their soft exptime.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.staleHits) }},
+	{"rendlmdb_early_expirations_total", "Reads of live items missed by early expiration.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.earlyMisses) }},
+	{"rendlmdb_negative_hits_total", "Misses answered by the negative cache.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.negHits) }},
+	{"rendlmdb_bloom_misses_total", "Misses answered by the bloom filter.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.bloomMisses) }},
+	{"rendlmdb_read_cache_hits_total", "Entries served from the read cache.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.cacheHits) }},
+	{"rendlmdb_read_cache_misses_total", "Entries read from the map into the read cache.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.cacheMisses) }},
+	{"rendlmdb_coalesced_gets_total", "Gets answered by a concurrent get's read.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.coalesced) }},
+	{"rendlmdb_write_behind_errors_total", "Staged sets that failed to commit.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.stagedErrs) }},
+	{"rendlmdb_syncs_total", "Explicit syncs of an environment that doesn't sync every commit.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.syncs) }},
+	{"rendlmdb_corrupt_reads_total", "Entries that failed their checksum on a read.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.corrupt) }},
+	{"rendlmdb_corrupt_env_errors_total", "LMDB errors from a corrupt environment.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.errCorrupt) }},
+	{"rendlmdb_full_errors_total", "LMDB errors from a full map, transaction or disk.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.errFull) }},
+	{"rendlmdb_busy_errors_total", "LMDB errors worth retrying, e.g. a full reader table.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.errBusy) }},
+	{"rendlmdb_internal_errors_total", "Other LMDB errors, mostly bugs.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.errInternal) }},
+	{"rendlmdb_disk_full_total", "Times writes were turned off because the file system was full.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.diskFulls) }},
+	{"rendlmdb_breaker_trips_total", "Times the write breaker opened.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.breakerTrips) }},
+	{"rendlmdb_breaker_rejects_total", "Client writes failed fast by the open write breaker.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.breakerRejects) }},
+	{"rendlmdb_timeouts_total", "Operations given up on after the read or write timeout.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.timeouts) }},
+	{"rendlmdb_events_dropped_total", "Keyspace events dropped because a subscriber had no room for them.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.eventsDropped) }},
+	{"rendlmdb_replicated_total", "Changes the replica took.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.replicated) }},
+	{"rendlmdb_replica_errors_total", "Batches of changes that failed to replicate and are retried.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.replicaErrors) }},
+	{"rendlmdb_replica_skipped_total", "Changes not sent to the replica.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.replicaSkipped) }},
+	{"rendlmdb_slow_ops_total", "Handler operations that took the slow op threshold or longer.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.slowOps) }},
+	{"rendlmdb_long_reads_total", "Read transactions open longer than the long read threshold.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.longReads) }},
+	{"rendlmdb_evictions_total", "Items evicted to make room for writes.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.evictions) }},
+	{"rendlmdb_reaper_runs_total", "Completed reaper runs.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.reaperRuns) }},
+	{"rendlmdb_reaper_deleted_total", "Expired items removed by the reaper.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.reaperDeleted) }},
+	{"rendlmdb_reaper_scanned_total", "TTL index records read by the reaper.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.reaperScanned) }},
+	{"rendlmdb_reaper_stale_index_total", "Stale TTL index records removed by the reaper.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.reaperStale) }},
+	{"rendlmdb_reaper_errors_total", "Reaper runs that ended in an error.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.reaperErrors) }},
+	{"rendlmdb_compression_input_bytes_total", "Bytes of values compressed, before compression.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.compressIn) }},
+	{"rendlmdb_compression_output_bytes_total", "Bytes of values compressed, after compression.", func(m storeMetrics) uint64 { return atomic.LoadUint64(&m.s.stats.compressOut) }},
+}
+
+type gaugeMetric struct {
+	name, help string
+	val        func(m storeMetrics) uint64
+	// env is set for gauges of the whole environment rather than a namespace
+	env bool
+}
+
+var gaugeMetrics = []gaugeMetric{
+	{"rendlmdb_entries", "Items stored.", func(m storeMetrics) uint64 { return m.es.entries }, false},
+	{"rendlmdb_ttl_entries", "Items stored with an expiration time.", func(m storeMetrics) uint64 { return m.es.ttlEntries }, false},
+	{"rendlmdb_page_size_bytes", "Size of an LMDB page.", func(m storeMetrics) uint64 { return m.es.pageSize }, true},
+	{"rendlmdb_pages_used", "Pages allocated in the data file.", func(m storeMetrics) uint64 { return m.es.pagesUsed }, true},
+	{"rendlmdb_freelist_pages", "Allocated pages free for reuse.", func(m storeMetrics) uint64 { return m.es.freePages }, true},
+	{"rendlmdb_map_size_bytes", "Current size of the memory map.", func(m storeMetrics) uint64 { return m.es.mapSize }, true},
+	{"rendlmdb_readers_used", "Reader slots in use.", func(m storeMetrics) uint64 { return m.es.readersUsed }, true},
+	{"rendlmdb_readers_max", "Reader slots available.", func(m storeMetrics) uint64 { return m.es.readersLimit }, true},
+	{"rendlmdb_reaper_paused", "1 while the reaper is paused.", func(m storeMetrics) uint64 {
+		if m.s.reaperPaused() {
+			return 1
+		}
+		return 0
+	}, true},
+	{"rendlmdb_disk_full", "1 while writes are off because the file system is full.", func(m storeMetrics) uint64 {
+		if m.s.diskFull() {
+			return 1
+		}
+		return 0
+	}, true},
+	{"rendlmdb_breaker_open", "1 while the write breaker is open.", func(m storeMetrics) uint64 {
+		if m.s.breakerOpen() {
+			return 1
+		}
+		return 0
+	}, true},
+	{"rendlmdb_replica_lag_changes", "Changes not yet taken by the replica.", func(m storeMetrics) uint64 {
+		n, _ := m.s.replicaLag()
+		return n
+	}, true},
+	{"rendlmdb_replica_lag_seconds", "How long the replica has been behind.", func(m storeMetrics) uint64 {
+		_, d := m.s.replicaLag()
+		return uint64(d / time.Second)
+	}, true},
+	{"rendlmdb_reader_lag_transactions", "Most write transactions committed since a reader's snapshot.", func(m storeMetrics) uint64 { return m.es.readerLag }, true},
+}
+
+func writeMetrics(w io.Writer) {
+	storesLock.Lock()
+	ss := make([]*store, 0, len(stores))
+	for _, s := range stores {
+		ss = append(ss, s)
+	}
+	storesLock.Unlock()
+
+	sort.Slice(ss, func(i, j int) bool { return ss[i].path < ss[j].path })
+
+	ms := make([]storeMetrics, 0, len(ss))
+	for _, s := range ss {
+		es, err := s.envStats()
+		if err != nil {
+			// closed while scraping
+			continue
+		}
+		ms = append(ms, storeMetrics{s: s, es: es})
+
+		for _, ns := range s.namespaces[1:] {
+			nes := es
+			if nes.entries, nes.ttlEntries, err = ns.entries(); err != nil {
+				break
+			}
+			ms = append(ms, storeMetrics{s: ns, es: nes})
+		}
+	}
+
+	for _, c := range counterMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, m := range ms {
+			fmt.Fprintf(w, "%s{%s} %d\n", c.name, m.labels(), c.val(m))
+		}
+	}
+
+	fmt.Fprint(w, "# HELP rendlmdb_reaper_seconds_total Time spent in reaper runs.\n# TYPE rendlmdb_reaper_seconds_total counter\n")
+	for _, m := range ms {
+		fmt.Fprintf(w, "rendlmdb_reaper_seconds_total{%s} %s\n", m.labels(), seconds(atomic.LoadUint64(&m.s.stats.reaperNanos)))
+	}
+
+	fmt.Fprint(w, "# HELP rendlmdb_reaper_last_duration_seconds Duration of the last reaper run.\n# TYPE rendlmdb_reaper_last_duration_seconds gauge\n")
+	for _, m := range ms {
+		fmt.Fprintf(w, "rendlmdb_reaper_last_duration_seconds{%s} %s\n", m.labels(), seconds(atomic.LoadUint64(&m.s.stats.reaperLastNanos)))
+	}
+
+	fmt.Fprint(w, "# HELP rendlmdb_reaper_last_success_timestamp_seconds End of the last reaper run without errors, 0 if there hasn't been one.\n# TYPE rendlmdb_reaper_last_success_timestamp_seconds gauge\n")
+	for _, m := range ms {
+		fmt.Fprintf(w, "rendlmdb_reaper_last_success_timestamp_seconds{%s} %d\n", m.labels(), atomic.LoadUint64(&m.s.stats.reaperLastSuccess)/1e9)
+	}
+
+	for _, g := range gaugeMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		for _, m := range ms {
+			if g.env && m.s.name != "" {
+				continue
+			}
+			fmt.Fprintf(w, "%s{%s} %d\n", g.name, m.labels(), g.val(m))
+		}
+	}
+
+	writeOpHist(w, ms, "rendlmdb_op_duration_seconds", "Latency of handler operations.",
+		func(st *stats, o op) *latency { return &st.ops[o] })
+	writeOpHist(w, ms, "rendlmdb_txn_wait_seconds", "Time handler operations waited for their transaction to begin.",
+		func(st *stats, o op) *latency { return &st.waits[o] })
+}
+
+// writeOpHist writes a histogram by operation of the latencies l picks.
+func writeOpHist(w io.Writer, ms []storeMetrics, hist, help string, l func(*stats, op) *latency) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hist, help, hist)
+	for _, m := range ms {
+		for o := op(0); o < numOps; o++ {
+			l := l(&m.s.stats, o)
+			labels := fmt.Sprintf("%s,op=%q", m.labels(), opNames[o])
+
+			var cum uint64
+			for i, b := range latencyBuckets {
+				cum += atomic.LoadUint64(&l.buckets[i])
+				fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", hist, labels, seconds(uint64(b)), cum)
+			}
+			cum += atomic.LoadUint64(&l.buckets[len(latencyBuckets)])
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", hist, labels, cum)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", hist, labels, seconds(atomic.LoadUint64(&l.sum)))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", hist, labels, cum)
+		}
+	}
+}
+
+func seconds(nanos uint64) string {
+	return strconv.FormatFloat(float64(nanos)/1e9, 'g', -1, 64)
+}
@@ -0,0 +1,148 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// exptime converts an exptime from a client like absExptime, or as relative
+// milliseconds with ExptimeMillis, then applies the namespace's DefaultTTL,
+// TTLJitter and the namespace's MaxTTL.
+func (s *store) exptime(exptime uint32) uint64 {
+	c := &s.conf
+	now := s.now()
+	abs := absExptime(exptime, now)
+	if c.ExptimeMillis && exptime != 0 {
+		abs = now + uint64(exptime)
+	}
+	return s.limitExptime(abs, now)
+}
+
+// limitExptime applies the namespace's DefaultTTL, TTLJitter and the
+// namespace's MaxTTL to the absolute exptime abs, in milliseconds.
+func (s *store) limitExptime(abs, now uint64) uint64 {
+	c := &s.conf
+	if abs == 0 && c.DefaultTTL > 0 {
+		abs = now + uint64(c.DefaultTTL/time.Millisecond)
+	}
+	abs = s.jitterExptime(abs, now)
+	if c.MaxTTL > 0 {
+		if max := now + uint64(c.MaxTTL/time.Millisecond); abs == 0 || abs > max {
+			abs = max
+		}
+	}
+	return abs
+}
+
+// jitterExptime changes the time left until abs by a random amount up to
+// TTLJitter of it either way.
+func (s *store) jitterExptime(abs, now uint64) uint64 {
+	frac := s.opts.TTLJitter
+	if frac <= 0 || abs <= now {
+		return abs
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	ttl := float64(abs - now)
+	return now + uint64(ttl+(rand.Float64()*2-1)*frac*ttl)
+}
+
+// checkQuota makes sure storing size bytes at key, replacing whatever is
+// there, keeps the namespace within its quotas. If it would not, items of the
+// namespace are evicted first with its QuotaEviction policy, or the write
+// fails with common.ErrNoMem if there is none. It is called before anything is
+// written for the op, so a failed write leaves nothing behind.
+//
+// Bytes are counted in whole pages of the namespace's DBs, so they are only
+// approximate, and evicting items frees less than their size until pages
+// empty out.
+func (s *store) checkQuota(txn *lmdb.Txn, key []byte, size int) error {
+	c := &s.conf
+	if c.MaxItems <= 0 && c.MaxBytes <= 0 {
+		return nil
+	}
+
+	raw := txn.RawRead
+	txn.RawRead = true
+	old, err := txn.Get(s.dbi, key)
+	txn.RawRead = raw
+	found := err == nil
+	if err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+
+	items, used, err := s.usage(txn)
+	if err != nil {
+		return err
+	}
+
+	var over int64
+	if c.MaxBytes > 0 && size > len(old) {
+		over = used + int64(size-len(old)) - c.MaxBytes
+	}
+	full := c.MaxItems > 0 && !found && items >= uint64(c.MaxItems)
+	if over <= 0 && !full {
+		return nil
+	}
+
+	if c.QuotaEviction == EvictNone {
+		return common.ErrNoMem
+	}
+
+	// Over on bytes, take a bit more than needed so the next writes don't
+	// all evict. Over on items, any one item makes room.
+	target := 1
+	if over > 0 {
+		target = int(over + c.MaxBytes/evictFraction)
+	}
+
+	keys, err := s.candidates(txn, c.QuotaEviction, target)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return common.ErrNoMem
+	}
+	n, err := s.evictKeys(txn, keys)
+	if err != nil {
+		return err
+	}
+	s.countEvictions(n)
+	return nil
+}
+
+// usage returns the number of items in the namespace and the bytes of the
+// pages of its DBs.
+func (s *store) usage(txn *lmdb.Txn) (uint64, int64, error) {
+	var items uint64
+	var used int64
+	for i, dbi := range []lmdb.DBI{s.dbi, s.ttldbi, s.chunkdbi, s.refdbi, s.leasedbi} {
+		stat, err := txn.Stat(dbi)
+		if err != nil {
+			return 0, 0, err
+		}
+		if i == 0 {
+			items = stat.Entries
+		}
+		used += int64(stat.BranchPages+stat.LeafPages+stat.OverflowPages) * int64(stat.PSize)
+	}
+	return items, used, nil
+}
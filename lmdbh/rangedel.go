@@ -0,0 +1,222 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// DeletePrefix and DeleteRange scan the main DB of each store with a cursor
+// from the start of the range, deleting in write transactions of
+// rangeBatchSize items so clients get the writer lock in between. A hashed
+// key is stored under its start, see keyhash.go, so with HashLongKeys the
+// scan starts and stops at the part of the range that start can be in, and
+// checks the whole key the entry holds.
+
+// rangeBatchSize is how many items each transaction of a range delete
+// deletes, or a dry run counts.
+const rangeBatchSize = 1000
+
+var (
+	errNoPrefix = errors.New("Rend LMDB prefix delete needs a prefix, see Flush")
+	errBadRange = errors.New("Rend LMDB key range is empty")
+)
+
+// rangeItem is an item found in a range, stored under dk.
+type rangeItem struct {
+	dk      []byte
+	expired bool
+}
+
+// DeletePrefix deletes every item whose key starts with prefix, in every
+// shard and namespace, and returns how many there were. With dryRun it only
+// counts them. Items are deleted in batches, so a concurrent reader may see
+// some gone before the others, and items set with the prefix while it runs
+// may or may not be deleted.
+func (h *Handler) DeletePrefix(prefix []byte, dryRun bool) (int, error) {
+	if len(prefix) == 0 {
+		return 0, errNoPrefix
+	}
+	return h.DeleteRange(prefix, prefixEnd(prefix), dryRun)
+}
+
+// DeleteRange is DeletePrefix for the keys from start up to but not including
+// end. A nil end is the end of the keyspace.
+func (h *Handler) DeleteRange(start, end []byte, dryRun bool) (int, error) {
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, errBadRange
+	}
+	n := 0
+	for _, s := range h.all() {
+		m, err := s.deleteRange(start, end, dryRun)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// prefixEnd returns the first key after every key with prefix, nil if there
+// is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// stored returns the part of key a hashed key keeps as is.
+func (s *store) stored(key []byte) []byte {
+	if n := s.hashedKeyLen - sha256.Size; s.opts.HashLongKeys && len(key) > n {
+		return key[:n]
+	}
+	return key
+}
+
+func (s *store) deleteRange(start, end []byte, dryRun bool) (int, error) {
+	if !dryRun && s.opts.ReadOnly {
+		return 0, errReadOnly
+	}
+	if !dryRun && s.staging != nil {
+		if err := s.commitStaged(); err != nil {
+			return 0, err
+		}
+	}
+
+	began := time.Now()
+	n := 0
+	from := s.stored(start)
+	for more := true; more; more = from != nil {
+		var items []rangeItem
+		at := from
+		scan := func(txn *lmdb.Txn) (err error) {
+			items = items[:0]
+			from, err = s.scanRange(txn, at, start, end, rangeBatchSize, func(dk, _, buf []byte) error {
+				items = append(items, rangeItem{
+					dk:      append([]byte(nil), dk...),
+					expired: s.hasExpired(entryExptime(buf)),
+				})
+				return nil
+			})
+			return
+		}
+
+		if dryRun {
+			if err := s.view(scan); err != nil {
+				return n, err
+			}
+			for _, it := range items {
+				if !it.expired {
+					n++
+				}
+			}
+			continue
+		}
+
+		deleted := 0
+		err := s.update(func(txn *lmdb.Txn) error {
+			if err := scan(txn); err != nil {
+				return err
+			}
+			deleted = 0
+			for _, it := range items {
+				if it.expired {
+					if err := s.delEvent(txn, it.dk, EventExpire); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := s.delLease(txn, it.dk); err != nil {
+					return err
+				}
+				if err := s.delEvent(txn, it.dk, EventDelete); err != nil {
+					return err
+				}
+				deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		n += deleted
+	}
+
+	if n > 0 && !dryRun {
+		s.opts.Logger.Info("Deleted key range", "component", "delete", "namespace", s.name,
+			"start", string(start), "end", string(end), "items", n, "duration", time.Since(began))
+	}
+	return n, nil
+}
+
+// scanRange calls fn with the stored and whole key and the stored value of
+// each of up to max items from from on with keys from start up to end, and
+// returns the key to carry on from, nil once the range is done.
+func (s *store) scanRange(txn *lmdb.Txn, from, start, end []byte, max int, fn func(dk, key, buf []byte) error) ([]byte, error) {
+	cur, err := txn.OpenCursor(s.dbi)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close()
+
+	n := 0
+	var dk, buf []byte
+	if len(from) == 0 {
+		dk, buf, err = cur.Get(nil, nil, lmdb.First)
+	} else {
+		dk, buf, err = cur.Get(from, nil, lmdb.SetRange)
+	}
+	for ; err == nil; dk, buf, err = cur.Get(nil, nil, lmdb.Next) {
+		// Sorted, so no key after one past the stored end can be in range
+		if end != nil && bytes.Compare(dk, end) >= 0 && bytes.Compare(s.stored(dk), s.stored(end)) > 0 {
+			return nil, nil
+		}
+		if n == max {
+			return append([]byte(nil), dk...), nil
+		}
+
+		key := dk
+		if s.opts.HashLongKeys && len(dk) == s.hashedKeyLen {
+			e, err := s.decodeEntry(txn, dk, buf)
+			if err != nil {
+				return nil, err
+			}
+			if e.key != nil {
+				key = e.key
+			}
+		}
+		if bytes.Compare(key, start) < 0 || end != nil && bytes.Compare(key, end) >= 0 {
+			continue
+		}
+		n++
+		if err := fn(dk, key, buf); err != nil {
+			return nil, err
+		}
+	}
+	if !lmdb.IsNotFound(err) {
+		return nil, err
+	}
+	return nil, nil
+}
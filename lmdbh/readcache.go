@@ -0,0 +1,180 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// The read cache keeps recently read entries in memory, decoded, up to
+// ReadCacheBytes, so gets of hot keys need neither a transaction nor the
+// pages under them. Entries are still checked for expiry as they are served.
+//
+// It is kept in sync the same way as the negative cache: every write to a key
+// drops it, see written, and each stripe remembers the ID of the last write
+// transaction to touch any of its keys, so only a read whose snapshot includes
+// that write adds an entry. Writes by other processes sharing the environment
+// aren't seen, so it must not be used with any, and it isn't used in
+// read-only mode.
+const (
+	readStripes = 16
+
+	// readItemOverhead is roughly what an item costs beyond its key and data
+	readItemOverhead = 128
+)
+
+type readCache struct {
+	max     int // bytes per stripe
+	stripes [readStripes]readStripe
+}
+
+type readStripe struct {
+	sync.Mutex
+	lastWrite uintptr
+	size      int
+	// lru holds *readItems, most recently read first
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type readItem struct {
+	key  string
+	e    entry
+	size int
+}
+
+func newReadCache(opts Options) *readCache {
+	if opts.ReadCacheBytes <= 0 {
+		return nil
+	}
+
+	c := &readCache{max: opts.ReadCacheBytes / readStripes}
+	for i := range c.stripes {
+		c.stripes[i].reset()
+	}
+	return c
+}
+
+func (st *readStripe) reset() {
+	st.size = 0
+	st.lru = list.New()
+	st.items = make(map[string]*list.Element)
+}
+
+func (c *readCache) stripe(key []byte) *readStripe {
+	h := fnv.New32a()
+	h.Write(key)
+	return &c.stripes[h.Sum32()%readStripes]
+}
+
+func (c *readCache) get(key []byte) (entry, bool) {
+	st := c.stripe(key)
+	st.Lock()
+	defer st.Unlock()
+
+	el, ok := st.items[string(key)]
+	if !ok {
+		return entry{}, false
+	}
+	st.lru.MoveToFront(el)
+	return el.Value.(*readItem).e, true
+}
+
+// add caches e, read for key in a transaction that sees up to the write
+// transaction readID. e must not share memory with the map.
+func (c *readCache) add(key []byte, e entry, readID uintptr) {
+	size := len(key) + len(e.data) + len(e.key) + readItemOverhead
+	if size > c.max {
+		return
+	}
+
+	st := c.stripe(key)
+	st.Lock()
+	defer st.Unlock()
+
+	if readID < st.lastWrite {
+		return
+	}
+	st.remove(string(key))
+	st.items[string(key)] = st.lru.PushFront(&readItem{key: string(key), e: e, size: size})
+	st.size += size
+	for st.size > c.max {
+		st.remove(st.lru.Back().Value.(*readItem).key)
+	}
+}
+
+func (st *readStripe) remove(key string) {
+	if el, ok := st.items[key]; ok {
+		st.size -= el.Value.(*readItem).size
+		st.lru.Remove(el)
+		delete(st.items, key)
+	}
+}
+
+// written drops key, which the write transaction writeID is changing.
+func (c *readCache) written(key []byte, writeID uintptr) {
+	st := c.stripe(key)
+	st.Lock()
+	if writeID > st.lastWrite {
+		st.lastWrite = writeID
+	}
+	st.remove(string(key))
+	st.Unlock()
+}
+
+// clear drops every entry, for the write transaction writeID that flushes
+// them all.
+func (c *readCache) clear(writeID uintptr) {
+	for i := range c.stripes {
+		st := &c.stripes[i]
+		st.Lock()
+		if writeID > st.lastWrite {
+			st.lastWrite = writeID
+		}
+		st.reset()
+		st.Unlock()
+	}
+}
+
+// cached returns the entry the read cache has for dk, if any.
+func (s *store) cached(dk []byte) (entry, bool) {
+	if s.recent == nil {
+		return entry{}, false
+	}
+	e, ok := s.recent.get(dk)
+	if ok {
+		s.count(&s.stats.cacheHits, MetricCacheHits)
+	}
+	return e, ok
+}
+
+// cache adds e, decoded from what txn read for dk, to the read cache.
+func (s *store) cache(txn *lmdb.Txn, dk []byte, e entry) {
+	if s.recent == nil {
+		return
+	}
+	s.count(&s.stats.cacheMisses, MetricCacheMisses)
+
+	// With RawRead the data may point into the map
+	e.data = append([]byte(nil), e.data...)
+	if e.key != nil {
+		e.key = append([]byte(nil), e.key...)
+	}
+	s.recent.add(dk, e, txn.ID())
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A read that finds the reader table full is tried this many more times,
+// waiting readersFullWait longer each time if no stale slots were cleared for
+// it, for live readers to finish.
+const (
+	readersFullRetries = 5
+	readersFullWait    = time.Millisecond
+)
+
+// Several processes can have an environment open at once: one writer, and any
+// number of others opened with ReadOnly. They must be on the same host, since
+// they coordinate through the lock file, lock.mdb, which every one of them,
+// the read-only ones included, needs write access to. The writer should be
+// started first, so the files are there when the readers open them.
+//
+// Two things need care with more than one process:
+//
+// A reader slot in the lock file is left behind when a process dies with a
+// read transaction open. Until the slot is cleared the writer can't reuse the
+// pages that reader could see, and the file grows, and once all MaxReaders
+// slots are taken reads fail with MDB_READERS_FULL. Stale slots are cleared
+// when an environment is opened, every ReaderCheckInterval after that, and
+// whenever a read finds the table full, see readersFull.
+//
+// When the writer grows the map, transactions in the other processes fail to
+// start with MDB_MAP_RESIZED until they adopt the new size. view and update
+// do that and start the transaction again, see adoptMapSize.
+//
+// Compaction replaces the data file, which the other processes would not see,
+// so it must not be used by a writer that has readers. CompactInterval is
+// refused with ReadOnly or SharedReaders, and Compact fails while the reader
+// table has slots of another process, see compact.
+//
+// NoLock does without the lock file, for read-only file systems where it
+// can't be created. Nothing then coordinates readers with a writer, so it is
+// only allowed with ReadOnly, and no process may write to the environment
+// while any has it open that way. Its readers take no slots, so MaxReaders
+// and clearing stale slots don't apply.
+
+var (
+	errReadOnlyWriteMap = errors.New("Rend LMDB read-only mode can't be used with WriteMap")
+	errNoLockWriter     = errors.New("Rend LMDB NoLock can only be used with ReadOnly")
+	errCompactShared    = errors.New("Rend LMDB compaction can't be used with ReadOnly or SharedReaders")
+	errCompactReaders   = errors.New("Rend LMDB can't compact while other processes have the environment open")
+)
+
+// checkReaders clears the reader slots of dead processes and returns how many
+// there were.
+func (s *store) checkReaders() (int, error) {
+	n, err := s.env.ReaderCheck()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.opts.Logger.Info("Cleared stale readers", "component", "readers", "cleared", n)
+	}
+	return n, nil
+}
+
+// readerChecker calls checkReaders every ReaderCheckInterval until the store
+// is closed.
+func readerChecker(s *store) {
+	for {
+		select {
+		case <-time.After(s.opts.ReaderCheckInterval):
+		case <-s.done:
+			return
+		}
+
+		s.resizeLock.RLock()
+		err := errClosed
+		if !s.closed {
+			_, err = s.checkReaders()
+		}
+		s.resizeLock.RUnlock()
+
+		if err != nil && err != errClosed {
+			s.opts.Logger.Error("Error checking readers", "component", "readers", "error", err)
+		}
+	}
+}
+
+// readersFull clears stale reader slots after a read found the reader table
+// full on the given attempt, and returns whether to try it again.
+func (s *store) readersFull(attempt int) bool {
+	if attempt >= readersFullRetries {
+		max, _ := s.env.MaxReaders()
+		s.opts.Logger.Warn("Reader table full, raise MaxReaders", "component", "readers",
+			"max_readers", max)
+		return false
+	}
+
+	n, err := s.checkReaders()
+	if err != nil {
+		s.opts.Logger.Error("Error checking readers", "component", "readers", "error", err)
+		return false
+	}
+	if n > 0 {
+		return true
+	}
+
+	time.Sleep(time.Duration(attempt+1) * readersFullWait)
+	return true
+}
+
+// Reader is a slot in an environment's reader table.
+type Reader struct {
+	Shard  int
+	PID    int
+	Thread string
+
+	// TxnID is the transaction the reader is reading, or zero for a slot not
+	// in use by a transaction. Lag is how many write transactions have been
+	// committed since, which is how far back the pages the writer can't
+	// reuse go. LMDB doesn't know when a read started, so a reader that stays
+	// far behind across a few looks is the one to worry about.
+	TxnID uint64
+	Lag   uint64
+}
+
+// Readers lists the reader slots of every shard, including those taken by
+// other processes.
+func (h *Handler) Readers() ([]Reader, error) {
+	var all []Reader
+	for i, s := range h.shards {
+		rs, err := s.readers()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			r.Shard = i
+			all = append(all, r)
+		}
+	}
+	return all, nil
+}
+
+// readers parses the reader table as mdb_reader_list prints it: a header,
+// then a line of pid, thread and txnid for each slot, with txnid "-" for one
+// that is not in a transaction.
+func (s *store) readers() ([]Reader, error) {
+	s.resizeLock.RLock()
+	defer s.resizeLock.RUnlock()
+	if s.closed {
+		return nil, errClosed
+	}
+
+	info, err := s.env.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []Reader
+	err = s.env.ReaderList(func(msg string) error {
+		for _, line := range strings.Split(msg, "\n") {
+			f := strings.Fields(line)
+			if len(f) != 3 {
+				continue
+			}
+			pid, err := strconv.Atoi(f[0])
+			if err != nil {
+				// The header
+				continue
+			}
+			r := Reader{PID: pid, Thread: f[1]}
+			if txnid, err := strconv.ParseUint(f[2], 10, 64); err == nil {
+				r.TxnID = txnid
+				if last := uint64(info.LastTxnID); last > txnid {
+					r.Lag = last - txnid
+				}
+			}
+			rs = append(rs, r)
+		}
+		return nil
+	})
+	return rs, err
+}
+
+// readerLag returns the largest Lag in the store's reader table.
+func (s *store) readerLag() (uint64, error) {
+	rs, err := s.readers()
+	if err != nil {
+		return 0, err
+	}
+	var max uint64
+	for _, r := range rs {
+		if r.TxnID != 0 && r.Lag > max {
+			max = r.Lag
+		}
+	}
+	return max, nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// ReadThrough makes a local handler, usually this one, a persistent near
+// cache of an origin, e.g. a remote memcached. Gets are answered locally, and
+// the keys that miss are fetched from the origin, stored locally for next
+// time and returned. Writes go to the origin first; sets, adds, replaces and
+// touches it takes are then made locally too, while appends, prepends and
+// deletes remove the key locally, to be fetched again on the next read. GAT
+// always goes to the origin. Items keep the exptime the origin has for them,
+// cut to ReadThroughOptions.TTL if that is set, so a change made at the
+// origin by someone else is seen within TTL.
+//
+// A failed fetch from the origin is answered as a miss, and a failed local
+// write is ignored, both logged and counted, so the near cache only ever
+// degrades to the origin.
+type ReadThrough struct {
+	local, origin handlers.Handler
+	opts          ReadThroughOptions
+}
+
+// ReadThroughOptions configures a ReadThrough.
+type ReadThroughOptions struct {
+	// TTL is the longest an item fetched or written through is kept
+	// locally. Zero keeps it for as long as the origin does.
+	TTL time.Duration
+
+	// Logger receives the errors of the origin and local writes. Defaults to
+	// standard error.
+	Logger Logger
+}
+
+// NewReadThrough returns a HandlerConst of ReadThroughs of the handlers that
+// local and origin make.
+func NewReadThrough(local, origin handlers.HandlerConst, opts ReadThroughOptions) handlers.HandlerConst {
+	if opts.Logger == nil {
+		opts.Logger = defaultLogger
+	}
+	return func() (handlers.Handler, error) {
+		l, err := local()
+		if err != nil {
+			return nil, err
+		}
+		o, err := origin()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return &ReadThrough{local: l, origin: o, opts: opts}, nil
+	}
+}
+
+// exptime returns the exptime to store an item locally with, as an absolute
+// time, for one the origin has with exptime.
+func (r *ReadThrough) exptime(exptime uint32) uint32 {
+	now := time.Now().Unix()
+	abs := int64(exptime)
+	if exptime != 0 && exptime <= maxRelativeExptime {
+		abs = now + int64(exptime)
+	}
+	if r.opts.TTL > 0 {
+		ttl := int64(r.opts.TTL / time.Second)
+		if ttl == 0 {
+			ttl = 1
+		}
+		if abs == 0 || abs > now+ttl {
+			abs = now + ttl
+		}
+	}
+	return uint32(abs)
+}
+
+// fill stores an item locally.
+func (r *ReadThrough) fill(op string, cmd common.SetRequest) {
+	cmd.Exptime = r.exptime(cmd.Exptime)
+	if err := r.local.Set(cmd); err != nil {
+		r.localFailed(op, cmd.Key, err)
+	}
+}
+
+// invalidate removes key locally, to be fetched again.
+func (r *ReadThrough) invalidate(op string, key []byte) {
+	if err := r.local.Delete(common.DeleteRequest{Key: key}); err != nil && err != common.ErrKeyNotFound {
+		r.localFailed(op, key, err)
+	}
+}
+
+func (r *ReadThrough) localFailed(op string, key []byte, err error) {
+	metrics.IncCounter(MetricFillErrors)
+	r.opts.Logger.Warn("Error writing an item from the origin", "component", "readthrough", "op", op,
+		"key", string(key), "error", err)
+}
+
+func collectE(data <-chan common.GetEResponse, errs <-chan error) ([]common.GetEResponse, error) {
+	var res []common.GetEResponse
+	for d := range data {
+		res = append(res, d)
+	}
+	return res, <-errs
+}
+
+// getE answers cmd locally, fetching the keys that miss from the origin.
+func (r *ReadThrough) getE(cmd common.GetRequest) ([]common.GetEResponse, error) {
+	res, err := collectE(r.local.GetE(cmd))
+	if err != nil {
+		return nil, err
+	}
+
+	var missed []int
+	var fetch common.GetRequest
+	for i, d := range res {
+		if d.Miss {
+			missed = append(missed, i)
+			fetch.Keys = append(fetch.Keys, d.Key)
+			fetch.Opaques = append(fetch.Opaques, d.Opaque)
+			fetch.Quiet = append(fetch.Quiet, d.Quiet)
+		}
+	}
+	if len(missed) == 0 {
+		return res, nil
+	}
+
+	fetched, err := collectE(r.origin.GetE(fetch))
+	if err != nil {
+		metrics.IncCounter(MetricOriginErrors)
+		r.opts.Logger.Warn("Error fetching from the origin", "component", "readthrough", "keys", len(fetch.Keys),
+			"error", err)
+		return res, nil
+	}
+
+	// Responses come back in any order
+	byKey := make(map[string][]int, len(missed))
+	for _, i := range missed {
+		byKey[string(res[i].Key)] = append(byKey[string(res[i].Key)], i)
+	}
+	for _, d := range fetched {
+		idx := byKey[string(d.Key)]
+		if len(idx) == 0 {
+			continue
+		}
+		byKey[string(d.Key)] = idx[1:]
+		if d.Miss {
+			metrics.IncCounter(MetricOriginMisses)
+			continue
+		}
+		metrics.IncCounter(MetricOriginFills)
+		r.fill("get", common.SetRequest{Key: d.Key, Data: d.Data, Flags: d.Flags, Exptime: d.Exptime})
+		d.Opaque, d.Quiet = res[idx[0]].Opaque, res[idx[0]].Quiet
+		res[idx[0]] = d
+	}
+	return res, nil
+}
+
+func (r *ReadThrough) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	res, err := r.getE(cmd)
+	dataOut := make(chan common.GetEResponse, len(res))
+	for _, d := range res {
+		dataOut <- d
+	}
+	close(dataOut)
+	return dataOut, errorsOf(err)
+}
+
+func (r *ReadThrough) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	res, err := r.getE(cmd)
+	dataOut := make(chan common.GetResponse, len(res))
+	for _, d := range res {
+		dataOut <- common.GetResponse{
+			Key:    d.Key,
+			Data:   d.Data,
+			Opaque: d.Opaque,
+			Flags:  d.Flags,
+			Miss:   d.Miss,
+			Quiet:  d.Quiet,
+		}
+	}
+	close(dataOut)
+	return dataOut, errorsOf(err)
+}
+
+// GAT goes to the origin, to touch the item there too, and stores what it
+// returns.
+func (r *ReadThrough) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := r.origin.GAT(cmd)
+	switch {
+	case err == nil && !res.Miss:
+		r.fill("gat", common.SetRequest{Key: cmd.Key, Data: res.Data, Flags: res.Flags, Exptime: cmd.Exptime})
+	case err == nil || err == common.ErrKeyNotFound:
+		r.invalidate("gat", cmd.Key)
+	}
+	return res, err
+}
+
+func (r *ReadThrough) Set(cmd common.SetRequest) error {
+	if err := r.origin.Set(cmd); err != nil {
+		return err
+	}
+	r.fill("set", cmd)
+	return nil
+}
+
+func (r *ReadThrough) Add(cmd common.SetRequest) error {
+	if err := r.origin.Add(cmd); err != nil {
+		return err
+	}
+	r.fill("add", cmd)
+	return nil
+}
+
+func (r *ReadThrough) Replace(cmd common.SetRequest) error {
+	if err := r.origin.Replace(cmd); err != nil {
+		return err
+	}
+	r.fill("replace", cmd)
+	return nil
+}
+
+func (r *ReadThrough) Append(cmd common.SetRequest) error {
+	err := r.origin.Append(cmd)
+	r.invalidate("append", cmd.Key)
+	return err
+}
+
+func (r *ReadThrough) Prepend(cmd common.SetRequest) error {
+	err := r.origin.Prepend(cmd)
+	r.invalidate("prepend", cmd.Key)
+	return err
+}
+
+func (r *ReadThrough) Delete(cmd common.DeleteRequest) error {
+	err := r.origin.Delete(cmd)
+	r.invalidate("delete", cmd.Key)
+	return err
+}
+
+func (r *ReadThrough) Touch(cmd common.TouchRequest) error {
+	if err := r.origin.Touch(cmd); err != nil {
+		if err == common.ErrKeyNotFound {
+			r.invalidate("touch", cmd.Key)
+		}
+		return err
+	}
+	err := r.local.Touch(common.TouchRequest{Key: cmd.Key, Exptime: r.exptime(cmd.Exptime)})
+	if err != nil && err != common.ErrKeyNotFound {
+		r.localFailed("touch", cmd.Key, err)
+	}
+	return nil
+}
+
+// Close closes both handlers, returning the local one's error if both fail.
+func (r *ReadThrough) Close() error {
+	err := r.local.Close()
+	if oerr := r.origin.Close(); err == nil {
+		err = oerr
+	}
+	return err
+}
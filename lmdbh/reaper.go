@@ -0,0 +1,369 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/metrics"
+)
+
+func reaper(s *store) {
+	// Seeded apart from every other process, which the global source isn't
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid())<<32))
+
+	wait := s.opts.ReaperInterval
+	if s.opts.ReaperInitialDelay > 0 {
+		wait = s.opts.ReaperInitialDelay
+	}
+
+	for {
+		select {
+		case <-time.After(jitter(wait, s.opts.ReaperJitter, rnd)):
+		case <-s.done:
+			return
+		}
+		wait = s.opts.ReaperInterval
+
+		if s.reaperPaused() || s.diskFull() {
+			continue
+		}
+		s.reapRun(true)
+	}
+}
+
+// jitter returns d changed by a random amount up to frac of it either way.
+func jitter(d time.Duration, frac float64, rnd *rand.Rand) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	return d + time.Duration((rnd.Float64()*2-1)*frac*float64(d))
+}
+
+// reapRun does one reaper run, logging it and counting it in the stats. The
+// runs of the background reaper stop early if it is paused.
+func (s *store) reapRun(background bool) (int, error) {
+	start := time.Now()
+	s.opts.Logger.Debug("Reaper started", "component", "reaper")
+
+	before, err := s.itemCount()
+	if err != nil {
+		s.opts.Logger.Error("Error while reaping", "component", "reaper", "error", err)
+	}
+
+	deleted, reapErr := s.reap(background, true)
+	if reapErr != nil {
+		s.opts.Logger.Error("Error while reaping", "component", "reaper", "error", reapErr)
+	}
+	if !s.opts.ReadOnly {
+		if _, err := s.reapLeases(); err != nil {
+			s.opts.Logger.Error("Error while reaping leases", "component", "reaper", "error", err)
+		}
+	}
+
+	after, err := s.itemCount()
+	if err != nil {
+		s.opts.Logger.Error("Error while reaping", "component", "reaper", "error", err)
+	}
+
+	dur := time.Since(start)
+	s.count(&s.stats.reaperRuns, MetricReaperRuns)
+	atomic.AddUint64(&s.stats.reaperNanos, uint64(dur))
+	atomic.StoreUint64(&s.stats.reaperLastNanos, uint64(dur))
+	metrics.SetIntGauge(MetricReaperDuration, uint64(dur))
+	if reapErr != nil {
+		s.count(&s.stats.reaperErrors, MetricReaperErrors)
+	} else {
+		now := time.Now()
+		atomic.StoreUint64(&s.stats.reaperLastSuccess, uint64(now.UnixNano()))
+		metrics.SetIntGauge(MetricReaperLastSuccess, uint64(now.Unix()))
+	}
+
+	s.opts.Logger.Info("Reaper finished", "component", "reaper",
+		"items_before", before, "items_after", after, "deleted", deleted, "duration", dur)
+	return deleted, reapErr
+}
+
+func (s *store) itemCount() (uint64, error) {
+	var n uint64
+	err := s.view(func(txn *lmdb.Txn) error {
+		stats, err := txn.Stat(s.dbi)
+		if err != nil {
+			return err
+		}
+		n = stats.Entries
+		return nil
+	})
+	return n, err
+}
+
+// reapChunk is the most expired index records collected per read transaction.
+const reapChunk = 256
+
+// reap walks the TTL index from the soonest expiration and deletes every item
+// whose TTL has passed, stopping at the first one that has not or when one of
+// the configured per-run limits is reached. It returns the number of items
+// removed. With background set it also stops once the reaper is paused, and
+// without limited it ignores the limits and pacing options.
+//
+// The index is read in chunks, each in a short read transaction of its own
+// that is finished before the chunk's deletes are done, so no reader holds on
+// to old pages for the whole sweep. Nesting the write transactions inside the
+// read would also deadlock against a map resize. Each chunk starts after the
+// last record of the one before, so records that could not be removed are not
+// read again.
+func (s *store) reap(background, limited bool) (int, error) {
+	start := time.Now()
+	now := s.now()
+	deleted := 0
+	var last []byte
+
+	maxDeletes, maxDuration := s.opts.ReaperMaxDeletes, s.opts.ReaperMaxDuration
+	if !limited {
+		maxDeletes, maxDuration = 0, 0
+	}
+
+	for {
+		var expired [][]byte
+
+		err := s.view(func(txn *lmdb.Txn) error {
+			cur, err := txn.OpenCursor(s.ttldbi)
+			if err != nil {
+				return err
+			}
+			defer cur.Close()
+
+			op, from := uint(lmdb.First), []byte(nil)
+			if last != nil {
+				op, from = lmdb.SetRange, last
+			}
+
+			for len(expired) < reapChunk {
+				tk, err := ttlRecord(txn, cur, from, op)
+				op, from = lmdb.Next, nil
+				// SetRange lands on last itself if it is still there
+				if err == nil && last != nil && bytes.Equal(tk, last) {
+					continue
+				}
+				if err != nil {
+					if lmdb.IsNotFound(err) {
+						return nil
+					}
+					return err
+				}
+				atomic.AddUint64(&s.stats.reaperScanned, 1)
+				metrics.IncCounter(MetricReaperScanned)
+
+				if exptime, _ := parseTTLKey(tk); exptime >= now {
+					return nil
+				}
+
+				expired = append(expired, tk)
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		if len(expired) == 0 {
+			return deleted, nil
+		}
+		last = expired[len(expired)-1]
+
+		for len(expired) > 0 {
+			select {
+			case <-s.done:
+				return deleted, nil
+			default:
+			}
+
+			if background && s.reaperPaused() {
+				s.opts.Logger.Debug("Reaper stopping, paused", "component", "reaper", "deleted", deleted)
+				return deleted, nil
+			}
+			if maxDeletes > 0 && deleted >= maxDeletes {
+				s.opts.Logger.Debug("Reaper stopping at delete limit", "component", "reaper", "deleted", deleted)
+				return deleted, nil
+			}
+			if maxDuration > 0 && time.Since(start) > maxDuration {
+				s.opts.Logger.Debug("Reaper stopping at time limit", "component", "reaper", "duration", time.Since(start))
+				return deleted, nil
+			}
+
+			n := s.opts.ReaperBatchSize
+			if n > len(expired) {
+				n = len(expired)
+			}
+			if maxDeletes > 0 && n > maxDeletes-deleted {
+				n = maxDeletes - deleted
+			}
+			batch := expired[:n]
+			expired = expired[n:]
+
+			// Small update transactions here to avoid blocking other writers
+			var reaped, stale int
+			err = s.update(func(t *lmdb.Txn) error {
+				reaped, stale = 0, 0
+				for _, tk := range batch {
+					item, err := s.reapRecord(t, tk)
+					if err != nil && !lmdb.IsNotFound(err) {
+						return err
+					}
+					switch {
+					case err != nil:
+					case item:
+						reaped++
+					default:
+						stale++
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return deleted, err
+			}
+
+			deleted += reaped
+			atomic.AddUint64(&s.stats.reaperDeleted, uint64(reaped))
+			metrics.IncCounterBy(MetricReaperDeleted, uint64(reaped))
+			atomic.AddUint64(&s.stats.reaperStale, uint64(stale))
+			metrics.IncCounterBy(MetricReaperStale, uint64(stale))
+
+			if wait := s.reapWait(start, deleted); limited && wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-s.done:
+					return deleted, nil
+				}
+			}
+		}
+	}
+}
+
+// reapWait returns how long to wait before the next batch to keep to
+// ReaperBatchPause and ReaperMaxRate, deleted items into a run that began at
+// start.
+func (s *store) reapWait(start time.Time, deleted int) time.Duration {
+	wait := s.opts.ReaperBatchPause
+	if rate := s.opts.ReaperMaxRate; rate > 0 {
+		due := start.Add(time.Duration(deleted) * time.Second / time.Duration(rate))
+		if d := time.Until(due); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// reapRecord deletes the item of the TTL index record tk if it has not been
+// rewritten since, or else the stale record, and returns whether it was the
+// item.
+func (s *store) reapRecord(txn *lmdb.Txn, tk []byte) (bool, error) {
+	exptime, key := parseTTLKey(tk)
+
+	// double check the expire time after getting txn lock
+	stored, found, err := s.storedExptime(txn, key)
+	if err != nil {
+		return false, err
+	}
+	if found && stored == exptime {
+		return true, s.delEvent(txn, key, EventExpire)
+	}
+	// The index record is stale, the item was rewritten or removed
+	return false, txn.Del(s.ttldbi, tk, nil)
+}
+
+// purge removes every item that expired while the store was closed, before New
+// returns, see Options.PurgeOnOpen. Handlers opened for the same path in the
+// meantime are served while it runs.
+func (s *store) purge() {
+	start := time.Now()
+	deleted, err := s.reap(false, false)
+	if err == errClosed {
+		return
+	}
+	if err != nil {
+		s.count(&s.stats.reaperErrors, MetricReaperErrors)
+		s.opts.Logger.Error("Error purging expired items", "component", "reaper", "namespace", s.name, "error", err)
+		return
+	}
+	s.opts.Logger.Info("Purged expired items", "component", "reaper", "namespace", s.name,
+		"deleted", deleted, "duration", time.Since(start))
+}
+
+// Reap removes expired items now instead of waiting for the next reaper run,
+// within the same limits, and returns the number removed. It works whether or
+// not the reaper is enabled or paused, and commits any staged sets first.
+func (h *Handler) Reap() (int, error) {
+	deleted := 0
+	for _, s := range h.all() {
+		if s.staging != nil {
+			// Reaping may be what makes room for them, so it goes ahead
+			// even if they can't be
+			s.commitStaged()
+		}
+		n, err := s.reapRun(false)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// reaperForever is the reaperPause of a reaper paused until resumed
+const reaperForever = math.MaxInt64
+
+// PauseReaper stops the background reaper for d, or until ResumeReaper if d
+// is zero, e.g. while a failover or a bulk load needs all of the disk. A run
+// under way stops after its current batch. Expired items are still never
+// returned, and Reap still removes them.
+func (h *Handler) PauseReaper(d time.Duration) {
+	until := int64(reaperForever)
+	if d > 0 {
+		until = time.Now().Add(d).UnixNano()
+	}
+	for _, s := range h.shards {
+		atomic.StoreInt64(&s.reaperPause, until)
+	}
+	h.shards[0].opts.Logger.Info("Reaper paused", "component", "reaper", "duration", d)
+}
+
+// ResumeReaper undoes PauseReaper. The reaper carries on at its next run.
+func (h *Handler) ResumeReaper() {
+	for _, s := range h.shards {
+		atomic.StoreInt64(&s.reaperPause, 0)
+	}
+	h.shards[0].opts.Logger.Info("Reaper resumed", "component", "reaper")
+}
+
+// ReaperPaused reports whether the background reaper is paused.
+func (h *Handler) ReaperPaused() bool {
+	return h.shards[0].reaperPaused()
+}
+
+func (s *store) reaperPaused() bool {
+	until := atomic.LoadInt64(&s.reaperPause)
+	return until != 0 && time.Now().UnixNano() < until
+}
@@ -0,0 +1,334 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// With Options.ReplicaAddr set, each environment tails its oplog and sends
+// the changes to another server at that address, in the memcached text
+// protocol, so it is a warm standby to fail over to. Batches of records are
+// pipelined on one connection and the peer's answers read back in order. A
+// batch that fails is sent again from the first record the peer didn't
+// take, after a backoff that doubles up to ReplicaMaxBackoff. The last
+// record taken is saved in a DB of its own, so a restart carries on where
+// it left off, resending at most a second of records.
+//
+// The peer expires items on its own, so expirations aren't sent. Neither are
+// flushes of a namespace other than the default one, which the protocol has
+// no command for, a flush of the default one being sent as flush_all, nor
+// changes to keys the protocol can't carry. Those are counted as skipped.
+// Once more than OplogSize records are waiting the oldest are trimmed before
+// they are sent; the replicator logs an error and carries on with the oldest
+// left, so the peer is missing changes until they are rewritten.
+const (
+	replicaDBSuffix = "_replica"
+
+	defaultReplicaTimeout    = 5 * time.Second
+	defaultReplicaMaxBackoff = 10 * time.Second
+
+	replicaBatchSize  = 100
+	replicaPoll       = 50 * time.Millisecond
+	replicaMinBackoff = 100 * time.Millisecond
+	replicaSaveEvery  = time.Second
+
+	// maxTextKey is the longest key of the memcached text protocol
+	maxTextKey = 250
+)
+
+var errReplicaOplog = errors.New("Rend LMDB replication needs OplogSize and OplogValues")
+
+type replica struct {
+	// dbi is opened by openEnv
+	dbi lmdb.DBI
+
+	// acked is the last record the peer has taken, last the last in the
+	// oplog when it was read, and behind the time of the first record not
+	// yet taken in Unix nanoseconds, zero if there are none. Only accessed
+	// atomically.
+	acked  uint64
+	last   uint64
+	behind int64
+
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// readAcked reads how far the peer had got from the replica progress DB.
+func (r *replica) readAcked(env *lmdb.Env, opts Options) error {
+	return env.View(func(txn *lmdb.Txn) error {
+		buf, err := txn.Get(r.dbi, []byte(opts.ReplicaAddr))
+		switch {
+		case err == nil && len(buf) == 8:
+			r.acked = binary.BigEndian.Uint64(buf)
+		case err != nil && !lmdb.IsNotFound(err):
+			return err
+		}
+		return nil
+	})
+}
+
+// replicaLag returns how many records the peer is behind by, and for how
+// long it has been.
+func (s *store) replicaLag() (uint64, time.Duration) {
+	r := s.replica
+	if r == nil {
+		return 0, 0
+	}
+	var n uint64
+	if last, acked := atomic.LoadUint64(&r.last), atomic.LoadUint64(&r.acked); last > acked {
+		n = last - acked
+	}
+	behind := atomic.LoadInt64(&r.behind)
+	if n == 0 || behind == 0 {
+		return n, 0
+	}
+	return n, time.Since(time.Unix(0, behind))
+}
+
+// replicator sends the oplog to the peer until the store is closed.
+func replicator(s *store) {
+	r := s.replica
+	backoff := replicaMinBackoff
+	saved := atomic.LoadUint64(&r.acked)
+	lastSave := time.Now()
+	defer func() {
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		if acked := atomic.LoadUint64(&r.acked); acked != saved {
+			s.saveReplicaSeq(acked)
+		}
+	}()
+
+	wait := time.Duration(0)
+	for {
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-s.done:
+				timer.Stop()
+				return
+			}
+		}
+
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		sent, err := s.replicate()
+		switch {
+		case err == nil && sent == 0:
+			wait, backoff = replicaPoll, replicaMinBackoff
+		case err == nil:
+			wait, backoff = 0, replicaMinBackoff
+		case err == errClosed:
+			return
+		default:
+			root := s.namespaces[0]
+			root.count(&root.stats.replicaErrors, MetricReplicaErrors)
+			s.opts.Logger.Warn("Error replicating", "component", "replicate", "path", s.path,
+				"peer", s.opts.ReplicaAddr, "error", err, "retry_in", backoff)
+			if r.conn != nil {
+				r.conn.Close()
+				r.conn = nil
+			}
+			wait = backoff
+			if backoff *= 2; backoff > s.opts.ReplicaMaxBackoff {
+				backoff = s.opts.ReplicaMaxBackoff
+			}
+		}
+
+		if acked := atomic.LoadUint64(&r.acked); acked != saved && time.Since(lastSave) >= replicaSaveEvery {
+			if err := s.saveReplicaSeq(acked); err != nil {
+				s.opts.Logger.Warn("Error saving replication progress", "component", "replicate", "error", err)
+			} else {
+				saved, lastSave = acked, time.Now()
+			}
+		}
+	}
+}
+
+// replicate sends the peer the next batch of records, returning how many
+// there were.
+func (s *store) replicate() (int, error) {
+	r := s.replica
+	acked := atomic.LoadUint64(&r.acked)
+	from := acked + 1
+	if acked == 0 {
+		from = 0
+	}
+
+	recs, err := s.oplogRecords(from, replicaBatchSize)
+	if err == ErrOplogTrimmed {
+		s.opts.Logger.Error("Replica fell too far behind, changes trimmed from the oplog were never sent",
+			"component", "replicate", "path", s.path, "peer", s.opts.ReplicaAddr, "from", from)
+		recs, err = s.oplogRecords(0, replicaBatchSize)
+	}
+	if err != nil {
+		return 0, err
+	}
+	last, err := s.oplogSeq()
+	if err != nil {
+		return 0, err
+	}
+	atomic.StoreUint64(&r.last, last)
+	if len(recs) == 0 {
+		atomic.StoreInt64(&r.behind, 0)
+		return 0, nil
+	}
+	atomic.StoreInt64(&r.behind, recs[0].Time.UnixNano())
+
+	if r.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.opts.ReplicaAddr, s.opts.ReplicaTimeout)
+		if err != nil {
+			return 0, err
+		}
+		r.conn, r.r, r.w = conn, bufio.NewReader(conn), bufio.NewWriter(conn)
+	}
+	r.conn.SetDeadline(time.Now().Add(s.opts.ReplicaTimeout))
+
+	// Skipped records are taken as soon as those before them are
+	sent := make([]OplogRecord, 0, len(recs))
+	for _, rec := range recs {
+		if !writeReplicaCmd(r.w, rec) && len(sent) == 0 {
+			s.skipReplica(rec)
+			continue
+		}
+		sent = append(sent, rec)
+	}
+	if err := r.w.Flush(); err != nil {
+		return 0, err
+	}
+
+	root := s.namespaces[0]
+	for _, rec := range sent {
+		if !replicaCmd(rec) {
+			s.skipReplica(rec)
+			continue
+		}
+		line, err := r.r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case replicaOK(rec.Op, line):
+			root.count(&root.stats.replicated, MetricReplicated)
+		case strings.HasPrefix(line, "CLIENT_ERROR"):
+			// It would fail again
+			root.count(&root.stats.replicaSkipped, MetricReplicaSkipped)
+			s.opts.Logger.Warn("Peer refused a change", "component", "replicate", "op", rec.Op,
+				"key", string(rec.Key), "response", line)
+		default:
+			return 0, fmt.Errorf("Rend LMDB peer answered %s to %s of %q", line, rec.Op, rec.Key)
+		}
+		atomic.StoreUint64(&r.acked, rec.Seq)
+	}
+	return len(recs), nil
+}
+
+// skipReplica takes rec as sent without sending it.
+func (s *store) skipReplica(rec OplogRecord) {
+	if rec.Op != EventExpire {
+		root := s.namespaces[0]
+		root.count(&root.stats.replicaSkipped, MetricReplicaSkipped)
+	}
+	atomic.StoreUint64(&s.replica.acked, rec.Seq)
+}
+
+// replicaCmd reports whether rec is sent to the peer.
+func replicaCmd(rec OplogRecord) bool {
+	switch rec.Op {
+	case EventSet, EventDelete, EventTouch:
+		return textKey(rec.Key)
+	case EventFlush:
+		return rec.Namespace == ""
+	}
+	return false
+}
+
+// writeReplicaCmd writes the command for rec, if it is sent.
+func writeReplicaCmd(w *bufio.Writer, rec OplogRecord) bool {
+	if !replicaCmd(rec) {
+		return false
+	}
+	// Absolute, rounded up so nothing outlives its exptime early
+	exptime := strconv.FormatUint(uint64(clientExptime(rec.Exptime+999)), 10)
+	switch rec.Op {
+	case EventSet:
+		fmt.Fprintf(w, "set %s %d %s %d\r\n", rec.Key, rec.Flags, exptime, len(rec.Value))
+		w.Write(rec.Value)
+		w.WriteString("\r\n")
+	case EventDelete:
+		fmt.Fprintf(w, "delete %s\r\n", rec.Key)
+	case EventTouch:
+		fmt.Fprintf(w, "touch %s %s\r\n", rec.Key, exptime)
+	case EventFlush:
+		w.WriteString("flush_all\r\n")
+	}
+	return true
+}
+
+// replicaOK reports whether line is the peer taking a change of type t.
+func replicaOK(t EventType, line string) bool {
+	switch t {
+	case EventSet:
+		return line == "STORED"
+	case EventDelete:
+		return line == "DELETED" || line == "NOT_FOUND"
+	case EventTouch:
+		return line == "TOUCHED" || line == "NOT_FOUND"
+	case EventFlush:
+		return line == "OK"
+	}
+	return false
+}
+
+// textKey reports whether key can be sent in the text protocol.
+func textKey(key []byte) bool {
+	if len(key) == 0 || len(key) > maxTextKey {
+		return false
+	}
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *store) saveReplicaSeq(seq uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, seq)
+	return s.tryUpdate(func(txn *lmdb.Txn) error {
+		return txn.Put(s.replica.dbi, []byte(s.opts.ReplicaAddr), buf, 0)
+	})
+}
@@ -0,0 +1,333 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// BackupSource supplies a snapshot to restore from, see Options.RestoreSource.
+type BackupSource interface {
+	// Latest opens the most recent complete snapshot, a single data.mdb
+	// image as written by BackupTo.
+	Latest() (io.ReadCloser, error)
+}
+
+const (
+	dataFile = "data.mdb"
+	lockFile = "lock.mdb"
+)
+
+var errNoSnapshot = errors.New("Rend LMDB found no snapshot to restore from")
+
+// Latest opens the newest committed snapshot in the directory.
+func (d DirSink) Latest() (io.ReadCloser, error) {
+	infos, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts by name, which sorts by time
+	for i := len(infos) - 1; i >= 0; i-- {
+		name := infos[i].Name()
+		if !infos[i].IsDir() && strings.HasPrefix(name, snapshotPrefix) && !strings.HasSuffix(name, partialSuffix) {
+			return os.Open(filepath.Join(string(d), name))
+		}
+	}
+
+	return nil, errNoSnapshot
+}
+
+// CorruptionPolicy selects what happens when the data file fails its
+// integrity check on startup, see Options.OnCorruption.
+type CorruptionPolicy int
+
+const (
+	// CorruptRestore restores from RestoreFrom or RestoreSource, and fails to
+	// open if neither is set.
+	CorruptRestore CorruptionPolicy = iota
+	// CorruptFail fails to open, leaving the data file as it is.
+	CorruptFail
+	// CorruptWipe starts over with an empty data file.
+	CorruptWipe
+)
+
+// checkOnOpen runs checkEnv on the data file at path, if there is one, and
+// deals with a corrupt one as opts.OnCorruption says. A missing data file is
+// restored if there is a backup to restore from. A corrupt data file is kept
+// alongside, renamed, for inspection.
+func checkOnOpen(path string, opts Options) error {
+	data := opts.dataPath(path)
+	restore := opts.RestoreFrom != "" || opts.RestoreSource != nil
+
+	switch _, err := os.Stat(data); {
+	case os.IsNotExist(err):
+		if !restore {
+			return nil
+		}
+		opts.Logger.Info("No data file, restoring from backup", "component", "restore", "path", path)
+	case err != nil:
+		return err
+	default:
+		cerr := checkEnv(path, opts)
+		if cerr == nil {
+			return nil
+		}
+		if !isCorrupt(cerr) {
+			// e.g. permissions, which a restore would not fix
+			return cerr
+		}
+		if opts.OnCorruption == CorruptFail || opts.OnCorruption == CorruptRestore && !restore {
+			opts.Logger.Error("Data file failed integrity check", "component", "restore", "path", path, "error", cerr)
+			return fmt.Errorf("Rend LMDB data file %s failed its integrity check: %v", data, cerr)
+		}
+
+		bad, err := moveAside(data)
+		if err != nil {
+			return err
+		}
+
+		if opts.OnCorruption == CorruptWipe {
+			opts.Logger.Error("Data file failed integrity check, starting empty", "component", "restore",
+				"path", path, "moved", bad, "error", cerr)
+			return nil
+		}
+		opts.Logger.Error("Data file failed integrity check, restoring from backup", "component", "restore",
+			"path", path, "moved", bad, "error", cerr)
+	}
+
+	r, err := openRestoreSource(opts)
+	if err != nil {
+		if err == errNoSnapshot {
+			// Nothing to restore, start out empty
+			opts.Logger.Warn("No backup to restore from, starting empty", "component", "restore", "path", path)
+			return nil
+		}
+		return err
+	}
+	defer r.Close()
+
+	start := time.Now()
+
+	// Write aside first so a failed restore leaves no half written data file
+	tmp := data + partialSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, opts.FileMode)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, data); err != nil {
+		return err
+	}
+
+	opts.Logger.Info("Restored from backup", "component", "restore", "path", path,
+		"bytes", n, "duration", time.Since(start))
+	return nil
+}
+
+// moveAside renames the corrupt data file, not replacing any moved aside
+// before within the same second.
+func moveAside(data string) (string, error) {
+	base := data + ".corrupt-" + time.Now().UTC().Format(snapshotTimeFormat)
+	bad := base
+	for i := 1; ; i++ {
+		_, err := os.Stat(bad)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		bad = fmt.Sprintf("%s.%d", base, i)
+	}
+	return bad, os.Rename(data, bad)
+}
+
+// openRestoreSource opens the snapshot to restore from. RestoreFrom may be a
+// directory holding a data.mdb, a BackupDir of scheduled snapshots, or a
+// single data.mdb image.
+func openRestoreSource(opts Options) (io.ReadCloser, error) {
+	if opts.RestoreSource != nil {
+		return opts.RestoreSource.Latest()
+	}
+
+	from := opts.RestoreFrom
+
+	fi, err := os.Stat(from)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errNoSnapshot
+		}
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return os.Open(from)
+	}
+
+	if f, err := os.Open(filepath.Join(from, dataFile)); err == nil || !os.IsNotExist(err) {
+		return f, err
+	}
+
+	names, err := snapshots(from)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, errNoSnapshot
+	}
+	return os.Open(filepath.Join(from, names[len(names)-1], dataFile))
+}
+
+func isCorrupt(err error) bool {
+	if err == errCorruptValue || err == errChecksum {
+		return true
+	}
+	oe, ok := err.(*lmdb.OpError)
+	if !ok {
+		return false
+	}
+	switch oe.Errno {
+	case lmdb.Invalid, lmdb.Corrupted, lmdb.PageNotFound, lmdb.Panic, lmdb.VersionMismatch, lmdb.Incompatible:
+		return true
+	}
+	return false
+}
+
+// checkEnv opens the environment at path read only and reads the roots of
+// every namespace's main DB and TTL index, which catches truncated files and
+// bad meta pages. It does not walk the whole tree, but reads CheckEntries
+// entries of the main DBs picked at random, and with CheckChecksums decodes
+// them, checking the checksums of those that have one. Entries still in the
+// original layout, which migrateOriginal has yet to rewrite, are decoded as
+// that.
+func checkEnv(path string, opts Options) error {
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	names := []string{opts.DBName}
+	for _, n := range opts.Namespaces {
+		names = append(names, namespaceDBName(opts.DBName, n.Name))
+	}
+
+	if err := env.SetMaxDBs(2*len(names) + 1); err != nil {
+		return err
+	}
+	flags := uint(lmdb.Readonly)
+	if opts.NoSubdir {
+		flags |= lmdb.NoSubdir
+	}
+	if err := env.Open(path, flags, opts.FileMode); err != nil {
+		return err
+	}
+
+	return env.View(func(txn *lmdb.Txn) error {
+		formatdbi, err := txn.OpenDBI(opts.DBName+formatDBSuffix, 0)
+		hasFormat := err == nil
+		if err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+
+		for i, name := range names {
+			original, err := originalKeys(txn, formatdbi, hasFormat, name)
+			if err != nil {
+				return err
+			}
+			for j, db := range []string{name, name + ttlDBSuffix} {
+				dbi, err := txn.OpenDBI(db, 0)
+				if lmdb.IsNotFound(err) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+
+				cur, err := txn.OpenCursor(dbi)
+				if err != nil {
+					return err
+				}
+				_, _, ferr := cur.Get(nil, nil, lmdb.First)
+				_, _, lerr := cur.Get(nil, nil, lmdb.Last)
+				if ferr == nil && lerr == nil && j == 0 {
+					// Spread the entries over the namespaces
+					n := opts.CheckEntries / len(names)
+					if i < opts.CheckEntries%len(names) {
+						n++
+					}
+					ferr = checkEntries(cur, n, opts.CheckChecksums, original)
+				}
+				cur.Close()
+
+				for _, err := range []error{ferr, lerr} {
+					if err != nil && !lmdb.IsNotFound(err) {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// checkEntries reads n entries at random keys of cur's DB, wrapping around to
+// the first past the last, and with decode checks they can be decoded, in the
+// original layout for the keys original says.
+func checkEntries(cur *lmdb.Cursor, n int, decode bool, original func(key []byte) bool) error {
+	seek := make([]byte, 8)
+	for i := 0; i < n; i++ {
+		rand.Read(seek)
+		k, v, err := cur.Get(seek, nil, lmdb.SetRange)
+		if lmdb.IsNotFound(err) {
+			k, v, err = cur.Get(nil, nil, lmdb.First)
+		}
+		if err != nil {
+			return err
+		}
+		if !decode {
+			continue
+		}
+		if original(k) {
+			_, err = originalToEntry(v)
+		} else {
+			_, err = bufToEntry(v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+const (
+	// defaultScanLimit is how many items a page of Scan holds at most if
+	// the limit asked for isn't positive, and maxScanLimit the most /scan
+	// takes
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+)
+
+var errBadCursor = errors.New("Rend LMDB scan cursor is not one Scan returned")
+
+// ScanItem is an item as listed by Scan.
+type ScanItem struct {
+	Key       []byte
+	Namespace string
+
+	// Size is the length of the value, and Exptime is in Unix seconds, zero
+	// for never
+	Size    int
+	Flags   uint32
+	Exptime uint32
+}
+
+// Scan returns a page of up to limit live items whose keys start with
+// prefix, an empty one listing every item, and the cursor to pass back for
+// the next page, empty once there are none. Items come in key order within
+// each shard and namespace, one after the other. Each page is read in its
+// own transactions, so items changed between pages may be listed as they
+// were or as they are, or skipped, and a page can hold fewer than limit
+// items, even none, with more to come.
+func (h *Handler) Scan(prefix []byte, cursor string, limit int) ([]ScanItem, string, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	stores := h.all()
+
+	i, from := 0, []byte(nil)
+	if cursor != "" {
+		buf, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, "", errBadCursor
+		}
+		idx, n := binary.Uvarint(buf)
+		if n <= 0 || idx >= uint64(len(stores)) {
+			return nil, "", errBadCursor
+		}
+		i, from = int(idx), buf[n:]
+	}
+
+	var end []byte
+	if len(prefix) > 0 {
+		end = prefixEnd(prefix)
+	}
+
+	var items []ScanItem
+	for ; i < len(stores); i, from = i+1, nil {
+		s := stores[i]
+		if len(from) == 0 {
+			from = s.stored(prefix)
+		}
+		next, err := s.scan(from, prefix, end, limit-len(items), &items)
+		if err != nil {
+			return nil, "", err
+		}
+		if next != nil {
+			return items, scanCursor(i, next), nil
+		}
+		if len(items) == limit {
+			if i+1 == len(stores) {
+				return items, "", nil
+			}
+			return items, scanCursor(i+1, nil), nil
+		}
+	}
+	return items, "", nil
+}
+
+func scanCursor(i int, from []byte) string {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(from))
+	buf = append(buf[:binary.PutUvarint(buf, uint64(i))], from...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// scan appends up to max live items from from on with keys from start up to
+// end to items, and returns the key to carry on from, nil once there are
+// none.
+func (s *store) scan(from, start, end []byte, max int, items *[]ScanItem) ([]byte, error) {
+	n := len(*items)
+	var next []byte
+	err := s.view(func(txn *lmdb.Txn) (err error) {
+		*items = (*items)[:n]
+		next, err = s.scanRange(txn, from, start, end, max, func(dk, key, buf []byte) error {
+			if s.hasExpired(entryExptime(buf)) {
+				return nil
+			}
+			e, err := s.decodeEntry(txn, dk, buf)
+			if err != nil {
+				return err
+			}
+			*items = append(*items, ScanItem{
+				Key:       append([]byte(nil), key...),
+				Namespace: s.name,
+				Size:      len(e.data),
+				Flags:     e.flags,
+				Exptime:   clientExptime(e.exptime),
+			})
+			return nil
+		})
+		return
+	})
+	return next, err
+}
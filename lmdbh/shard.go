@@ -0,0 +1,133 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+
+	"github.com/netflix/rend/common"
+)
+
+var errShardedSink = errors.New("Rend LMDB streamed backups can't be used with Shards")
+
+// shardDir is the name of the directory of shard i under Options.Path.
+func shardDir(i int) string {
+	return fmt.Sprintf("shard-%02d", i)
+}
+
+// forShard returns the options for shard i of n. Each shard keeps its data,
+// and its scheduled backups, in its own directory, or with NoSubdir its data
+// in a file of its own next to Path.
+func (o Options) forShard(i int) Options {
+	if o.NoSubdir {
+		o.Path += "-" + shardDir(i)
+	} else {
+		o.Path = filepath.Join(o.Path, shardDir(i))
+	}
+	if o.BackupDir != "" {
+		o.BackupDir = filepath.Join(o.BackupDir, shardDir(i))
+	}
+	if o.RestoreFrom != "" {
+		o.RestoreFrom = filepath.Join(o.RestoreFrom, shardDir(i))
+	}
+	return o
+}
+
+// getShards returns the stores of the default namespace of every shard for
+// opts, opening them if needed.
+func getShards(opts Options) ([]*store, error) {
+	if err := checkNamespaces(opts.Namespaces); err != nil {
+		return nil, err
+	}
+
+	if opts.Shards <= 1 {
+		s, err := getStore(opts)
+		if err != nil {
+			return nil, err
+		}
+		return []*store{s}, nil
+	}
+
+	if opts.BackupSink != nil || opts.RestoreSource != nil {
+		return nil, errShardedSink
+	}
+
+	shards := make([]*store, opts.Shards)
+	for i := range shards {
+		s, err := getStore(opts.forShard(i))
+		if err != nil {
+			for _, s := range shards[:i] {
+				s.release()
+			}
+			return nil, err
+		}
+		shards[i] = s
+	}
+	return shards, nil
+}
+
+// shard returns the store key lives in, the one of its namespace in its
+// shard.
+func (h *Handler) shard(key []byte) *store {
+	return h.shards[h.shardIndex(key)].namespace(key)
+}
+
+// shardIndex returns the index of the shard key lives in. Changing the hash
+// or the number of shards strands every item stored before.
+func (h *Handler) shardIndex(key []byte) int {
+	if len(h.shards) == 1 {
+		return 0
+	}
+	f := fnv.New32a()
+	f.Write(key)
+	return int(f.Sum32() % uint32(len(h.shards)))
+}
+
+// shardGet is the part of a multi-key get for one store.
+type shardGet struct {
+	s   *store
+	cmd common.GetRequest
+}
+
+// splitGet splits cmd up by shard and namespace. The keys keep their order
+// within each part.
+func (h *Handler) splitGet(cmd common.GetRequest) []shardGet {
+	if len(h.shards) == 1 && len(h.shards[0].namespaces) == 1 {
+		return []shardGet{{s: h.shards[0], cmd: cmd}}
+	}
+
+	var parts []shardGet
+	idx := make(map[*store]int)
+	for i, key := range cmd.Keys {
+		s := h.shard(key)
+		p, ok := idx[s]
+		if !ok {
+			p = len(parts)
+			idx[s] = p
+			parts = append(parts, shardGet{s: s, cmd: common.GetRequest{
+				NoopOpaque: cmd.NoopOpaque,
+				NoopEnd:    cmd.NoopEnd,
+			}})
+		}
+		c := &parts[p].cmd
+		c.Keys = append(c.Keys, key)
+		c.Opaques = append(c.Opaques, cmd.Opaques[i])
+		c.Quiet = append(c.Quiet, cmd.Quiet[i])
+	}
+	return parts
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"strconv"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// sizesChunk is the most items looked at per read transaction, so a scan of a
+// big DB doesn't hold up reuse of the pages freed in the meantime.
+const sizesChunk = 10000
+
+// SizeBucket counts the items of up to Size bytes and more than the Size of
+// the bucket before it.
+type SizeBucket struct {
+	Size  uint64
+	Items uint64
+	Bytes uint64
+}
+
+// SizeStats is a histogram of item sizes, like memcached's "stats sizes".
+// Sizes are of the key and value as stored, after compression and encryption.
+// Buckets are powers of two, and empty ones are left out.
+type SizeStats struct {
+	Buckets []SizeBucket
+
+	// Scanned is the number of items looked at. Complete is false if the
+	// scan stopped at its limit before the end of the DB.
+	Scanned  uint64
+	Complete bool
+}
+
+// SizeStats walks up to max items, or all of them if max is zero, and returns
+// a histogram of their sizes. Items are visited in key order, so a partial
+// scan is biased to whatever the first keys hold.
+func (h *Handler) SizeStats(max int) (SizeStats, error) {
+	var counts, sums [65]uint64
+	ss := SizeStats{Complete: true}
+
+	for _, s := range h.all() {
+		complete, err := s.sizeScan(max, &counts, &sums, &ss)
+		if err != nil {
+			return ss, err
+		}
+		if !complete {
+			ss.Complete = false
+			break
+		}
+	}
+
+	for b := range counts {
+		if counts[b] > 0 {
+			ss.Buckets = append(ss.Buckets, SizeBucket{Size: 1 << uint(b), Items: counts[b], Bytes: sums[b]})
+		}
+	}
+	return ss, nil
+}
+
+// sizeScan adds the sizes of the store's items to the buckets counts and sums
+// until ss.Scanned reaches max. It returns whether it got to the end of the
+// DB.
+func (s *store) sizeScan(max int, counts, sums *[65]uint64, ss *SizeStats) (bool, error) {
+	var last []byte
+	var complete bool
+
+	for {
+		var done bool
+		err := s.view(func(txn *lmdb.Txn) error {
+			txn.RawRead = true
+			cur, err := txn.OpenCursor(s.dbi)
+			if err != nil {
+				return err
+			}
+			defer cur.Close()
+
+			var key, buf []byte
+			if last == nil {
+				key, buf, err = cur.Get(nil, nil, lmdb.First)
+			} else {
+				key, buf, err = cur.Get(last, nil, lmdb.SetRange)
+				// SetRange lands on last itself if it is still there
+				if err == nil && bytes.Equal(key, last) {
+					key, buf, err = cur.Get(nil, nil, lmdb.Next)
+				}
+			}
+
+			for i := 0; i < sizesChunk; i++ {
+				if lmdb.IsNotFound(err) {
+					complete, done = true, true
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if max > 0 && ss.Scanned >= uint64(max) {
+					done = true
+					return nil
+				}
+
+				size := uint64(len(key) + storedSize(buf))
+				b := bits.Len64(size - 1)
+				counts[b]++
+				sums[b] += size
+				ss.Scanned++
+
+				last = append(last[:0], key...)
+				key, buf, err = cur.Get(nil, nil, lmdb.Next)
+			}
+			return nil
+		})
+		if err != nil || done {
+			return complete, err
+		}
+	}
+}
+
+// storedSize is the length of the entry in buf, or of the whole entry if buf
+// is a manifest.
+func storedSize(buf []byte) int {
+	if !entryChunked(buf) {
+		return len(buf)
+	}
+	return int(binary.BigEndian.Uint32(buf[len(buf)-manifestLen+4:]))
+}
+
+// WriteTo writes the histogram the way memcached answers "stats sizes",
+// "STAT <size> <items>" lines followed by "END".
+func (s SizeStats) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, b := range s.Buckets {
+		m, _ := bw.WriteString("STAT " + strconv.FormatUint(b.Size, 10) + " " + strconv.FormatUint(b.Items, 10) + "\r\n")
+		n += int64(m)
+	}
+	m, _ := bw.WriteString("END\r\n")
+	n += int64(m)
+	return n, bw.Flush()
+}
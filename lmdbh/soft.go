@@ -0,0 +1,60 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// An item can have a soft exptime before its exptime. Past it the item is
+// stale: reads still find it, and Gets flags it, so a client can keep serving
+// it while it fetches a fresh value, instead of every client missing at once
+// when it expires. rend's responses have no room for the flag, so Get and GetE
+// return stale items as plain hits.
+//
+// Touch and GAT only move the exptime, and Append, Prepend, Incr and Decr keep
+// the soft exptime the item had. Anything that stores a new item sets a new
+// one, from the namespace's SoftTTL.
+
+// SetSoft is Set, with the item going stale softTTL from now. Zero uses the
+// namespace's SoftTTL. A soft exptime at or past the item's exptime is
+// dropped, the item expires first.
+func (h *Handler) SetSoft(cmd common.SetRequest, softTTL time.Duration) error {
+	return h.set(cmd, softTTL, nil)
+}
+
+// softExptime is the soft exptime of an item stored now with exptime, going
+// stale ttl from now, or the namespace's SoftTTL if ttl is zero.
+func (s *store) softExptime(exptime uint64, ttl time.Duration) uint64 {
+	if ttl <= 0 {
+		ttl = s.conf.SoftTTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+
+	soft := s.now() + uint64(ttl/time.Millisecond)
+	if exptime != 0 && soft >= exptime {
+		return 0
+	}
+	return soft
+}
+
+// isStale returns whether e, which has not expired, is past its soft exptime.
+func (s *store) isStale(e entry) bool {
+	return e.soft != 0 && e.soft < s.now()
+}
@@ -0,0 +1,310 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/metrics"
+)
+
+type op int
+
+const (
+	opSet op = iota
+	opAdd
+	opReplace
+	opAppend
+	opPrepend
+	opCas
+	opIncr
+	opDecr
+	opGet
+	opGetE
+	opGets
+	opGAT
+	opDelete
+	opTouch
+	opGetL
+	opSetL
+	numOps
+)
+
+var opNames = [numOps]string{
+	opSet:     "set",
+	opAdd:     "add",
+	opReplace: "replace",
+	opAppend:  "append",
+	opPrepend: "prepend",
+	opCas:     "cas",
+	opIncr:    "incr",
+	opDecr:    "decr",
+	opGet:     "get",
+	opGetE:    "gete",
+	opGets:    "gets",
+	opGAT:     "gat",
+	opDelete:  "delete",
+	opTouch:   "touch",
+	opGetL:    "getl",
+	opSetL:    "setl",
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets. There
+// is one more bucket past the end for anything slower.
+var latencyBuckets = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+}
+
+type latency struct {
+	sum     uint64 // nanoseconds
+	buckets [len(latencyBuckets) + 1]uint64
+}
+
+func (l *latency) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&l.buckets[i], 1)
+	atomic.AddUint64(&l.sum, uint64(d))
+}
+
+// stats are the counters kept for each store. Every field is only accessed
+// atomically.
+type stats struct {
+	hits        uint64
+	misses      uint64
+	sets        uint64
+	deletes     uint64
+	expirations uint64 // expired items found by reads
+	staleHits   uint64 // hits on items past their soft exptime
+	earlyMisses uint64 // reads of live items missed by EarlyExpiration
+	negHits     uint64 // misses answered by the negative cache
+	bloomMisses uint64 // misses answered by the bloom filter
+	cacheHits   uint64 // entries served from the read cache
+	cacheMisses uint64 // entries read into the read cache
+	coalesced   uint64 // gets answered by another get's read
+	stagedErrs  uint64 // staged sets that failed to commit
+	syncs       uint64 // explicit syncs of a lazily synced environment
+	corrupt     uint64 // entries that failed their checksum on a read
+	errCorrupt  uint64 // LMDB errors by class, see decodeErr
+	errFull     uint64
+	errBusy     uint64
+	errInternal uint64
+	diskFulls   uint64 // times writes were turned off for a full disk
+	longReads   uint64 // read transactions reported by the watchdog
+	slowOps     uint64 // operations that took SlowOpThreshold or more
+
+	breakerTrips   uint64 // times the write breaker opened
+	breakerRejects uint64 // client writes failed by the open breaker
+	timeouts       uint64 // operations given up on, see timeout.go
+	eventsDropped  uint64 // events a subscriber had no room for
+
+	replicated     uint64 // changes the replica took, see replicate.go
+	replicaErrors  uint64 // batches that failed to replicate
+	replicaSkipped uint64 // changes not sent to the replica
+
+	reaperRuns        uint64
+	reaperDeleted     uint64
+	reaperScanned     uint64 // TTL index records read
+	reaperStale       uint64 // TTL index records of rewritten or removed items
+	reaperErrors      uint64 // runs that ended in an error
+	reaperNanos       uint64
+	reaperLastNanos   uint64 // duration of the last run
+	reaperLastSuccess uint64 // Unix time in nanoseconds
+
+	// bytes of values before and after compression, for the ratio
+	compressIn  uint64
+	compressOut uint64
+
+	// ops is how long each operation took, and waits how long of that it
+	// waited for its transaction to begin
+	ops   [numOps]latency
+	waits [numOps]latency
+}
+
+// opTimer times one call of an operation, see startOp.
+type opTimer struct {
+	s        *store
+	o        op
+	start    time.Time
+	keyBytes int
+
+	// valueBytes and wait are only accessed atomically, as a read or write
+	// given up on may still set them, see timeout.go
+	valueBytes int64
+	wait       int64
+}
+
+// startOp starts timing a call of o with keys and values of the given sizes.
+// Values read are added as they are found, see addValue.
+func (s *store) startOp(o op, keyBytes, valueBytes int) *opTimer {
+	return &opTimer{s: s, o: o, start: time.Now(), keyBytes: keyBytes, valueBytes: int64(valueBytes)}
+}
+
+func (t *opTimer) addValue(n int) {
+	atomic.AddInt64(&t.valueBytes, int64(n))
+}
+
+// waited records that the operation's transaction began, asked for at since.
+// Only the first transaction of the operation counts.
+func (t *opTimer) waited(since time.Time) {
+	atomic.CompareAndSwapInt64(&t.wait, 0, int64(time.Since(since))+1)
+}
+
+// done records the call, both in the store's stats and in rend's metrics, and
+// logs it if it took SlowOpThreshold or more.
+func (t *opTimer) done() {
+	s := t.s
+	d := time.Since(t.start)
+	s.stats.ops[t.o].observe(d)
+	metrics.IncCounter(opCmdMetrics[t.o])
+	metrics.ObserveHist(opHistMetrics[t.o], uint64(d))
+
+	wait := time.Duration(atomic.LoadInt64(&t.wait))
+	if wait > 0 {
+		// Less the 1 that marks it as set
+		wait--
+		s.stats.waits[t.o].observe(wait)
+	}
+
+	if s.opts.SlowOpThreshold > 0 && d >= s.opts.SlowOpThreshold {
+		s.count(&s.stats.slowOps, MetricSlowOps)
+		s.opts.Logger.Warn("Slow operation", "component", "slowop", "op", opNames[t.o], "namespace", s.name,
+			"duration", d, "txn_wait", wait, "key_bytes", t.keyBytes, "value_bytes", atomic.LoadInt64(&t.valueBytes))
+	}
+}
+
+// keyBytes is the total size of keys.
+func keyBytes(keys [][]byte) int {
+	n := 0
+	for _, key := range keys {
+		n += len(key)
+	}
+	return n
+}
+
+// count increments one of the counters in s.stats along with its rend metric.
+func (s *store) count(c *uint64, metric uint32) {
+	atomic.AddUint64(c, 1)
+	metrics.IncCounter(metric)
+}
+
+// envStats describes the space used by a store's environment.
+type envStats struct {
+	entries      uint64
+	ttlEntries   uint64
+	pageSize     uint64
+	pagesUsed    uint64 // pages allocated in the file so far
+	freePages    uint64 // allocated pages that are free for reuse
+	mapSize      uint64
+	readersUsed  uint64
+	readersLimit uint64
+	readerLag    uint64 // the most transactions a reader is behind by
+}
+
+// envStats reads the current LMDB statistics for the store.
+func (s *store) envStats() (envStats, error) {
+	var es envStats
+
+	err := s.view(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+
+		info, err := s.env.Info()
+		if err != nil {
+			return err
+		}
+		es.mapSize = uint64(info.MapSize)
+		es.pagesUsed = uint64(info.LastPNO) + 1
+		es.readersUsed = uint64(info.NumReaders)
+		es.readersLimit = uint64(info.MaxReaders)
+
+		stat, err := txn.Stat(s.dbi)
+		if err != nil {
+			return err
+		}
+		es.pageSize = uint64(stat.PSize)
+		es.entries = stat.Entries
+
+		if stat, err = txn.Stat(s.ttldbi); err != nil {
+			return err
+		}
+		es.ttlEntries = stat.Entries
+
+		// Each freelist record is a list of page numbers prefixed by its
+		// length, all size_t
+		cur, err := txn.OpenCursor(freeDBI)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		for {
+			_, val, err := cur.Get(nil, nil, lmdb.Next)
+			if lmdb.IsNotFound(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if len(val) >= sizeofSizeT {
+				es.freePages += uint64(len(val)/sizeofSizeT - 1)
+			}
+		}
+	})
+	if err != nil {
+		return es, err
+	}
+
+	// Outside of the transaction, which would count itself
+	es.readerLag, err = s.readerLag()
+	return es, err
+}
+
+// entries returns the number of items in the store's DB and its TTL index.
+func (s *store) entries() (items, ttlItems uint64, err error) {
+	err = s.view(func(txn *lmdb.Txn) error {
+		stat, err := txn.Stat(s.dbi)
+		if err != nil {
+			return err
+		}
+		items = stat.Entries
+
+		if stat, err = txn.Stat(s.ttldbi); err != nil {
+			return err
+		}
+		ttlItems = stat.Entries
+		return nil
+	})
+	return items, ttlItems, err
+}
+
+// freeDBI is the DBI of LMDB's internal freelist DB
+const freeDBI lmdb.DBI = 0
+
+const sizeofSizeT = strconv.IntSize / 8
@@ -0,0 +1,372 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of a store's counters and space usage, for serving
+// memcached's stats command. Counters are since the store was opened. For a
+// sharded handler, everything but Uptime, PageSize and ReaderLag is summed
+// over the shards, and they are the largest.
+type Stats struct {
+	Uptime time.Duration
+	Shards int
+
+	Items    uint64 // items stored, including expired ones not yet reaped
+	TTLItems uint64 // items stored with an expiration time
+
+	// Bytes is the space taken by pages in use, which is what limits how
+	// much more fits. FileBytes includes free pages, and MapSize is the
+	// limit, see Options.MapSize.
+	Bytes     uint64
+	FileBytes uint64
+	MapSize   uint64
+	PageSize  uint64
+	FreePages uint64
+
+	Readers    uint64
+	MaxReaders uint64
+	ReaderLag  uint64 // the most write transactions a reader is behind by
+
+	Hits        uint64
+	Misses      uint64
+	Sets        uint64
+	Deletes     uint64
+	Expirations uint64
+	StaleHits   uint64
+	EarlyMisses uint64
+	NegHits     uint64 // misses answered by the negative cache
+	BloomMisses uint64 // misses answered by the bloom filter
+	CacheHits   uint64 // entries served from the read cache
+	CacheMisses uint64 // entries read into the read cache
+	Coalesced   uint64 // gets answered by another get's read
+	StagedErrs  uint64 // staged sets that failed to commit
+	Syncs       uint64 // explicit syncs of a lazily synced environment
+	Corrupt     uint64
+	ErrCorrupt  uint64 // LMDB errors from a corrupt environment
+	ErrFull     uint64 // LMDB errors from a full map, transaction or disk
+	ErrBusy     uint64 // LMDB errors worth retrying, e.g. a full reader table
+	ErrInternal uint64 // other LMDB errors, mostly bugs
+	DiskFulls   uint64 // times writes were turned off for a full disk
+	Evictions   uint64
+	LongReads   uint64
+	SlowOps     uint64 // see Options.SlowOpThreshold
+
+	BreakerTrips   uint64 // times the write breaker opened
+	BreakerRejects uint64 // client writes failed by the open breaker
+	Timeouts       uint64 // operations given up on after ReadTimeout or WriteTimeout
+	EventsDropped  uint64 // events a subscriber had no room for
+
+	Replicated     uint64 // changes the replica took, see Options.ReplicaAddr
+	ReplicaErrors  uint64 // batches that failed to replicate, to be retried
+	ReplicaSkipped uint64 // changes the replica was not sent
+	ReplicaLag     uint64 // changes not yet sent to the replica
+	ReplicaLagTime time.Duration
+
+	ReaperRuns    uint64
+	ReaperDeleted uint64
+	ReaperScanned uint64 // TTL index records read by the reaper
+	ReaperStale   uint64 // stale TTL index records it removed
+	ReaperErrors  uint64 // reaper runs that ended in an error
+	ReaperTime    time.Duration
+
+	// ReaperLastRun is how long the last reaper run took, the longest of the
+	// shards and namespaces. ReaperLastSuccess is when the last run without
+	// errors ended, the least recent of those that have had one.
+	ReaperLastRun     time.Duration
+	ReaperLastSuccess time.Time
+	ReaperPaused      bool // see Handler.PauseReaper
+
+	DiskFull    bool // see Handler.DiskFull
+	BreakerOpen bool // see Handler.BreakerOpen
+}
+
+// Stats returns the current stats of the handler's stores, all namespaces
+// included.
+func (h *Handler) Stats() (Stats, error) {
+	var sum Stats
+	for _, s := range h.shards {
+		st, err := s.statsSnapshot()
+		if err != nil {
+			return Stats{}, err
+		}
+
+		for _, ns := range s.namespaces[1:] {
+			c := ns.counters()
+			if c.Items, c.TTLItems, err = ns.entries(); err != nil {
+				return Stats{}, err
+			}
+			st.addCounts(c)
+		}
+
+		sum.add(st)
+	}
+	return sum, nil
+}
+
+// statsSnapshot returns the stats of the store's environment along with the
+// store's own counters.
+func (s *store) statsSnapshot() (Stats, error) {
+	es, err := s.envStats()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	st := s.counters()
+
+	st.Uptime = time.Since(s.started)
+	st.Shards = 1
+
+	st.Items = es.entries
+	st.TTLItems = es.ttlEntries
+
+	st.Bytes = (es.pagesUsed - es.freePages) * es.pageSize
+	st.FileBytes = es.pagesUsed * es.pageSize
+	st.MapSize = es.mapSize
+	st.PageSize = es.pageSize
+	st.FreePages = es.freePages
+
+	st.Readers = es.readersUsed
+	st.MaxReaders = es.readersLimit
+	st.ReaderLag = es.readerLag
+
+	return st, nil
+}
+
+// counters returns the store's counters, without anything that needs a
+// transaction.
+func (s *store) counters() Stats {
+	st := &s.stats
+	c := Stats{
+		Hits:        atomic.LoadUint64(&st.hits),
+		Misses:      atomic.LoadUint64(&st.misses),
+		Sets:        atomic.LoadUint64(&st.sets),
+		Deletes:     atomic.LoadUint64(&st.deletes),
+		Expirations: atomic.LoadUint64(&st.expirations),
+		StaleHits:   atomic.LoadUint64(&st.staleHits),
+		EarlyMisses: atomic.LoadUint64(&st.earlyMisses),
+		NegHits:     atomic.LoadUint64(&st.negHits),
+		BloomMisses: atomic.LoadUint64(&st.bloomMisses),
+		CacheHits:   atomic.LoadUint64(&st.cacheHits),
+		CacheMisses: atomic.LoadUint64(&st.cacheMisses),
+		Coalesced:   atomic.LoadUint64(&st.coalesced),
+		StagedErrs:  atomic.LoadUint64(&st.stagedErrs),
+		Syncs:       atomic.LoadUint64(&st.syncs),
+		Corrupt:     atomic.LoadUint64(&st.corrupt),
+		ErrCorrupt:  atomic.LoadUint64(&st.errCorrupt),
+		ErrFull:     atomic.LoadUint64(&st.errFull),
+		ErrBusy:     atomic.LoadUint64(&st.errBusy),
+		ErrInternal: atomic.LoadUint64(&st.errInternal),
+		DiskFulls:   atomic.LoadUint64(&st.diskFulls),
+		Evictions:   atomic.LoadUint64(&s.evictions),
+		LongReads:   atomic.LoadUint64(&st.longReads),
+		SlowOps:     atomic.LoadUint64(&st.slowOps),
+
+		BreakerTrips:   atomic.LoadUint64(&st.breakerTrips),
+		BreakerRejects: atomic.LoadUint64(&st.breakerRejects),
+		Timeouts:       atomic.LoadUint64(&st.timeouts),
+		EventsDropped:  atomic.LoadUint64(&st.eventsDropped),
+
+		Replicated:     atomic.LoadUint64(&st.replicated),
+		ReplicaErrors:  atomic.LoadUint64(&st.replicaErrors),
+		ReplicaSkipped: atomic.LoadUint64(&st.replicaSkipped),
+
+		ReaperRuns:    atomic.LoadUint64(&st.reaperRuns),
+		ReaperDeleted: atomic.LoadUint64(&st.reaperDeleted),
+		ReaperScanned: atomic.LoadUint64(&st.reaperScanned),
+		ReaperStale:   atomic.LoadUint64(&st.reaperStale),
+		ReaperErrors:  atomic.LoadUint64(&st.reaperErrors),
+		ReaperTime:    time.Duration(atomic.LoadUint64(&st.reaperNanos)),
+		ReaperLastRun: time.Duration(atomic.LoadUint64(&st.reaperLastNanos)),
+	}
+	c.ReaperPaused = s.reaperPaused()
+	c.DiskFull = s.diskFull()
+	c.BreakerOpen = s.breakerOpen()
+	c.ReplicaLag, c.ReplicaLagTime = s.replicaLag()
+	if ns := atomic.LoadUint64(&st.reaperLastSuccess); ns != 0 {
+		c.ReaperLastSuccess = time.Unix(0, int64(ns))
+	}
+	return c
+}
+
+// add sums o into s.
+func (s *Stats) add(o Stats) {
+	if o.Uptime > s.Uptime {
+		s.Uptime = o.Uptime
+	}
+	s.Shards += o.Shards
+	s.Bytes += o.Bytes
+	s.FileBytes += o.FileBytes
+	s.MapSize += o.MapSize
+	s.PageSize = o.PageSize
+	s.FreePages += o.FreePages
+	s.Readers += o.Readers
+	s.MaxReaders += o.MaxReaders
+	if o.ReaderLag > s.ReaderLag {
+		s.ReaderLag = o.ReaderLag
+	}
+	s.addCounts(o)
+}
+
+// addCounts sums the item counts and counters of o into s.
+func (s *Stats) addCounts(o Stats) {
+	s.Items += o.Items
+	s.TTLItems += o.TTLItems
+	s.Hits += o.Hits
+	s.Misses += o.Misses
+	s.Sets += o.Sets
+	s.Deletes += o.Deletes
+	s.Expirations += o.Expirations
+	s.StaleHits += o.StaleHits
+	s.EarlyMisses += o.EarlyMisses
+	s.NegHits += o.NegHits
+	s.BloomMisses += o.BloomMisses
+	s.CacheHits += o.CacheHits
+	s.CacheMisses += o.CacheMisses
+	s.Coalesced += o.Coalesced
+	s.StagedErrs += o.StagedErrs
+	s.Syncs += o.Syncs
+	s.Corrupt += o.Corrupt
+	s.ErrCorrupt += o.ErrCorrupt
+	s.ErrFull += o.ErrFull
+	s.ErrBusy += o.ErrBusy
+	s.ErrInternal += o.ErrInternal
+	s.DiskFulls += o.DiskFulls
+	s.BreakerTrips += o.BreakerTrips
+	s.BreakerRejects += o.BreakerRejects
+	s.Timeouts += o.Timeouts
+	s.EventsDropped += o.EventsDropped
+	s.Replicated += o.Replicated
+	s.ReplicaErrors += o.ReplicaErrors
+	s.ReplicaSkipped += o.ReplicaSkipped
+	s.ReplicaLag += o.ReplicaLag
+	if o.ReplicaLagTime > s.ReplicaLagTime {
+		s.ReplicaLagTime = o.ReplicaLagTime
+	}
+	s.Evictions += o.Evictions
+	s.LongReads += o.LongReads
+	s.SlowOps += o.SlowOps
+	s.ReaperRuns += o.ReaperRuns
+	s.ReaperDeleted += o.ReaperDeleted
+	s.ReaperScanned += o.ReaperScanned
+	s.ReaperStale += o.ReaperStale
+	s.ReaperErrors += o.ReaperErrors
+	s.ReaperTime += o.ReaperTime
+	s.ReaperPaused = s.ReaperPaused || o.ReaperPaused
+	s.DiskFull = s.DiskFull || o.DiskFull
+	s.BreakerOpen = s.BreakerOpen || o.BreakerOpen
+	if o.ReaperLastRun > s.ReaperLastRun {
+		s.ReaperLastRun = o.ReaperLastRun
+	}
+	if !o.ReaperLastSuccess.IsZero() && (s.ReaperLastSuccess.IsZero() || o.ReaperLastSuccess.Before(s.ReaperLastSuccess)) {
+		s.ReaperLastSuccess = o.ReaperLastSuccess
+	}
+}
+
+// Pairs returns the stats as name and value pairs, using memcached's names
+// where there is one.
+func (s Stats) Pairs() [][2]string {
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	var lastSuccess, paused, diskFull, breakerOpen uint64
+	if s.ReaperPaused {
+		paused = 1
+	}
+	if s.DiskFull {
+		diskFull = 1
+	}
+	if s.BreakerOpen {
+		breakerOpen = 1
+	}
+	if !s.ReaperLastSuccess.IsZero() {
+		lastSuccess = uint64(s.ReaperLastSuccess.Unix())
+	}
+	return [][2]string{
+		{"uptime", u(uint64(s.Uptime / time.Second))},
+		{"shards", u(uint64(s.Shards))},
+		{"curr_items", u(s.Items)},
+		{"ttl_items", u(s.TTLItems)},
+		{"bytes", u(s.Bytes)},
+		{"file_bytes", u(s.FileBytes)},
+		{"limit_maxbytes", u(s.MapSize)},
+		{"page_size", u(s.PageSize)},
+		{"free_pages", u(s.FreePages)},
+		{"curr_readers", u(s.Readers)},
+		{"max_readers", u(s.MaxReaders)},
+		{"reader_lag", u(s.ReaderLag)},
+		{"get_hits", u(s.Hits)},
+		{"get_misses", u(s.Misses)},
+		{"get_expired", u(s.Expirations)},
+		{"get_stale", u(s.StaleHits)},
+		{"get_expired_early", u(s.EarlyMisses)},
+		{"get_negative_hits", u(s.NegHits)},
+		{"get_bloom_misses", u(s.BloomMisses)},
+		{"read_cache_hits", u(s.CacheHits)},
+		{"read_cache_misses", u(s.CacheMisses)},
+		{"get_coalesced", u(s.Coalesced)},
+		{"write_behind_errors", u(s.StagedErrs)},
+		{"env_syncs", u(s.Syncs)},
+		{"get_corrupt", u(s.Corrupt)},
+		{"lmdb_errors_corrupt", u(s.ErrCorrupt)},
+		{"lmdb_errors_full", u(s.ErrFull)},
+		{"lmdb_errors_busy", u(s.ErrBusy)},
+		{"lmdb_errors_internal", u(s.ErrInternal)},
+		{"disk_full_events", u(s.DiskFulls)},
+		{"disk_full", u(diskFull)},
+		{"breaker_trips", u(s.BreakerTrips)},
+		{"breaker_rejects", u(s.BreakerRejects)},
+		{"breaker_open", u(breakerOpen)},
+		{"timeouts", u(s.Timeouts)},
+		{"events_dropped", u(s.EventsDropped)},
+		{"replicated", u(s.Replicated)},
+		{"replica_errors", u(s.ReplicaErrors)},
+		{"replica_skipped", u(s.ReplicaSkipped)},
+		{"replica_lag", u(s.ReplicaLag)},
+		{"replica_lag_seconds", u(uint64(s.ReplicaLagTime / time.Second))},
+		{"cmd_set", u(s.Sets)},
+		{"delete_hits", u(s.Deletes)},
+		{"evictions", u(s.Evictions)},
+		{"long_reads", u(s.LongReads)},
+		{"slow_ops", u(s.SlowOps)},
+		{"reaper_runs", u(s.ReaperRuns)},
+		{"reaper_deleted", u(s.ReaperDeleted)},
+		{"reaper_scanned", u(s.ReaperScanned)},
+		{"reaper_stale_index", u(s.ReaperStale)},
+		{"reaper_errors", u(s.ReaperErrors)},
+		{"reaper_time", strconv.FormatFloat(s.ReaperTime.Seconds(), 'f', 6, 64)},
+		{"reaper_last_time", strconv.FormatFloat(s.ReaperLastRun.Seconds(), 'f', 6, 64)},
+		{"reaper_last_success", u(lastSuccess)},
+		{"reaper_paused", u(paused)},
+	}
+}
+
+// WriteTo writes the stats the way memcached answers the stats command,
+// "STAT <name> <value>" lines followed by "END".
+func (s Stats) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, p := range s.Pairs() {
+		m, _ := bw.WriteString("STAT " + p[0] + " " + p[1] + "\r\n")
+		n += int64(m)
+	}
+	m, _ := bw.WriteString("END\r\n")
+	n += int64(m)
+	return n, bw.Flush()
+}
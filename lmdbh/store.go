@@ -0,0 +1,688 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// store is one namespace of an opened LMDB environment, see namespace.go, with
+// its DBs and counters. The environment itself is in shared, which every
+// namespace of it points to. Rend calls the HandlerConst once per connection,
+// so the default namespace of each environment is kept in a registry keyed by
+// path and every handler for that path shares the same one.
+type store struct {
+	// The atomically accessed counters must stay first in the struct for
+	// 64-bit alignment on 32-bit platforms.
+
+	// evictions counts items removed to make room, see evict.go
+	evictions uint64
+
+	// stats are the counters reported as metrics, see stats.go
+	stats stats
+
+	*shared
+
+	// name is the namespace's name, empty for the default one, and prefix is
+	// how its keys start. conf holds its quotas and TTLs, and for the default
+	// one only Options.ExptimeMillis.
+	name   string
+	prefix []byte
+	conf   Namespace
+
+	opts Options
+
+	// dbis are the namespace's DBs
+	dbis
+
+	// flushTimer is the pending delayed flush, if any, see Flush
+	flushLock  sync.Mutex
+	flushTimer *time.Timer
+
+	// evictHand is where EvictClock eviction carries on from, and movedHands
+	// where each write transaction that moved it left it, until that commits
+	handLock   sync.Mutex
+	evictHand  []byte
+	movedHands map[*lmdb.Txn][]byte
+
+	// expired receives keys found expired on reads when DeleteExpiredOnRead
+	// is set, see lazyDeleter
+	expired chan []byte
+
+	// corrupt receives keys that failed their checksum on reads when
+	// DeleteCorrupt is set, see lazyDeleter
+	corrupt chan []byte
+
+	// negative holds the tombstones of recent misses when NegativeCacheTTL
+	// is set, see negcache.go
+	negative *negCache
+
+	// bloom filters the keys of the data DB when BloomFilterItems is set,
+	// see bloom.go
+	bloom *bloom
+
+	// recent holds recently read entries when ReadCacheBytes is set, see
+	// readcache.go
+	recent *readCache
+
+	// flights are the reads gets can share when CoalesceGets is set, see
+	// coalesce.go
+	flights *flights
+
+	// referenced receives keys found by reads when EvictLRU is used, see
+	// referenceWriter
+	referenced chan []byte
+}
+
+// dbis are the DBs of one namespace.
+type dbis struct {
+	dbi lmdb.DBI
+	// ttldbi is the TTL index, see ttlindex.go
+	ttldbi lmdb.DBI
+	// chunkdbi holds the chunks of large entries, see chunk.go
+	chunkdbi lmdb.DBI
+	// refdbi holds the reference bits of EvictLRU, see lru.go, and leasedbi
+	// the leases of GetL, see lease.go. They aren't opened in read-only mode.
+	refdbi   lmdb.DBI
+	leasedbi lmdb.DBI
+
+	// tagdbi holds the tags of items with TagIndex, see tags.go
+	tagdbi lmdb.DBI
+}
+
+// shared is the part of a store common to all of the namespaces of its
+// environment.
+type shared struct {
+	// cas is the last CAS token handed out, and reaperPause is when the
+	// reaper is paused until, see PauseReaper. They must stay first in the
+	// struct for 64-bit alignment on 32-bit platforms.
+	cas         uint64
+	reaperPause int64
+
+	path string
+	env  *lmdb.Env
+
+	// namespaces are the stores of every namespace, the default one first
+	namespaces []*store
+
+	// hashedKeyLen is the length of hashed keys, see keyhash.go
+	hashedKeyLen int
+
+	// formatdbi records which main DBs still have entries in the original
+	// layout, see migrateOriginal. It is zero in a read-only store of an
+	// environment that has never had one.
+	formatdbi lmdb.DBI
+
+	// started is when the store was opened, for Stats
+	started time.Time
+
+	// crypt is set when values are encrypted, see crypt.go
+	crypt *crypter
+
+	// resizeLock and mapSize coordinate map growth, see mapsize.go
+	resizeLock sync.RWMutex
+	mapSize    int64
+
+	// compacting is non-nil, and closed once done, while a compaction holds
+	// off writes. It is guarded by resizeLock, see compact.go
+	compacting chan struct{}
+
+	// batch receives client mutations when write batching is on, see
+	// batch.go
+	batch chan batchOp
+
+	// staging holds the sets not yet committed in write-behind mode, see
+	// writebehind.go
+	staging *staging
+
+	// syncOps are the operations in SyncOps, see commitSync
+	syncOps [numOps]bool
+
+	// refs counts the open handlers using this store and is guarded by
+	// storesLock, see close.go
+	refs int
+
+	// closeLock is held for reading by client writes for their whole
+	// duration, so closing waits for them to finish. closed is set with both
+	// closeLock and resizeLock held, so it may be read under either.
+	closeLock sync.RWMutex
+	closed    bool
+
+	// reads are the open read transactions, see LongReadThreshold
+	reads reads
+
+	// warm is closed once the page cache is warmed up, see warmup.go
+	warm chan struct{}
+
+	// outOfDisk is set while writes are off for a full file system, see
+	// diskfull.go
+	outOfDisk int32
+
+	// events are handed to subscribers, see events.go
+	events *eventHub
+
+	// oplog is set when changes are recorded, see oplog.go, and replica
+	// when they are sent on, see replicate.go
+	oplog   *oplog
+	replica *replica
+
+	// breaker fails client writes fast while writes are slow or failing, see
+	// breaker.go
+	breaker *breaker
+
+	// done is closed to stop the background goroutines, which bg tracks
+	done chan struct{}
+	bg   sync.WaitGroup
+}
+
+var (
+	storesLock = &sync.Mutex{}
+	stores     = make(map[string]*store)
+
+	// shutdown is set by CloseAll so no store is reopened afterwards
+	shutdown bool
+)
+
+var (
+	errPathIsFile  = errors.New("Rend LMDB path exists and is a file")
+	errPathIsDir   = errors.New("Rend LMDB path exists and is a directory, which NoSubdir can't use")
+	errNoBackupDir = errors.New("Rend LMDB scheduled backups need a BackupDir or BackupSink")
+	errReadOnly    = errors.New("Rend LMDB mutations are not permitted in read-only mode")
+)
+
+// getStore returns the store for the path in opts, opening it if this is the
+// first time the path has been seen.
+func getStore(opts Options) (*store, error) {
+	if opts.BackupInterval > 0 && opts.BackupDir == "" && opts.BackupSink == nil {
+		return nil, errNoBackupDir
+	}
+	if opts.ReplicaAddr != "" && (opts.OplogSize <= 0 || !opts.OplogValues) {
+		return nil, errReplicaOplog
+	}
+	for _, name := range opts.SyncOps {
+		if _, err := opNamed(name); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ReadOnly && opts.WriteMap {
+		return nil, errReadOnlyWriteMap
+	}
+	if opts.NoLock && !opts.ReadOnly {
+		return nil, errNoLockWriter
+	}
+	if opts.CompactInterval > 0 && (opts.ReadOnly || opts.SharedReaders) {
+		return nil, errCompactShared
+	}
+
+	path, err := filepath.Abs(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, opened, err := sharedStore(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Purging can take a while, and would hold up opening every other
+	// environment if done under storesLock
+	if opened && opts.PurgeOnOpen && !opts.ReadOnly {
+		for _, ns := range s.namespaces {
+			ns.purge()
+		}
+	}
+	return s, nil
+}
+
+// sharedStore returns the store open at path, or opens it and starts its
+// background goroutines, and returns whether it did.
+func sharedStore(path string, opts Options) (*store, bool, error) {
+	storesLock.Lock()
+	defer storesLock.Unlock()
+
+	if shutdown {
+		return nil, false, errClosed
+	}
+
+	if s, ok := stores[path]; ok {
+		s.refs++
+		return s, false, nil
+	}
+
+	s, err := openStore(path, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.refs = 1
+	stores[path] = s
+
+	// Each namespace has its own reaper and lazy deleter, so a busy one
+	// doesn't hold up the others
+	if opts.ReaderCheckInterval > 0 {
+		s.spawn(readerChecker)
+	}
+	if opts.LongReadThreshold > 0 {
+		s.spawn(readWatchdog)
+	}
+	if opts.WarmUp {
+		s.spawn(warmUp)
+	} else {
+		close(s.warm)
+	}
+	if opts.ReadOnly {
+		if opts.BackupInterval > 0 {
+			s.spawn(backupScheduler)
+		}
+		return s, true, nil
+	}
+
+	s.breaker = newBreaker(opts)
+	s.spawn(diskFullProber)
+	if s.replica != nil {
+		s.spawn(replicator)
+	}
+	for _, ns := range s.namespaces {
+		ns.negative = newNegCache(opts)
+		ns.recent = newReadCache(opts)
+		ns.flights = newFlights(opts)
+		if !opts.DisableReaper {
+			ns.spawn(reaper)
+		}
+		if opts.DeleteExpiredOnRead {
+			ns.expired = make(chan []byte, expiredQueueLen)
+		}
+		if opts.DeleteCorrupt {
+			ns.corrupt = make(chan []byte, expiredQueueLen)
+		}
+		if opts.DeleteExpiredOnRead || opts.DeleteCorrupt {
+			ns.spawn(lazyDeleter)
+		}
+		if ns.tracksReferences() {
+			ns.referenced = make(chan []byte, refQueueLen)
+			ns.spawn(referenceWriter)
+		}
+		if ns.bloom != nil {
+			ns.spawn(bloomRebuilder)
+		}
+	}
+	if opts.EvictHighWater > 0 {
+		s.spawn(highWater)
+	}
+	if opts.WriteBatchSize > 1 {
+		s.batch = make(chan batchOp, opts.WriteBatchSize)
+		s.spawn(batchWriter)
+	}
+	if opts.WriteBehind > 0 {
+		s.staging = newStaging()
+		s.spawn(writeBehind)
+	}
+	for _, name := range opts.SyncOps {
+		o, _ := opNamed(name)
+		s.syncOps[o] = true
+	}
+	if opts.SyncInterval > 0 && opts.lazySync() {
+		s.spawn(syncer)
+	}
+	if opts.BackupInterval > 0 {
+		s.spawn(backupScheduler)
+	}
+	if opts.CompactInterval > 0 {
+		// not spawned, see compactor
+		go compactor(s)
+	}
+
+	return s, true, nil
+}
+
+// dataPath returns the data file of the environment at path, which is path
+// itself with NoSubdir.
+func (o Options) dataPath(path string) string {
+	if o.NoSubdir {
+		return path
+	}
+	return filepath.Join(path, dataFile)
+}
+
+// lockPath returns the lock file of the environment at path.
+func (o Options) lockPath(path string) string {
+	if o.NoSubdir {
+		return path + "-lock"
+	}
+	return filepath.Join(path, lockFile)
+}
+
+// setModes applies FileMode and DirMode to the files of an environment at
+// path, and the directory they are in, for ExactModes.
+func (o Options) setModes(path string) error {
+	dir := path
+	if o.NoSubdir {
+		dir = filepath.Dir(path)
+	}
+	if err := os.Chmod(dir, o.DirMode); err != nil {
+		return err
+	}
+	for _, f := range []string{o.dataPath(path), o.lockPath(path)} {
+		if err := os.Chmod(f, o.FileMode); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyMode keeps a data file written by an env copy, which LMDB creates as
+// 0666 under the umask, from being more open than FileMode, or with
+// ExactModes gives it FileMode.
+func (o Options) copyMode(data string) error {
+	if o.ExactModes {
+		return os.Chmod(data, o.FileMode)
+	}
+	fi, err := os.Stat(data)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(data, fi.Mode().Perm()&o.FileMode)
+}
+
+// copyPath returns what to pass to an env copy for it to write a data file
+// in the directory dir.
+func (o Options) copyPath(dir string) string {
+	if o.NoSubdir {
+		return filepath.Join(dir, dataFile)
+	}
+	return dir
+}
+
+// spawn runs fn as a background goroutine that Close waits for
+func (s *store) spawn(fn func(*store)) {
+	s.bg.Add(1)
+	go func() {
+		defer s.bg.Done()
+		fn(s)
+	}()
+}
+
+func openStore(path string, opts Options) (*store, error) {
+	// With NoSubdir the path is the data file, in a dir of its own choosing
+	dir := path
+	if opts.NoSubdir {
+		dir = filepath.Dir(path)
+	}
+
+	// Create the db dir if it doesn't already exist
+	fs, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) && !opts.ReadOnly {
+			if err := os.MkdirAll(dir, opts.DirMode); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	// Don't correct for a file already existing, let the user deal with it.
+	if fs != nil && !fs.IsDir() {
+		return nil, errPathIsFile
+	}
+	if opts.NoSubdir {
+		if fs, err := os.Stat(path); err == nil && fs.IsDir() {
+			return nil, errPathIsDir
+		}
+	}
+
+	if !opts.ReadOnly {
+		if err := checkOnOpen(path, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	env, d, err := openEnv(path, opts, opts.MapSize)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ExactModes && !opts.ReadOnly {
+		if err := opts.setModes(path); err != nil {
+			env.Close()
+			return nil, err
+		}
+	}
+
+	s := &store{
+		shared: &shared{
+			// Seeding with the current time keeps tokens increasing across
+			// restarts without having to persist the counter.
+			cas:     uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+			path:    path,
+			started: time.Now(),
+			env:     env,
+			reads:   reads{open: make(map[*lmdb.Txn]*openRead)},
+			warm:    make(chan struct{}),
+			events:  newEventHub(),
+			done:    make(chan struct{}),
+		},
+		conf: Namespace{ExptimeMillis: opts.ExptimeMillis},
+		opts: opts,
+	}
+
+	if opts.Encryption != nil {
+		s.crypt = newCrypter(opts.Encryption)
+	}
+
+	max := env.MaxKeySize() - keyOverhead
+	if opts.HashLongKeys {
+		s.hashedKeyLen, max = max, maxEmbeddedKey
+	}
+	if s.opts.MaxKeySize > max {
+		s.opts.Logger.Warn("MaxKeySize is more than can be stored, lowering it", "component", "store",
+			"max_key_size", s.opts.MaxKeySize, "limit", max)
+		s.opts.MaxKeySize = max
+	}
+
+	// The map may be bigger than asked for if the DB already existed
+	info, err := env.Info()
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+	s.mapSize = info.MapSize
+
+	if _, err := s.checkReaders(); err != nil {
+		env.Close()
+		return nil, err
+	}
+
+	if opts.OplogSize > 0 && !opts.ReadOnly {
+		s.oplog = &oplog{}
+		if opts.ReplicaAddr != "" {
+			s.replica = &replica{}
+		}
+	}
+
+	s.namespaces = []*store{s}
+	for _, n := range opts.Namespaces {
+		s.namespaces = append(s.namespaces, &store{
+			shared: s.shared,
+			name:   n.Name,
+			prefix: []byte(n.Prefix),
+			conf:   n,
+			opts:   s.opts,
+		})
+	}
+	s.setDBIs(d)
+
+	if s.replica != nil {
+		if err := s.replica.readAcked(env, opts); err != nil {
+			env.Close()
+			return nil, err
+		}
+	}
+
+	// Nothing else can read entries in the original layout, so they are
+	// rewritten before anything looks at them
+	for _, ns := range s.namespaces {
+		if err := ns.checkFormat(); err != nil {
+			env.Close()
+			return nil, err
+		}
+	}
+
+	// A read-only store can't keep a bloom filter up to date
+	for _, ns := range s.namespaces {
+		if opts.ReadOnly {
+			break
+		}
+		if opts.BloomFilterItems > 0 {
+			ns.bloom = &bloom{rebuild: make(chan struct{}, 1)}
+			if err := ns.buildBloom(); err != nil {
+				env.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// envDBIs are all of the DBs of an environment. Every DB a store uses is
+// opened by openEnv and set by setDBIs, so compact reopens them all.
+type envDBIs struct {
+	// sets are the DBs of each namespace, the default one first
+	sets []dbis
+
+	format  lmdb.DBI
+	oplog   lmdb.DBI
+	replica lmdb.DBI
+}
+
+// openEnv opens the LMDB environment at path with a map of at least mapSize
+// bytes, creating the DBs of every namespace if needed, and its format DB,
+// oplog and replica progress DBs.
+func openEnv(path string, opts Options, mapSize int64) (*lmdb.Env, envDBIs, error) {
+	// initialize the LMDB environment and DB
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return nil, envDBIs{}, err
+	}
+
+	names := []string{opts.DBName}
+	for _, n := range opts.Namespaces {
+		names = append(names, namespaceDBName(opts.DBName, n.Name))
+	}
+
+	// apply size limit, data, TTL index, chunk, reference, lease and tag DBs,
+	// the format records, the oplog and replica progress
+	if err := env.SetMapSize(mapSize); err != nil {
+		env.Close()
+		return nil, envDBIs{}, err
+	}
+	if err := env.SetMaxDBs(6*len(names) + 3); err != nil {
+		env.Close()
+		return nil, envDBIs{}, err
+	}
+	if opts.MaxReaders > 0 {
+		if err := env.SetMaxReaders(opts.MaxReaders); err != nil {
+			env.Close()
+			return nil, envDBIs{}, err
+		}
+	}
+
+	if err := env.Open(path, opts.envFlags(), opts.FileMode); err != nil {
+		env.Close()
+		return nil, envDBIs{}, err
+	}
+
+	// A read-only environment can only open DBs that are already there
+	run, flags := env.Update, uint(lmdb.Create)
+	if opts.ReadOnly {
+		run, flags = env.View, 0
+	}
+
+	d := envDBIs{sets: make([]dbis, len(names))}
+	err = run(func(txn *lmdb.Txn) (err error) {
+		if d.format, err = openFormatDB(txn, opts); err != nil {
+			return
+		}
+		if opts.OplogSize > 0 && !opts.ReadOnly {
+			if d.oplog, err = txn.OpenDBI(opts.DBName+oplogDBSuffix, lmdb.Create); err != nil {
+				return
+			}
+			if opts.ReplicaAddr != "" {
+				if d.replica, err = txn.OpenDBI(opts.DBName+replicaDBSuffix, lmdb.Create); err != nil {
+					return
+				}
+			}
+		}
+		for i, name := range names {
+			set := &d.sets[i]
+			if set.dbi, err = txn.OpenDBI(name, flags); err != nil {
+				return
+			}
+			if set.ttldbi, err = txn.OpenDBI(name+ttlDBSuffix, flags); err != nil {
+				return
+			}
+			if set.chunkdbi, err = txn.OpenDBI(name+chunkDBSuffix, flags); err != nil {
+				return
+			}
+			// Older environments don't have it, and readers don't need it
+			if !opts.ReadOnly {
+				if set.refdbi, err = txn.OpenDBI(name+refDBSuffix, flags); err != nil {
+					return
+				}
+				if set.leasedbi, err = txn.OpenDBI(name+leaseDBSuffix, flags); err != nil {
+					return
+				}
+			}
+			if opts.TagIndex && !opts.ReadOnly {
+				if set.tagdbi, err = txn.OpenDBI(name+tagDBSuffix, flags); err != nil {
+					return
+				}
+			}
+		}
+		return
+	})
+	if err != nil {
+		env.Close()
+		return nil, envDBIs{}, err
+	}
+
+	return env, d, nil
+}
+
+// setDBIs points the store and its namespaces at the DBs of d.
+func (s *store) setDBIs(d envDBIs) {
+	s.formatdbi = d.format
+	if s.oplog != nil {
+		s.oplog.dbi = d.oplog
+	}
+	if s.replica != nil {
+		s.replica.dbi = d.replica
+	}
+	for i, ns := range s.namespaces {
+		ns.dbis = d.sets[i]
+	}
+}
+
+// nextCAS returns a new, never before used, CAS token
+func (s *store) nextCAS() uint64 {
+	return atomic.AddUint64(&s.cas, 1)
+}
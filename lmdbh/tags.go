@@ -0,0 +1,212 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// With Options.TagIndex, SetTagged stores an item with tags, and
+// InvalidateTag deletes every item with a tag. Each namespace keeps its tags
+// in a DB of its own holding two empty records for each tag of a key, one
+// to find the keys of a tag and one to find the tags of a key:
+//
+//	tagFwd | tag length | tag | key
+//	tagRev | key length | key | tag
+//
+// with the lengths two bytes, big endian. del and put drop the tags of the
+// key, so an item rewritten without them, or deleted, expired or evicted,
+// loses them, and the index never holds more than the live items' tags. A
+// tag and the key it is on must fit in an LMDB key together.
+const (
+	tagDBSuffix = "_tags"
+
+	tagFwd = 1
+	tagRev = 2
+
+	// tagBatchSize is how many items each write transaction of
+	// InvalidateTag deletes
+	tagBatchSize = 1000
+)
+
+var (
+	errNoTagIndex = errors.New("Rend LMDB tags need Options.TagIndex")
+	errBadTag     = errors.New("Rend LMDB tag is empty or too long for its key")
+)
+
+func tagRecord(kind byte, a, b []byte) []byte {
+	buf := make([]byte, 3, 3+len(a)+len(b))
+	buf[0] = kind
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(a)))
+	return append(append(buf, a...), b...)
+}
+
+// checkTags returns errBadTag unless every tag can go on the key stored as
+// dk.
+func (s *store) checkTags(dk []byte, tags [][]byte) error {
+	if s.tagdbi == 0 {
+		return errNoTagIndex
+	}
+	for _, tag := range tags {
+		if len(tag) == 0 || 3+len(tag)+len(dk) > s.env.MaxKeySize() {
+			return errBadTag
+		}
+	}
+	return nil
+}
+
+// tag puts tags on key.
+func (s *store) tag(txn *lmdb.Txn, key []byte, tags [][]byte) error {
+	for _, tag := range tags {
+		if err := txn.Put(s.tagdbi, tagRecord(tagFwd, tag, key), nil, 0); err != nil {
+			return err
+		}
+		if err := txn.Put(s.tagdbi, tagRecord(tagRev, key, tag), nil, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// untag takes every tag off key.
+func (s *store) untag(txn *lmdb.Txn, key []byte) error {
+	if s.tagdbi == 0 {
+		return nil
+	}
+
+	prefix := tagRecord(tagRev, key, nil)
+	var tags [][]byte
+	err := func() error {
+		cur, err := txn.OpenCursor(s.tagdbi)
+		if err != nil {
+			return err
+		}
+		defer cur.Close()
+
+		k, _, err := cur.Get(prefix, nil, lmdb.SetRange)
+		for ; err == nil && bytes.HasPrefix(k, prefix); k, _, err = cur.Get(nil, nil, lmdb.Next) {
+			tags = append(tags, append([]byte(nil), k[len(prefix):]...))
+		}
+		if err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if err := txn.Del(s.tagdbi, tagRecord(tagRev, key, tag), nil); err != nil {
+			return err
+		}
+		if err := txn.Del(s.tagdbi, tagRecord(tagFwd, tag, key), nil); err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetTagged is Set, putting tags on the item for InvalidateTag. Any other
+// write that replaces it, an append too, takes them off again. Tagged sets
+// are never staged by WriteBehind.
+func (h *Handler) SetTagged(cmd common.SetRequest, tags ...[]byte) error {
+	return h.set(cmd, 0, tags)
+}
+
+// InvalidateTag deletes every item with tag, in every shard and namespace,
+// and returns how many there were. The items are deleted in batches, so a
+// concurrent reader may see some gone before the others.
+func (h *Handler) InvalidateTag(tag []byte) (int, error) {
+	n := 0
+	for _, s := range h.all() {
+		m, err := s.invalidateTag(tag)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *store) invalidateTag(tag []byte) (int, error) {
+	if s.opts.ReadOnly {
+		return 0, errReadOnly
+	}
+	if s.tagdbi == 0 {
+		return 0, errNoTagIndex
+	}
+
+	start := time.Now()
+	prefix := tagRecord(tagFwd, tag, nil)
+	n := 0
+	for more := true; more; {
+		var deleted int
+		err := s.update(func(txn *lmdb.Txn) error {
+			var keys [][]byte
+			err := func() error {
+				cur, err := txn.OpenCursor(s.tagdbi)
+				if err != nil {
+					return err
+				}
+				defer cur.Close()
+
+				k, _, err := cur.Get(prefix, nil, lmdb.SetRange)
+				for ; err == nil && bytes.HasPrefix(k, prefix) && len(keys) < tagBatchSize; k, _, err = cur.Get(nil, nil, lmdb.Next) {
+					keys = append(keys, append([]byte(nil), k[len(prefix):]...))
+				}
+				if err != nil && !lmdb.IsNotFound(err) {
+					return err
+				}
+				return nil
+			}()
+			if err != nil {
+				return err
+			}
+
+			deleted, more = 0, len(keys) == tagBatchSize
+			for _, key := range keys {
+				// del takes the tags off, but can't if the item is gone
+				switch err := s.delEvent(txn, key, EventDelete); {
+				case err == nil:
+					deleted++
+				case lmdb.IsNotFound(err):
+					if err := s.untag(txn, key); err != nil {
+						return err
+					}
+				default:
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return n, err
+		}
+		n += deleted
+	}
+
+	if n > 0 {
+		s.opts.Logger.Info("Invalidated tag", "component", "tags", "namespace", s.name, "tag", string(tag),
+			"items", n, "duration", time.Since(start))
+	}
+	return n, nil
+}
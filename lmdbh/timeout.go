@@ -0,0 +1,110 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"time"
+)
+
+// With ReadTimeout or WriteTimeout, the reads of gets and the writes of
+// mutations run in a goroutine of their own, and the request gives up on them
+// with ErrTimeout once the timeout has passed, so a stalled disk or a write
+// stuck behind the writer lock doesn't hang the connection. LMDB can't cancel
+// a transaction, so an abandoned one still runs to the end: a write that timed
+// out may yet be committed. An abandoned read only reports to a buffer that
+// is dropped.
+
+// ErrTimeout is returned by an operation that gave up waiting on LMDB after
+// ReadTimeout or WriteTimeout.
+var ErrTimeout = errors.New("Rend LMDB operation timed out")
+
+// withTimeout runs fn, giving up on it with ErrTimeout after d. fn must not
+// touch anything the caller uses once it has given up.
+func (s *store) withTimeout(d time.Duration, fn func() error) error {
+	if d <= 0 {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		root := s.namespaces[0]
+		root.count(&root.stats.timeouts, MetricTimeouts)
+		return ErrTimeout
+	}
+}
+
+// detach returns a copy of b, part of a request, if a write may still use it
+// after giving up.
+func (s *store) detach(b []byte) []byte {
+	if s.opts.WriteTimeout <= 0 {
+		return b
+	}
+	return append([]byte(nil), b...)
+}
+
+func detachKeys(keys [][]byte) [][]byte {
+	own := make([][]byte, len(keys))
+	for i, key := range keys {
+		own[i] = append([]byte(nil), key...)
+	}
+	return own
+}
+
+// read is one key answered by readKeys, kept to hand to the caller's fn once
+// the read has finished in time.
+type read struct {
+	idx      int
+	dk, long []byte
+	e        *entry
+}
+
+// readKeysTimed is readKeys giving up after ReadTimeout. The entries are
+// copied out of the map so fn can be called after the transaction is over.
+func (s *store) readKeysTimed(t *opTimer, keys [][]byte, fn func(idx int, dk, long []byte, e *entry)) error {
+	keys = detachKeys(keys)
+	var reads []read
+	err := s.withTimeout(s.opts.ReadTimeout, func() error {
+		var rs []read
+		err := s.readKeysNow(t, keys, func(idx int, dk, long []byte, e *entry) {
+			if e != nil {
+				c := *e
+				c.data = append([]byte(nil), e.data...)
+				if e.key != nil {
+					c.key = append([]byte(nil), e.key...)
+				}
+				e = &c
+			}
+			rs = append(rs, read{idx, dk, long, e})
+		})
+		reads = rs
+		return err
+	})
+	if err == ErrTimeout {
+		return err
+	}
+	// Even with an error, as keys answered before it are
+	for _, r := range reads {
+		fn(r.idx, r.dk, r.long, r.e)
+	}
+	return err
+}
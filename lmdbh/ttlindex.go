@@ -0,0 +1,257 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"encoding/binary"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// The TTL index is a second DB whose keys are the 64 bit big endian exptime, in
+// milliseconds, followed by the item key, with empty values. Since LMDB keeps
+// keys sorted, walking it from the beginning visits items in order of
+// expiration, which lets the reaper stop as soon as it sees an item that has
+// not yet expired. Items that never expire are not indexed.
+const ttlDBSuffix = "_ttl"
+
+func ttlKey(exptime uint64, key []byte) []byte {
+	buf := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(buf[0:8], exptime)
+	copy(buf[8:], key)
+	return buf
+}
+
+// ttlRecord moves cur, a cursor on the TTL index, with op and returns the
+// key of the record there, copied out of the map. Records have empty values,
+// and a raw read of one at the very end of the last page of the file would
+// touch the page after it, which is past the end of the file, so RawRead is
+// turned off for the read.
+func ttlRecord(txn *lmdb.Txn, cur *lmdb.Cursor, setkey []byte, op uint) ([]byte, error) {
+	raw := txn.RawRead
+	txn.RawRead = false
+	tk, _, err := cur.Get(setkey, nil, op)
+	txn.RawRead = raw
+	return tk, err
+}
+
+func parseTTLKey(tk []byte) (uint64, []byte) {
+	return binary.BigEndian.Uint64(tk[0:8]), tk[8:]
+}
+
+// put stores buf at key and keeps the TTL index, chunks and negative cache in
+// sync. All writes to the main DB must go through put, putEntry, setExptime or
+// del. A buf that is itself a manifest is taken to be the stored one with a
+// new exptime, and keeps its chunks.
+func (s *store) put(txn *lmdb.Txn, key, buf []byte, flags uint) error {
+	// A manifest only changes the exptime of what is there
+	if !entryChunked(buf) {
+		if err := s.checkQuota(txn, key, len(key)+len(buf)); err != nil {
+			return err
+		}
+	}
+
+	oldExp, oldChunked, found, err := s.storedHeader(txn, key)
+	if err != nil {
+		return err
+	}
+
+	s.written(txn, key)
+
+	whole := buf
+	split := !entryChunked(buf) && s.splits(len(buf))
+	if split {
+		buf = s.manifest(whole)
+	}
+
+	if err := txn.Put(s.dbi, key, buf, flags); err != nil {
+		return err
+	}
+
+	if oldChunked && !entryChunked(whole) {
+		if err := s.delChunks(txn, key); err != nil {
+			return err
+		}
+	}
+	if split {
+		if err := s.putChunks(txn, key, whole); err != nil {
+			return err
+		}
+	}
+
+	if found {
+		if err := s.untag(txn, key); err != nil {
+			return err
+		}
+	}
+	if err := s.reindex(txn, key, oldExp, entryExptime(buf), found); err != nil {
+		return err
+	}
+	return s.emit(txn, EventSet, key)
+}
+
+// putEntry is put for an entry from prepareEntry, which is serialized straight
+// into the space LMDB reserves for it, saving the copy and allocation of a
+// buffer of its own. Entries that get chunked still go through one.
+func (s *store) putEntry(txn *lmdb.Txn, key []byte, e entry, flags uint) error {
+	size := entryLen(e)
+	if s.splits(size) {
+		return s.put(txn, key, entryToBuf(e), flags)
+	}
+
+	if err := s.checkQuota(txn, key, len(key)+size); err != nil {
+		return err
+	}
+
+	oldExp, oldChunked, found, err := s.storedHeader(txn, key)
+	if err != nil {
+		return err
+	}
+
+	s.written(txn, key)
+
+	buf, err := txn.PutReserve(s.dbi, key, size, flags)
+	if err != nil {
+		return err
+	}
+	writeEntry(buf, e)
+
+	if oldChunked {
+		if err := s.delChunks(txn, key); err != nil {
+			return err
+		}
+	}
+
+	if found {
+		if err := s.untag(txn, key); err != nil {
+			return err
+		}
+	}
+	if err := s.reindex(txn, key, oldExp, e.exptime, found); err != nil {
+		return err
+	}
+	return s.emit(txn, EventSet, key)
+}
+
+// splits reports whether put stores an entry of size bytes in chunks.
+func (s *store) splits(size int) bool {
+	return s.opts.SeparateValues || s.opts.ChunkSize > 0 && size > s.opts.ChunkSize
+}
+
+// setExptime changes only the exptime of the entry at key, whose stored value
+// is old, and moves its TTL index record. All but the exptime is copied from
+// old into the space LMDB reserves for the new value, so with old read raw the
+// value never passes through Go memory, and nothing else about the item needs
+// checking since its size is unchanged. LMDB overwrites the value in place if
+// its pages were already written in txn, but otherwise copies them, as for any
+// write, so large values are still better chunked, see ChunkSize: the stored
+// value of a chunked item is only its small manifest.
+//
+// old may be a raw read of the value, since the pages it points to stay
+// valid: replacing a value of the same size either reuses its pages or frees
+// them, and pages freed in a write transaction are not reused until it has
+// committed.
+func (s *store) setExptime(txn *lmdb.Txn, key, old []byte, exptime uint64) error {
+	oldExp := entryExptime(old)
+	s.written(txn, key)
+
+	if _, err := entryVersionOf(old); err != nil {
+		return err
+	}
+
+	buf, err := txn.PutReserve(s.dbi, key, len(old), 0)
+	if err != nil {
+		return err
+	}
+	copy(buf, old)
+	binary.BigEndian.PutUint64(buf[offExptime:], exptime)
+
+	if err := s.reindex(txn, key, oldExp, exptime, true); err != nil {
+		return err
+	}
+	return s.emit(txn, EventTouch, key)
+}
+
+// reindex moves the TTL index record of key from oldExp to newExp. found is
+// whether key was stored before, with oldExp.
+func (s *store) reindex(txn *lmdb.Txn, key []byte, oldExp, newExp uint64, found bool) error {
+	if found && oldExp != 0 && oldExp != newExp {
+		if err := txn.Del(s.ttldbi, ttlKey(oldExp, key), nil); err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+	}
+	if newExp != 0 && (!found || oldExp != newExp) {
+		return txn.Put(s.ttldbi, ttlKey(newExp, key), nil, 0)
+	}
+
+	return nil
+}
+
+// del removes key, its TTL index record, its chunks and its reference bit.
+func (s *store) del(txn *lmdb.Txn, key []byte) error {
+	oldExp, oldChunked, found, err := s.storedHeader(txn, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return &lmdb.OpError{Op: "mdb_del", Errno: lmdb.NotFound}
+	}
+
+	s.written(txn, key)
+	if err := txn.Del(s.dbi, key, nil); err != nil {
+		return err
+	}
+
+	if oldChunked {
+		if err := s.delChunks(txn, key); err != nil {
+			return err
+		}
+	}
+
+	if oldExp != 0 {
+		if err := txn.Del(s.ttldbi, ttlKey(oldExp, key), nil); err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if err := txn.Del(s.refdbi, key, nil); err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+
+	return s.untag(txn, key)
+}
+
+// storedExptime reads just the exptime of the item currently stored at key.
+func (s *store) storedExptime(txn *lmdb.Txn, key []byte) (uint64, bool, error) {
+	exptime, _, found, err := s.storedHeader(txn, key)
+	return exptime, found, err
+}
+
+// storedHeader reads the exptime of the item currently stored at key and
+// whether it is chunked.
+func (s *store) storedHeader(txn *lmdb.Txn, key []byte) (exptime uint64, chunked, found bool, err error) {
+	// Only the header is needed, so avoid copying the whole value out
+	raw := txn.RawRead
+	txn.RawRead = true
+	buf, err := txn.Get(s.dbi, key)
+	txn.RawRead = raw
+	if err != nil {
+		if lmdb.IsNotFound(err) {
+			return 0, false, false, nil
+		}
+		return 0, false, false, err
+	}
+	return entryExptime(buf), entryChunked(buf), true, nil
+}
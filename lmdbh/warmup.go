@@ -0,0 +1,117 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// With WarmUp, the pages of the data file in use are read through once in the
+// background after it is opened, in big sequential reads that the OS serves
+// far faster than the page faults of reads scattered over a cold map. The map
+// is backed by the same page cache, so later reads find the pages there. It
+// only helps while the data file fits in memory.
+const warmChunk = 1 << 20
+
+// warmUp reads the data file into the page cache, logging its progress every
+// tenth of the way, and closes warm once done.
+func warmUp(s *store) {
+	defer close(s.warm)
+
+	start := time.Now()
+	n, err := s.warmUp()
+	if err == errClosed {
+		return
+	}
+	if err != nil {
+		s.opts.Logger.Error("Error warming up the page cache", "component", "warmup", "path", s.path, "error", err)
+		return
+	}
+	s.opts.Logger.Info("Page cache warm", "component", "warmup", "path", s.path,
+		"bytes", n, "duration", time.Since(start))
+}
+
+func (s *store) warmUp() (int64, error) {
+	size, err := s.usedBytes()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(s.opts.dataPath(s.path))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, warmChunk)
+	var read, logged int64
+	for read < size {
+		select {
+		case <-s.done:
+			return read, nil
+		default:
+		}
+
+		n, err := f.Read(buf)
+		read += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return read, err
+		}
+
+		if read-logged >= size/10 && read < size {
+			logged = read
+			s.opts.Logger.Info("Warming up the page cache", "component", "warmup", "path", s.path,
+				"percent", 100*read/size)
+		}
+	}
+	return read, nil
+}
+
+// usedBytes returns the size of the pages of the data file in use.
+func (s *store) usedBytes() (int64, error) {
+	s.resizeLock.RLock()
+	defer s.resizeLock.RUnlock()
+
+	if s.closed {
+		return 0, errClosed
+	}
+	info, err := s.env.Info()
+	if err != nil {
+		return 0, err
+	}
+	st, err := s.env.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return (info.LastPNO + 1) * int64(st.PSize), nil
+}
+
+// Warm reports whether every shard has finished warming up the page cache,
+// which is always the case without Options.WarmUp.
+func (h *Handler) Warm() bool {
+	for _, s := range h.shards {
+		select {
+		case <-s.warm:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// A read transaction keeps every page it can see from being reused, so one
+// held open for long makes the file grow and can fill the map. With
+// LongReadThreshold set, every read transaction of the process is tracked and
+// a watchdog reports any open longer than that, once each.
+//
+// LMDB transactions can't be touched from another goroutine, so a long read
+// can't be aborted from outside. With AbortLongReads the watchdog marks it
+// instead, and the scans that can run long, like Dump, check the mark as they
+// go and end with errReadAborted.
+
+var errReadAborted = errors.New("Rend LMDB read transaction was open too long and was aborted")
+
+// abortCheckEvery is how many items a long scan reads between checks of its
+// abort mark.
+const abortCheckEvery = 256
+
+// openRead is a tracked read transaction.
+type openRead struct {
+	start time.Time
+	// pc is the caller of view, for the report
+	pc       uintptr
+	reported bool
+	aborted  int32
+}
+
+// reads tracks the open read transactions of an environment.
+type reads struct {
+	sync.Mutex
+	open map[*lmdb.Txn]*openRead
+}
+
+// tracked wraps fn to track its transaction if the watchdog is on.
+func (s *store) tracked(fn lmdb.TxnOp) lmdb.TxnOp {
+	if s.opts.LongReadThreshold <= 0 {
+		return fn
+	}
+
+	var pc [1]uintptr
+	runtime.Callers(3, pc[:])
+	return func(txn *lmdb.Txn) error {
+		r := &openRead{start: time.Now(), pc: pc[0]}
+		s.reads.Lock()
+		s.reads.open[txn] = r
+		s.reads.Unlock()
+
+		defer func() {
+			s.reads.Lock()
+			delete(s.reads.open, txn)
+			s.reads.Unlock()
+		}()
+		return fn(txn)
+	}
+}
+
+// readAborted returns whether the watchdog marked txn to be aborted.
+func (s *store) readAborted(txn *lmdb.Txn) bool {
+	if !s.opts.AbortLongReads {
+		return false
+	}
+	s.reads.Lock()
+	r := s.reads.open[txn]
+	s.reads.Unlock()
+	return r != nil && atomic.LoadInt32(&r.aborted) != 0
+}
+
+// readWatchdog looks for long reads a few times per LongReadThreshold until
+// the store is closed.
+func readWatchdog(s *store) {
+	for {
+		select {
+		case <-time.After(s.opts.LongReadThreshold / 4):
+		case <-s.done:
+			return
+		}
+
+		now := time.Now()
+		s.reads.Lock()
+		for _, r := range s.reads.open {
+			age := now.Sub(r.start)
+			if r.reported || age < s.opts.LongReadThreshold {
+				continue
+			}
+			r.reported = true
+
+			caller := "unknown"
+			if f := runtime.FuncForPC(r.pc); f != nil {
+				caller = f.Name()
+			}
+			s.opts.Logger.Warn("Read transaction open too long", "component", "watchdog",
+				"age", age, "caller", caller, "abort", s.opts.AbortLongReads)
+			s.count(&s.stats.longReads, MetricLongReads)
+
+			if s.opts.AbortLongReads {
+				atomic.StoreInt32(&r.aborted, 1)
+			}
+		}
+		s.reads.Unlock()
+	}
+}
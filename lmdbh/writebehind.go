@@ -0,0 +1,378 @@
+// Copyright 2016 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lmdbh
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bmatsuo/lmdb-go/lmdb"
+	"github.com/netflix/rend/common"
+)
+
+// With WriteBehind, sets are acknowledged once they are staged in memory, and
+// writeBehind commits everything staged in one write transaction once
+// WriteBehindDelay has passed since the first of it, or as soon as WriteBehind
+// sets are waiting. Sets block while that many are.
+//
+// Gets look for staged sets before anything else, and before their read
+// transaction begins, since a set is only unstaged once it has committed.
+// Every other mutation commits what is staged before it runs, see write, so
+// it sees them too, and so does a flush.
+//
+// A set that would take its namespace over a quota is refused before it is
+// staged. Sets that fail to commit for lack of room, with the map or the disk
+// full, stay staged and are tried again after WriteBehindDelay. Until they
+// commit new sets are refused with the same error, rather than acknowledged,
+// and so are the other mutations, which must come after them. Reaps and
+// flushes go ahead, since they make room, and a flush drops the staged sets
+// of its namespace. Staged sets are lost if the process dies, and so are any
+// that fail to commit for another reason, or when the store is closed, which
+// are only logged.
+const defaultWriteBehindDelay = 100 * time.Millisecond
+
+type staging struct {
+	lock sync.Mutex
+	// room is signalled as staged sets are committed
+	room *sync.Cond
+	// items are the staged sets gets see, the latest for each key, and
+	// queue the ones still to commit, in order. staged counts the sets
+	// staged and not yet committed.
+	items  map[stagedKey]*stagedSet
+	queue  []*stagedSet
+	staged int
+
+	// failing is why the last commit had to keep sets staged, until one
+	// commits them
+	failing error
+
+	// first wakes writeBehind when the first set is staged, and full when
+	// WriteBehind are
+	first, full chan struct{}
+
+	// committing keeps commits in the order the sets were staged
+	committing sync.Mutex
+}
+
+type stagedKey struct {
+	ns *store
+	dk string
+}
+
+type stagedSet struct {
+	ns *store
+	dk []byte
+	// stored is the entry to write, e the one gets are served
+	stored, e entry
+}
+
+func newStaging() *staging {
+	st := &staging{
+		items: make(map[stagedKey]*stagedSet),
+		first: make(chan struct{}, 1),
+		full:  make(chan struct{}, 1),
+	}
+	st.room = sync.NewCond(&st.lock)
+	return st
+}
+
+// stage stages a set of dk, waiting for room if need be. stored and e must
+// not share memory with the request.
+func (s *store) stage(dk []byte, stored, e entry) error {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+
+	if s.closed {
+		return errClosed
+	}
+	if err := s.allowWrite(true); err != nil {
+		return err
+	}
+	if err := s.checkStagedQuota(dk, len(dk)+entryLen(stored)); err != nil {
+		return err
+	}
+
+	st := s.staging
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	for st.staged >= s.opts.WriteBehind && st.failing == nil {
+		st.room.Wait()
+	}
+	if st.failing != nil {
+		return st.failing
+	}
+
+	set := &stagedSet{ns: s, dk: dk, stored: stored, e: e}
+	st.items[stagedKey{s, string(dk)}] = set
+	st.queue = append(st.queue, set)
+	st.staged++
+
+	if len(st.queue) == 1 {
+		kick(st.first)
+	}
+	if st.staged == s.opts.WriteBehind {
+		kick(st.full)
+	}
+	return nil
+}
+
+// checkStagedQuota fails a set of size bytes at dk with common.ErrNoMem if it
+// would take the namespace over a quota once the sets staged before it have
+// committed too. It is checkQuota for staged sets, which can't fail once
+// acknowledged. With a QuotaEviction policy, room is made when they commit.
+// Every staged set of the namespace counts as a new item, so the count is
+// only an upper bound.
+func (s *store) checkStagedQuota(dk []byte, size int) error {
+	c := &s.conf
+	if c.QuotaEviction != EvictNone || c.MaxItems <= 0 && c.MaxBytes <= 0 {
+		return nil
+	}
+
+	st := s.staging
+	var stagedItems, stagedBytes int64
+	st.lock.Lock()
+	for _, set := range st.queue {
+		if set.ns == s {
+			stagedItems++
+			stagedBytes += int64(len(set.dk) + entryLen(set.stored))
+		}
+	}
+	st.lock.Unlock()
+
+	return s.view(func(txn *lmdb.Txn) error {
+		txn.RawRead = true
+		old, err := txn.Get(s.dbi, dk)
+		found := err == nil
+		if err != nil && !lmdb.IsNotFound(err) {
+			return err
+		}
+
+		items, used, err := s.usage(txn)
+		if err != nil {
+			return err
+		}
+		if c.MaxBytes > 0 && size > len(old) && used+stagedBytes+int64(size-len(old)) > c.MaxBytes {
+			return common.ErrNoMem
+		}
+		if c.MaxItems > 0 && !found && int64(items)+stagedItems >= int64(c.MaxItems) {
+			return common.ErrNoMem
+		}
+		return nil
+	})
+}
+
+func kick(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// stagedEntry returns the entry of the latest set staged for dk, if any.
+func (s *store) stagedEntry(dk []byte) (entry, bool) {
+	if s.staging == nil {
+		return entry{}, false
+	}
+
+	st := s.staging
+	st.lock.Lock()
+	set, ok := st.items[stagedKey{s, string(dk)}]
+	st.lock.Unlock()
+	if !ok {
+		return entry{}, false
+	}
+	return set.e, true
+}
+
+// stagedEntries returns the entries of the sets staged for keys, by index,
+// nil if there are none.
+func (s *store) stagedEntries(keys [][]byte) map[int]entry {
+	if s.staging == nil {
+		return nil
+	}
+
+	var staged map[int]entry
+	for idx, key := range keys {
+		dk, _ := s.dbKey(key)
+		if e, ok := s.stagedEntry(dk); ok {
+			if staged == nil {
+				staged = make(map[int]entry)
+			}
+			staged[idx] = e
+		}
+	}
+	return staged
+}
+
+// commitStaged commits every set staged so far. Sets that fail for lack of
+// room stay staged, ahead of those staged since, and their error is returned,
+// unless a later set of the same key has replaced them. Other failures are
+// logged and counted, and the sets dropped.
+func (s *store) commitStaged() error {
+	st := s.staging
+	st.committing.Lock()
+	defer st.committing.Unlock()
+
+	st.lock.Lock()
+	sets := st.queue
+	st.queue = nil
+	st.lock.Unlock()
+
+	if len(sets) == 0 {
+		return nil
+	}
+
+	errs := make([]error, len(sets))
+	err := s.update(func(txn *lmdb.Txn) error {
+		for i, set := range sets {
+			errs[i] = set.ns.putEntry(txn, set.dk, set.stored, 0)
+			if txnFatal(errs[i]) {
+				return errs[i]
+			}
+		}
+		return nil
+	})
+
+	// Too much in one transaction, fall back to one each
+	if lmdb.IsErrno(err, lmdb.TxnFull) && len(sets) > 1 {
+		for i, set := range sets {
+			set := set
+			errs[i] = s.update(func(txn *lmdb.Txn) error {
+				return set.ns.putEntry(txn, set.dk, set.stored, 0)
+			})
+		}
+		err = nil
+	}
+
+	// Nothing is tried again once the store is closing
+	closing := false
+	select {
+	case <-s.done:
+		closing = true
+	default:
+	}
+
+	var retry []*stagedSet
+	var retryErr error
+	for i, set := range sets {
+		if err != nil {
+			errs[i] = err
+		}
+		if errs[i] == nil {
+			continue
+		}
+		if !closing && noRoom(errs[i]) {
+			retry = append(retry, set)
+			if retryErr == nil {
+				retryErr = errs[i]
+			}
+			continue
+		}
+		set.ns.count(&set.ns.stats.stagedErrs, MetricStagedErrs)
+		s.opts.Logger.Error("Error committing staged set", "component", "writebehind",
+			"namespace", set.ns.name, "error", errs[i])
+	}
+
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	kept := make(map[*stagedSet]bool)
+	var queue []*stagedSet
+	for _, set := range retry {
+		if st.items[stagedKey{set.ns, string(set.dk)}] == set {
+			kept[set] = true
+			queue = append(queue, set)
+		}
+	}
+	for _, set := range sets {
+		k := stagedKey{set.ns, string(set.dk)}
+		if st.items[k] == set && !kept[set] {
+			delete(st.items, k)
+		}
+	}
+	st.queue = append(queue, st.queue...)
+	st.staged -= len(sets) - len(queue)
+	st.room.Broadcast()
+
+	if len(queue) == 0 {
+		st.failing = nil
+		return nil
+	}
+	if st.failing == nil {
+		s.opts.Logger.Error("Staged sets kept until there is room", "component", "writebehind",
+			"sets", len(queue), "error", retryErr)
+	}
+	st.failing = retryErr
+	kick(st.first)
+	return retryErr
+}
+
+// noRoom reports whether a set failed to commit for lack of room in the map,
+// a namespace or on disk, which other writes, the reaper or eviction may make.
+func noRoom(err error) bool {
+	return decode(err) == common.ErrNoMem || err == errDiskFull
+}
+
+// dropStaged drops the sets staged for s, which are about to be flushed.
+func (s *store) dropStaged() {
+	st := s.staging
+	st.committing.Lock()
+	defer st.committing.Unlock()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	var queue []*stagedSet
+	for _, set := range st.queue {
+		if set.ns != s {
+			queue = append(queue, set)
+			continue
+		}
+		k := stagedKey{set.ns, string(set.dk)}
+		if st.items[k] == set {
+			delete(st.items, k)
+		}
+		st.staged--
+	}
+	st.queue = queue
+	if len(queue) == 0 {
+		st.failing = nil
+	}
+	st.room.Broadcast()
+}
+
+// writeBehind commits staged sets until the store is closed, and then what is
+// left. Closing waits for sets being staged first.
+func writeBehind(s *store) {
+	st := s.staging
+	for {
+		select {
+		case <-st.first:
+		case <-s.done:
+			s.commitStaged()
+			return
+		}
+
+		timer := time.NewTimer(s.opts.WriteBehindDelay)
+		select {
+		case <-timer.C:
+		case <-st.full:
+		case <-s.done:
+		}
+		timer.Stop()
+
+		s.commitStaged()
+	}
+}